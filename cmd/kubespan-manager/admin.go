@@ -0,0 +1,627 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	"github.com/talos-systems/kubespan-manager/internal/db"
+	"github.com/talos-systems/kubespan-manager/pkg/types"
+)
+
+// adminAuth returns a middleware which requires the admin bearer token.
+//
+// If no token is configured, the admin API is disabled.
+func adminAuth(token string, logger *zap.Logger) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		logger := requestLogger(c, logger)
+
+		if token == "" {
+			return c.SendStatus(http.StatusForbidden)
+		}
+
+		provided := strings.TrimPrefix(c.Get(fiber.HeaderAuthorization), "Bearer ")
+
+		if subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+			logger.Warn("unauthorized admin request",
+				zap.String("method", c.Method()),
+				zap.String("path", c.Path()),
+				zap.String("remote", clientIP(c)),
+			)
+
+			return c.SendStatus(http.StatusUnauthorized)
+		}
+
+		return c.Next()
+	}
+}
+
+// exportRecord is a single line of the NDJSON export format.
+type exportRecord struct {
+	Cluster string      `json:"cluster"`
+	Node    *types.Node `json:"node"`
+}
+
+// maxImportLineSize is the maximum size of a single NDJSON import line.
+const maxImportLineSize = 1024 * 1024
+
+const (
+	// defaultClustersPage is the number of clusters returned by the cluster list unless the limit is requested.
+	defaultClustersPage = 100
+
+	// maxClustersPage caps the page size of the cluster list.
+	maxClustersPage = 1000
+)
+
+// registerAdminRoutes registers the admin API handlers on the given router.
+func registerAdminRoutes(r fiber.Router, logger *zap.Logger) {
+	r.Get("/export", func(c *fiber.Ctx) error {
+		logger := requestLogger(c, logger)
+
+		c.Set(fiber.HeaderContentType, "application/x-ndjson")
+
+		extendDeadline := writeDeadlineExtender(c)
+
+		c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+			enc := json.NewEncoder(w)
+
+			var clusters, nodes int
+
+			err := nodeDB.ForEachCluster(context.Background(), func(cluster string, list []*types.Node) error {
+				for _, n := range list {
+					extendDeadline()
+
+					if err := enc.Encode(exportRecord{Cluster: cluster, Node: n}); err != nil {
+						return err
+					}
+				}
+
+				clusters++
+				nodes += len(list)
+
+				return w.Flush()
+			})
+			if err != nil {
+				logger.Error("export failed",
+					zap.Int("clusters", clusters),
+					zap.Int("nodes", nodes),
+					zap.Error(err),
+				)
+
+				return
+			}
+
+			logger.Info("exported database",
+				zap.Int("clusters", clusters),
+				zap.Int("nodes", nodes),
+			)
+		})
+
+		return nil
+	})
+
+	// GET /admin/clusters?limit=<n>&after=<id> returns a page of clusters ordered by the ID,
+	// the next page is requested with the cursor returned as next, which is absent on the last page.
+	r.Get("/clusters", func(c *fiber.Ctx) error {
+		logger := requestLogger(c, logger)
+
+		limit := defaultClustersPage
+
+		if c.Query("limit") != "" {
+			var e error
+
+			if limit, e = strconv.Atoi(c.Query("limit")); e != nil || limit <= 0 {
+				logger.Error("bad cluster list limit", zap.String("limit", c.Query("limit")))
+
+				return c.SendStatus(http.StatusBadRequest)
+			}
+
+			if limit > maxClustersPage {
+				limit = maxClustersPage
+			}
+		}
+
+		clusters, e := nodeDB.ListClusters(requestContext(c), c.Query("after"), limit)
+		if e != nil {
+			logger.Error("failed to list clusters", zap.Error(e))
+
+			return sendDBError(c, e)
+		}
+
+		resp := fiber.Map{
+			"clusters": clusters,
+		}
+
+		if len(clusters) == limit {
+			resp["next"] = clusters[len(clusters)-1].ID
+		}
+
+		return c.JSON(resp)
+	})
+
+	r.Post("/import", refuseWrites, requireContentType(fiber.MIMEApplicationJSON, mimeNDJSON), func(c *fiber.Ctx) error {
+		logger := requestLogger(c, logger)
+
+		scanner := bufio.NewScanner(bytes.NewReader(c.Body()))
+		scanner.Buffer(nil, maxImportLineSize)
+
+		var imported int
+
+		for line := 1; scanner.Scan(); line++ {
+			if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+				continue
+			}
+
+			var rec exportRecord
+
+			if e := json.Unmarshal(scanner.Bytes(), &rec); e != nil || rec.Node == nil {
+				logger.Error("bad import record",
+					zap.Int("line", line),
+					zap.Error(e),
+				)
+
+				return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+					"imported": imported,
+					"error":    fmt.Sprintf("bad record on line %d", line),
+				})
+			}
+
+			if e := validateClusterID(rec.Cluster); e != nil {
+				return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+					"imported": imported,
+					"error":    fmt.Sprintf("line %d: %s", line, e),
+				})
+			}
+
+			id, e := types.NormalizeKey(rec.Node.ID)
+			if e != nil {
+				return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+					"imported": imported,
+					"error":    fmt.Sprintf("line %d: node ID is not a valid wireguard key", line),
+				})
+			}
+
+			rec.Node.ID = id
+
+			// Replace keeps the pin of the existing node, the exported one is restored explicitly
+			sticky := rec.Node.Sticky
+
+			e = nodeDB.Replace(requestContext(c), rec.Cluster, rec.Node)
+			if e == nil {
+				e = nodeDB.Pin(requestContext(c), rec.Cluster, id, sticky)
+			}
+
+			if e != nil {
+				logger.Error("failed to import node",
+					zap.String("cluster", rec.Cluster),
+					zap.String("node", rec.Node.ID),
+					zap.Error(e),
+				)
+
+				return sendDBError(c, e)
+			}
+
+			imported++
+		}
+
+		if e := scanner.Err(); e != nil {
+			logger.Error("failed to read import body", zap.Error(e))
+
+			return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+				"imported": imported,
+				"error":    e.Error(),
+			})
+		}
+
+		logger.Info("imported nodes", zap.Int("count", imported))
+
+		return c.JSON(fiber.Map{
+			"imported": imported,
+		})
+	})
+
+	r.Get("/log-level", func(c *fiber.Ctx) error {
+		return c.JSON(fiber.Map{
+			"level": logLevel.String(),
+		})
+	})
+
+	r.Put("/log-level", requireContentType(fiber.MIMEApplicationJSON), func(c *fiber.Ctx) error {
+		logger := requestLogger(c, logger)
+
+		var req struct {
+			Level string `json:"level"`
+		}
+
+		if e := parseBody(c, &req); e != nil {
+			logger.Error("failed to parse log level PUT", zap.Error(e))
+
+			return sendParseError(c, e)
+		}
+
+		var level zapcore.Level
+
+		if e := level.UnmarshalText([]byte(req.Level)); e != nil {
+			logger.Error("bad log level",
+				zap.String("level", req.Level),
+				zap.Error(e),
+			)
+
+			return c.SendStatus(http.StatusBadRequest)
+		}
+
+		logLevel.SetLevel(level)
+
+		logger.Info("log level changed", zap.Stringer("level", level))
+
+		return c.SendStatus(http.StatusNoContent)
+	})
+
+	r.Post("/drain", requireContentType(fiber.MIMEApplicationJSON), func(c *fiber.Ctx) error {
+		logger := requestLogger(c, logger)
+
+		grace := drainGrace
+
+		if c.Query("grace") != "" {
+			var e error
+
+			if grace, e = time.ParseDuration(c.Query("grace")); e != nil || grace < 0 {
+				logger.Error("bad drain grace period",
+					zap.String("grace", c.Query("grace")),
+				)
+
+				return c.SendStatus(http.StatusBadRequest)
+			}
+		}
+
+		if !draining.start(grace) {
+			return c.Status(http.StatusConflict).JSON(fiber.Map{
+				"error": "already draining",
+			})
+		}
+
+		logger.Warn("draining connections", zap.Duration("grace", grace))
+
+		return c.Status(http.StatusAccepted).JSON(fiber.Map{
+			"draining": true,
+			"grace":    grace.String(),
+		})
+	})
+
+	r.Post("/repair", refuseWrites, requireContentType(fiber.MIMEApplicationJSON), func(c *fiber.Ctx) error {
+		logger := requestLogger(c, logger)
+
+		if repairer == nil {
+			logger.Warn("consistency repair is not supported by the backend")
+
+			return c.SendStatus(http.StatusNotImplemented)
+		}
+
+		dryRun := c.Query("dry-run") == "true"
+
+		report, e := repairer.Repair(context.Background(), dryRun)
+		if e != nil {
+			logger.Error("consistency repair failed", zap.Error(e))
+
+			return sendDBError(c, e)
+		}
+
+		logger.Info("consistency repair finished",
+			zap.Bool("dry_run", dryRun),
+			zap.Int("scanned_nodes", report.ScannedNodes),
+			zap.Int("malformed_nodes", report.MalformedNodes),
+			zap.Int("orphaned_addresses", report.OrphanedAddresses),
+			zap.Int("stale_members", report.StaleMembers),
+			zap.Int("removed", report.Removed),
+		)
+
+		return c.JSON(report)
+	})
+
+	// POST /admin/gc runs the cleanup pass immediately, instead of waiting for the scheduled one.
+	r.Post("/gc", refuseWrites, requireContentType(fiber.MIMEApplicationJSON), func(c *fiber.Ctx) error {
+		logger := requestLogger(c, logger)
+
+		start := time.Now()
+		report := nodeDB.Clean()
+
+		logger.Info("garbage collection finished",
+			zap.Int("removed_nodes", report.RemovedNodes),
+			zap.Int("removed_clusters", report.RemovedClusters),
+			zap.Duration("duration", time.Since(start)),
+		)
+
+		return c.JSON(report)
+	})
+
+	r.Get("/:cluster/config", validateParams(logger), func(c *fiber.Ctx) error {
+		logger := requestLogger(c, logger)
+
+		cfg, e := nodeDB.ClusterConfig(requestContext(c), c.Params("cluster"))
+		if e != nil {
+			logger.Error("failed to get cluster config",
+				zap.String("cluster", c.Params("cluster")),
+				zap.Error(e),
+			)
+
+			return sendDBError(c, e)
+		}
+
+		if cfg == nil {
+			cfg = &types.ClusterConfig{}
+		}
+
+		return c.JSON(cfg)
+	})
+
+	r.Put("/:cluster/config", validateParams(logger), refuseWrites, requireContentType(fiber.MIMEApplicationJSON), func(c *fiber.Ctx) error {
+		logger := requestLogger(c, logger)
+
+		cfg := new(types.ClusterConfig)
+
+		if e := parseBody(c, cfg); e != nil {
+			logger.Error("failed to parse cluster config PUT",
+				zap.String("cluster", c.Params("cluster")),
+				zap.Error(e),
+			)
+
+			return sendParseError(c, e)
+		}
+
+		if e := cfg.Validate(); e != nil {
+			logger.Error("bad cluster config",
+				zap.String("cluster", c.Params("cluster")),
+				zap.Error(e),
+			)
+
+			return c.SendStatus(http.StatusBadRequest)
+		}
+
+		if e := nodeDB.SetClusterConfig(requestContext(c), c.Params("cluster"), cfg); e != nil {
+			logger.Error("failed to set cluster config",
+				zap.String("cluster", c.Params("cluster")),
+				zap.Error(e),
+			)
+
+			return sendDBError(c, e)
+		}
+
+		logger.Info("cluster config updated",
+			zap.String("cluster", c.Params("cluster")),
+			zap.Int("addressTTLSeconds", cfg.AddressTTLSeconds),
+			zap.Int("maxNodes", cfg.MaxNodes),
+		)
+
+		return c.SendStatus(http.StatusNoContent)
+	})
+
+	// GET /admin/:cluster/reachability lists the nodes with the probe results of their addresses.
+	r.Get("/:cluster/reachability", validateParams(logger), listReachability(logger))
+
+	// GET /admin/:cluster/debug dumps the internal state of the cluster, the output format is unstable.
+	r.Get("/:cluster/debug", validateParams(logger), inspectCluster(logger))
+
+	// PUT /admin/:cluster/:node/pin makes the node sticky, DELETE unpins it.
+	r.Put("/:cluster/:node/pin", validateParams(logger), refuseWrites, requireContentType(fiber.MIMEApplicationJSON), pinNode(logger, true))
+	r.Delete("/:cluster/:node/pin", validateParams(logger), refuseWrites, pinNode(logger, false))
+
+	// DELETE /admin/:cluster/nodes?label=key=value removes all the nodes matching the label selector.
+	r.Delete("/:cluster/nodes", validateParams(logger), refuseWrites, deleteNodes(logger))
+
+	// POST /admin/:cluster/alias points the new cluster ID at the cluster, DELETE /admin/:alias removes the alias.
+	if clusterAlias {
+		r.Post("/:cluster/alias", validateParams(logger), refuseWrites, requireContentType(fiber.MIMEApplicationJSON), aliasCluster(logger))
+	}
+
+	r.Delete("/:cluster", validateParams(logger), refuseWrites, func(c *fiber.Ctx) error {
+		logger := requestLogger(c, logger)
+
+		cluster := c.Params("cluster", "")
+
+		count, e := nodeDB.DeleteCluster(requestContext(c), cluster)
+		if e != nil {
+			if errors.Is(e, db.ErrNotFound) {
+				logger.Warn("cluster not found",
+					zap.String("cluster", cluster),
+					zap.Error(e),
+				)
+
+				return c.SendStatus(http.StatusNotFound)
+			}
+
+			logger.Error("failed to delete cluster",
+				zap.String("cluster", cluster),
+				zap.Error(e),
+			)
+
+			return sendDBError(c, e)
+		}
+
+		logger.Info("evicted cluster",
+			zap.String("cluster", cluster),
+			zap.Int("count", count),
+		)
+
+		return c.JSON(fiber.Map{
+			"evicted": count,
+		})
+	})
+}
+
+// pinNode returns the handler which sets or clears the sticky flag of the node.
+//
+// Sticky nodes (e.g. relays or bootstrap peers) are never garbage collected, even if they go quiet.
+func pinNode(logger *zap.Logger, sticky bool) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		logger := requestLogger(c, logger)
+
+		cluster, node := c.Params("cluster"), nodeParam(c)
+
+		if e := nodeDB.Pin(requestContext(c), cluster, node, sticky); e != nil {
+			if errors.Is(e, db.ErrNotFound) {
+				logger.Warn("node not found",
+					zap.String("cluster", cluster),
+					zap.String("node", node),
+					zap.Error(e),
+				)
+
+				return c.SendStatus(http.StatusNotFound)
+			}
+
+			logger.Error("failed to pin node",
+				zap.String("cluster", cluster),
+				zap.String("node", node),
+				zap.Bool("sticky", sticky),
+				zap.Error(e),
+			)
+
+			return sendDBError(c, e)
+		}
+
+		logger.Info("node pin changed",
+			zap.String("cluster", cluster),
+			zap.String("node", node),
+			zap.Bool("sticky", sticky),
+		)
+
+		return c.SendStatus(http.StatusNoContent)
+	}
+}
+
+// deleteNodes returns the handler which removes the nodes of the cluster matching the ?label= selector,
+// e.g. when decommissioning a failed zone.
+//
+// This is destructive: the nodes are removed regardless of their expiration and sticky flag,
+// the subscribers see them removed. The selector is required, DELETE /admin/:cluster removes the whole cluster.
+func deleteNodes(logger *zap.Logger) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		logger := requestLogger(c, logger)
+
+		cluster := c.Params("cluster")
+
+		var selectors []string
+
+		for _, sel := range c.Context().QueryArgs().PeekMulti("label") {
+			selectors = append(selectors, string(sel))
+		}
+
+		selector, e := types.ParseLabelSelector(selectors)
+		if e == nil && len(selector) == 0 {
+			e = fmt.Errorf("label selector is required")
+		}
+
+		if e != nil {
+			logger.Error("bad label selector",
+				zap.String("cluster", cluster),
+				zap.Error(e),
+			)
+
+			return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+				"error": e.Error(),
+			})
+		}
+
+		removed, e := nodeDB.DeleteNodes(requestContext(c), cluster, selector)
+		if e != nil {
+			if errors.Is(e, db.ErrNotFound) {
+				logger.Warn("cluster not found",
+					zap.String("cluster", cluster),
+					zap.Error(e),
+				)
+
+				return c.SendStatus(http.StatusNotFound)
+			}
+
+			logger.Error("failed to delete nodes",
+				zap.String("cluster", cluster),
+				zap.Strings("selector", selectors),
+				zap.Error(e),
+			)
+
+			return sendDBError(c, e)
+		}
+
+		sort.Strings(removed)
+
+		logger.Info("deleted nodes",
+			zap.String("cluster", cluster),
+			zap.Strings("selector", selectors),
+			zap.Strings("nodes", removed),
+		)
+
+		if removed == nil {
+			removed = []string{}
+		}
+
+		return c.JSON(fiber.Map{
+			"deleted": len(removed),
+			"nodes":   removed,
+		})
+	}
+}
+
+// aliasCluster returns the handler which makes the alias from the request body point at the cluster.
+func aliasCluster(logger *zap.Logger) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		logger := requestLogger(c, logger)
+
+		cluster := c.Params("cluster")
+
+		var req struct {
+			Alias string `json:"alias"`
+		}
+
+		if e := parseBody(c, &req); e != nil {
+			logger.Error("failed to parse cluster alias POST",
+				zap.String("cluster", cluster),
+				zap.Error(e),
+			)
+
+			return sendParseError(c, e)
+		}
+
+		if e := validateClusterID(req.Alias); e != nil {
+			logger.Error("bad cluster alias",
+				zap.String("cluster", cluster),
+				zap.String("alias", req.Alias),
+				zap.Error(e),
+			)
+
+			return c.SendStatus(http.StatusBadRequest)
+		}
+
+		if e := nodeDB.SetAlias(requestContext(c), req.Alias, cluster); e != nil {
+			logger.Error("failed to alias cluster",
+				zap.String("cluster", cluster),
+				zap.String("alias", req.Alias),
+				zap.Error(e),
+			)
+
+			return sendDBError(c, e)
+		}
+
+		logger.Info("cluster aliased",
+			zap.String("cluster", cluster),
+			zap.String("alias", req.Alias),
+		)
+
+		return c.SendStatus(http.StatusNoContent)
+	}
+}
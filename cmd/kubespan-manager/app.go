@@ -0,0 +1,60 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/compress"
+	"go.uber.org/zap"
+
+	"github.com/talos-systems/kubespan-manager/internal/db"
+)
+
+// appOptions configures the application built by newApp.
+type appOptions struct {
+	// Config is the fiber configuration, see appConfig.
+	Config fiber.Config
+
+	// AdminToken is the bearer token of the admin API, the admin API is disabled if empty.
+	AdminToken string
+}
+
+// newApp wires the API handlers on top of the database.
+//
+// The app is not bound to a listener, so that tests can exercise the whole API with app.Test
+// and the in-memory backend, while main only adds the bootstrap around it.
+func newApp(d db.DB, logger *zap.Logger, opts appOptions) *fiber.App {
+	nodeDB = d
+
+	app := fiber.New(opts.Config)
+
+	app.Use(correlate, observeRequests, limitRequestTime)
+
+	// the level is validated by main, tests run with the compression off
+	if level, err := compressionLevel(respCompress); err == nil && level != compress.LevelDisabled {
+		app.Use(compress.New(compress.Config{Level: level}))
+	}
+
+	registerHealthRoutes(app, logger)
+
+	// registered before the API routes, where /whoami would match as the cluster ID;
+	// the response depends on the client, so it is never cached
+	app.Get("/whoami", noStore, whoami)
+	app.Get("/v1/whoami", noStore, whoami)
+
+	// multi-cluster subscription, registered before the API routes for the same reason
+	app.Get("/watch", noStore, refuseWhileDraining, watchClusters(logger))
+	app.Get("/v1/watch", noStore, refuseWhileDraining, watchClusters(logger))
+
+	registerAdminRoutes(app.Group("/admin", noStore, adminAuth(opts.AdminToken, logger)), logger)
+
+	// versioned API
+	registerRoutes(app.Group("/v1"), logger)
+
+	// unversioned aliases, kept for compatibility with existing agents
+	registerRoutes(app, logger)
+
+	return app
+}
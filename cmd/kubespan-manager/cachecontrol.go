@@ -0,0 +1,46 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// cacheControl returns the middleware which lets caches keep successful GET responses for maxAge.
+//
+// Error and long-poll responses are never cached, nothing is set if maxAge is zero.
+// The representation is negotiated from the Accept header (JSON, protobuf or NDJSON), so the cached responses vary by it.
+func cacheControl(maxAge time.Duration) fiber.Handler {
+	value := fmt.Sprintf("max-age=%d", int(maxAge.Seconds()))
+
+	return func(c *fiber.Ctx) error {
+		err := c.Next()
+
+		if err != nil || maxAge <= 0 || (c.Method() != http.MethodGet && c.Method() != http.MethodHead) {
+			return err
+		}
+
+		switch {
+		case c.Query("wait") != "":
+			c.Set(fiber.HeaderCacheControl, "no-store")
+		case c.Response().StatusCode() == http.StatusOK:
+			c.Set(fiber.HeaderCacheControl, value)
+			c.Vary(fiber.HeaderAccept)
+		}
+
+		return nil
+	}
+}
+
+// noStore forbids caching the responses, e.g. of the admin API.
+func noStore(c *fiber.Ctx) error {
+	c.Set(fiber.HeaderCacheControl, "no-store")
+
+	return c.Next()
+}
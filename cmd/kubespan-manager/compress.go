@@ -0,0 +1,32 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/gofiber/fiber/v2/middleware/compress"
+)
+
+// compressionLevels maps the -response-compression values to the compression levels.
+var compressionLevels = map[string]compress.Level{
+	"off":     compress.LevelDisabled,
+	"speed":   compress.LevelBestSpeed,
+	"default": compress.LevelDefault,
+	"best":    compress.LevelBestCompression,
+}
+
+// compressionLevel parses the -response-compression value.
+//
+// The encoding (gzip, deflate or brotli) is negotiated with the client via Accept-Encoding,
+// responses to the clients which don't accept any are sent uncompressed.
+func compressionLevel(s string) (compress.Level, error) {
+	level, ok := compressionLevels[s]
+	if !ok {
+		return 0, fmt.Errorf("unsupported response compression %q", s)
+	}
+
+	return level, nil
+}
@@ -0,0 +1,60 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+
+	"github.com/talos-systems/kubespan-manager/internal/db"
+)
+
+// headerCorrelationID carries the ID tying together the log lines of a single request.
+const headerCorrelationID = "X-Correlation-ID"
+
+// maxCorrelationIDLength bounds the length of the client-provided correlation IDs.
+const maxCorrelationIDLength = 128
+
+// correlate is the middleware assigning the correlation ID to the request.
+//
+// The ID provided by the client is kept if it is sane, otherwise a new one is generated.
+// The ID is echoed in the response and stored in the request context, so that the database layer logs it as well.
+func correlate(c *fiber.Ctx) error {
+	id := c.Get(headerCorrelationID)
+
+	if !validCorrelationID(id) {
+		id = uuid.New().String()
+	}
+
+	c.Set(headerCorrelationID, id)
+	c.Context().SetUserValue(db.CorrelationIDKey, id)
+
+	return c.Next()
+}
+
+// validCorrelationID allows only short printable IDs, so that they can't mess up the logs.
+func validCorrelationID(id string) bool {
+	if id == "" || len(id) > maxCorrelationIDLength {
+		return false
+	}
+
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// requestLogger returns the logger annotated with the correlation ID of the request.
+func requestLogger(c *fiber.Ctx, logger *zap.Logger) *zap.Logger {
+	if id, ok := c.Context().UserValue(db.CorrelationIDKey).(string); ok {
+		return logger.With(zap.String("correlation_id", id))
+	}
+
+	return logger
+}
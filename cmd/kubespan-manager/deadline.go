@@ -0,0 +1,63 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// localRequestContext is the key of the request context in the fiber locals.
+const localRequestContext = "requestContext"
+
+// limitRequestTime is the middleware bounding the total time of the request handling with -request-timeout.
+//
+// The handlers run the backend operations with requestContext, so that the remaining work is cancelled
+// once the budget is spent, and the failed request is answered with 504.
+// Long-polls wait on the connection context instead, they are bounded by their own wait timeout.
+func limitRequestTime(c *fiber.Ctx) error {
+	if reqTimeout <= 0 {
+		return c.Next()
+	}
+
+	ctx, cancel := context.WithTimeout(c.Context(), reqTimeout)
+	defer cancel()
+
+	c.Locals(localRequestContext, ctx)
+
+	err := c.Next()
+
+	status := c.Response().StatusCode()
+
+	var fiberErr *fiber.Error
+
+	switch {
+	case errors.As(err, &fiberErr):
+		status = fiberErr.Code
+	case err != nil:
+		status = http.StatusInternalServerError
+	}
+
+	// requests which have completed or failed on their own keep the response
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) && status >= http.StatusInternalServerError {
+		c.Response().ResetBody()
+
+		return c.SendStatus(http.StatusGatewayTimeout)
+	}
+
+	return err
+}
+
+// requestContext returns the context of the backend operations of the request.
+func requestContext(c *fiber.Ctx) context.Context {
+	if ctx, ok := c.Locals(localRequestContext).(context.Context); ok {
+		return ctx
+	}
+
+	return c.Context()
+}
@@ -0,0 +1,95 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gofiber/fiber/v2"
+	"go.uber.org/zap"
+
+	"github.com/talos-systems/kubespan-manager/internal/db"
+)
+
+// debugWarning is returned with the internal state, so that nobody mistakes it for a stable API.
+const debugWarning = "debug output, the format is unstable and might change without notice"
+
+// clusterDebug is the internal state of the cluster returned by the admin API.
+type clusterDebug struct {
+	Warning string `json:"warning"`
+	Cluster string `json:"cluster"`
+
+	// Target is the cluster the alias points at, empty if the cluster is not an alias.
+	Target string `json:"target,omitempty"`
+
+	// Subscriptions is the number of the long-poll clients of the cluster connected to this instance.
+	Subscriptions int `json:"subscriptions"`
+
+	*db.ClusterState
+}
+
+// inspectCluster returns the handler dumping the internal state of the cluster for debugging.
+func inspectCluster(logger *zap.Logger) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		logger := requestLogger(c, logger)
+
+		cluster := c.Params("cluster")
+
+		if inspector == nil {
+			logger.Warn("cluster inspection is not supported by the backend")
+
+			return c.SendStatus(http.StatusNotImplemented)
+		}
+
+		target, err := nodeDB.ResolveAlias(requestContext(c), cluster)
+		if err != nil {
+			logger.Error("failed to resolve cluster alias",
+				zap.String("cluster", cluster),
+				zap.Error(err),
+			)
+
+			return sendDBError(c, err)
+		}
+
+		resolved := cluster
+		if target != "" {
+			resolved = target
+		}
+
+		state, err := inspector.Inspect(requestContext(c), resolved)
+		if err != nil {
+			if errors.Is(err, db.ErrNotFound) {
+				logger.Warn("cluster not found",
+					zap.String("cluster", cluster),
+					zap.Error(err),
+				)
+
+				return c.SendStatus(http.StatusNotFound)
+			}
+
+			logger.Error("failed to inspect cluster",
+				zap.String("cluster", cluster),
+				zap.Error(err),
+			)
+
+			return sendDBError(c, err)
+		}
+
+		for _, n := range state.Nodes {
+			if n.LastChange != nil {
+				fillEventFields(n.LastChange)
+			}
+		}
+
+		return c.JSON(&clusterDebug{
+			Warning:       debugWarning,
+			Cluster:       cluster,
+			Target:        target,
+			Subscriptions: watcherCount(cluster),
+			ClusterState:  state,
+		})
+	}
+}
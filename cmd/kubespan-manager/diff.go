@@ -0,0 +1,103 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gofiber/fiber/v2"
+	"go.uber.org/zap"
+
+	"github.com/talos-systems/kubespan-manager/internal/db"
+	"github.com/talos-systems/kubespan-manager/pkg/types"
+)
+
+// nodeDiff is the comparison of the addresses of two nodes.
+type nodeDiff struct {
+	A string `json:"a"`
+	B string `json:"b"`
+
+	Common  []*types.Address `json:"common"`
+	OnlyInA []*types.Address `json:"onlyInA"`
+	OnlyInB []*types.Address `json:"onlyInB"`
+}
+
+// diffAddresses compares the address sets, addresses are matched by the host and the port.
+func diffAddresses(a, b *types.Node) *nodeDiff {
+	diff := &nodeDiff{
+		A:       a.ID,
+		B:       b.ID,
+		Common:  []*types.Address{},
+		OnlyInA: []*types.Address{},
+		OnlyInB: []*types.Address{},
+	}
+
+	contains := func(list []*types.Address, addr *types.Address) bool {
+		for _, other := range list {
+			if addr.Equal(other) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	for _, addr := range a.Addresses {
+		if contains(b.Addresses, addr) {
+			diff.Common = append(diff.Common, addr)
+		} else {
+			diff.OnlyInA = append(diff.OnlyInA, addr)
+		}
+	}
+
+	for _, addr := range b.Addresses {
+		if !contains(a.Addresses, addr) {
+			diff.OnlyInB = append(diff.OnlyInB, addr)
+		}
+	}
+
+	return diff
+}
+
+// diffNodes handles GET /:cluster/:node/:other/diff, comparing the addresses known for two nodes.
+//
+// It helps debugging connectivity when two nodes disagree about the endpoints of a peer.
+func diffNodes(logger *zap.Logger) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		logger := requestLogger(c, logger)
+
+		cluster := c.Params("cluster")
+
+		nodes := make([]*types.Node, 0, 2)
+
+		for _, id := range []string{nodeParam(c), keyParam(c, "other")} {
+			n, err := nodeDB.Get(requestContext(c), cluster, id)
+			if err != nil {
+				if errors.Is(err, db.ErrNotFound) {
+					logger.Warn("node not found",
+						zap.String("cluster", cluster),
+						zap.String("node", id),
+						zap.Error(err),
+					)
+
+					return c.SendStatus(http.StatusNotFound)
+				}
+
+				logger.Error("failed to get node",
+					zap.String("cluster", cluster),
+					zap.String("node", id),
+					zap.Error(err),
+				)
+
+				return sendDBError(c, err)
+			}
+
+			nodes = append(nodes, n)
+		}
+
+		return c.JSON(diffAddresses(nodes[0], nodes[1]))
+	}
+}
@@ -0,0 +1,93 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// drainRetryAfter is the Retry-After hint of the requests refused while draining.
+const drainRetryAfter = 5 * time.Second
+
+// drainState tracks the connection draining of the replica during rolling deploys.
+type drainState struct {
+	mu       sync.Mutex
+	draining bool
+
+	// expired is closed once the grace period for the existing long-polls elapses.
+	expired chan struct{}
+}
+
+var draining = &drainState{
+	expired: make(chan struct{}),
+}
+
+// start switches the replica into the drain mode, existing long-polls are cut after the grace period.
+//
+// It returns false if the replica is already draining.
+func (s *drainState) start(grace time.Duration) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.draining {
+		return false
+	}
+
+	s.draining = true
+
+	time.AfterFunc(grace, func() {
+		close(s.expired)
+	})
+
+	return true
+}
+
+func (s *drainState) active() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.draining
+}
+
+// context returns the context which is canceled once the grace period elapses.
+func (s *drainState) context(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	go func() {
+		select {
+		case <-s.expired:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	return ctx, cancel
+}
+
+// refuseWhileDraining returns the middleware which refuses writes and new long-polls while draining.
+//
+// Plain reads are still served, and the connections are closed after the response,
+// so that keep-alive clients reconnect to other replicas.
+func refuseWhileDraining(c *fiber.Ctx) error {
+	if !draining.active() {
+		return c.Next()
+	}
+
+	c.Response().SetConnectionClose()
+
+	if (c.Method() == http.MethodGet || c.Method() == http.MethodHead) && c.Query("wait") == "" {
+		return c.Next()
+	}
+
+	c.Set(fiber.HeaderRetryAfter, strconv.Itoa(int(drainRetryAfter.Seconds())))
+
+	return c.SendStatus(http.StatusServiceUnavailable)
+}
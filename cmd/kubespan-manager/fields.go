@@ -0,0 +1,74 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+
+	"github.com/talos-systems/kubespan-manager/pkg/types"
+)
+
+// parseFields parses the ?fields=id,ip projection: the list of JSON fields of the node to return.
+//
+// nil means the full node should be returned.
+func parseFields(c *fiber.Ctx) map[string]struct{} {
+	query := c.Query("fields")
+	if query == "" {
+		return nil
+	}
+
+	fields := make(map[string]struct{})
+
+	for _, field := range strings.Split(query, ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			fields[field] = struct{}{}
+		}
+	}
+
+	return fields
+}
+
+// projectNodes trims the nodes down to the requested fields.
+//
+// Unknown fields are ignored, empty fields are omitted the same way as in the full node.
+func projectNodes(list []*types.Node, fields map[string]struct{}) ([]map[string]json.RawMessage, error) {
+	projected := make([]map[string]json.RawMessage, 0, len(list))
+
+	for _, n := range list {
+		full, err := projectNode(n, fields)
+		if err != nil {
+			return nil, err
+		}
+
+		projected = append(projected, full)
+	}
+
+	return projected, nil
+}
+
+// projectNode trims a single node down to the requested fields.
+func projectNode(n *types.Node, fields map[string]struct{}) (map[string]json.RawMessage, error) {
+	data, err := json.Marshal(n)
+	if err != nil {
+		return nil, err
+	}
+
+	var full map[string]json.RawMessage
+
+	if err = json.Unmarshal(data, &full); err != nil {
+		return nil, err
+	}
+
+	for field := range full {
+		if _, ok := fields[field]; !ok {
+			delete(full, field)
+		}
+	}
+
+	return full, nil
+}
@@ -0,0 +1,313 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+
+	"github.com/talos-systems/kubespan-manager/pkg/types"
+)
+
+// nodeFilter selects the nodes returned by the cluster list and the long-poll changes.
+type nodeFilter struct {
+	// labels is the label selector: nodes should match all the labels.
+	labels map[string]string
+
+	// ids is the set of node IDs the client is interested in, all nodes match if empty.
+	ids map[string]struct{}
+
+	// role selects the nodes of the role, all nodes match if empty.
+	role types.NodeRole
+
+	// minGeneration hides the nodes running an older configuration generation.
+	minGeneration int64
+
+	// modifiedAfter hides the nodes which were not changed after the time, all nodes match if zero.
+	modifiedAfter time.Time
+
+	// addresses trims the addresses of the returned nodes.
+	addresses addressFilter
+}
+
+// addressFilter selects the returned addresses of the nodes.
+type addressFilter struct {
+	family   types.AddressFamily
+	addrType types.AddressType
+
+	// maxAge hides the addresses which were not reported for longer, the addresses are still stored.
+	maxAge time.Duration
+}
+
+// parseAddressFilter parses the ?address_family=4|6|both, ?address_type=direct|relay|stun
+// and ?max_address_age=<duration> query parameters.
+//
+// The maximum address age defaults to -max-address-age, 0 shows the addresses of any age.
+func parseAddressFilter(c *fiber.Ctx) (addressFilter, error) {
+	var (
+		f   addressFilter
+		err error
+	)
+
+	f.maxAge = maxAddrAge
+
+	if c.Query("max_address_age") != "" {
+		if f.maxAge, err = time.ParseDuration(c.Query("max_address_age")); err != nil || f.maxAge < 0 {
+			return f, fmt.Errorf("bad maximum address age %q", c.Query("max_address_age"))
+		}
+	}
+
+	if f.family, err = types.ParseAddressFamily(c.Query("address_family")); err != nil {
+		return f, err
+	}
+
+	if c.Query("address_type") != "" {
+		if f.addrType, err = types.ParseAddressType(c.Query("address_type")); err != nil {
+			return f, err
+		}
+	}
+
+	return f, nil
+}
+
+func (f addressFilter) empty() bool {
+	return f.family == types.AddressFamilyBoth && f.addrType == "" && f.maxAge <= 0
+}
+
+func (f addressFilter) match(a *types.Address) bool {
+	return a.InFamily(f.family) && (f.addrType == "" || a.IsType(f.addrType))
+}
+
+func (f addressFilter) fresh(a *types.Address) bool {
+	return f.maxAge <= 0 || time.Since(a.LastReported) <= f.maxAge
+}
+
+// node returns the node with the matching addresses only.
+//
+// Addresses of the sticky nodes never expire, so they are shown regardless of the age.
+func (f addressFilter) node(n *types.Node) *types.Node {
+	if f.empty() {
+		return n
+	}
+
+	return n.WithAddresses(func(a *types.Address) bool {
+		return f.match(a) && (n.Sticky || f.fresh(a))
+	})
+}
+
+// parseMinGeneration parses the ?min_generation= query parameter, 0 if not set.
+func parseMinGeneration(c *fiber.Ctx) (int64, error) {
+	if c.Query("min_generation") == "" {
+		return 0, nil
+	}
+
+	generation, err := strconv.ParseInt(c.Query("min_generation"), 10, 64)
+	if err != nil || generation < 0 {
+		return 0, fmt.Errorf("bad minimum generation %q", c.Query("min_generation"))
+	}
+
+	return generation, nil
+}
+
+// parseModifiedAfter parses the ?modified_after=<rfc3339> query parameter, zero if not set.
+func parseModifiedAfter(c *fiber.Ctx) (time.Time, error) {
+	if c.Query("modified_after") == "" {
+		return time.Time{}, nil
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, c.Query("modified_after"))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("bad modification time %q", c.Query("modified_after"))
+	}
+
+	return t, nil
+}
+
+// parseNodeFilter parses the filter passed as ?label=key=value, ?node=<id>, ?role=controlplane|worker,
+// ?min_generation=<generation> and ?modified_after=<rfc3339> query parameters along with the address filter.
+//
+// Label and node parameters might be repeated, a node should match all the labels and any of the IDs.
+func parseNodeFilter(c *fiber.Ctx) (*nodeFilter, error) {
+	var selectors []string
+
+	for _, sel := range c.Context().QueryArgs().PeekMulti("label") {
+		selectors = append(selectors, string(sel))
+	}
+
+	labels, err := types.ParseLabelSelector(selectors)
+	if err != nil {
+		return nil, err
+	}
+
+	addresses, err := parseAddressFilter(c)
+	if err != nil {
+		return nil, err
+	}
+
+	filter := &nodeFilter{
+		labels:    labels,
+		addresses: addresses,
+	}
+
+	if c.Query("role") != "" {
+		if filter.role, err = types.ParseNodeRole(c.Query("role")); err != nil {
+			return nil, err
+		}
+	}
+
+	if filter.minGeneration, err = parseMinGeneration(c); err != nil {
+		return nil, err
+	}
+
+	if filter.modifiedAfter, err = parseModifiedAfter(c); err != nil {
+		return nil, err
+	}
+
+	for _, param := range c.Context().QueryArgs().PeekMulti("node") {
+		id, err := types.NormalizeKey(string(param))
+		if err != nil {
+			return nil, fmt.Errorf("bad node filter %q: %w", string(param), err)
+		}
+
+		if filter.ids == nil {
+			filter.ids = make(map[string]struct{})
+		}
+
+		filter.ids[id] = struct{}{}
+	}
+
+	return filter, nil
+}
+
+func (f *nodeFilter) matchID(id string) bool {
+	if len(f.ids) == 0 {
+		return true
+	}
+
+	_, ok := f.ids[id]
+
+	return ok
+}
+
+func (f *nodeFilter) match(n *types.Node) bool {
+	return f.matchID(n.ID) && n.MatchLabels(f.labels) && (f.role == "" || n.Role == f.role) && n.Generation >= f.minGeneration &&
+		(f.modifiedAfter.IsZero() || n.LastModified.After(f.modifiedAfter))
+}
+
+// nodes returns the nodes matching the filter.
+func (f *nodeFilter) nodes(list []*types.Node) []*types.Node {
+	if len(f.labels) == 0 && len(f.ids) == 0 && f.role == "" && f.minGeneration == 0 && f.modifiedAfter.IsZero() && f.addresses.empty() {
+		return list
+	}
+
+	filtered := make([]*types.Node, 0, len(list))
+
+	for _, n := range list {
+		if f.match(n) {
+			filtered = append(filtered, f.addresses.node(n))
+		}
+	}
+
+	return filtered
+}
+
+// removed returns the removed node IDs matching the filter.
+//
+// Labels and roles of the removed nodes are not known, so only the ID filter applies.
+func (f *nodeFilter) removed(ids []string) []string {
+	if len(f.ids) == 0 {
+		return ids
+	}
+
+	var filtered []string
+
+	for _, id := range ids {
+		if f.matchID(id) {
+			filtered = append(filtered, id)
+		}
+	}
+
+	return filtered
+}
+
+// membershipFields returns the fields which decide whether a node matches the filter.
+//
+// Nodes with these fields changed might enter the filter (enter) or leave it (leave) after the cursor.
+// Any change moves the modification time, so it might bring the node past ?modified_after, but never back.
+func (f *nodeFilter) membershipFields() (enter, leave types.NodeFields) {
+	if len(f.labels) > 0 {
+		leave |= types.FieldLabels
+	}
+
+	if f.role != "" {
+		leave |= types.FieldRole
+	}
+
+	if f.minGeneration > 0 {
+		leave |= types.FieldGeneration
+	}
+
+	enter = leave
+
+	if !f.modifiedAfter.IsZero() {
+		enter = types.AllNodeFields
+	}
+
+	return enter, leave
+}
+
+// changes applies the filter to the changes after the cursor.
+//
+// The subscriber only knows the nodes which matched the filter at the cursor, so the nodes which enter the filter
+// are sent in full as created, and the nodes which leave it are sent as removed.
+func (f *nodeFilter) changes(changes *types.Changes) {
+	enter, leave := f.membershipFields()
+
+	if changes.Reset || (enter == 0 && leave == 0) {
+		changes.Nodes = f.nodes(changes.Nodes)
+		changes.Removed = f.removed(changes.Removed)
+
+		return
+	}
+
+	// the deltas might be shared with the other subscribers
+	deltas := make(map[string]types.NodeDelta, len(changes.Deltas))
+
+	for id, delta := range changes.Deltas {
+		deltas[id] = delta
+	}
+
+	nodes := make([]*types.Node, 0, len(changes.Nodes))
+	removed := append([]string(nil), f.removed(changes.Removed)...)
+
+	for _, n := range changes.Nodes {
+		delta, tracked := deltas[n.ID]
+
+		switch {
+		case f.match(n):
+			if tracked && delta.Fields&enter != 0 {
+				delta.Created = true
+				deltas[n.ID] = delta
+			}
+
+			nodes = append(nodes, f.addresses.node(n))
+		case !f.matchID(n.ID):
+		case tracked && (delta.Created || delta.Fields&leave == 0):
+			// the node didn't match the filter at the cursor either
+		default:
+			removed = append(removed, n.ID)
+		}
+	}
+
+	changes.Nodes = nodes
+	changes.Removed = removed
+
+	if changes.Deltas != nil {
+		changes.Deltas = deltas
+	}
+}
@@ -0,0 +1,37 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/talos-systems/kubespan-manager/internal/db"
+)
+
+// gcInterval is the interval between the periodic database cleanups.
+const gcInterval = time.Hour
+
+// collectGarbage runs the database cleanup every interval until the context is canceled.
+//
+// If final is set, one more cleanup runs once the context is canceled, so that the cluster empty notifications
+// of the expired nodes are queued before the webhooks are drained on shutdown.
+func collectGarbage(ctx context.Context, d db.DB, interval time.Duration, final bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			if final {
+				d.Clean()
+			}
+
+			return
+		case <-ticker.C:
+			d.Clean()
+		}
+	}
+}
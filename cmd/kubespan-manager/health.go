@@ -0,0 +1,44 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"go.uber.org/zap"
+)
+
+// readinessTimeout bounds the backend check of the readiness probe.
+const readinessTimeout = 2 * time.Second
+
+// registerHealthRoutes registers the liveness and readiness probes.
+//
+// Liveness only reports that the process serves requests, readiness reports NOT_SERVING
+// while the database backend is unreachable or the replica is draining.
+func registerHealthRoutes(r fiber.Router, logger *zap.Logger) {
+	r.Get("/healthz", func(c *fiber.Ctx) error {
+		return c.SendString("SERVING")
+	})
+
+	r.Get("/readyz", func(c *fiber.Ctx) error {
+		if draining.active() {
+			return c.Status(http.StatusServiceUnavailable).SendString("NOT_SERVING")
+		}
+
+		ctx, cancel := context.WithTimeout(requestContext(c), readinessTimeout)
+		defer cancel()
+
+		if err := nodeDB.Ping(ctx); err != nil {
+			logger.Warn("backend is not ready", zap.Error(err))
+
+			return c.Status(http.StatusServiceUnavailable).SendString("NOT_SERVING")
+		}
+
+		return c.SendString("SERVING")
+	})
+}
@@ -0,0 +1,53 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gofiber/fiber/v2"
+	"go.uber.org/zap"
+
+	"github.com/talos-systems/kubespan-manager/internal/db"
+)
+
+// heartbeat handles POST /:cluster/:node/heartbeat, postponing the expiration of the node and its addresses.
+//
+// It is the cheap keep-alive of the agents: the node data is not sent, and the subscribers are not notified.
+func heartbeat(logger *zap.Logger) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		logger := requestLogger(c, logger)
+
+		cluster, node := c.Params("cluster"), nodeParam(c)
+
+		if err := nodeDB.Touch(requestContext(c), cluster, node); err != nil {
+			if errors.Is(err, db.ErrNotFound) {
+				logger.Warn("node not found",
+					zap.String("cluster", cluster),
+					zap.String("node", node),
+					zap.Error(err),
+				)
+
+				return c.SendStatus(http.StatusNotFound)
+			}
+
+			logger.Error("failed to touch node",
+				zap.String("cluster", cluster),
+				zap.String("node", node),
+				zap.Error(err),
+			)
+
+			return sendDBError(c, err)
+		}
+
+		logger.Debug("node heartbeat",
+			zap.String("cluster", cluster),
+			zap.String("node", node),
+		)
+
+		return c.SendStatus(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,183 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"container/list"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"go.uber.org/zap"
+)
+
+const (
+	idempotencyKeyHeader = "Idempotency-Key"
+
+	// idempotencyCacheSize is the maximum number of responses kept for replay.
+	idempotencyCacheSize = 4096
+
+	// maxIdempotencyKeyLength bounds the length of the client-supplied key.
+	maxIdempotencyKeyLength = 256
+)
+
+// idempotencyKey identifies a keyed request.
+type idempotencyKey struct {
+	cluster string
+	key     string
+}
+
+// idempotentResponse is the recorded outcome of a keyed request.
+//
+// done is closed once the response is recorded, so that concurrent retries wait for the first request to complete.
+type idempotentResponse struct {
+	key     idempotencyKey
+	done    chan struct{}
+	expires time.Time
+
+	status      int
+	contentType []byte
+	body        []byte
+}
+
+// idempotencyCache is an LRU of the responses to keyed requests.
+type idempotencyCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	lru     *list.List
+	entries map[idempotencyKey]*list.Element
+}
+
+func newIdempotencyCache(ttl time.Duration) *idempotencyCache {
+	return &idempotencyCache{
+		ttl:     ttl,
+		lru:     list.New(),
+		entries: make(map[idempotencyKey]*list.Element),
+	}
+}
+
+// acquire returns the recorded response for the key, or registers a new in-flight entry.
+//
+// If the returned entry is owned by the caller, it should be completed with either record or forget.
+func (ic *idempotencyCache) acquire(key idempotencyKey) (entry *idempotentResponse, owned bool) {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+
+	if el, ok := ic.entries[key]; ok {
+		entry = el.Value.(*idempotentResponse) //nolint:forcetypeassert
+
+		if entry.expires.IsZero() || time.Now().Before(entry.expires) {
+			ic.lru.MoveToFront(el)
+
+			return entry, false
+		}
+
+		ic.lru.Remove(el)
+		delete(ic.entries, key)
+	}
+
+	entry = &idempotentResponse{
+		key:  key,
+		done: make(chan struct{}),
+	}
+
+	ic.entries[key] = ic.lru.PushFront(entry)
+
+	for ic.lru.Len() > idempotencyCacheSize {
+		oldest := ic.lru.Back()
+
+		ic.lru.Remove(oldest)
+		delete(ic.entries, oldest.Value.(*idempotentResponse).key) //nolint:forcetypeassert
+	}
+
+	return entry, true
+}
+
+// record stores the response of the in-flight entry and wakes up the waiters.
+func (ic *idempotencyCache) record(entry *idempotentResponse, c *fiber.Ctx) {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+
+	entry.status = c.Response().StatusCode()
+	entry.contentType = append([]byte(nil), c.Response().Header.ContentType()...)
+	entry.body = append([]byte(nil), c.Response().Body()...)
+	entry.expires = time.Now().Add(ic.ttl)
+
+	close(entry.done)
+}
+
+// forget drops the in-flight entry without recording the response, so that the retry is executed again.
+func (ic *idempotencyCache) forget(entry *idempotentResponse) {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+
+	if el, ok := ic.entries[entry.key]; ok && el.Value == entry {
+		ic.lru.Remove(el)
+		delete(ic.entries, entry.key)
+	}
+
+	close(entry.done)
+}
+
+// idempotent returns the middleware which replays the responses to requests with the same Idempotency-Key header.
+//
+// Responses are cached per cluster for the cache TTL, server errors are not cached, so that the retries are re-executed.
+func idempotent(ic *idempotencyCache, logger *zap.Logger) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		logger := requestLogger(c, logger)
+
+		key := c.Get(idempotencyKeyHeader)
+		if key == "" || ic == nil {
+			return c.Next()
+		}
+
+		if len(key) > maxIdempotencyKeyLength {
+			logger.Error("idempotency key is too long",
+				zap.String("cluster", c.Params("cluster", "")),
+				zap.Int("length", len(key)),
+			)
+
+			return c.SendStatus(http.StatusBadRequest)
+		}
+
+		for {
+			entry, owned := ic.acquire(idempotencyKey{cluster: c.Params("cluster", ""), key: key})
+
+			if !owned {
+				select {
+				case <-entry.done:
+				case <-requestContext(c).Done():
+					return c.SendStatus(http.StatusServiceUnavailable)
+				}
+
+				if entry.expires.IsZero() {
+					// first request was not recorded, retry the acquire
+					continue
+				}
+
+				logger.Debug("replaying idempotent response",
+					zap.String("cluster", c.Params("cluster", "")),
+					zap.String("key", key),
+				)
+
+				c.Response().Header.SetContentTypeBytes(entry.contentType)
+
+				return c.Status(entry.status).Send(entry.body)
+			}
+
+			err := c.Next()
+
+			if err != nil || c.Response().StatusCode() >= http.StatusInternalServerError {
+				ic.forget(entry)
+			} else {
+				ic.record(entry, c)
+			}
+
+			return err
+		}
+	}
+}
@@ -0,0 +1,92 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// appConfig builds the listener configuration from the flags.
+//
+// Prefork is only allowed with a shared database, as every child process would otherwise keep its own state.
+//
+// Read and idle timeouts protect against slowloris-style clients holding connections open,
+// while the write timeout is counted from the moment the handler returns, so long-polls are not affected by it.
+func appConfig(sharedDB bool) (fiber.Config, error) {
+	if prefork && !sharedDB {
+		return fiber.Config{}, fmt.Errorf("prefork requires redis backend")
+	}
+
+	if (tlsCert == "") != (tlsKey == "") {
+		return fiber.Config{}, fmt.Errorf("both TLS certificate and key should be set")
+	}
+
+	return fiber.Config{
+		// route parameters are stored by the database (e.g. as the in-memory cluster keys),
+		// so they should not reference the request buffers which are reused
+		Immutable: true,
+
+		Prefork:      prefork,
+		ReadTimeout:  readTimeout,
+		WriteTimeout: writeTimeout,
+		IdleTimeout:  idleTimeout,
+		Concurrency:  concurrency,
+	}, nil
+}
+
+// listen starts the listener, serving TLS if the certificate is configured.
+//
+// TLS listener doesn't offer any ALPN protocols, so the clients fall back to HTTP/1.1: the underlying
+// fasthttp server doesn't support HTTP/2, so connection reuse relies on the keep-alive tuning above.
+func listen(app *fiber.App) error {
+	if tlsCert != "" {
+		return app.ListenTLS(listenAddr, tlsCert, tlsKey)
+	}
+
+	return app.Listen(listenAddr)
+}
+
+// shutdown stops the listener and waits for the open connections to be closed, up to the timeout.
+func shutdown(app *fiber.App, timeout time.Duration) error {
+	done := make(chan error, 1)
+
+	go func() {
+		done <- app.Shutdown()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+		return fmt.Errorf("connections were not closed in %s", timeout)
+	}
+}
+
+// writeDeadlineExtender returns the function extending the write deadline of the connection,
+// which the body stream writers call as they produce the body.
+//
+// fasthttp sets the write deadline once per response, so the streams taking longer than -write-timeout
+// (e.g. exports or huge node lists) would be cut off mid-body. The deadline is extended at most
+// every half of the timeout, so that a stalled client still times out.
+func writeDeadlineExtender(c *fiber.Ctx) func() {
+	conn := c.Context().Conn()
+
+	var extended time.Time
+
+	return func() {
+		if writeTimeout <= 0 || conn == nil {
+			return
+		}
+
+		if now := time.Now(); now.Sub(extended) > writeTimeout/2 {
+			conn.SetWriteDeadline(now.Add(writeTimeout)) //nolint:errcheck
+
+			extended = now
+		}
+	}
+}
@@ -0,0 +1,38 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"fmt"
+
+	"go.uber.org/zap"
+)
+
+// newLogger builds the logger according to the mode and logging flags.
+//
+// The level is bound to logLevel, so that it can be changed at runtime.
+func newLogger() (*zap.Logger, error) {
+	cfg := zap.NewProductionConfig()
+
+	if devMode {
+		cfg = zap.NewDevelopmentConfig()
+	}
+
+	if err := logLevel.UnmarshalText([]byte(logLevelName)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q: %w", logLevelName, err)
+	}
+
+	cfg.Level = logLevel
+	cfg.Sampling = nil
+
+	if logSamplingInitial > 0 {
+		cfg.Sampling = &zap.SamplingConfig{
+			Initial:    logSamplingInitial,
+			Thereafter: logSamplingThereafter,
+		}
+	}
+
+	return cfg.Build()
+}
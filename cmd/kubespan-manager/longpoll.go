@@ -0,0 +1,248 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"go.uber.org/zap"
+
+	"github.com/talos-systems/kubespan-manager/pkg/types"
+)
+
+// maxLongPollWait caps the wait duration requested by the client.
+const maxLongPollWait = 5 * time.Minute
+
+// maxCoalesceWindow caps the coalescing window requested by the client.
+const maxCoalesceWindow = time.Minute
+
+// cursorHeader carries the opaque change cursor of the cluster in long-poll responses.
+const cursorHeader = "X-Cursor"
+
+// reconnectHeader is set on the last long-poll response of the connection which reached the maximum stream duration.
+const reconnectHeader = "X-Reconnect"
+
+// streamDeadline caps the wait duration so that the long-poll connection doesn't outlive the maximum stream duration.
+//
+// Once the connection reaches the limit, it is closed after the response and the client is asked to reconnect,
+// which also rebalances the subscribers across the replicas.
+// Behind a reverse proxy, the limit applies to the connection from the proxy.
+func streamDeadline(c *fiber.Ctx, wait time.Duration) time.Duration {
+	if maxStream <= 0 {
+		return wait
+	}
+
+	remaining := maxStream - time.Since(c.Context().ConnTime())
+
+	if remaining >= wait {
+		return wait
+	}
+
+	c.Set(reconnectHeader, "true")
+	c.Response().SetConnectionClose()
+
+	// the response is still delivered, the client resumes from the returned cursor
+	if remaining < time.Millisecond {
+		remaining = time.Millisecond
+	}
+
+	return remaining
+}
+
+// listChanges handles long-poll variant of the cluster node list: GET /:cluster?wait=30s&since=<cursor>.
+//
+// It blocks up to the wait duration and returns the changes since the cursor (filtered by the node filter),
+// or 304 Not Modified if nothing changed before the timeout.
+// If the cursor is too old, a full snapshot is returned with the reset flag set.
+// The new cursor is returned in the X-Cursor header in both cases.
+//
+// The changes are encoded in the format of the subscription, see notificationEncoderFor.
+// The wait is also bounded by the maximum stream duration of the connection, see streamDeadline.
+//
+// With ?snapshot_chunk=<nodes>, a large snapshot (from the zero cursor or after a reset) is delivered in chunks,
+// see snapshotChunk.
+//
+// With ?replay=true, new subscribers first get the retained changes of the cluster one by one, see sendReplay.
+//
+// With ?coalesce=<duration>, the response is delayed by the coalescing window once the first change arrives,
+// so that a burst of changes (e.g. rapid updates of a single node) is delivered as one response with the latest state.
+func listChanges(c *fiber.Ctx, logger *zap.Logger, cluster string, filter *nodeFilter) error {
+	wait, err := time.ParseDuration(c.Query("wait"))
+	if err != nil || wait <= 0 {
+		logger.Error("bad wait duration",
+			zap.String("cluster", cluster),
+			zap.String("wait", c.Query("wait")),
+		)
+
+		return c.SendStatus(http.StatusBadRequest)
+	}
+
+	if wait > maxLongPollWait {
+		wait = maxLongPollWait
+	}
+
+	wait = streamDeadline(c, wait)
+
+	var since uint64
+
+	if c.Query("since") != "" {
+		if since, err = strconv.ParseUint(c.Query("since"), 10, 64); err != nil {
+			logger.Error("bad cursor",
+				zap.String("cluster", cluster),
+				zap.String("since", c.Query("since")),
+				zap.Error(err),
+			)
+
+			return c.SendStatus(http.StatusBadRequest)
+		}
+	}
+
+	if c.Query("replay") != "" {
+		replay, err := strconv.ParseBool(c.Query("replay"))
+		if err != nil {
+			logger.Error("bad replay flag",
+				zap.String("cluster", cluster),
+				zap.String("replay", c.Query("replay")),
+			)
+
+			return c.SendStatus(http.StatusBadRequest)
+		}
+
+		// replay is only sent to the new subscribers, the ones resuming from a cursor get the live changes
+		if replay && since == 0 {
+			return sendReplay(c, logger, cluster, filter)
+		}
+	}
+
+	chunk, err := parseSnapshotChunk(c)
+	if err != nil {
+		logger.Error("bad snapshot chunk",
+			zap.String("cluster", cluster),
+			zap.Error(err),
+		)
+
+		return c.SendStatus(http.StatusBadRequest)
+	}
+
+	// continuation of the chunked snapshot has to be a snapshot as well
+	if chunk.after != "" && since != 0 {
+		logger.Error("snapshot continuation with a cursor",
+			zap.String("cluster", cluster),
+			zap.Uint64("since", since),
+		)
+
+		return c.SendStatus(http.StatusBadRequest)
+	}
+
+	enc, err := notificationEncoderFor(c)
+	if err != nil {
+		logger.Error("bad notification format",
+			zap.String("cluster", cluster),
+			zap.Error(err),
+		)
+
+		return c.SendStatus(http.StatusBadRequest)
+	}
+
+	var coalesce time.Duration
+
+	if c.Query("coalesce") != "" {
+		if coalesce, err = time.ParseDuration(c.Query("coalesce")); err != nil || coalesce < 0 {
+			logger.Error("bad coalesce window",
+				zap.String("cluster", cluster),
+				zap.String("coalesce", c.Query("coalesce")),
+			)
+
+			return c.SendStatus(http.StatusBadRequest)
+		}
+
+		if coalesce > maxCoalesceWindow {
+			coalesce = maxCoalesceWindow
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(c.Context(), wait)
+	defer cancel()
+
+	// once the drain grace period elapses, the client gets the response and reconnects to another replica
+	ctx, stop := draining.context(ctx)
+	defer stop()
+
+	watchDone, err := watchStart(cluster)
+	if err != nil {
+		logger.Warn("refusing subscription",
+			zap.String("cluster", cluster),
+			zap.Error(err),
+		)
+
+		return c.Status(http.StatusTooManyRequests).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	changes, err := nodeDB.Changes(ctx, cluster, since)
+	if err == nil && coalesce > 0 && !changes.Empty() {
+		changes, err = coalesceChanges(c.Context(), cluster, since, coalesce, changes)
+	}
+
+	watchDone()
+
+	if err != nil {
+		logger.Error("failed to wait for cluster changes",
+			zap.String("cluster", cluster),
+			zap.Uint64("since", since),
+			zap.Error(err),
+		)
+
+		return sendDBError(c, err)
+	}
+
+	c.Set(cursorHeader, strconv.FormatUint(changes.Cursor, 10))
+
+	observeLag(since, changes.Cursor, changes.Reset)
+
+	filter.changes(changes)
+
+	if since == 0 || changes.Reset {
+		chunk.apply(c, changes)
+	}
+
+	if changes.Empty() {
+		return c.SendStatus(http.StatusNotModified)
+	}
+
+	logger.Info("listing changed cluster nodes",
+		zap.String("cluster", cluster),
+		zap.Uint64("since", since),
+		zap.Uint64("cursor", changes.Cursor),
+		zap.Int("count", len(changes.Nodes)),
+		zap.Int("removed", len(changes.Removed)),
+		zap.Bool("reset", changes.Reset),
+	)
+
+	if err = sendNotification(c, enc, changes); err != nil {
+		return err
+	}
+
+	observeDelivery(changes)
+
+	return nil
+}
+
+// coalesceChanges waits for the coalescing window and re-reads the changes after the cursor,
+// collapsing all the changes of the window into a single set.
+func coalesceChanges(ctx context.Context, cluster string, since uint64, window time.Duration, changes *types.Changes) (*types.Changes, error) {
+	select {
+	case <-time.After(window):
+	case <-ctx.Done():
+		return changes, nil
+	}
+
+	return nodeDB.Changes(ctx, cluster, since)
+}
@@ -5,81 +5,571 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.uber.org/zap"
-	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"inet.af/netaddr"
 
 	"github.com/talos-systems/kubespan-manager/internal/db"
 	"github.com/talos-systems/kubespan-manager/pkg/types"
 )
 
 var (
-	listenAddr = ":3000"
-	devMode    bool
-	nodeDB     db.DB
+	listenAddr    = ":3000"
+	devMode       bool
+	redisMode     string
+	redisAddrs    string
+	redisMaster   string
+	redisCompress bool
+	redisGrace    time.Duration
+	redisRetries  int
+	redisJitter   float64
+	redisCodec    string
+	deadLetter    string
+	adminToken    string
+	metricsAddr   string
+	cacheTTL      time.Duration
+	cacheMaxAge   time.Duration
+	dbTimeout     time.Duration
+	reqTimeout    time.Duration
+	writeWindow   time.Duration
+	writeAck      string
+	writeMax      int
+	allowedIPs    string
+	proxies       string
+	emptyWebhook  string
+	joinWebhook   string
+	joinClusters  string
+	drainGrace    time.Duration
+	allowZeroIP   bool
+	readOnly      bool
+	strictBody    bool
+	clusterAlias  bool
+	skipSelfTest  bool
+	gcOnShutdown  bool
+	dupKeys       string
+	keyDenylist   string
+	maxLabels     int
+	maxLabelBytes int
+	maxAddrTTL    time.Duration
+	retryAfter    time.Duration
+	respCompress  string
+	flapWindow    time.Duration
+	flapThreshold int
+	flapDampen    time.Duration
+	idFormat      string
+	idPattern     string
+	idemTTL       time.Duration
+	maxClusters   int
+	maxSubs       int
+	clusterSubs   int
+	maxStream     time.Duration
+	ramShards     int
+	tombRetain    time.Duration
+	maxAddrAge    time.Duration
+	probeEnabled  bool
+	probeNetwork  string
+	probeInterval time.Duration
+	probeRate     int
+	probeAllow    string
+	nodeDB        db.DB
+
+	prefork      bool
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+	idleTimeout  time.Duration
+	concurrency  int
+	tlsCert      string
+	tlsKey       string
+
+	logLevelName          string
+	logSamplingInitial    int
+	logSamplingThereafter int
+	logLevel              = zap.NewAtomicLevel()
+
+	allowedIPPrefixes []netaddr.IPPrefix
+
+	idempotencyResponses *idempotencyCache
+
+	probes *prober
+
+	repairer db.Repairer
+
+	replayer db.Replayer
+
+	inspector db.Inspector
 )
 
 func init() {
 	flag.StringVar(&listenAddr, "addr", ":3000", "addr on which to listen")
 	flag.BoolVar(&devMode, "debug", false, "enable debug mode")
+	flag.StringVar(&redisMode, "redis-mode", string(db.RedisModeSingle), "redis deployment mode: single, sentinel or cluster")
+	flag.StringVar(&redisAddrs, "redis-addrs", "", "comma-separated list of redis addresses (overrides REDIS_ADDR)")
+	flag.StringVar(&redisMaster, "redis-master", "", "redis sentinel master name")
+	flag.BoolVar(&redisCompress, "redis-compress", false, "gzip node payloads stored in redis")
+	flag.DurationVar(&redisGrace, "redis-malformed-grace", 0, "delete redis node entries which keep failing to decode for this long (never deleted if 0)")
+	flag.StringVar(&redisCodec, "redis-codec", string(db.CodecJSON), "serialization of node payloads stored in redis: json or proto, payloads in either format are always readable")
+	flag.Float64Var(&redisJitter, "redis-ttl-jitter", db.DefaultTTLJitter, "extend the expiration of the redis keys randomly by up to the fraction of the TTL (e.g. 0.1 for up to 10%, 0 disables)")
+	flag.IntVar(&redisRetries, "redis-retries", 2, "number of retries of the redis operations failing with transient errors (timeouts, slot migrations, failovers)")
+	flag.StringVar(&deadLetter, "redis-dead-letter", "", "path of the file the redis node writes which failed permanently are appended to as JSON lines (disabled if empty)")
+	flag.StringVar(&logLevelName, "log-level", "info", "log level: debug, info, warn or error")
+	flag.IntVar(&logSamplingInitial, "log-sampling-initial", 100, "number of identical log entries per second logged before sampling kicks in (0 disables sampling)")
+	flag.IntVar(&logSamplingThereafter, "log-sampling-thereafter", 100, "once sampling kicks in, log every Nth identical entry per second")
+	flag.StringVar(&metricsAddr, "metrics-addr", ":2122", "addr on which to serve Prometheus metrics (disabled if empty)")
+	flag.DurationVar(&cacheMaxAge, "cache-max-age", 0, "max-age of the Cache-Control header of successful GET responses (no header if 0)")
+	flag.DurationVar(&cacheTTL, "cache-ttl", 0, "TTL of the read-through cache in front of the database (disabled if 0)")
+	flag.DurationVar(&flapWindow, "flap-window", time.Minute, "sliding window the node updates are counted in to detect flapping nodes")
+	flag.IntVar(&flapThreshold, "flap-threshold", 0, "number of node updates within the window above which the node is flapping (detection disabled if 0)")
+	flag.DurationVar(&flapDampen, "flap-dampen", 0, "delay the change notifications of flapping nodes, coalescing their updates (disabled if 0)")
+	flag.DurationVar(&writeWindow, "write-buffer", 0, "coalesce the node writes within this window and flush them in batches (disabled if 0)")
+	flag.StringVar(&writeAck, "write-buffer-ack", string(db.WriteAckFlush), "durability of the buffered writes: flush (acknowledged once written) or queue (acknowledged once buffered, lost on a crash)")
+	flag.IntVar(&writeMax, "write-buffer-size", 10000, "maximum number of nodes with buffered writes, extra writes bypass the buffer")
+	flag.DurationVar(&reqTimeout, "request-timeout", 0, "maximum total time of handling a request, long-polls excluded, answered with 504 once exceeded (disabled if 0)")
+	flag.DurationVar(&dbTimeout, "db-timeout", 5*time.Second, "timeout of a single database operation (disabled if 0)")
+	flag.StringVar(&allowedIPs, "allowed-ip-cidrs", "", "comma-separated list of CIDRs node IPs should belong to (any IP is accepted if empty)")
+	flag.StringVar(&proxies, "trusted-proxies", "", "comma-separated list of CIDRs of the proxies trusted to set X-Forwarded-For (header is ignored if empty)")
+	flag.StringVar(&joinWebhook, "node-join-webhook", "", "URL POSTed with the cluster ID and the node when a new node joins the cluster (disabled if empty)")
+	flag.StringVar(&joinClusters, "node-join-webhook-clusters", "", "comma-separated list of the clusters reported by the node join webhook (all clusters if empty)")
+	flag.StringVar(&emptyWebhook, "cluster-empty-webhook", "", "URL POSTed with the cluster ID when the last node of the cluster expires (disabled if empty)")
+	flag.DurationVar(&drainGrace, "drain-grace", 30*time.Second, "how long existing long-polls are served once draining is requested via the admin API")
+	flag.BoolVar(&gcOnShutdown, "gc-on-shutdown", false, "run the final database cleanup on SIGINT or SIGTERM before exiting")
+	flag.BoolVar(&skipSelfTest, "skip-self-test", false, "start without verifying that the backend is writable (e.g. for offline starts)")
+	flag.BoolVar(&readOnly, "read-only", false, "serve reads from the shared redis only, rejecting all the mutations with 405")
+	flag.BoolVar(&clusterAlias, "cluster-aliases", false, "enable the cluster aliases managed via the admin API (every cluster operation resolves the alias first)")
+	flag.BoolVar(&strictBody, "strict-body", false, "reject JSON request bodies with unknown fields with 422 instead of ignoring the fields")
+	flag.BoolVar(&allowZeroIP, "allow-zero-node-ip", false, "accept nodes registered without the Wireguard interface IP")
+	flag.BoolVar(&prefork, "prefork", false, "spawn multiple listener processes sharing the port (requires redis)")
+	flag.DurationVar(&readTimeout, "read-timeout", 10*time.Second, "maximum duration for reading the full request")
+	flag.DurationVar(&writeTimeout, "write-timeout", 10*time.Second, "maximum duration for writing the response")
+	flag.DurationVar(&idleTimeout, "idle-timeout", 2*time.Minute, "maximum amount of time to wait for the next request on a keep-alive connection")
+	flag.IntVar(&concurrency, "concurrency", fiber.DefaultConcurrency, "maximum number of concurrent connections")
+	flag.StringVar(&tlsCert, "tls-cert", "", "path to the TLS certificate (TLS is disabled if empty)")
+	flag.StringVar(&tlsKey, "tls-key", "", "path to the TLS private key")
+	flag.StringVar(&idFormat, "cluster-id-format", "uuid", "cluster ID format: uuid, opaque (any bounded string) or regex")
+	flag.StringVar(&idPattern, "cluster-id-pattern", "", "regular expression cluster IDs should match with -cluster-id-format=regex")
+	flag.DurationVar(&idemTTL, "idempotency-ttl", 5*time.Minute, "how long responses to POST requests with Idempotency-Key are replayed (disabled if 0)")
+	flag.IntVar(&maxSubs, "max-subscriptions", 0, "maximum number of concurrent long-poll subscriptions, extra ones are refused with 429 (unlimited if 0)")
+	flag.DurationVar(&maxStream, "max-stream-duration", time.Hour, "maximum lifetime of the long-poll connection, the client is then asked to reconnect (unlimited if 0)")
+	flag.IntVar(&clusterSubs, "max-subscriptions-per-cluster", 0, "maximum number of concurrent long-poll subscriptions of a single cluster (unlimited if 0)")
+	flag.IntVar(&maxClusters, "max-clusters", 0, "maximum number of clusters kept by the in-memory backend, least recently active ones are evicted (unlimited if 0)")
+	flag.IntVar(&ramShards, "ram-shards", 1, "number of independently locked shards of the in-memory backend, more shards reduce the lock contention between clusters")
+	flag.DurationVar(&tombRetain, "tombstone-retention", 10*time.Minute, "how long the in-memory backend reports the expired nodes as removed in the cluster snapshots (0 disables)")
+	flag.DurationVar(&maxAddrAge, "max-address-age", 0, "hide the addresses not reported for longer from the API responses, without removing them (0 shows all, overridden by ?max_address_age=)")
+	flag.BoolVar(&probeEnabled, "probe-endpoints", false, "periodically probe the reachability of the stored endpoints and report it in the admin API")
+	flag.StringVar(&probeNetwork, "probe-network", "udp", "protocol of the endpoint probes: udp or tcp")
+	flag.DurationVar(&probeInterval, "probe-interval", 5*time.Minute, "interval between the endpoint probes of the same endpoint")
+	flag.IntVar(&probeRate, "probe-rate", 10, "maximum number of endpoint probes per second")
+	flag.StringVar(&probeAllow, "probe-allowed-cidrs", "", "comma-separated list of private CIDRs whose endpoints are probed as well (private endpoints are never probed if empty)")
+	flag.StringVar(&respCompress, "response-compression", "off", "compression of the responses negotiated via Accept-Encoding: off, speed, default or best")
+	flag.DurationVar(&retryAfter, "retry-after", time.Second, "minimum Retry-After hint of the responses failed by the backend, jittered and extended by the backend reconnect backoff")
+	flag.IntVar(&maxLabels, "max-labels", 32, "maximum number of the labels of a node (unlimited if 0)")
+	flag.IntVar(&maxLabelBytes, "max-label-bytes", 4096, "maximum total size of the label keys and values of a node in bytes (unlimited if 0)")
+	flag.DurationVar(&maxAddrTTL, "max-address-ttl", 24*time.Hour, "maximum TTL of the reported addresses, addresses with longer TTLs are rejected (unlimited if 0)")
+	flag.StringVar(&keyDenylist, "key-denylist", "", "path of the file with the node keys banned in every cluster, one key per line (disabled if empty)")
+	flag.StringVar(&dupKeys, "duplicate-keys", "allow", "handling of node keys registered in several clusters: allow, warn or reject")
+	flag.StringVar(&adminToken, "admin-token", os.Getenv("ADMIN_TOKEN"), "bearer token required by the admin API (admin API is disabled if empty)")
 }
 
-//nolint:gocognit,gocyclo,cyclop
 func main() {
 	flag.Parse()
 
-	logger, err := zap.NewProduction()
+	if os.Getenv("MODE") == "dev" {
+		devMode = true
+	}
+
+	logger, err := newLogger()
 	if err != nil {
 		log.Fatalln("failed to initialize logger:", err)
 	}
 
-	if os.Getenv("MODE") == "dev" {
-		devMode = true
-		logger, err = zap.NewDevelopment()
+	if allowedIPPrefixes, err = parseIPPrefixes(allowedIPs); err != nil {
+		log.Fatalln("failed to parse allowed IP CIDRs:", err)
+	}
+
+	if trustedProxyPrefixes, err = parseIPPrefixes(proxies); err != nil {
+		log.Fatalln("failed to parse trusted proxy CIDRs:", err)
+	}
+
+	if clusterIDValidator, err = newClusterIDValidator(idFormat, idPattern); err != nil {
+		log.Fatalln("failed to configure cluster ID format:", err)
+	}
+
+	if _, err = compressionLevel(respCompress); err != nil {
+		log.Fatalln("failed to configure response compression:", err)
+	}
+
+	// webhooks are drained on shutdown
+	var webhooks []*webhook
+
+	var deadLetterLog io.Writer
+
+	if deadLetter != "" {
+		f, e := os.OpenFile(deadLetter, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+		if e != nil {
+			log.Fatalln("failed to open redis dead-letter log:", e)
+		}
+
+		defer f.Close() //nolint:errcheck
+
+		deadLetterLog = f
+	}
+
+	switch {
+	case redisAddrs != "":
+		nodeDB, err = db.NewRedis(db.RedisOptions{
+			Mode:           db.RedisMode(redisMode),
+			Addrs:          strings.Split(redisAddrs, ","),
+			MasterName:     redisMaster,
+			Compress:       redisCompress,
+			MalformedGrace: redisGrace,
+			Retries:        redisRetries,
+			TTLJitter:      redisJitter,
+			Codec:          db.Codec(redisCodec),
+			DeadLetter:     deadLetterLog,
+		}, logger)
+		if err != nil {
+			log.Fatalln("failed to connect to redis:", err)
+		}
+	case os.Getenv("REDIS_ADDR") != "":
+		nodeDB, err = db.NewRedis(db.RedisOptions{
+			Mode:           db.RedisModeSingle,
+			Addrs:          []string{os.Getenv("REDIS_ADDR")},
+			Compress:       redisCompress,
+			MalformedGrace: redisGrace,
+			Retries:        redisRetries,
+			TTLJitter:      redisJitter,
+			Codec:          db.Codec(redisCodec),
+			DeadLetter:     deadLetterLog,
+		}, logger)
+		if err != nil {
+			log.Fatalln("failed to connect to redis:", err)
+		}
+	default:
+		var onClusterEmpty func(string)
+
+		if emptyWebhook != "" {
+			hook := newWebhook(emptyWebhook, "cluster-empty", logger)
+			webhooks = append(webhooks, hook)
+
+			onClusterEmpty = func(cluster string) {
+				hook.send(fiber.Map{
+					"cluster": cluster,
+				})
+			}
+		}
+
+		nodeDB = db.NewRAM(db.RAMOptions{
+			MaxClusters:    maxClusters,
+			OnClusterEmpty: onClusterEmpty,
+			Shards:         ramShards,
+
+			TombstoneRetention: tombRetain,
+		}, logger)
+	}
+
+	setWatcherLimits()
+
+	if readOnly {
+		readOnlyGauge.Set(1)
+
+		if redisAddrs == "" && os.Getenv("REDIS_ADDR") == "" {
+			logger.Warn("read-only mode without redis serves an empty in-memory database")
+		}
+	}
+
+	if emptyWebhook != "" && (redisAddrs != "" || os.Getenv("REDIS_ADDR") != "") {
+		// redis clusters expire key by key, there is no cleanup pass to observe
+		logger.Warn("cluster empty webhook is only supported by the in-memory backend")
+	}
+
+	// read-only replicas can't write the sentinel, the backend is verified by the primary
+	if !skipSelfTest && !readOnly {
+		if err = selfTest(nodeDB); err != nil {
+			log.Fatalln("backend self-test failed:", err)
+		}
+	}
+
+	// consistency repair is only available on the backend itself
+	repairer, _ = nodeDB.(db.Repairer) //nolint:errcheck
+
+	// change replay is only available on the backends keeping the individual changes
+	replayer, _ = nodeDB.(db.Replayer) //nolint:errcheck
+
+	// internal state is only available on the in-memory backend
+	inspector, _ = nodeDB.(db.Inspector) //nolint:errcheck
+
+	// node count is only available on the in-memory backend, redis expires the keys by itself
+	if counter, ok := nodeDB.(db.NodeCounter); ok {
+		prometheus.MustRegister(db.NewNodesGauge(counter))
+	}
 
+	if dbTimeout > 0 {
+		nodeDB = db.NewTimeout(nodeDB, dbTimeout)
+	}
+
+	// below the write buffer, so that the joins are reported once the writes reach the backend
+	if joinWebhook != "" {
+		hook := newWebhook(joinWebhook, "node-join", logger)
+		webhooks = append(webhooks, hook)
+
+		nodeDB = db.NewJoinNotifier(nodeDB, onNodeJoin(hook, joinClusters))
+	}
+
+	// writeBuffer is flushed on shutdown
+	var writeBuffer io.Closer
+
+	if writeWindow > 0 {
+		nodeDB, err = db.NewWriteBuffer(nodeDB, logger, db.WriteBufferOptions{
+			Window:     writeWindow,
+			MaxPending: writeMax,
+			Ack:        db.WriteAck(writeAck),
+		})
 		if err != nil {
-			log.Fatalln("failed to initialize development logger:", err)
+			log.Fatalln("failed to configure the write buffer:", err)
 		}
+
+		writeBuffer = nodeDB.(io.Closer) //nolint:forcetypeassert
+	}
+
+	switch dupKeys {
+	case "allow":
+	case "warn", "reject":
+		nodeDB = db.NewKeyIndex(nodeDB, logger, dupKeys == "reject")
+	default:
+		log.Fatalln("unsupported duplicate keys mode:", dupKeys)
+	}
+
+	if flapThreshold > 0 {
+		if flapWindow <= 0 {
+			log.Fatalln("flapping detection window should be positive")
+		}
+
+		nodeDB = db.NewFlapDetector(nodeDB, logger, db.FlapOptions{
+			Window:    flapWindow,
+			Threshold: flapThreshold,
+			Dampen:    flapDampen,
+		})
+	}
+
+	if cacheTTL > 0 {
+		nodeDB = db.NewCached(nodeDB, cacheTTL)
+	}
+
+	// above the caches and the key index, so that they only see the target clusters
+	if clusterAlias {
+		nodeDB = db.NewAliases(nodeDB)
+	}
+
+	// banned keys are rejected before any backend read
+	if keyDenylist != "" {
+		keys, e := loadKeyList(keyDenylist)
+		if e != nil {
+			log.Fatalln("failed to load the key denylist:", e)
+		}
+
+		nodeDB = db.NewDenylist(nodeDB, keys)
+
+		logger.Info("loaded the key denylist", zap.Int("keys", len(keys)))
+	}
+
+	if idemTTL > 0 {
+		idempotencyResponses = newIdempotencyCache(idemTTL)
 	}
 
-	if os.Getenv("REDIS_ADDR") != "" {
-		nodeDB, err = db.NewRedis(os.Getenv("REDIS_ADDR"), logger)
+	if probeEnabled {
+		if probeNetwork != "udp" && probeNetwork != "tcp" {
+			log.Fatalln("unsupported probe network:", probeNetwork)
+		}
+
+		if probeRate <= 0 || probeInterval <= 0 {
+			log.Fatalln("probe rate and interval should be positive")
+		}
+
+		allowed, err := parseIPPrefixes(probeAllow)
 		if err != nil {
-			log.Fatalln("failed to connect to redis: %w", err)
+			log.Fatalln("failed to parse probe allowed CIDRs:", err)
 		}
-	} else {
-		nodeDB = db.New(logger)
+
+		probes = newProber(probeNetwork, probeInterval, probeRate, allowed, logger)
+
+		go probes.run(context.Background())
+	}
+
+	if metricsAddr != "" {
+		go func() {
+			mux := http.NewServeMux()
+			mux.Handle("/metrics", promhttp.InstrumentMetricHandler(
+				prometheus.DefaultRegisterer,
+				promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{
+					// exemplars are only supported by the OpenMetrics format
+					EnableOpenMetrics: true,
+				}),
+			))
+
+			logger.Error("metrics listener exited",
+				zap.Error(http.ListenAndServe(metricsAddr, mux)), //nolint:gosec
+			)
+		}()
+	}
+
+	appCfg, err := appConfig(redisAddrs != "" || os.Getenv("REDIS_ADDR") != "")
+	if err != nil {
+		log.Fatalln("failed to configure listener:", err)
+	}
+
+	app := newApp(nodeDB, logger, appOptions{
+		Config:     appCfg,
+		AdminToken: adminToken,
+	})
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	gcDone := make(chan struct{})
+
+	go func() {
+		defer close(gcDone)
+
+		collectGarbage(ctx, nodeDB, gcInterval, gcOnShutdown)
+	}()
+
+	listenErr := make(chan error, 1)
+
+	go func() {
+		listenErr <- listen(app)
+	}()
+
+	select {
+	case err = <-listenErr:
+		logger.Fatal("listen exited",
+			zap.Error(err),
+		)
+	case <-ctx.Done():
 	}
 
-	app := fiber.New()
+	logger.Info("shutting down")
+
+	// long-polls are answered right away, so that the subscribers reconnect to other replicas
+	draining.start(0)
+
+	if err = shutdown(app, shutdownTimeout); err != nil {
+		logger.Warn("failed to shut down the listener", zap.Error(err))
+	}
+
+	if writeBuffer != nil {
+		writeBuffer.Close() //nolint:errcheck
+	}
+
+	<-gcDone
+
+	// the final cleanup might have queued the cluster empty notifications
+	drainCtx, drainCancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer drainCancel()
+
+	for _, hook := range webhooks {
+		hook.close(drainCtx)
+	}
+}
+
+// selfTestTimeout bounds the startup self-test of the backend.
+const selfTestTimeout = 10 * time.Second
+
+// shutdownTimeout bounds closing the open connections and delivering the queued webhook events on shutdown.
+const shutdownTimeout = 10 * time.Second
+
+func selfTest(d db.DB) error {
+	ctx, cancel := context.WithTimeout(context.Background(), selfTestTimeout)
+	defer cancel()
+
+	return db.SelfTest(ctx, d)
+}
+
+// totalCountHeader carries the number of nodes of the cluster in response to HEAD requests.
+const totalCountHeader = "X-Total-Count"
+
+// registerRoutes registers the API handlers on the given router.
+//
+//nolint:gocognit,gocyclo,cyclop
+func registerRoutes(r fiber.Router, logger *zap.Logger) {
+	validate := validateParams(logger)
+
+	r.Use(cacheControl(cacheMaxAge), refuseWhileDraining, refuseWrites)
+
+	// registered before GET /:cluster, which also handles HEAD requests
+	r.Head("/:cluster", validate, func(c *fiber.Ctx) error {
+		logger := requestLogger(c, logger)
 
-	app.Get("/:cluster", func(c *fiber.Ctx) error {
 		cluster := c.Params("cluster")
-		if cluster == "" {
-			logger.Error("empty cluster for node list")
 
-			return c.SendStatus(http.StatusBadRequest)
+		count, e := nodeDB.Count(requestContext(c), cluster)
+		if e != nil {
+			if errors.Is(e, db.ErrNotFound) {
+				return c.SendStatus(http.StatusNotFound)
+			}
+
+			logger.Error("failed to count cluster nodes",
+				zap.String("cluster", cluster),
+				zap.Error(e),
+			)
+
+			return sendDBError(c, e)
 		}
 
-		if e := validateClusterID(cluster); e != nil {
-			logger.Error("bad cluster ID",
-				zap.String("cluster", c.Params("cluster", "")),
+		c.Set(totalCountHeader, strconv.Itoa(count))
+		c.Status(http.StatusOK)
+
+		return nil
+	})
+
+	r.Get("/:cluster", validate, func(c *fiber.Ctx) error {
+		logger := requestLogger(c, logger)
+
+		cluster := c.Params("cluster")
+
+		filter, e := parseNodeFilter(c)
+		if e != nil {
+			logger.Error("bad node filter",
+				zap.String("cluster", cluster),
 				zap.Error(e),
 			)
 
 			return c.SendStatus(http.StatusBadRequest)
 		}
 
-		list, e := nodeDB.List(c.Context(), cluster)
+		if c.Query("wait") != "" {
+			return listChanges(c, logger, cluster, filter)
+		}
+
+		fields := parseFields(c)
+
+		var listType interface{} = []*types.Node(nil)
+
+		if fields != nil {
+			listType = []map[string]json.RawMessage(nil)
+		}
+
+		if c.Accepts(append(responseOffers(listType), mimeNDJSON)...) == mimeNDJSON {
+			return streamNodes(c, logger, cluster, filter, fields)
+		}
+
+		list, e := nodeDB.List(requestContext(c), cluster)
 		if e != nil {
 			if errors.Is(e, db.ErrNotFound) {
 				logger.Warn("cluster not found",
@@ -90,66 +580,107 @@ func main() {
 				return c.SendStatus(http.StatusNotFound)
 			}
 
-			return c.SendStatus(http.StatusInternalServerError)
+			logger.Error("failed to list cluster nodes",
+				zap.String("cluster", cluster),
+				zap.Error(e),
+			)
+
+			return sendDBError(c, e)
 		}
 
+		list = filter.nodes(list)
+
 		logger.Info("listing cluster nodes",
 			zap.String("cluster", c.Params("cluster", "")),
 			zap.Int("count", len(list)),
 		)
 
-		return c.JSON(list)
-	})
+		if fields != nil {
+			projected, e := projectNodes(list, fields)
+			if e != nil {
+				logger.Error("failed to project cluster nodes",
+					zap.String("cluster", cluster),
+					zap.Error(e),
+				)
 
-	app.Get("/:cluster/:node", func(c *fiber.Ctx) error {
-		cluster := c.Params("cluster", "")
-		if cluster == "" {
-			logger.Error("empty cluster for node get")
+				return c.SendStatus(http.StatusInternalServerError)
+			}
 
-			return c.SendStatus(http.StatusBadRequest)
+			return respond(c, projected)
 		}
 
-		if e := validateClusterID(cluster); e != nil {
-			logger.Error("bad cluster ID",
-				zap.String("cluster", c.Params("cluster", "")),
+		return respond(c, list)
+	})
+
+	// registered before /:cluster/:node, so that it is not matched as a node
+	r.Get("/:cluster/summary", validate, func(c *fiber.Ctx) error {
+		logger := requestLogger(c, logger)
+
+		summary, e := nodeDB.Summarize(requestContext(c), c.Params("cluster"))
+		if e != nil {
+			if errors.Is(e, db.ErrNotFound) {
+				return c.SendStatus(http.StatusNotFound)
+			}
+
+			logger.Error("failed to summarize cluster",
+				zap.String("cluster", c.Params("cluster")),
 				zap.Error(e),
 			)
 
-			return c.SendStatus(http.StatusBadRequest)
+			return sendDBError(c, e)
 		}
 
-		if e := validatePublicKey(c.Params("node")); e != nil {
-			logger.Error("bad node ID",
-				zap.String("cluster", c.Params("cluster", "")),
-				zap.String("node", c.Params("node", "")),
+		return respond(c, summary)
+	})
+
+	r.Get("/:cluster/:node", validate, func(c *fiber.Ctx) error {
+		logger := requestLogger(c, logger)
+
+		cluster, node := c.Params("cluster"), nodeParam(c)
+
+		addrFilter, e := parseAddressFilter(c)
+		if e != nil {
+			logger.Error("bad address filter",
+				zap.String("cluster", cluster),
 				zap.Error(e),
 			)
 
 			return c.SendStatus(http.StatusBadRequest)
 		}
 
-		node := c.Params("node", "")
-		if node == "" {
-			logger.Error("empty node for node get",
-				zap.String("cluster", c.Params("cluster", "")),
+		minGeneration, e := parseMinGeneration(c)
+		if e != nil {
+			logger.Error("bad generation filter",
+				zap.String("cluster", cluster),
+				zap.Error(e),
 			)
 
 			return c.SendStatus(http.StatusBadRequest)
 		}
 
-		n, e := nodeDB.Get(c.Context(), cluster, node)
+		n, e := nodeDB.Get(requestContext(c), cluster, node)
+		if e == nil && n.Generation < minGeneration {
+			e = fmt.Errorf("node generation %d is older than %d: %w", n.Generation, minGeneration, db.ErrNotFound)
+		}
+
 		if e != nil {
 			if errors.Is(e, db.ErrNotFound) {
 				logger.Warn("node not found",
 					zap.String("cluster", cluster),
 					zap.String("node", node),
-					zap.Error(err),
+					zap.Error(e),
 				)
 
 				return c.SendStatus(http.StatusNotFound)
 			}
 
-			return c.SendStatus(http.StatusInternalServerError)
+			logger.Error("failed to get node",
+				zap.String("cluster", cluster),
+				zap.String("node", node),
+				zap.Error(e),
+			)
+
+			return sendDBError(c, e)
 		}
 
 		logger.Info("returning cluster node",
@@ -157,18 +688,20 @@ func main() {
 			zap.String("node", n.ID),
 			zap.String("ip", n.IP.String()),
 			zap.Strings("addresses", addressToString(n.Addresses)),
-			zap.Error(err),
+			zap.Time("lastSeen", n.LastSeen),
 		)
 
-		return c.JSON(n)
+		setETag(c, n.Version)
+
+		return respond(c, addrFilter.node(n))
 	})
 
-	// PUT addresses to a Node
-	app.Put("/:cluster/:node", func(c *fiber.Ctx) error {
-		var addresses []*types.Address
+	r.Get("/:cluster/:node/addresses", validate, func(c *fiber.Ctx) error {
+		logger := requestLogger(c, logger)
 
-		if e := validateClusterID(c.Params("cluster")); e != nil {
-			logger.Error("bad cluster ID",
+		addrFilter, e := parseAddressFilter(c)
+		if e != nil {
+			logger.Error("bad address filter",
 				zap.String("cluster", c.Params("cluster", "")),
 				zap.Error(e),
 			)
@@ -176,71 +709,344 @@ func main() {
 			return c.SendStatus(http.StatusBadRequest)
 		}
 
-		if e := validatePublicKey(c.Params("node")); e != nil {
-			logger.Error("bad node ID",
+		n, e := nodeDB.Get(requestContext(c), c.Params("cluster", ""), nodeParam(c))
+		if e != nil {
+			if errors.Is(e, db.ErrNotFound) {
+				logger.Warn("node not found",
+					zap.String("cluster", c.Params("cluster", "")),
+					zap.String("node", nodeParam(c)),
+					zap.Error(e),
+				)
+
+				return c.SendStatus(http.StatusNotFound)
+			}
+
+			logger.Error("failed to get node",
 				zap.String("cluster", c.Params("cluster", "")),
-				zap.String("node", c.Params("node", "")),
+				zap.String("node", nodeParam(c)),
 				zap.Error(e),
 			)
 
+			return sendDBError(c, e)
+		}
+
+		addresses := addrFilter.node(n).Addresses
+		if addresses == nil {
+			addresses = []*types.Address{}
+		}
+
+		return respond(c, addresses)
+	})
+
+	r.Get("/:cluster/:node/wg", validate, wgConfig(logger))
+
+	r.Get("/:cluster/:node/:other/diff", validate, diffNodes(logger))
+
+	r.Post("/:cluster/:node/heartbeat", validate, requireContentType(fiber.MIMEApplicationJSON), heartbeat(logger))
+
+	// DELETE a single address from a Node
+	r.Delete("/:cluster/:node/addresses/:addr", validate, func(c *fiber.Ctx) error {
+		logger := requestLogger(c, logger)
+
+		host, e := url.PathUnescape(c.Params("addr", ""))
+		if e != nil || host == "" {
+			logger.Error("bad address",
+				zap.String("cluster", c.Params("cluster", "")),
+				zap.String("node", nodeParam(c)),
+				zap.String("addr", c.Params("addr", "")),
+			)
+
 			return c.SendStatus(http.StatusBadRequest)
 		}
 
-		if e := c.BodyParser(&addresses); e != nil {
-			logger.Error("failed to parse node PUT",
+		if e = nodeDB.RemoveAddress(requestContext(c), c.Params("cluster", ""), nodeParam(c), types.ParseAddress(host)); e != nil {
+			if errors.Is(e, db.ErrNotFound) {
+				logger.Warn("address not found",
+					zap.String("cluster", c.Params("cluster", "")),
+					zap.String("node", nodeParam(c)),
+					zap.String("addr", host),
+					zap.Error(e),
+				)
+
+				return c.SendStatus(http.StatusNotFound)
+			}
+
+			logger.Error("failed to remove address",
 				zap.String("cluster", c.Params("cluster", "")),
-				zap.String("node", c.Params("node", "")),
+				zap.String("node", nodeParam(c)),
+				zap.String("addr", host),
 				zap.Error(e),
 			)
 
+			return sendDBError(c, e)
+		}
+
+		logger.Info("removed node address",
+			zap.String("cluster", c.Params("cluster", "")),
+			zap.String("node", nodeParam(c)),
+			zap.String("addr", host),
+		)
+
+		return c.SendStatus(http.StatusNoContent)
+	})
+
+	// PUT addresses to a Node
+	//
+	// An empty list is a no-op, while an empty JSON body is rejected as a likely client bug.
+	// With ?clear=true the addresses of the Node are replaced with the ones in the body (if any).
+	r.Put("/:cluster/:node", validate, requireContentType(fiber.MIMEApplicationJSON, types.MIMEProtobuf), func(c *fiber.Ctx) error {
+		logger := requestLogger(c, logger)
+
+		cluster, node := c.Params("cluster", ""), nodeParam(c)
+
+		var clearAll bool
+
+		if c.Query("clear") != "" {
+			var e error
+
+			if clearAll, e = strconv.ParseBool(c.Query("clear")); e != nil {
+				logger.Error("bad clear parameter",
+					zap.String("cluster", cluster),
+					zap.String("node", node),
+					zap.Error(e),
+				)
+
+				return c.SendStatus(http.StatusBadRequest)
+			}
+		}
+
+		var addresses []*types.Address
+
+		// empty protobuf body is the valid encoding of the empty address list
+		if len(c.Body()) > 0 || isProtobuf(c) {
+			var e error
+
+			if addresses, e = parseAddresses(c); e != nil {
+				logger.Error("failed to parse node PUT",
+					zap.String("cluster", cluster),
+					zap.String("node", node),
+					zap.Error(e),
+				)
+
+				return sendParseError(c, e)
+			}
+
+			if e := types.ValidateAddresses(addresses, validateOptions(true)); e != nil {
+				logger.Error("invalid node addresses",
+					zap.String("cluster", cluster),
+					zap.String("node", node),
+					zap.Error(e),
+				)
+
+				return sendValidationError(c, e)
+			}
+		} else if !clearAll {
+			logger.Error("empty node PUT body",
+				zap.String("cluster", cluster),
+				zap.String("node", node),
+			)
+
 			return c.SendStatus(http.StatusBadRequest)
 		}
 
-		node := c.Params("node", "")
-		if node == "" {
-			logger.Error("invalid node key",
-				zap.String("cluster", c.Params("cluster", "")),
-				zap.String("node", c.Params("node", "")),
+		ctx, err := versionContext(c)
+		if err != nil {
+			logger.Error("bad node version",
+				zap.String("cluster", cluster),
+				zap.String("node", node),
+				zap.Error(err),
 			)
+
+			return c.SendStatus(http.StatusBadRequest)
 		}
 
-		if err := nodeDB.AddAddresses(c.Context(), c.Params("cluster", ""), node, addresses...); err != nil {
+		switch {
+		case clearAll:
+			err = setAddresses(ctx, cluster, node, addresses, c.Get(fiber.HeaderIfMatch) == "")
+		case len(addresses) == 0:
+			return c.SendStatus(http.StatusNoContent)
+		default:
+			err = nodeDB.AddAddresses(ctx, cluster, node, addresses...)
+		}
+
+		if err != nil {
+			if errors.Is(err, db.ErrNotFound) {
+				logger.Warn("node not found",
+					zap.String("cluster", cluster),
+					zap.String("node", node),
+					zap.Error(err),
+				)
+
+				return c.SendStatus(http.StatusNotFound)
+			}
+
 			logger.Error("failed to add known endpoints",
-				zap.String("cluster", c.Params("cluster", "")),
+				zap.String("cluster", cluster),
 				zap.String("node", node),
 				zap.Strings("addresses", addressToString(addresses)),
+				zap.Bool("clear", clearAll),
 				zap.Error(err),
 			)
 
-			return c.SendStatus(http.StatusInternalServerError)
+			return sendError(c, err)
 		}
 
 		return c.SendStatus(http.StatusNoContent)
 	})
 
-	app.Post("/:cluster", func(c *fiber.Ctx) error {
+	// PATCH a Node with JSON Merge Patch, e.g. to set the complete list of addresses
+	r.Patch("/:cluster/:node", validate, requireContentType(fiber.MIMEApplicationJSON, mimeMergePatch), func(c *fiber.Ctx) error {
+		logger := requestLogger(c, logger)
+
+		cluster, node := c.Params("cluster"), nodeParam(c)
+
+		ctx, e := versionContext(c)
+		if e != nil {
+			logger.Error("bad node version",
+				zap.String("cluster", cluster),
+				zap.String("node", node),
+				zap.Error(e),
+			)
+
+			return c.SendStatus(http.StatusBadRequest)
+		}
+
+		n, e := nodeDB.Get(ctx, cluster, node)
+		if e != nil {
+			if errors.Is(e, db.ErrNotFound) {
+				logger.Warn("node not found",
+					zap.String("cluster", cluster),
+					zap.String("node", node),
+					zap.Error(e),
+				)
+
+				return c.SendStatus(http.StatusNotFound)
+			}
+
+			logger.Error("failed to get node",
+				zap.String("cluster", cluster),
+				zap.String("node", node),
+				zap.Error(e),
+			)
+
+			return sendDBError(c, e)
+		}
+
+		patched, e := patchNode(n, c.Body())
+		if e != nil {
+			logger.Error("bad node PATCH",
+				zap.String("cluster", cluster),
+				zap.String("node", node),
+				zap.Error(e),
+			)
+
+			return sendParseError(c, e)
+		}
+
+		// addresses might be removed by the patch, the node stays until it expires
+		if e = patched.Validate(validateOptions(true)); e != nil {
+			logger.Error("invalid patched node",
+				zap.String("cluster", cluster),
+				zap.String("node", node),
+				zap.Error(e),
+			)
+
+			return sendValidationError(c, e)
+		}
+
+		patched.AddressFamilyPreference, _ = types.ParseAddressFamily(string(patched.AddressFamilyPreference)) //nolint:errcheck
+
+		if !ipAllowed(patched.IP) {
+			logger.Error("node IP is outside of the allowed ranges",
+				zap.String("cluster", cluster),
+				zap.String("node", node),
+				zap.String("ip", patched.IP.String()),
+			)
+
+			return c.SendStatus(http.StatusUnprocessableEntity)
+		}
+
+		// the patch is computed against the version read above, concurrent updates are not overwritten
+		if c.Get(fiber.HeaderIfMatch) == "" {
+			ctx = db.ExpectVersion(ctx, n.Version)
+		}
+
+		if e = nodeDB.Replace(ctx, cluster, patched); e != nil {
+			logger.Error("failed to patch node",
+				zap.String("cluster", cluster),
+				zap.String("node", node),
+				zap.Error(e),
+			)
+
+			return sendError(c, e)
+		}
+
+		logger.Info("patched node",
+			zap.String("cluster", cluster),
+			zap.String("node", node),
+			zap.Strings("addresses", addressToString(patched.Addresses)),
+		)
+
+		return c.SendStatus(http.StatusNoContent)
+	})
+
+	r.Post("/:cluster", validate, requireContentType(fiber.MIMEApplicationJSON, types.MIMEProtobuf), idempotent(idempotencyResponses, logger), func(c *fiber.Ctx) error {
+		logger := requestLogger(c, logger)
+
 		n := new(types.Node)
 
-		if err := validateClusterID(c.Params("cluster")); err != nil {
-			logger.Error("bad cluster ID",
+		if err := parseNode(c, n); err != nil {
+			logger.Error("failed to parse node POST",
 				zap.String("cluster", c.Params("cluster", "")),
 				zap.Error(err),
 			)
 
-			return c.SendStatus(http.StatusBadRequest)
+			return sendParseError(c, err)
 		}
 
-		if err := c.BodyParser(n); err != nil {
-			logger.Error("failed to parse node POST",
+		if err := n.Validate(validateOptions(false)); err != nil {
+			logger.Error("invalid node",
 				zap.String("cluster", c.Params("cluster", "")),
+				zap.String("node", n.ID),
 				zap.Error(err),
 			)
 
+			return sendValidationError(c, err)
+		}
+
+		// normalize "both" to no preference
+		n.AddressFamilyPreference, _ = types.ParseAddressFamily(string(n.AddressFamilyPreference)) //nolint:errcheck
+
+		if !ipAllowed(n.IP) {
+			logger.Error("node IP is outside of the allowed ranges",
+				zap.String("cluster", c.Params("cluster", "")),
+				zap.String("node", n.ID),
+				zap.String("ip", n.IP.String()),
+			)
+
+			return c.SendStatus(http.StatusUnprocessableEntity)
+		}
+
+		var store func(ctx context.Context, cluster string, n *types.Node) error
+
+		switch mode := c.Query("mode", "merge"); mode {
+		case "merge":
+			store = nodeDB.Add
+		case "replace":
+			store = nodeDB.Replace
+		default:
+			logger.Error("bad node POST mode",
+				zap.String("cluster", c.Params("cluster", "")),
+				zap.String("node", n.ID),
+				zap.String("mode", mode),
+			)
+
 			return c.SendStatus(http.StatusBadRequest)
 		}
 
-		if err := validatePublicKey(n.ID); err != nil {
-			logger.Error("bad node ID",
+		ctx, err := versionContext(c)
+		if err != nil {
+			logger.Error("bad node version",
 				zap.String("cluster", c.Params("cluster", "")),
 				zap.String("node", n.ID),
 				zap.Error(err),
@@ -249,7 +1055,7 @@ func main() {
 			return c.SendStatus(http.StatusBadRequest)
 		}
 
-		if err := nodeDB.Add(c.Context(), c.Params("cluster", ""), n); err != nil {
+		if err = store(ctx, c.Params("cluster", ""), n); err != nil {
 			logger.Error("failed to add/update node",
 				zap.String("cluster", c.Params("cluster", "")),
 				zap.String("node", n.ID),
@@ -258,7 +1064,7 @@ func main() {
 				zap.Error(err),
 			)
 
-			return c.SendStatus(http.StatusInternalServerError)
+			return sendError(c, err)
 		}
 
 		logger.Info("add/update node",
@@ -270,45 +1076,104 @@ func main() {
 
 		return c.SendStatus(http.StatusNoContent)
 	})
-
-	go func() {
-		for {
-			time.Sleep(time.Hour)
-
-			nodeDB.Clean()
-		}
-	}()
-	logger.Fatal("listen exited",
-		zap.Error(app.Listen(listenAddr)),
-	)
 }
 
 func addressToString(addresses []*types.Address) (out []string) {
 	for _, a := range addresses {
-		if !a.IP.IsZero() {
-			out = append(out, a.IP.String())
+		out = append(out, a.Host())
+	}
+
+	return out
+}
+
+// validateOptions returns the node validation options configured by the flags.
+//
+// Partial updates (e.g. PATCH) might leave the node without addresses, the node stays until it expires.
+func validateOptions(allowNoAddresses bool) types.ValidateOptions {
+	return types.ValidateOptions{
+		AllowZeroIP:      allowZeroIP,
+		AllowNoAddresses: allowNoAddresses,
+		MaxLabels:        maxLabels,
+		MaxLabelBytes:    maxLabelBytes,
+		MaxAddressTTL:    maxAddrTTL,
+	}
+}
+
+// setAddresses replaces all the addresses of the node.
+//
+// Unless the version is already expected by the client, the write expects the version read,
+// so that concurrent updates are not overwritten.
+func setAddresses(ctx context.Context, cluster, id string, addresses []*types.Address, expectRead bool) error {
+	stored, err := nodeDB.Get(ctx, cluster, id)
+	if err != nil {
+		return err
+	}
+
+	// the stored node might be shared with the database
+	n := stored.Snapshot()
+	n.Addresses = nil
+	n.AddAddresses(addresses...)
+
+	if expectRead {
+		ctx = db.ExpectVersion(ctx, n.Version)
+	}
+
+	return nodeDB.Replace(ctx, cluster, n)
+}
+
+// parseIPPrefixes parses a comma-separated list of CIDRs.
+func parseIPPrefixes(s string) ([]netaddr.IPPrefix, error) {
+	if s == "" {
+		return nil, nil
+	}
 
-			continue
+	var prefixes []netaddr.IPPrefix
+
+	for _, cidr := range strings.Split(s, ",") {
+		prefix, err := netaddr.ParseIPPrefix(strings.TrimSpace(cidr))
+		if err != nil {
+			return nil, err
 		}
 
-		out = append(out, a.Name)
+		prefixes = append(prefixes, prefix)
 	}
 
-	return out
+	return prefixes, nil
 }
 
-func validateClusterID(cluster string) error {
-	if _, err := uuid.Parse(cluster); err != nil {
-		return fmt.Errorf("cluster ID is not a valid UUID: %w", err)
+// ipAllowed checks whether the node IP belongs to the allowed ranges, if any are configured.
+func ipAllowed(ip netaddr.IP) bool {
+	if len(allowedIPPrefixes) == 0 {
+		return true
+	}
+
+	for _, prefix := range allowedIPPrefixes {
+		if prefix.Contains(ip) {
+			return true
+		}
 	}
 
-	return nil
+	return false
 }
 
-func validatePublicKey(key string) error {
-	if _, err := wgtypes.ParseKey(key); err != nil {
-		return fmt.Errorf("node ID is not a valid wireguard key")
+// dbErrorStatus maps a database error to the HTTP status code returned to the client.
+func dbErrorStatus(err error) int {
+	if errors.Is(err, db.ErrUnavailable) || errors.Is(err, db.ErrTooManyClusters) {
+		return http.StatusServiceUnavailable
+	}
+
+	if errors.Is(err, db.ErrTimeout) || errors.Is(err, context.DeadlineExceeded) {
+		return http.StatusGatewayTimeout
+	}
+
+	if errors.Is(err, db.ErrKeyNotAllowed) {
+		return http.StatusForbidden
+	}
+
+	if errors.Is(err, db.ErrDuplicateKey) || errors.Is(err, db.ErrClusterFull) || errors.Is(err, db.ErrVersionConflict) ||
+		errors.Is(err, db.ErrAliasConflict) || errors.Is(err, db.ErrStaleGeneration) {
+		return http.StatusConflict
 	}
 
-	return nil
+	return http.StatusInternalServerError
 }
@@ -0,0 +1,1151 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+	"inet.af/netaddr"
+
+	"github.com/talos-systems/kubespan-manager/internal/db"
+	"github.com/talos-systems/kubespan-manager/pkg/types"
+)
+
+const (
+	testCluster = "0c5e1e9a-3c62-4f6e-9d59-8b2a0f0b2d4a"
+	testNode    = "IHOPEfmiUG1kE832FAxm77J5WP0O1ZHp9OwqbGowL1E="
+)
+
+// failingDB fails every Get with the configured error.
+type failingDB struct {
+	db.DB
+
+	err error
+}
+
+func (d *failingDB) Get(ctx context.Context, cluster, id string) (*types.Node, error) {
+	return nil, d.err
+}
+
+// cleanCountingDB counts the cleanup passes.
+type cleanCountingDB struct {
+	db.DB
+
+	cleans int32
+}
+
+func (d *cleanCountingDB) Clean() *db.CleanReport {
+	atomic.AddInt32(&d.cleans, 1)
+
+	return &db.CleanReport{}
+}
+
+// canceledChangesDB fails the waits cut short by the context, like the backends doing the network round trips.
+type canceledChangesDB struct {
+	db.DB
+}
+
+func (d *canceledChangesDB) Changes(ctx context.Context, cluster string, since uint64) (*types.Changes, error) {
+	changes, err := d.DB.Changes(ctx, cluster, since)
+	if err == nil && ctx.Err() != nil {
+		return nil, fmt.Errorf("failed to wait for changes: %w", ctx.Err())
+	}
+
+	return changes, err
+}
+
+// slowDB blocks every List until the context is done.
+type slowDB struct {
+	db.DB
+}
+
+func (d *slowDB) List(ctx context.Context, cluster string) ([]*types.Node, error) {
+	<-ctx.Done()
+
+	return nil, fmt.Errorf("failed to list nodes: %w", ctx.Err())
+}
+
+// addCountingDB counts the node additions, the first ones fail with ErrUnavailable.
+//
+// If the gate is set, the additions wait for it to be closed.
+type addCountingDB struct {
+	db.DB
+
+	adds     int32
+	failures int32
+	gate     chan struct{}
+}
+
+func (d *addCountingDB) Add(ctx context.Context, cluster string, n *types.Node) error {
+	atomic.AddInt32(&d.adds, 1)
+
+	if d.gate != nil {
+		<-d.gate
+	}
+
+	if atomic.AddInt32(&d.failures, -1) >= 0 {
+		return fmt.Errorf("failed to add node: %w", db.ErrUnavailable)
+	}
+
+	return d.DB.Add(ctx, cluster, n)
+}
+
+func TestCollectGarbageCancel(t *testing.T) {
+	for _, final := range []bool{false, true} {
+		d := &cleanCountingDB{DB: db.New(zap.NewNop())}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+
+		go func() {
+			defer close(done)
+
+			collectGarbage(ctx, d, time.Hour, final)
+		}()
+
+		cancel()
+
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatalf("final=%v: garbage collection was not canceled promptly", final)
+		}
+
+		expected := int32(0)
+		if final {
+			expected = 1
+		}
+
+		if cleans := atomic.LoadInt32(&d.cleans); cleans != expected {
+			t.Fatalf("final=%v: expected %d cleanups, got %d", final, expected, cleans)
+		}
+	}
+}
+
+func TestGetNodeLogsError(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		err    error
+		status int
+		msg    string
+
+		// retryAfter is the minimum expected Retry-After hint, 0 if no hint is expected
+		retryAfter int
+	}{
+		{
+			name:   "not found",
+			err:    fmt.Errorf("node %q: %w", testNode, db.ErrNotFound),
+			status: http.StatusNotFound,
+			msg:    "node not found",
+		},
+		{
+			name:   "unavailable",
+			err:    fmt.Errorf("redis is down: %w", db.ErrUnavailable),
+			status: http.StatusServiceUnavailable,
+			msg:    "failed to get node",
+
+			retryAfter: 1,
+		},
+		{
+			name:   "reconnecting",
+			err:    &db.UnavailableError{RetryAfter: 10 * time.Second},
+			status: http.StatusServiceUnavailable,
+			msg:    "failed to get node",
+
+			retryAfter: 10,
+		},
+	} {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			core, logs := observer.New(zapcore.DebugLevel)
+
+			app := newApp(&failingDB{DB: db.New(zap.NewNop()), err: tt.err}, zap.New(core), appOptions{})
+
+			resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/"+testCluster+"/"+testNode, nil))
+			if err != nil {
+				t.Fatalf("request failed: %s", err)
+			}
+
+			if resp.StatusCode != tt.status {
+				t.Fatalf("unexpected status %d", resp.StatusCode)
+			}
+
+			hint := resp.Header.Get(fiber.HeaderRetryAfter)
+
+			if tt.retryAfter == 0 && hint != "" {
+				t.Errorf("unexpected Retry-After %q", hint)
+			}
+
+			// the hint is jittered up to retryJitter
+			if seconds, _ := strconv.Atoi(hint); tt.retryAfter > 0 && (seconds < tt.retryAfter || seconds > tt.retryAfter*3/2+1) { //nolint:errcheck
+				t.Errorf("unexpected Retry-After %q", hint)
+			}
+
+			entries := logs.FilterMessage(tt.msg).All()
+			if len(entries) != 1 {
+				t.Fatalf("expected a single %q log entry, got %v", tt.msg, logs.All())
+			}
+
+			if logged := entries[0].ContextMap()["error"]; logged != tt.err.Error() {
+				t.Errorf("logged error %q doesn't match the database error %q", logged, tt.err)
+			}
+		})
+	}
+}
+
+func TestCorrelationID(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+
+	app := newApp(&failingDB{DB: db.New(zap.NewNop()), err: db.ErrNotFound}, zap.New(core), appOptions{})
+
+	req := httptest.NewRequest(http.MethodGet, "/"+testCluster+"/"+testNode, nil)
+	req.Header.Set(headerCorrelationID, "req-42")
+
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatalf("request failed: %s", err)
+	}
+
+	if id := resp.Header.Get(headerCorrelationID); id != "req-42" {
+		t.Errorf("unexpected correlation ID in the response %q", id)
+	}
+
+	entries := logs.FilterField(zap.String("correlation_id", "req-42")).All()
+	if len(entries) != 1 {
+		t.Fatalf("expected a single log entry with the correlation ID, got %v", logs.All())
+	}
+
+	resp, err = app.Test(httptest.NewRequest(http.MethodGet, "/"+testCluster+"/"+testNode, nil))
+	if err != nil {
+		t.Fatalf("request failed: %s", err)
+	}
+
+	if resp.Header.Get(headerCorrelationID) == "" {
+		t.Error("correlation ID was not generated")
+	}
+}
+
+func TestAppRegisterNode(t *testing.T) {
+	app := newApp(db.New(zap.NewNop()), zap.NewNop(), appOptions{
+		Config: fiber.Config{Immutable: true},
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/"+testCluster,
+		strings.NewReader(`{"id":"`+testNode+`","ip":"fd00::1","selfIPs":[{"ip":"192.168.0.1","port":51820}]}`))
+	req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatalf("request failed: %s", err)
+	}
+
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("unexpected POST status %d", resp.StatusCode)
+	}
+
+	resp, err = app.Test(httptest.NewRequest(http.MethodGet, "/"+testCluster, nil))
+	if err != nil {
+		t.Fatalf("request failed: %s", err)
+	}
+
+	defer resp.Body.Close() //nolint:errcheck
+
+	var list []*types.Node
+
+	if err = json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		t.Fatalf("failed to decode the list: %s", err)
+	}
+
+	if len(list) != 1 || list[0].ID != testNode || len(list[0].Addresses) != 1 {
+		t.Errorf("unexpected cluster nodes: %+v", list)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/"+testCluster, nil)
+	req.Header.Set(fiber.HeaderAccept, mimeNDJSON)
+
+	resp, err = app.Test(req)
+	if err != nil {
+		t.Fatalf("request failed: %s", err)
+	}
+
+	defer resp.Body.Close() //nolint:errcheck
+
+	if contentType := resp.Header.Get(fiber.HeaderContentType); contentType != mimeNDJSON {
+		t.Fatalf("unexpected content type %q", contentType)
+	}
+
+	var n types.Node
+
+	dec := json.NewDecoder(resp.Body)
+
+	if err = dec.Decode(&n); err != nil || n.ID != testNode {
+		t.Fatalf("unexpected streamed node %q: %v", n.ID, err)
+	}
+
+	if dec.More() {
+		t.Errorf("unexpected extra lines in the stream")
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/6f1d3a52-7b0e-4c5a-a1f3-2e9d8c7b6a50", nil)
+	req.Header.Set(fiber.HeaderAccept, mimeNDJSON)
+
+	if resp, err = app.Test(req); err != nil || resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unexpected response to streaming an unknown cluster: %v %v", resp, err)
+	}
+}
+
+func TestAppPutAddresses(t *testing.T) {
+	app := newApp(db.New(zap.NewNop()), zap.NewNop(), appOptions{
+		Config: fiber.Config{Immutable: true},
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/"+testCluster,
+		strings.NewReader(`{"id":"`+testNode+`","ip":"fd00::1","selfIPs":[{"ip":"192.168.0.1","port":51820}]}`))
+	req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+
+	if resp, err := app.Test(req); err != nil || resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("failed to register node: %v %v", resp, err)
+	}
+
+	for _, tt := range []struct {
+		name   string
+		query  string
+		body   string
+		status int
+		count  int
+	}{
+		{name: "empty body", status: http.StatusBadRequest, count: 1},
+		{name: "empty list", body: "[]", status: http.StatusNoContent, count: 1},
+		{name: "bad clear", query: "?clear=maybe", body: "[]", status: http.StatusBadRequest, count: 1},
+		{
+			name:   "ttl too long",
+			body:   `[{"ip":"192.168.0.2","port":51820,"ttlSeconds":9223372036854775807}]`,
+			status: http.StatusUnprocessableEntity,
+			count:  1,
+		},
+		{name: "clear", query: "?clear=true", status: http.StatusNoContent, count: 0},
+	} {
+		req = httptest.NewRequest(http.MethodPut, "/"+testCluster+"/"+url.PathEscape(testNode)+tt.query, strings.NewReader(tt.body))
+		req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatalf("%s: request failed: %s", tt.name, err)
+		}
+
+		if resp.StatusCode != tt.status {
+			t.Errorf("%s: expected status %d, got %d", tt.name, tt.status, resp.StatusCode)
+		}
+
+		n, err := nodeDB.Get(context.Background(), testCluster, testNode)
+		if err != nil {
+			t.Fatalf("%s: failed to get node: %s", tt.name, err)
+		}
+
+		if len(n.Addresses) != tt.count {
+			t.Errorf("%s: expected %d addresses, got %d", tt.name, tt.count, len(n.Addresses))
+		}
+	}
+
+	for _, path := range []string{
+		"/" + testCluster + "/" + url.PathEscape("9NqSzEoeNRqwCaBKdkxUR2dqvhxMyUe5nDm9yZ3JSn0="),
+		"/0c5e1e9a-3c62-4f6e-9d59-8b2a0f0b2d4b/" + url.PathEscape(testNode),
+	} {
+		req = httptest.NewRequest(http.MethodPut, path, strings.NewReader(`[{"ip":"192.168.0.2","port":51820}]`))
+		req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatalf("request failed: %s", err)
+		}
+
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("%s: expected status %d, got %d", path, http.StatusNotFound, resp.StatusCode)
+		}
+	}
+}
+
+func TestAppPatchNode(t *testing.T) {
+	app := newApp(db.New(zap.NewNop()), zap.NewNop(), appOptions{
+		Config: fiber.Config{Immutable: true},
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/"+testCluster,
+		strings.NewReader(`{"id":"`+testNode+`","name":"node","ip":"fd00::1","labels":{"a":"1","b":"2"},"selfIPs":[{"ip":"192.168.0.1","port":51820}]}`))
+	req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+
+	if resp, err := app.Test(req); err != nil || resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("failed to register node: %v %v", resp, err)
+	}
+
+	current, err := nodeDB.Get(context.Background(), testCluster, testNode)
+	if err != nil {
+		t.Fatalf("failed to get node: %s", err)
+	}
+
+	for _, tt := range []struct {
+		name    string
+		path    string
+		ifMatch string
+		body    string
+		status  int
+	}{
+		{name: "stale version", ifMatch: `"` + strconv.FormatUint(current.Version+1, 10) + `"`, body: `{"name":"other"}`, status: http.StatusConflict},
+		{name: "bad version", ifMatch: "latest", body: `{"name":"other"}`, status: http.StatusBadRequest},
+		{name: "id change", body: `{"id":"9NqSzEoeNRqwCaBKdkxUR2dqvhxMyUe5nDm9yZ3JSn0="}`, status: http.StatusBadRequest},
+		{name: "not a document", body: `{"name":`, status: http.StatusBadRequest},
+		{
+			name:   "unknown node",
+			path:   "/" + testCluster + "/" + url.PathEscape("9NqSzEoeNRqwCaBKdkxUR2dqvhxMyUe5nDm9yZ3JSn0="),
+			body:   `{"name":"other"}`,
+			status: http.StatusNotFound,
+		},
+		{
+			name:    "merge",
+			ifMatch: `"` + strconv.FormatUint(current.Version, 10) + `"`,
+			body:    `{"name":null,"labels":{"a":null,"c":"3"}}`,
+			status:  http.StatusNoContent,
+		},
+	} {
+		path := tt.path
+		if path == "" {
+			path = "/" + testCluster + "/" + url.PathEscape(testNode)
+		}
+
+		req = httptest.NewRequest(http.MethodPatch, path, strings.NewReader(tt.body))
+		req.Header.Set(fiber.HeaderContentType, mimeMergePatch)
+
+		if tt.ifMatch != "" {
+			req.Header.Set(fiber.HeaderIfMatch, tt.ifMatch)
+		}
+
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatalf("%s: request failed: %s", tt.name, err)
+		}
+
+		if resp.StatusCode != tt.status {
+			t.Errorf("%s: expected status %d, got %d", tt.name, tt.status, resp.StatusCode)
+		}
+	}
+
+	n, err := nodeDB.Get(context.Background(), testCluster, testNode)
+	if err != nil {
+		t.Fatalf("failed to get node: %s", err)
+	}
+
+	// null removes the member, the objects are merged, the rest of the node is kept
+	if n.Name != "" || !reflect.DeepEqual(n.Labels, map[string]string{"b": "2", "c": "3"}) || n.IP.String() != "fd00::1" || len(n.Addresses) != 1 {
+		t.Errorf("unexpected patched node: %+v", n)
+	}
+}
+
+func TestAppStrictBody(t *testing.T) {
+	defer func(strict bool) { strictBody = strict }(strictBody)
+
+	app := newApp(db.New(zap.NewNop()), zap.NewNop(), appOptions{
+		Config: fiber.Config{Immutable: true},
+	})
+
+	const body = `{"id":"` + testNode + `","ip":"fd00::1","selfIPs":[{"ip":"192.168.0.1","port":51820}],"addrs":[{"ip":"192.168.0.2","port":51820}]}`
+
+	for _, tt := range []struct {
+		name   string
+		strict bool
+		method string
+		path   string
+		mime   string
+		status int
+		field  string
+	}{
+		{name: "lenient", method: http.MethodPost, path: "/" + testCluster, mime: fiber.MIMEApplicationJSON, status: http.StatusNoContent},
+		{name: "strict", strict: true, method: http.MethodPost, path: "/" + testCluster, mime: fiber.MIMEApplicationJSON, status: http.StatusUnprocessableEntity, field: "addrs"},
+		{
+			name:   "strict patch",
+			strict: true,
+			method: http.MethodPatch,
+			path:   "/" + testCluster + "/" + url.PathEscape(testNode),
+			mime:   mimeMergePatch,
+			status: http.StatusUnprocessableEntity,
+			field:  "addrs",
+		},
+	} {
+		strictBody = tt.strict
+
+		req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(body))
+		req.Header.Set(fiber.HeaderContentType, tt.mime)
+
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatalf("%s: request failed: %s", tt.name, err)
+		}
+
+		if resp.StatusCode != tt.status {
+			t.Fatalf("%s: expected status %d, got %d", tt.name, tt.status, resp.StatusCode)
+		}
+
+		if tt.field == "" {
+			continue
+		}
+
+		var response struct {
+			Field string `json:"field"`
+		}
+
+		if err = json.NewDecoder(resp.Body).Decode(&response); err != nil {
+			t.Fatalf("%s: failed to decode the response: %s", tt.name, err)
+		}
+
+		resp.Body.Close() //nolint:errcheck
+
+		if response.Field != tt.field {
+			t.Errorf("%s: unexpected unknown field %q", tt.name, response.Field)
+		}
+	}
+}
+
+func TestAppRequireContentType(t *testing.T) {
+	app := newApp(db.New(zap.NewNop()), zap.NewNop(), appOptions{
+		Config: fiber.Config{Immutable: true},
+	})
+
+	const body = `{"id":"` + testNode + `","ip":"fd00::1","selfIPs":[{"ip":"192.168.0.1","port":51820}]}`
+
+	nodePath := "/" + testCluster + "/" + url.PathEscape(testNode)
+
+	for _, tt := range []struct {
+		name   string
+		method string
+		path   string
+		mime   string
+		body   string
+		status int
+	}{
+		{name: "wrong type", method: http.MethodPost, path: "/" + testCluster, mime: fiber.MIMETextPlain, body: body, status: http.StatusUnsupportedMediaType},
+		{name: "missing type", method: http.MethodPost, path: "/" + testCluster, body: body, status: http.StatusUnsupportedMediaType},
+		{name: "type with parameters", method: http.MethodPost, path: "/" + testCluster, mime: "Application/JSON; charset=utf-8", body: body, status: http.StatusNoContent},
+		{name: "merge patch type on PUT", method: http.MethodPut, path: nodePath, mime: mimeMergePatch, body: "[]", status: http.StatusUnsupportedMediaType},
+		{name: "form on PATCH", method: http.MethodPatch, path: nodePath, mime: fiber.MIMEApplicationForm, body: "name=node", status: http.StatusUnsupportedMediaType},
+		{name: "empty body", method: http.MethodPost, path: nodePath + "/heartbeat", mime: fiber.MIMETextPlain, status: http.StatusNoContent},
+	} {
+		req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+
+		if tt.mime != "" {
+			req.Header.Set(fiber.HeaderContentType, tt.mime)
+		}
+
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatalf("%s: request failed: %s", tt.name, err)
+		}
+
+		if resp.StatusCode != tt.status {
+			t.Errorf("%s: expected status %d, got %d", tt.name, tt.status, resp.StatusCode)
+		}
+
+		if tt.status != http.StatusUnsupportedMediaType {
+			continue
+		}
+
+		var response struct {
+			Supported []string `json:"supported"`
+		}
+
+		if err = json.NewDecoder(resp.Body).Decode(&response); err != nil {
+			t.Fatalf("%s: failed to decode the response: %s", tt.name, err)
+		}
+
+		resp.Body.Close() //nolint:errcheck
+
+		if len(response.Supported) == 0 {
+			t.Errorf("%s: the supported content types are not listed", tt.name)
+		}
+	}
+}
+
+func TestAppWatchClusters(t *testing.T) {
+	const otherCluster = "0c5e1e9a-3c62-4f6e-9d59-8b2a0f0b2d4b"
+
+	app := newApp(db.New(zap.NewNop()), zap.NewNop(), appOptions{
+		Config: fiber.Config{Immutable: true},
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/"+otherCluster,
+		strings.NewReader(`{"id":"`+testNode+`","ip":"fd00::1","selfIPs":[{"ip":"192.168.0.1","port":51820}]}`))
+	req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+
+	if resp, err := app.Test(req); err != nil || resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("failed to register node: %v %v", resp, err)
+	}
+
+	resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/watch?wait=1s&cluster="+testCluster+"&cluster="+otherCluster+":0", nil), 2000)
+	if err != nil {
+		t.Fatalf("request failed: %s", err)
+	}
+
+	defer resp.Body.Close() //nolint:errcheck
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status %d", resp.StatusCode)
+	}
+
+	var response multiChanges
+
+	if err = json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		t.Fatalf("failed to decode the changes: %s", err)
+	}
+
+	if len(response.Clusters) != 1 || response.Clusters[0].Cluster != otherCluster || len(response.Clusters[0].Changes.Nodes) != 1 {
+		t.Errorf("unexpected changes: %+v", response.Clusters)
+	}
+}
+
+func TestAppWatchClustersCanceled(t *testing.T) {
+	const otherCluster = "0c5e1e9a-3c62-4f6e-9d59-8b2a0f0b2d4b"
+
+	app := newApp(&canceledChangesDB{DB: db.New(zap.NewNop())}, zap.NewNop(), appOptions{
+		Config: fiber.Config{Immutable: true},
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/"+otherCluster,
+		strings.NewReader(`{"id":"`+testNode+`","ip":"fd00::1","selfIPs":[{"ip":"192.168.0.1","port":51820}]}`))
+	req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+
+	if resp, err := app.Test(req); err != nil || resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("failed to register node: %v %v", resp, err)
+	}
+
+	// the wait for the unchanged cluster is canceled once the other cluster changes
+	resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/watch?wait=1s&cluster="+testCluster+"&cluster="+otherCluster, nil), 2000)
+	if err != nil {
+		t.Fatalf("request failed: %s", err)
+	}
+
+	defer resp.Body.Close() //nolint:errcheck
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status %d", resp.StatusCode)
+	}
+
+	var response multiChanges
+
+	if err = json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		t.Fatalf("failed to decode the changes: %s", err)
+	}
+
+	if len(response.Clusters) != 1 || response.Clusters[0].Cluster != otherCluster {
+		t.Errorf("unexpected changes: %+v", response.Clusters)
+	}
+}
+
+func TestFormatPeersDropsControlCharacters(t *testing.T) {
+	config := formatPeers([]*wgPeer{
+		{
+			PublicKey:  testNode,
+			AllowedIPs: []string{"fd00::1/128"},
+			Name:       "node\n[Peer]\nAllowedIPs = 0.0.0.0/0",
+		},
+	})
+
+	if strings.Count(config, "[Peer]\n") != 1 || strings.Contains(config, "\nAllowedIPs = 0.0.0.0/0") {
+		t.Errorf("node name injected config lines:\n%s", config)
+	}
+}
+
+func TestProbeEndpointSkipsPrivate(t *testing.T) {
+	p := newProber("udp", time.Minute, 1, []netaddr.IPPrefix{netaddr.MustParseIPPrefix("10.1.0.0/16")}, zap.NewNop())
+
+	for _, tt := range []struct {
+		ip     string
+		probed bool
+	}{
+		{"203.0.113.1", true},
+		{"10.1.2.3", true},
+		{"10.2.3.4", false},
+		{"192.168.0.1", false},
+		{"100.64.0.1", false},
+		{"fd00::1", false},
+		{"127.0.0.1", false},
+	} {
+		if _, probed := p.endpoint(&types.Address{IP: netaddr.MustParseIP(tt.ip)}); probed != tt.probed {
+			t.Errorf("%s: expected probed %v", tt.ip, tt.probed)
+		}
+	}
+}
+
+func TestFilterChangesMembership(t *testing.T) {
+	filter := &nodeFilter{labels: map[string]string{"zone": "us-east-1"}}
+
+	entered := &types.Node{ID: "entered", Labels: map[string]string{"zone": "us-east-1"}}
+	left := &types.Node{ID: "left", Labels: map[string]string{"zone": "us-west-1"}}
+	updated := &types.Node{ID: "updated", Labels: map[string]string{"zone": "us-east-1"}}
+	other := &types.Node{ID: "other", Labels: map[string]string{"zone": "us-west-1"}}
+
+	changes := &types.Changes{
+		Nodes:  []*types.Node{entered, left, updated, other},
+		Cursor: 2,
+		Deltas: map[string]types.NodeDelta{
+			"entered": {Fields: types.FieldLabels},
+			"left":    {Fields: types.FieldLabels},
+			"updated": {Fields: types.FieldAddresses},
+			"other":   {Fields: types.FieldAddresses},
+		},
+	}
+
+	filter.changes(changes)
+
+	if len(changes.Nodes) != 2 || changes.Nodes[0].ID != "entered" || changes.Nodes[1].ID != "updated" {
+		t.Errorf("unexpected nodes: %v", changes.Nodes)
+	}
+
+	if len(changes.Removed) != 1 || changes.Removed[0] != "left" {
+		t.Errorf("node leaving the filter should be removed: %v", changes.Removed)
+	}
+
+	if !changes.Deltas["entered"].Created || changes.Deltas["updated"].Created {
+		t.Errorf("only the node entering the filter should be sent in full: %+v", changes.Deltas)
+	}
+}
+
+func TestWebhookCloseDrainsQueue(t *testing.T) {
+	var delivered int32
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&delivered, 1)
+	}))
+	defer srv.Close()
+
+	hook := newWebhook(srv.URL, "test", zap.NewNop())
+
+	for i := 0; i < 3; i++ {
+		hook.send(fiber.Map{"cluster": testCluster})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	hook.close(ctx)
+
+	if n := atomic.LoadInt32(&delivered); n != 3 {
+		t.Fatalf("expected 3 queued events delivered on close, got %d", n)
+	}
+
+	// events after close are dropped
+	hook.send(fiber.Map{"cluster": testCluster})
+}
+
+func TestAppSnapshotChunks(t *testing.T) {
+	ctx := context.Background()
+	d := db.NewRAM(db.RAMOptions{TombstoneRetention: time.Hour}, zap.NewNop())
+
+	for i := 0; i < 5; i++ {
+		if err := d.Add(ctx, testCluster, &types.Node{
+			ID:        fmt.Sprintf("node-%d", 4-i),
+			IP:        netaddr.MustParseIP("fd00::1"),
+			Addresses: []*types.Address{{IP: netaddr.MustParseIP("192.168.0.1"), Port: 51820}},
+			Labels:    map[string]string{"index": strconv.Itoa(4 - i)},
+		}); err != nil {
+			t.Fatalf("failed to add node: %s", err)
+		}
+	}
+
+	if _, err := d.DeleteNodes(ctx, testCluster, map[string]string{"index": "2"}); err != nil {
+		t.Fatalf("failed to delete nodes: %s", err)
+	}
+
+	app := newApp(d, zap.NewNop(), appOptions{
+		Config: fiber.Config{Immutable: true},
+	})
+
+	var (
+		ids    []string
+		chunks int
+		after  string
+	)
+
+	for {
+		resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/"+testCluster+"?wait=1s&snapshot_chunk=2&after="+after, nil), 2000)
+		if err != nil {
+			t.Fatalf("request failed: %s", err)
+		}
+
+		var changes types.Changes
+
+		err = json.NewDecoder(resp.Body).Decode(&changes)
+		resp.Body.Close() //nolint:errcheck
+
+		if err != nil {
+			t.Fatalf("failed to decode the changes: %s", err)
+		}
+
+		chunks++
+
+		for _, n := range changes.Nodes {
+			ids = append(ids, n.ID)
+		}
+
+		after = resp.Header.Get(snapshotNextHeader)
+
+		if after == "" {
+			// removals are sent with the last chunk only
+			if len(changes.Removed) != 1 || changes.Removed[0] != "node-2" {
+				t.Errorf("unexpected removals in the last chunk: %v", changes.Removed)
+			}
+
+			break
+		}
+
+		if len(changes.Removed) != 0 {
+			t.Errorf("unexpected removals in chunk %d: %v", chunks, changes.Removed)
+		}
+	}
+
+	if chunks != 2 || strings.Join(ids, ",") != "node-0,node-1,node-3,node-4" {
+		t.Errorf("unexpected snapshot in %d chunks: %v", chunks, ids)
+	}
+
+	// continuation of the chunked snapshot can't be mixed with a cursor
+	resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/"+testCluster+"?wait=1s&since=1&snapshot_chunk=2&after=node-1", nil), 2000)
+	if err != nil {
+		t.Fatalf("request failed: %s", err)
+	}
+
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected status %d, got %d", http.StatusBadRequest, resp.StatusCode)
+	}
+}
+
+func TestAppCacheControlVary(t *testing.T) {
+	defer func(maxAge time.Duration) { cacheMaxAge = maxAge }(cacheMaxAge)
+
+	cacheMaxAge = time.Minute
+
+	app := newApp(db.New(zap.NewNop()), zap.NewNop(), appOptions{
+		Config: fiber.Config{Immutable: true},
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/"+testCluster,
+		strings.NewReader(`{"id":"`+testNode+`","ip":"fd00::1","selfIPs":[{"ip":"192.168.0.1","port":51820}]}`))
+	req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+
+	if resp, err := app.Test(req); err != nil || resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("failed to register node: %v %v", resp, err)
+	}
+
+	resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/"+testCluster, nil))
+	if err != nil {
+		t.Fatalf("request failed: %s", err)
+	}
+
+	if resp.Header.Get(fiber.HeaderCacheControl) != "max-age=60" || !strings.Contains(resp.Header.Get(fiber.HeaderVary), fiber.HeaderAccept) {
+		t.Errorf("cached response should vary by Accept: %v", resp.Header)
+	}
+}
+
+func TestAppRequestTimeout(t *testing.T) {
+	defer func(timeout time.Duration) { reqTimeout = timeout }(reqTimeout)
+
+	reqTimeout = 50 * time.Millisecond
+
+	app := newApp(&slowDB{DB: db.New(zap.NewNop())}, zap.NewNop(), appOptions{
+		Config: fiber.Config{Immutable: true},
+	})
+
+	resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/"+testCluster, nil), 2000)
+	if err != nil {
+		t.Fatalf("request failed: %s", err)
+	}
+
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		t.Errorf("expected status %d, got %d", http.StatusGatewayTimeout, resp.StatusCode)
+	}
+
+	// long-polls are bounded by their own wait
+	start := time.Now()
+
+	resp, err = app.Test(httptest.NewRequest(http.MethodGet, "/"+testCluster+"?wait=300ms", nil), 2000)
+	if err != nil {
+		t.Fatalf("request failed: %s", err)
+	}
+
+	if resp.StatusCode != http.StatusNotModified {
+		t.Errorf("expected status %d, got %d", http.StatusNotModified, resp.StatusCode)
+	}
+
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Errorf("long-poll was cut by the request timeout after %s", elapsed)
+	}
+}
+
+func TestAppListModifiedAfter(t *testing.T) {
+	ctx := context.Background()
+	d := db.New(zap.NewNop())
+
+	add := func(id string) {
+		if err := d.Add(ctx, testCluster, &types.Node{
+			ID:        id,
+			IP:        netaddr.MustParseIP("fd00::1"),
+			Addresses: []*types.Address{{IP: netaddr.MustParseIP("192.168.0.1"), Port: 51820}},
+		}); err != nil {
+			t.Fatalf("failed to add node: %s", err)
+		}
+	}
+
+	add("node-old")
+
+	time.Sleep(10 * time.Millisecond)
+
+	cutoff := time.Now()
+
+	time.Sleep(10 * time.Millisecond)
+
+	add("node-new")
+
+	app := newApp(d, zap.NewNop(), appOptions{
+		Config: fiber.Config{Immutable: true},
+	})
+
+	resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/"+testCluster+"?modified_after="+url.QueryEscape(cutoff.Format(time.RFC3339Nano)), nil))
+	if err != nil {
+		t.Fatalf("request failed: %s", err)
+	}
+
+	defer resp.Body.Close() //nolint:errcheck
+
+	var list []*types.Node
+
+	if err = json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		t.Fatalf("failed to decode the list: %s", err)
+	}
+
+	if len(list) != 1 || list[0].ID != "node-new" {
+		t.Errorf("unexpected nodes modified after the cutoff: %+v", list)
+	}
+
+	resp, err = app.Test(httptest.NewRequest(http.MethodGet, "/"+testCluster+"?modified_after=yesterday", nil))
+	if err != nil {
+		t.Fatalf("request failed: %s", err)
+	}
+
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected status %d, got %d", http.StatusBadRequest, resp.StatusCode)
+	}
+}
+
+// postIdempotentNode registers the test node with the IP under the Idempotency-Key.
+func postIdempotentNode(app *fiber.App, cluster, key, ip string) (*http.Response, error) {
+	req := httptest.NewRequest(http.MethodPost, "/"+cluster,
+		strings.NewReader(`{"id":"`+testNode+`","ip":"`+ip+`","selfIPs":[{"ip":"192.168.0.1","port":51820}]}`))
+	req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	req.Header.Set(idempotencyKeyHeader, key)
+
+	return app.Test(req, 2000)
+}
+
+func TestAppIdempotencyReplay(t *testing.T) {
+	defer func(ic *idempotencyCache) { idempotencyResponses = ic }(idempotencyResponses)
+
+	idempotencyResponses = newIdempotencyCache(time.Minute)
+
+	d := &addCountingDB{DB: db.New(zap.NewNop())}
+	app := newApp(d, zap.NewNop(), appOptions{Config: fiber.Config{Immutable: true}})
+
+	for _, ip := range []string{"fd00::1", "fd00::2"} {
+		resp, err := postIdempotentNode(app, testCluster, "key-1", ip)
+		if err != nil || resp.StatusCode != http.StatusNoContent {
+			t.Fatalf("unexpected response to POST with %s: %v %v", ip, resp, err)
+		}
+	}
+
+	if adds := atomic.LoadInt32(&d.adds); adds != 1 {
+		t.Errorf("the replayed request was executed again: %d additions", adds)
+	}
+
+	n, err := d.Get(context.Background(), testCluster, testNode)
+	if err != nil {
+		t.Fatalf("failed to get node: %s", err)
+	}
+
+	if n.IP.String() != "fd00::1" {
+		t.Errorf("unexpected node IP %s after the replay", n.IP)
+	}
+
+	// the keys are scoped per cluster
+	resp, err := postIdempotentNode(app, "6f1d3a52-7b0e-4c5a-a1f3-2e9d8c7b6a50", "key-1", "fd00::2")
+	if err != nil || resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("unexpected response to POST to another cluster: %v %v", resp, err)
+	}
+
+	if adds := atomic.LoadInt32(&d.adds); adds != 2 {
+		t.Errorf("the request to another cluster was replayed: %d additions", adds)
+	}
+}
+
+func TestAppIdempotencyServerError(t *testing.T) {
+	defer func(ic *idempotencyCache) { idempotencyResponses = ic }(idempotencyResponses)
+
+	idempotencyResponses = newIdempotencyCache(time.Minute)
+
+	d := &addCountingDB{DB: db.New(zap.NewNop()), failures: 1}
+	app := newApp(d, zap.NewNop(), appOptions{Config: fiber.Config{Immutable: true}})
+
+	resp, err := postIdempotentNode(app, testCluster, "key-1", "fd00::1")
+	if err != nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("unexpected response to the failed POST: %v %v", resp, err)
+	}
+
+	// the server error is not replayed, the retry is executed
+	resp, err = postIdempotentNode(app, testCluster, "key-1", "fd00::1")
+	if err != nil || resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("unexpected response to the retried POST: %v %v", resp, err)
+	}
+
+	if adds := atomic.LoadInt32(&d.adds); adds != 2 {
+		t.Errorf("unexpected number of additions %d", adds)
+	}
+}
+
+func TestAppIdempotencyConcurrent(t *testing.T) {
+	defer func(ic *idempotencyCache) { idempotencyResponses = ic }(idempotencyResponses)
+
+	idempotencyResponses = newIdempotencyCache(time.Minute)
+
+	d := &addCountingDB{DB: db.New(zap.NewNop()), gate: make(chan struct{})}
+	app := newApp(d, zap.NewNop(), appOptions{Config: fiber.Config{Immutable: true}})
+
+	statuses := make(chan int, 2)
+
+	post := func() {
+		resp, err := postIdempotentNode(app, testCluster, "key-1", "fd00::1")
+		if err != nil {
+			t.Errorf("request failed: %s", err)
+
+			statuses <- 0
+
+			return
+		}
+
+		statuses <- resp.StatusCode
+	}
+
+	go post()
+
+	for atomic.LoadInt32(&d.adds) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// the duplicate waits for the first request in flight
+	go post()
+
+	time.Sleep(100 * time.Millisecond)
+
+	if len(statuses) != 0 {
+		t.Errorf("the duplicate request completed before the first one")
+	}
+
+	close(d.gate)
+
+	for i := 0; i < 2; i++ {
+		if status := <-statuses; status != http.StatusNoContent {
+			t.Errorf("unexpected status %d", status)
+		}
+	}
+
+	if adds := atomic.LoadInt32(&d.adds); adds != 1 {
+		t.Errorf("the duplicate request was executed: %d additions", adds)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	defer func(prefixes []netaddr.IPPrefix) { trustedProxyPrefixes = prefixes }(trustedProxyPrefixes)
+
+	app := newApp(db.New(zap.NewNop()), zap.NewNop(), appOptions{Config: fiber.Config{Immutable: true}})
+
+	// the remote address of the test connections is 0.0.0.0
+	trustedChain := []netaddr.IPPrefix{netaddr.MustParseIPPrefix("0.0.0.0/32"), netaddr.MustParseIPPrefix("10.0.0.0/8")}
+
+	for _, tt := range []struct {
+		name      string
+		trusted   []netaddr.IPPrefix
+		forwarded string
+		expected  string
+	}{
+		{
+			name:      "untrusted remote with spoofed header",
+			forwarded: "203.0.113.7",
+			expected:  "0.0.0.0",
+		},
+		{
+			name:      "trusted proxy chain",
+			trusted:   trustedChain,
+			forwarded: "203.0.113.7, 10.0.0.2, 10.0.0.1",
+			expected:  "203.0.113.7",
+		},
+		{
+			name:      "spoofed hops before the client",
+			trusted:   trustedChain,
+			forwarded: "198.51.100.1, 203.0.113.7, 10.0.0.1",
+			expected:  "203.0.113.7",
+		},
+		{
+			name:      "malformed hop",
+			trusted:   trustedChain,
+			forwarded: "203.0.113.7, garbage, 10.0.0.1",
+			expected:  "10.0.0.1",
+		},
+		{
+			name:     "empty header",
+			trusted:  trustedChain,
+			expected: "0.0.0.0",
+		},
+	} {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			trustedProxyPrefixes = tt.trusted
+
+			req := httptest.NewRequest(http.MethodGet, "/whoami", nil)
+
+			if tt.forwarded != "" {
+				req.Header.Set(fiber.HeaderXForwardedFor, tt.forwarded)
+			}
+
+			resp, err := app.Test(req)
+			if err != nil {
+				t.Fatalf("request failed: %s", err)
+			}
+
+			defer resp.Body.Close() //nolint:errcheck
+
+			var body struct {
+				IP string `json:"ip"`
+			}
+
+			if err = json.NewDecoder(resp.Body).Decode(&body); err != nil {
+				t.Fatalf("failed to decode the response: %s", err)
+			}
+
+			if body.IP != tt.expected {
+				t.Errorf("unexpected client IP %q, expected %q", body.IP, tt.expected)
+			}
+		})
+	}
+}
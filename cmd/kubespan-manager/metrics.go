@@ -0,0 +1,95 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "discovery_http_request_duration_seconds",
+	Help:    "Duration of the HTTP requests.",
+	Buckets: prometheus.DefBuckets,
+}, []string{"method", "route", "code"})
+
+var payloadSize = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "discovery_http_payload_size_bytes",
+	Help:    "Size of the HTTP request and response bodies, as transferred (after the compression).",
+	Buckets: prometheus.ExponentialBuckets(64, 4, 9),
+}, []string{"method", "route", "direction"})
+
+func init() {
+	prometheus.MustRegister(requestDuration, payloadSize)
+}
+
+// observeRequests is the middleware recording the request latency and the payload sizes.
+//
+// Streamed responses (e.g. the admin export) have no size known upfront, only their requests are measured.
+//
+// If the request carries W3C trace context (traceparent header), the trace ID is attached to the observation
+// as an exemplar, linking latency outliers to the traces. Exemplars are only exposed in the OpenMetrics format.
+func observeRequests(c *fiber.Ctx) error {
+	start := time.Now()
+
+	err := c.Next()
+
+	code := c.Response().StatusCode()
+	if fe, ok := err.(*fiber.Error); ok { //nolint:errorlint
+		code = fe.Code
+	}
+
+	payloadSize.WithLabelValues(c.Method(), c.Route().Path, "request").Observe(float64(len(c.Request().Body())))
+
+	if size, ok := responseSize(c); ok {
+		payloadSize.WithLabelValues(c.Method(), c.Route().Path, "response").Observe(float64(size))
+	}
+
+	observer := requestDuration.WithLabelValues(c.Method(), c.Route().Path, strconv.Itoa(code))
+	elapsed := time.Since(start).Seconds()
+
+	if traceID := traceIDFromParent(c.Get("traceparent")); traceID != "" {
+		observer.(prometheus.ExemplarObserver).ObserveWithExemplar(elapsed, prometheus.Labels{"trace_id": traceID}) //nolint:forcetypeassert
+	} else {
+		observer.Observe(elapsed)
+	}
+
+	return err
+}
+
+// responseSize returns the size of the response body as sent, false if the size is not known.
+func responseSize(c *fiber.Ctx) (int, bool) {
+	if c.Response().IsBodyStream() {
+		return 0, false
+	}
+
+	// the body (e.g. the status text) is never sent with these statuses and in response to HEAD
+	if code := c.Response().StatusCode(); code < http.StatusOK || code == http.StatusNoContent || code == http.StatusNotModified || c.Method() == fiber.MethodHead {
+		return 0, true
+	}
+
+	return len(c.Response().Body()), true
+}
+
+// traceIDFromParent extracts the trace ID from the W3C traceparent header: version-traceid-parentid-flags.
+func traceIDFromParent(header string) string {
+	parts := strings.Split(header, "-")
+	if len(parts) != 4 || len(parts[1]) != 32 || parts[1] == strings.Repeat("0", 32) {
+		return ""
+	}
+
+	for _, r := range parts[1] {
+		if !strings.ContainsRune("0123456789abcdef", r) {
+			return ""
+		}
+	}
+
+	return parts[1]
+}
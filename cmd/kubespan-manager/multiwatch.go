@@ -0,0 +1,265 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"go.uber.org/zap"
+
+	"github.com/talos-systems/kubespan-manager/pkg/types"
+)
+
+// maxWatchClusters bounds the number of the clusters of a single multi-cluster subscription.
+const maxWatchClusters = 16
+
+// clusterCursor is a cluster of the multi-cluster subscription along with the cursor of the client.
+type clusterCursor struct {
+	cluster string
+	since   uint64
+}
+
+// clusterChanges are the changes of a single cluster of the multi-cluster subscription.
+type clusterChanges struct {
+	Cluster string         `json:"cluster"`
+	Changes *types.Changes `json:"changes"`
+}
+
+// multiChanges is the response of the multi-cluster subscription.
+type multiChanges struct {
+	Clusters []clusterChanges `json:"clusters"`
+}
+
+// parseWatchClusters parses the repeated ?cluster=<id>[:<cursor>] query parameters.
+//
+// The cursor is split off at the last colon if it is a number, so the opaque cluster IDs
+// ending with a colon and digits should always be passed with the cursor (e.g. with :0).
+func parseWatchClusters(c *fiber.Ctx) ([]clusterCursor, error) {
+	params := c.Context().QueryArgs().PeekMulti("cluster")
+
+	if len(params) == 0 {
+		return nil, fmt.Errorf("no clusters to watch")
+	}
+
+	if len(params) > maxWatchClusters {
+		return nil, fmt.Errorf("at most %d clusters can be watched at once", maxWatchClusters)
+	}
+
+	cursors := make([]clusterCursor, 0, len(params))
+	seen := make(map[string]struct{}, len(params))
+
+	for _, param := range params {
+		cc := clusterCursor{
+			cluster: string(param),
+		}
+
+		if i := strings.LastIndexByte(cc.cluster, ':'); i >= 0 {
+			if since, err := strconv.ParseUint(cc.cluster[i+1:], 10, 64); err == nil {
+				cc.cluster, cc.since = cc.cluster[:i], since
+			}
+		}
+
+		if err := validateClusterID(cc.cluster); err != nil {
+			return nil, fmt.Errorf("bad cluster %q: %w", cc.cluster, err)
+		}
+
+		if _, ok := seen[cc.cluster]; ok {
+			return nil, fmt.Errorf("cluster %q is watched twice", cc.cluster)
+		}
+
+		seen[cc.cluster] = struct{}{}
+
+		cursors = append(cursors, cc)
+	}
+
+	return cursors, nil
+}
+
+// watchResult is the outcome of waiting for the changes of a single cluster.
+type watchResult struct {
+	clusterCursor
+
+	changes *types.Changes
+	err     error
+}
+
+// watchClusters handles the multi-cluster long-poll: GET /watch?wait=30s&cluster=<id>[:<cursor>]&cluster=...
+//
+// It waits for the changes of all the clusters at once and returns as soon as any of them changes,
+// along with the changes of the other clusters which are already available, each tagged with its cluster ID
+// and carrying its own cursor. Clusters without changes are omitted, 304 Not Modified is returned if nothing
+// changed before the timeout.
+//
+// Node filters apply to all the clusters. Changes are always JSON-encoded, snapshot chunking, replay
+// and coalescing are only supported by the single cluster long-poll.
+func watchClusters(logger *zap.Logger) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		logger := requestLogger(c, logger)
+
+		wait, err := time.ParseDuration(c.Query("wait"))
+		if err != nil || wait <= 0 {
+			logger.Error("bad wait duration",
+				zap.String("wait", c.Query("wait")),
+			)
+
+			return c.SendStatus(http.StatusBadRequest)
+		}
+
+		if wait > maxLongPollWait {
+			wait = maxLongPollWait
+		}
+
+		wait = streamDeadline(c, wait)
+
+		cursors, err := parseWatchClusters(c)
+		if err != nil {
+			logger.Error("bad watched clusters",
+				zap.Error(err),
+			)
+
+			return c.SendStatus(http.StatusBadRequest)
+		}
+
+		filter, err := parseNodeFilter(c)
+		if err != nil {
+			logger.Error("bad node filter",
+				zap.Error(err),
+			)
+
+			return c.SendStatus(http.StatusBadRequest)
+		}
+
+		var watchDone []func()
+
+		defer func() {
+			for _, done := range watchDone {
+				done()
+			}
+		}()
+
+		for _, cc := range cursors {
+			done, err := watchStart(cc.cluster)
+			if err != nil {
+				logger.Warn("refusing subscription",
+					zap.String("cluster", cc.cluster),
+					zap.Error(err),
+				)
+
+				return c.Status(http.StatusTooManyRequests).JSON(fiber.Map{
+					"error": err.Error(),
+				})
+			}
+
+			watchDone = append(watchDone, done)
+		}
+
+		ctx, cancel := context.WithTimeout(c.Context(), wait)
+		defer cancel()
+
+		// once the drain grace period elapses, the client gets the response and reconnects to another replica
+		ctx, stop := draining.context(ctx)
+		defer stop()
+
+		results := make(chan watchResult, len(cursors))
+
+		for _, cc := range cursors {
+			go func(cc clusterCursor) {
+				changes, err := nodeDB.Changes(ctx, cc.cluster, cc.since)
+
+				results <- watchResult{
+					clusterCursor: cc,
+					changes:       changes,
+					err:           err,
+				}
+			}(cc)
+		}
+
+		var (
+			response  multiChanges
+			failed    error
+			delivered []watchResult
+		)
+
+		for range cursors {
+			r := <-results
+
+			// the wait was cut short by the change of another cluster (or by the timeout or the drain),
+			// the cursor of the cluster stays as is
+			if r.err != nil && ctx.Err() != nil && (errors.Is(r.err, context.Canceled) || errors.Is(r.err, context.DeadlineExceeded)) {
+				continue
+			}
+
+			if r.err != nil {
+				logger.Error("failed to wait for cluster changes",
+					zap.String("cluster", r.cluster),
+					zap.Uint64("since", r.since),
+					zap.Error(r.err),
+				)
+
+				failed = r.err
+
+				cancel()
+
+				continue
+			}
+
+			// the first change ends the wait for all the clusters
+			if !r.changes.Empty() {
+				cancel()
+			}
+
+			observeLag(r.since, r.changes.Cursor, r.changes.Reset)
+
+			filter.changes(r.changes)
+
+			// filtered out changes still move the cursor
+			if r.changes.Empty() && r.changes.Cursor == r.since {
+				continue
+			}
+
+			response.Clusters = append(response.Clusters, clusterChanges{
+				Cluster: r.cluster,
+				Changes: r.changes,
+			})
+
+			delivered = append(delivered, r)
+		}
+
+		if failed != nil {
+			return sendDBError(c, failed)
+		}
+
+		if len(response.Clusters) == 0 {
+			return c.SendStatus(http.StatusNotModified)
+		}
+
+		sort.Slice(response.Clusters, func(i, j int) bool {
+			return response.Clusters[i].Cluster < response.Clusters[j].Cluster
+		})
+
+		logger.Info("listing changed nodes of the watched clusters",
+			zap.Int("watched", len(cursors)),
+			zap.Int("changed", len(response.Clusters)),
+		)
+
+		if err = c.JSON(&response); err != nil {
+			return err
+		}
+
+		for _, r := range delivered {
+			observeDelivery(r.changes)
+		}
+
+		return nil
+	}
+}
@@ -0,0 +1,252 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"go.uber.org/zap"
+
+	"github.com/talos-systems/kubespan-manager/internal/db"
+	"github.com/talos-systems/kubespan-manager/pkg/types"
+)
+
+// responseEncoder serializes a response body in a specific content type.
+type responseEncoder struct {
+	contentType string
+	encode      func(c *fiber.Ctx, v interface{}) error
+
+	// supports reports whether the value can be encoded, nil means any value.
+	supports func(v interface{}) bool
+}
+
+// responseEncoders lists the supported response content types, the first one is the default.
+//
+// New wire formats are added by appending an encoder here.
+var responseEncoders = []responseEncoder{
+	{
+		contentType: fiber.MIMEApplicationJSON,
+		encode: func(c *fiber.Ctx, v interface{}) error {
+			return c.JSON(v)
+		},
+	},
+	{
+		contentType: types.MIMEProtobuf,
+		encode: func(c *fiber.Ctx, v interface{}) error {
+			var (
+				data []byte
+				err  error
+			)
+
+			switch v := v.(type) {
+			case *types.Node:
+				data, err = v.MarshalProto()
+			case []*types.Node:
+				data, err = types.MarshalNodesProto(v)
+			case []*types.Address:
+				data, err = types.MarshalAddressesProto(v)
+			default:
+				return c.SendStatus(http.StatusNotAcceptable)
+			}
+
+			if err != nil {
+				return err
+			}
+
+			c.Set(fiber.HeaderContentType, types.MIMEProtobuf)
+
+			return c.Send(data)
+		},
+		supports: func(v interface{}) bool {
+			switch v.(type) {
+			case *types.Node, []*types.Node, []*types.Address:
+				return true
+			}
+
+			return false
+		},
+	},
+}
+
+// respond encodes the response body using the content type negotiated from the Accept header.
+func respond(c *fiber.Ctx, v interface{}) error {
+	accepted := c.Accepts(responseOffers(v)...)
+
+	for _, enc := range responseEncoders {
+		if enc.contentType == accepted {
+			return enc.encode(c, v)
+		}
+	}
+
+	return c.SendStatus(http.StatusNotAcceptable)
+}
+
+// responseOffers returns the content types the value can be encoded in, the default one first.
+func responseOffers(v interface{}) []string {
+	offers := make([]string, 0, len(responseEncoders))
+
+	for _, enc := range responseEncoders {
+		if enc.supports == nil || enc.supports(v) {
+			offers = append(offers, enc.contentType)
+		}
+	}
+
+	return offers
+}
+
+// streamNodes streams the nodes of the cluster as newline-delimited JSON, one node per line.
+//
+// The nodes are read from the backend with DB.Walk while the response is sent, so that huge clusters
+// are never held in memory as a whole; the clients might process the nodes as they arrive.
+// As the body is written after the handler returns, the walk runs with its own context.
+func streamNodes(c *fiber.Ctx, logger *zap.Logger, cluster string, filter *nodeFilter, fields map[string]struct{}) error {
+	// the missing cluster is reported before the response status is sent
+	if _, err := nodeDB.Count(requestContext(c), cluster); err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			logger.Warn("cluster not found",
+				zap.String("cluster", cluster),
+				zap.Error(err),
+			)
+
+			return c.SendStatus(http.StatusNotFound)
+		}
+
+		logger.Error("failed to count cluster nodes",
+			zap.String("cluster", cluster),
+			zap.Error(err),
+		)
+
+		return sendDBError(c, err)
+	}
+
+	ctx := context.Background()
+
+	if id, ok := c.Context().UserValue(db.CorrelationIDKey).(string); ok {
+		ctx = context.WithValue(ctx, db.CorrelationIDKey, id) //nolint:staticcheck
+	}
+
+	c.Set(fiber.HeaderContentType, mimeNDJSON)
+
+	extendDeadline := writeDeadlineExtender(c)
+
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		enc := json.NewEncoder(w)
+		count := 0
+
+		err := nodeDB.Walk(ctx, cluster, func(n *types.Node) error {
+			if !filter.match(n) {
+				return nil
+			}
+
+			n = filter.addresses.node(n)
+
+			var item interface{} = n
+
+			if fields != nil {
+				projected, err := projectNode(n, fields)
+				if err != nil {
+					return err
+				}
+
+				item = projected
+			}
+
+			extendDeadline()
+
+			// the client went away, the rest of the cluster is dropped
+			if err := enc.Encode(item); err != nil {
+				return err
+			}
+
+			count++
+
+			return nil
+		})
+		if err != nil && !errors.Is(err, db.ErrNotFound) {
+			logger.Error("failed to stream cluster nodes",
+				zap.String("cluster", cluster),
+				zap.Int("count", count),
+				zap.Error(err),
+			)
+
+			return
+		}
+
+		logger.Info("streamed cluster nodes",
+			zap.String("cluster", cluster),
+			zap.Int("count", count),
+		)
+	})
+
+	return nil
+}
+
+// parseNode decodes the Node from the request body according to its content type.
+func parseNode(c *fiber.Ctx, n *types.Node) error {
+	if isProtobuf(c) {
+		return n.UnmarshalProto(c.Body())
+	}
+
+	return parseBody(c, n)
+}
+
+// parseAddresses decodes the list of addresses from the request body according to its content type.
+func parseAddresses(c *fiber.Ctx) ([]*types.Address, error) {
+	if isProtobuf(c) {
+		return types.UnmarshalAddressesProto(c.Body())
+	}
+
+	var addresses []*types.Address
+
+	err := parseBody(c, &addresses)
+
+	return addresses, err
+}
+
+// isProtobuf reports whether the request body is protobuf-encoded.
+func isProtobuf(c *fiber.Ctx) bool {
+	return strings.HasPrefix(strings.TrimSpace(strings.ToLower(string(c.Request().Header.ContentType()))), types.MIMEProtobuf)
+}
+
+// mimeNDJSON is the content type of the newline-delimited JSON bodies.
+const mimeNDJSON = "application/x-ndjson"
+
+// requireContentType returns the middleware rejecting the request bodies of other content types with 415,
+// so that the clients get a clear error instead of a confusing parse failure.
+//
+// Requests without a body are passed through, as there is nothing to parse.
+func requireContentType(mimes ...string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if len(c.Body()) == 0 {
+			return c.Next()
+		}
+
+		contentType := strings.ToLower(string(c.Request().Header.ContentType()))
+
+		if i := strings.IndexByte(contentType, ';'); i >= 0 {
+			contentType = contentType[:i]
+		}
+
+		contentType = strings.TrimSpace(contentType)
+
+		for _, mime := range mimes {
+			if contentType == mime {
+				return c.Next()
+			}
+		}
+
+		return c.Status(http.StatusUnsupportedMediaType).JSON(fiber.Map{
+			"error":     fmt.Sprintf("unsupported content type %q", contentType),
+			"supported": mimes,
+		})
+	}
+}
@@ -0,0 +1,205 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/gofiber/fiber/v2"
+
+	"github.com/talos-systems/kubespan-manager/pkg/types"
+)
+
+// notificationEncoder serializes the changes delivered to the subscribers.
+type notificationEncoder interface {
+	contentType() string
+	encode(changes *types.Changes) ([]byte, error)
+}
+
+type jsonNotifications struct{}
+
+func (jsonNotifications) contentType() string { return fiber.MIMEApplicationJSON }
+
+func (jsonNotifications) encode(changes *types.Changes) ([]byte, error) {
+	return json.Marshal(changes)
+}
+
+type protoNotifications struct{}
+
+func (protoNotifications) contentType() string { return types.MIMEProtobuf }
+
+func (protoNotifications) encode(changes *types.Changes) ([]byte, error) {
+	return changes.MarshalProto()
+}
+
+// mimeDelta is the content type of the delta notifications.
+const mimeDelta = "application/vnd.kubespan.delta+json"
+
+// deltaFields maps the changed Node fields to their JSON keys.
+var deltaFields = []struct {
+	field types.NodeFields
+	key   string
+}{
+	{types.FieldName, "name"},
+	{types.FieldIP, "ip"},
+	{types.FieldAddresses, "selfIPs"},
+	{types.FieldLabels, "labels"},
+	{types.FieldAddressFamily, "addressFamilyPreference"},
+	{types.FieldSticky, "sticky"},
+	{types.FieldRole, "role"},
+	{types.FieldGeneration, "generation"},
+}
+
+// deltaNotification is the delta-encoded Changes.
+type deltaNotification struct {
+	Cursor  uint64        `json:"cursor"`
+	Reset   bool          `json:"reset,omitempty"`
+	Changes []deltaChange `json:"changes"`
+}
+
+// deltaChange is a single node change: added nodes are sent in full, updates carry the changed fields only.
+type deltaChange struct {
+	Op     string                     `json:"op"`
+	ID     string                     `json:"id"`
+	Node   *types.Node                `json:"node,omitempty"`
+	Fields map[string]json.RawMessage `json:"fields,omitempty"`
+}
+
+// deltaNotifications sends the changed fields of the updated nodes only.
+//
+// The delta is relative to the state at the subscription cursor. If the backend doesn't track the changed fields,
+// or the changes are a reset snapshot, the nodes are sent in full.
+type deltaNotifications struct{}
+
+func (deltaNotifications) contentType() string { return mimeDelta }
+
+func (deltaNotifications) encode(changes *types.Changes) ([]byte, error) {
+	notification := deltaNotification{
+		Cursor:  changes.Cursor,
+		Reset:   changes.Reset,
+		Changes: make([]deltaChange, 0, len(changes.Nodes)+len(changes.Removed)),
+	}
+
+	for _, n := range changes.Nodes {
+		delta, tracked := changes.Deltas[n.ID]
+
+		switch {
+		case changes.Reset || delta.Created:
+			notification.Changes = append(notification.Changes, deltaChange{Op: "add", ID: n.ID, Node: n})
+
+			continue
+		case !tracked:
+			notification.Changes = append(notification.Changes, deltaChange{Op: "update", ID: n.ID, Node: n})
+
+			continue
+		}
+
+		fields, err := changedFields(n, delta.Fields)
+		if err != nil {
+			return nil, err
+		}
+
+		notification.Changes = append(notification.Changes, deltaChange{Op: "update", ID: n.ID, Fields: fields})
+	}
+
+	for _, id := range changes.Removed {
+		notification.Changes = append(notification.Changes, deltaChange{Op: "delete", ID: id})
+	}
+
+	return json.Marshal(notification)
+}
+
+// changedFields picks the changed fields from the JSON representation of the node.
+//
+// The version and the last seen time are always included, cleared fields are sent as null.
+func changedFields(n *types.Node, changed types.NodeFields) (map[string]json.RawMessage, error) {
+	data, err := json.Marshal(n)
+	if err != nil {
+		return nil, err
+	}
+
+	var full map[string]json.RawMessage
+
+	if err = json.Unmarshal(data, &full); err != nil {
+		return nil, err
+	}
+
+	fields := map[string]json.RawMessage{
+		"version":  full["version"],
+		"lastSeen": full["lastSeen"],
+	}
+
+	for _, f := range deltaFields {
+		if changed&f.field == 0 {
+			continue
+		}
+
+		value, ok := full[f.key]
+		if !ok {
+			value = json.RawMessage("null")
+		}
+
+		fields[f.key] = value
+	}
+
+	return fields, nil
+}
+
+// notificationFormats lists the notification encoders by the format name.
+//
+// New subscription formats are added by registering an encoder here, defaultNotificationFormat is used if none is requested.
+var notificationFormats = map[string]notificationEncoder{
+	"json":     jsonNotifications{},
+	"protobuf": protoNotifications{},
+	"delta":    deltaNotifications{},
+}
+
+const defaultNotificationFormat = "json"
+
+// notificationEncoderFor picks the encoder of the subscription.
+//
+// The format is requested explicitly with ?format=<name>, otherwise it is negotiated from the Accept header.
+func notificationEncoderFor(c *fiber.Ctx) (notificationEncoder, error) {
+	if format := c.Query("format"); format != "" {
+		enc, ok := notificationFormats[format]
+		if !ok {
+			return nil, fmt.Errorf("unsupported notification format %q", format)
+		}
+
+		return enc, nil
+	}
+
+	def := notificationFormats[defaultNotificationFormat]
+	offers := []string{def.contentType()}
+
+	for name, enc := range notificationFormats {
+		if name != defaultNotificationFormat {
+			offers = append(offers, enc.contentType())
+		}
+	}
+
+	accepted := c.Accepts(offers...)
+
+	for _, enc := range notificationFormats {
+		if enc.contentType() == accepted {
+			return enc, nil
+		}
+	}
+
+	return def, nil
+}
+
+// sendNotification writes the changes encoded for the subscriber.
+func sendNotification(c *fiber.Ctx, enc notificationEncoder, changes *types.Changes) error {
+	data, err := enc.encode(changes)
+	if err != nil {
+		return err
+	}
+
+	c.Set(fiber.HeaderContentType, enc.contentType())
+
+	return c.Send(data)
+}
@@ -0,0 +1,78 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/talos-systems/kubespan-manager/pkg/types"
+)
+
+// mimeMergePatch is the content type of JSON Merge Patch documents.
+const mimeMergePatch = "application/merge-patch+json"
+
+// mergePatch applies the JSON Merge Patch (RFC 7386) to the target document.
+//
+// Objects are merged recursively with null removing the member, any other value (including arrays) replaces the target.
+func mergePatch(target, patch interface{}) interface{} {
+	patchObj, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	targetObj, ok := target.(map[string]interface{})
+	if !ok {
+		targetObj = map[string]interface{}{}
+	}
+
+	for key, value := range patchObj {
+		if value == nil {
+			delete(targetObj, key)
+
+			continue
+		}
+
+		targetObj[key] = mergePatch(targetObj[key], value)
+	}
+
+	return targetObj
+}
+
+// patchNode returns the node with the merge patch applied, the node itself is not modified.
+func patchNode(n *types.Node, patch []byte) (*types.Node, error) {
+	var patchDoc interface{}
+
+	if err := json.Unmarshal(patch, &patchDoc); err != nil {
+		return nil, fmt.Errorf("bad merge patch: %w", err)
+	}
+
+	data, err := json.Marshal(n)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc interface{}
+
+	if err = json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+
+	if data, err = json.Marshal(mergePatch(doc, patchDoc)); err != nil {
+		return nil, err
+	}
+
+	patched := new(types.Node)
+
+	if err = decodeJSON(data, patched, strictBody); err != nil {
+		return nil, fmt.Errorf("patched node is invalid: %w", err)
+	}
+
+	if patched.ID != n.ID {
+		return nil, fmt.Errorf("node ID can't be changed")
+	}
+
+	return patched, nil
+}
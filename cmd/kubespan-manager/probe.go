@@ -0,0 +1,307 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"go.uber.org/zap"
+	"inet.af/netaddr"
+
+	"github.com/talos-systems/kubespan-manager/internal/db"
+	"github.com/talos-systems/kubespan-manager/pkg/types"
+)
+
+const (
+	// probeTimeout bounds a single endpoint probe.
+	probeTimeout = 2 * time.Second
+
+	// probeDefaultPort is probed if the address has no port, it is the default Wireguard port.
+	probeDefaultPort = 51820
+)
+
+// privatePrefixes are the ranges which are never probed unless explicitly allowed:
+// the service should not scan the internal network on behalf of the clients.
+var privatePrefixes = []netaddr.IPPrefix{
+	netaddr.MustParseIPPrefix("10.0.0.0/8"),
+	netaddr.MustParseIPPrefix("172.16.0.0/12"),
+	netaddr.MustParseIPPrefix("192.168.0.0/16"),
+	netaddr.MustParseIPPrefix("100.64.0.0/10"),
+	netaddr.MustParseIPPrefix("fc00::/7"),
+}
+
+// prober checks the reachability of the stored addresses in the background.
+//
+// Only the public IP addresses reported by the nodes are probed (and the private ones explicitly allowed),
+// each at most once per interval, and the probes are spread over time according to the rate,
+// so that the service doesn't turn into a scanner.
+// The results are advisory: they are returned by the admin API only, never stored and not used for the cleanup.
+type prober struct {
+	logger   *zap.Logger
+	network  string
+	interval time.Duration
+	rate     int
+	allowed  []netaddr.IPPrefix
+
+	mu      sync.Mutex
+	results map[string]*types.Reachability
+}
+
+func newProber(network string, interval time.Duration, rate int, allowed []netaddr.IPPrefix, logger *zap.Logger) *prober {
+	return &prober{
+		logger:   logger.With(zap.String("component", "prober")),
+		network:  network,
+		interval: interval,
+		rate:     rate,
+		allowed:  allowed,
+		results:  make(map[string]*types.Reachability),
+	}
+}
+
+// run probes all the stored endpoints every interval until the context is canceled.
+func (p *prober) run(ctx context.Context) {
+	throttle := time.NewTicker(time.Second / time.Duration(p.rate))
+	defer throttle.Stop()
+
+	for {
+		start := time.Now()
+
+		endpoints, err := p.endpoints(ctx)
+		if err != nil {
+			p.logger.Warn("failed to collect endpoints to probe", zap.Error(err))
+		}
+
+		for _, endpoint := range endpoints {
+			select {
+			case <-ctx.Done():
+				return
+			case <-throttle.C:
+			}
+
+			p.record(endpoint, p.probe(ctx, endpoint))
+		}
+
+		p.prune(endpoints)
+
+		p.logger.Debug("probed endpoints",
+			zap.Int("count", len(endpoints)),
+			zap.Duration("elapsed", time.Since(start)),
+		)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(p.interval - time.Since(start)):
+		}
+	}
+}
+
+// endpoints collects the distinct endpoints of all the stored nodes.
+func (p *prober) endpoints(ctx context.Context) ([]string, error) {
+	seen := make(map[string]struct{})
+
+	var endpoints []string
+
+	err := nodeDB.ForEachCluster(ctx, func(cluster string, nodes []*types.Node) error {
+		for _, n := range nodes {
+			for _, a := range n.Addresses {
+				endpoint, ok := p.endpoint(a)
+				if !ok {
+					continue
+				}
+
+				if _, dup := seen[endpoint]; !dup {
+					seen[endpoint] = struct{}{}
+					endpoints = append(endpoints, endpoint)
+				}
+			}
+		}
+
+		return nil
+	})
+
+	return endpoints, err
+}
+
+// endpoint returns the host:port to probe for the address.
+//
+// DNS names are never resolved, addresses which can't belong to a remote peer are skipped,
+// and so are the private addresses, unless they are allowed.
+func (p *prober) endpoint(a *types.Address) (string, bool) {
+	if a.IP.IsZero() || a.IP.IsUnspecified() || a.IP.IsLoopback() || a.IP.IsMulticast() || a.IP.IsLinkLocalUnicast() {
+		return "", false
+	}
+
+	if inPrefixes(privatePrefixes, a.IP) && !inPrefixes(p.allowed, a.IP) {
+		return "", false
+	}
+
+	port := a.Port
+	if port == 0 {
+		port = probeDefaultPort
+	}
+
+	return net.JoinHostPort(a.IP.String(), strconv.Itoa(int(port))), true
+}
+
+// probe checks the single endpoint.
+//
+// UDP endpoints are reachable only if they answer, and unreachable if the host rejects the datagram;
+// silence is the expected outcome for Wireguard, so it is reported as unknown.
+func (p *prober) probe(ctx context.Context, endpoint string) types.ReachabilityStatus {
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+
+	var dialer net.Dialer
+
+	conn, err := dialer.DialContext(ctx, p.network, endpoint)
+	if err != nil {
+		return types.Unreachable
+	}
+
+	defer conn.Close() //nolint:errcheck
+
+	if p.network == "tcp" {
+		return types.Reachable
+	}
+
+	deadline, _ := ctx.Deadline()
+
+	if err = conn.SetDeadline(deadline); err != nil {
+		return types.ReachabilityUnknown
+	}
+
+	if _, err = conn.Write([]byte{0}); err != nil {
+		return types.Unreachable
+	}
+
+	_, err = conn.Read(make([]byte, 1))
+
+	switch {
+	case err == nil:
+		return types.Reachable
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return types.Unreachable
+	default:
+		return types.ReachabilityUnknown
+	}
+}
+
+func (p *prober) record(endpoint string, status types.ReachabilityStatus) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.results[endpoint] = &types.Reachability{
+		Status:   status,
+		ProbedAt: time.Now(),
+	}
+}
+
+// prune forgets the results of the endpoints which are no longer stored.
+func (p *prober) prune(endpoints []string) {
+	current := make(map[string]struct{}, len(endpoints))
+
+	for _, endpoint := range endpoints {
+		current[endpoint] = struct{}{}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for endpoint := range p.results {
+		if _, ok := current[endpoint]; !ok {
+			delete(p.results, endpoint)
+		}
+	}
+}
+
+// inPrefixes checks whether the IP belongs to any of the prefixes.
+func inPrefixes(prefixes []netaddr.IPPrefix, ip netaddr.IP) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (p *prober) lookup(a *types.Address) *types.Reachability {
+	endpoint, ok := p.endpoint(a)
+	if !ok {
+		return nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.results[endpoint]
+}
+
+// node annotates the addresses of the node with the probe results, if probing is enabled.
+func (p *prober) node(n *types.Node) *types.Node {
+	if p == nil {
+		return n
+	}
+
+	return n.WithReachability(p.lookup)
+}
+
+// nodes annotates the addresses of the nodes with the probe results, if probing is enabled.
+func (p *prober) nodes(list []*types.Node) []*types.Node {
+	if p == nil {
+		return list
+	}
+
+	annotated := make([]*types.Node, 0, len(list))
+
+	for _, n := range list {
+		annotated = append(annotated, n.WithReachability(p.lookup))
+	}
+
+	return annotated
+}
+
+// listReachability handles GET /admin/:cluster/reachability, returning the nodes with the probe results
+// attached to their addresses.
+//
+// The results are kept off the public API, as they reveal which endpoints the service can reach.
+func listReachability(logger *zap.Logger) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		logger := requestLogger(c, logger)
+
+		cluster := c.Params("cluster")
+
+		if probes == nil {
+			logger.Warn("endpoint probing is disabled")
+
+			return c.SendStatus(http.StatusNotImplemented)
+		}
+
+		list, err := nodeDB.List(requestContext(c), cluster)
+		if err != nil {
+			if errors.Is(err, db.ErrNotFound) {
+				return c.SendStatus(http.StatusNotFound)
+			}
+
+			logger.Error("failed to list cluster nodes",
+				zap.String("cluster", cluster),
+				zap.Error(err),
+			)
+
+			return sendDBError(c, err)
+		}
+
+		return c.JSON(probes.nodes(list))
+	}
+}
@@ -0,0 +1,55 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"inet.af/netaddr"
+)
+
+// trustedProxyPrefixes is the list of networks of the proxies allowed to set X-Forwarded-For.
+var trustedProxyPrefixes []netaddr.IPPrefix
+
+func trustedProxy(ip netaddr.IP) bool {
+	for _, prefix := range trustedProxyPrefixes {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// clientIP returns the IP address of the client.
+//
+// X-Forwarded-For is only honored if the connection comes from a trusted proxy: the header is walked
+// from the nearest hop, skipping the trusted proxies, so that the client can't spoof its address
+// by sending the header itself.
+func clientIP(c *fiber.Ctx) string {
+	remote, ok := netaddr.FromStdIP(c.Context().RemoteIP())
+	if !ok || !trustedProxy(remote) {
+		return c.Context().RemoteIP().String()
+	}
+
+	hops := strings.Split(c.Get(fiber.HeaderXForwardedFor), ",")
+
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := netaddr.ParseIP(strings.TrimSpace(hops[i]))
+		if err != nil {
+			// malformed header, don't trust anything beyond this point
+			break
+		}
+
+		remote = hop
+
+		if !trustedProxy(hop) {
+			break
+		}
+	}
+
+	return remote.String()
+}
@@ -0,0 +1,41 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"net/http"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var readOnlyGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "discovery_read_only",
+	Help: "Set to 1 if the replica is read-only and rejects the mutations.",
+})
+
+func init() {
+	prometheus.MustRegister(readOnlyGauge)
+}
+
+// refuseWrites is the middleware rejecting the mutating requests on the read-only replicas.
+//
+// Reads (including long-polls) are served from the shared backend as usual.
+func refuseWrites(c *fiber.Ctx) error {
+	if !readOnly {
+		return c.Next()
+	}
+
+	switch c.Method() {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return c.Next()
+	}
+
+	c.Set(fiber.HeaderAllow, "GET, HEAD")
+
+	return c.Status(http.StatusMethodNotAllowed).JSON(fiber.Map{
+		"error": "read-only replica, mutations should be sent to the primary",
+	})
+}
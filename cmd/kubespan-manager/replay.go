@@ -0,0 +1,105 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+	"go.uber.org/zap"
+
+	"github.com/talos-systems/kubespan-manager/internal/db"
+	"github.com/talos-systems/kubespan-manager/pkg/types"
+)
+
+// replayHeader marks the long-poll response carrying the replay of the past changes instead of the live ones.
+const replayHeader = "X-Replay"
+
+// fillEventFields fills in the JSON keys of the fields changed by the event.
+//
+// Created nodes have all the fields set, so the fields are not listed.
+func fillEventFields(ev *types.ChangeEvent) {
+	for _, f := range deltaFields {
+		if !ev.Created && ev.Delta.Fields&f.field != 0 {
+			ev.Fields = append(ev.Fields, f.key)
+		}
+	}
+}
+
+// sendReplay responds to the initial long-poll with ?replay=true with the retained changes of the cluster.
+//
+// The response carries the changed nodes as of the returned cursor, and the client continues with the live changes
+// from it. Events are filtered by the node IDs only, as the labels and the roles of the nodes at the time
+// of the change are not known, while the nodes are filtered in full.
+func sendReplay(c *fiber.Ctx, logger *zap.Logger, cluster string, filter *nodeFilter) error {
+	if replayer == nil {
+		logger.Warn("change replay is not supported by the backend")
+
+		return c.SendStatus(http.StatusNotImplemented)
+	}
+
+	target, err := nodeDB.ResolveAlias(requestContext(c), cluster)
+	if err != nil {
+		logger.Error("failed to resolve cluster alias",
+			zap.String("cluster", cluster),
+			zap.Error(err),
+		)
+
+		return sendDBError(c, err)
+	}
+
+	if target == "" {
+		target = cluster
+	}
+
+	replay, err := replayer.Replay(requestContext(c), target)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			logger.Warn("cluster not found",
+				zap.String("cluster", cluster),
+				zap.Error(err),
+			)
+
+			return c.SendStatus(http.StatusNotFound)
+		}
+
+		logger.Error("failed to replay cluster changes",
+			zap.String("cluster", cluster),
+			zap.Error(err),
+		)
+
+		return sendDBError(c, err)
+	}
+
+	events := make([]*types.ChangeEvent, 0, len(replay.Events))
+
+	for _, ev := range replay.Events {
+		if !filter.matchID(ev.ID) {
+			continue
+		}
+
+		fillEventFields(ev)
+
+		events = append(events, ev)
+	}
+
+	replay.Events = events
+	replay.Nodes = filter.nodes(replay.Nodes)
+
+	logger.Info("replaying cluster changes",
+		zap.String("cluster", cluster),
+		zap.Int("count", len(events)),
+		zap.Int("nodes", len(replay.Nodes)),
+		zap.Uint64("cursor", replay.Cursor),
+		zap.Bool("truncated", replay.Truncated),
+	)
+
+	c.Set(replayHeader, "true")
+	c.Set(cursorHeader, strconv.FormatUint(replay.Cursor, 10))
+
+	return c.JSON(replay)
+}
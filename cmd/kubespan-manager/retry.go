@@ -0,0 +1,59 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+
+	"github.com/talos-systems/kubespan-manager/internal/db"
+)
+
+// retryJitter is the maximum fraction of the Retry-After hint added at random,
+// so that the clients failed at once don't retry in lockstep.
+const retryJitter = 0.5
+
+// sendDBError sends the status for the database error.
+//
+// Backend failures (5xx) are retryable, they carry the Retry-After hint, so that the clients back off
+// instead of retrying at once; client errors (4xx) should not be retried as is, and they carry no hint.
+func sendDBError(c *fiber.Ctx, err error) error {
+	status := dbErrorStatus(err)
+
+	if status >= http.StatusInternalServerError {
+		c.Set(fiber.HeaderRetryAfter, strconv.Itoa(retryAfterSeconds(err)))
+	}
+
+	return c.SendStatus(status)
+}
+
+// retryAfterSeconds returns the Retry-After hint of the backend failure in whole seconds.
+//
+// If the backend is unavailable, the hint is not shorter than the time until the next reconnect attempt,
+// so that it follows the reconnect backoff.
+func retryAfterSeconds(err error) int {
+	delay := retryAfter
+
+	var unavailable *db.UnavailableError
+
+	if errors.As(err, &unavailable) && unavailable.RetryAfter > delay {
+		delay = unavailable.RetryAfter
+	}
+
+	delay += time.Duration(rand.Float64() * retryJitter * float64(delay)) //nolint:gosec
+
+	seconds := int(math.Ceil(delay.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+
+	return seconds
+}
@@ -0,0 +1,84 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+
+	"github.com/talos-systems/kubespan-manager/pkg/types"
+)
+
+// snapshotNextHeader carries the node ID to continue the chunked snapshot after, it is not set on the last chunk.
+const snapshotNextHeader = "X-Snapshot-Next"
+
+// snapshotChunk selects the chunk of the snapshot: ?snapshot_chunk=<nodes>&after=<node ID>.
+type snapshotChunk struct {
+	size  int
+	after string
+}
+
+// parseSnapshotChunk parses the chunking of the snapshots, the snapshots are not chunked if the size is not set.
+func parseSnapshotChunk(c *fiber.Ctx) (snapshotChunk, error) {
+	var (
+		chunk snapshotChunk
+		err   error
+	)
+
+	if c.Query("snapshot_chunk") != "" {
+		if chunk.size, err = strconv.Atoi(c.Query("snapshot_chunk")); err != nil || chunk.size <= 0 {
+			return chunk, fmt.Errorf("bad snapshot chunk size %q", c.Query("snapshot_chunk"))
+		}
+	}
+
+	chunk.after = c.Query("after")
+
+	if chunk.after != "" && chunk.size == 0 {
+		return chunk, fmt.Errorf("snapshot chunk size is required to continue after %q", chunk.after)
+	}
+
+	return chunk, nil
+}
+
+// apply trims the snapshot to the nodes following the after ID in the ID order, up to the chunk size.
+//
+// If more nodes follow, the last returned ID is set in the X-Snapshot-Next header: the client requests
+// the next chunk with it as ?after=, and the absence of the header marks the last chunk.
+// The removed nodes are sent with the last chunk.
+//
+// Clients resume watching from the cursor of the first chunk: the changes made while the chunks are fetched
+// are delivered again, which is harmless, as the notifications carry the full state of the nodes.
+//
+// Every chunk re-reads and sorts the whole snapshot, so fetching all of it costs O(n²/size) in total:
+// the chunk size should be large enough to keep the number of chunks low.
+func (chunk snapshotChunk) apply(c *fiber.Ctx, changes *types.Changes) {
+	if chunk.size == 0 {
+		return
+	}
+
+	nodes := make([]*types.Node, 0, len(changes.Nodes))
+
+	for _, n := range changes.Nodes {
+		if n.ID > chunk.after {
+			nodes = append(nodes, n)
+		}
+	}
+
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].ID < nodes[j].ID
+	})
+
+	if len(nodes) > chunk.size {
+		nodes = nodes[:chunk.size]
+		changes.Removed = nil
+
+		c.Set(snapshotNextHeader, nodes[len(nodes)-1].ID)
+	}
+
+	changes.Nodes = nodes
+}
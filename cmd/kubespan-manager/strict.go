@@ -0,0 +1,78 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// unknownFieldPrefix starts the encoding/json errors about the unknown fields.
+const unknownFieldPrefix = "json: unknown field "
+
+// unknownFieldError is returned in the strict body mode for the JSON documents with unknown fields.
+type unknownFieldError struct {
+	field string
+}
+
+func (e *unknownFieldError) Error() string {
+	return fmt.Sprintf("unknown field %q", e.field)
+}
+
+// decodeJSON decodes the JSON document, rejecting unknown fields if strict is set.
+func decodeJSON(data []byte, v interface{}, strict bool) error {
+	if !strict {
+		return json.Unmarshal(data, v)
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+
+	err := dec.Decode(v)
+	if err != nil && strings.HasPrefix(err.Error(), unknownFieldPrefix) {
+		field := strings.TrimPrefix(err.Error(), unknownFieldPrefix)
+
+		if unquoted, e := strconv.Unquote(field); e == nil {
+			field = unquoted
+		}
+
+		return &unknownFieldError{field: field}
+	}
+
+	return err
+}
+
+// parseBody decodes the request body like c.BodyParser.
+//
+// With -strict-body, JSON bodies with unknown fields are rejected, so that client typos
+// (e.g. addrs instead of addresses) fail instead of dropping the data silently.
+func parseBody(c *fiber.Ctx, v interface{}) error {
+	if !strictBody || !strings.HasPrefix(strings.ToLower(string(c.Request().Header.ContentType())), fiber.MIMEApplicationJSON) {
+		return c.BodyParser(v)
+	}
+
+	return decodeJSON(c.Body(), v, true)
+}
+
+// sendParseError sends 422 naming the field for the bodies with unknown fields, and 400 for other malformed bodies.
+func sendParseError(c *fiber.Ctx, err error) error {
+	var unknown *unknownFieldError
+
+	if errors.As(err, &unknown) {
+		return c.Status(http.StatusUnprocessableEntity).JSON(fiber.Map{
+			"error": unknown.Error(),
+			"field": unknown.field,
+		})
+	}
+
+	return c.SendStatus(http.StatusBadRequest)
+}
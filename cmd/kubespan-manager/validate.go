@@ -0,0 +1,144 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"unicode"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+
+	"github.com/talos-systems/kubespan-manager/pkg/types"
+)
+
+// paramValidators validate the route parameters by name.
+var paramValidators = map[string]func(string) error{
+	"cluster": validateClusterID,
+	"node":    validatePublicKey,
+	"other":   validatePublicKey,
+}
+
+// validateParams returns the middleware which validates the cluster ID and the node key route parameters.
+//
+// It should be registered as the first handler of the route, so that the handlers can assume the parameters are valid.
+func validateParams(logger *zap.Logger) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		logger := requestLogger(c, logger)
+
+		for _, param := range c.Route().Params {
+			validator, ok := paramValidators[param]
+			if !ok {
+				continue
+			}
+
+			if err := validator(c.Params(param)); err != nil {
+				logger.Error("bad request parameter",
+					zap.String("method", c.Method()),
+					zap.String("path", c.Path()),
+					zap.String("param", param),
+					zap.String("value", c.Params(param)),
+					zap.Error(err),
+				)
+
+				return c.SendStatus(http.StatusBadRequest)
+			}
+		}
+
+		return c.Next()
+	}
+}
+
+// maxClusterIDLength bounds the length of the opaque and regex cluster IDs.
+const maxClusterIDLength = 128
+
+// clusterIDValidator is the validator of the configured cluster ID format.
+var clusterIDValidator = validateUUID
+
+func validateClusterID(cluster string) error {
+	return clusterIDValidator(cluster)
+}
+
+// newClusterIDValidator builds the cluster ID validator for the format: uuid, opaque or regex.
+func newClusterIDValidator(format, pattern string) (func(string) error, error) {
+	switch format {
+	case "uuid":
+		return validateUUID, nil
+	case "opaque":
+		return validateOpaqueID, nil
+	case "regex":
+		re, err := regexp.Compile("^(?:" + pattern + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid cluster ID pattern: %w", err)
+		}
+
+		return func(cluster string) error {
+			if err := validateOpaqueID(cluster); err != nil {
+				return err
+			}
+
+			if !re.MatchString(cluster) {
+				return fmt.Errorf("cluster ID doesn't match the pattern %q", pattern)
+			}
+
+			return nil
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported cluster ID format %q", format)
+	}
+}
+
+func validateUUID(cluster string) error {
+	if _, err := uuid.Parse(cluster); err != nil {
+		return fmt.Errorf("cluster ID is not a valid UUID: %w", err)
+	}
+
+	return nil
+}
+
+// validateOpaqueID accepts any non-empty bounded string of printable characters.
+//
+// Braces are rejected, as the cluster ID is used as the Redis Cluster hash tag.
+func validateOpaqueID(cluster string) error {
+	if cluster == "" || len(cluster) > maxClusterIDLength {
+		return fmt.Errorf("cluster ID should be between 1 and %d characters long", maxClusterIDLength)
+	}
+
+	for _, r := range cluster {
+		if !unicode.IsPrint(r) || unicode.IsSpace(r) || r == '{' || r == '}' {
+			return fmt.Errorf("cluster ID contains invalid character %q", r)
+		}
+	}
+
+	return nil
+}
+
+func validatePublicKey(key string) error {
+	if _, err := types.NormalizeKey(key); err != nil {
+		return fmt.Errorf("node ID is not a valid wireguard key")
+	}
+
+	return nil
+}
+
+// nodeParam returns the node key route parameter in the canonical form.
+//
+// The parameter is checked by validateParams, so a key in any accepted encoding resolves to the same node.
+func nodeParam(c *fiber.Ctx) string {
+	return keyParam(c, "node")
+}
+
+// keyParam returns the node key route parameter with the given name in the canonical form.
+func keyParam(c *fiber.Ctx, name string) string {
+	key, err := types.NormalizeKey(c.Params(name))
+	if err != nil {
+		return c.Params(name)
+	}
+
+	return key
+}
@@ -0,0 +1,74 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+
+	"github.com/talos-systems/kubespan-manager/internal/db"
+	"github.com/talos-systems/kubespan-manager/pkg/types"
+)
+
+// versionContext returns the request context, making the update conditional if the If-Match header is set.
+//
+// The header carries the node version as returned in the ETag header or the version field of the node.
+func versionContext(c *fiber.Ctx) (context.Context, error) {
+	header := c.Get(fiber.HeaderIfMatch)
+	if header == "" {
+		return requestContext(c), nil
+	}
+
+	version, err := strconv.ParseUint(strings.Trim(strings.TrimPrefix(header, "W/"), `"`), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("bad If-Match header %q: %w", header, err)
+	}
+
+	return db.ExpectVersion(requestContext(c), version), nil
+}
+
+// setETag returns the node version in the ETag header.
+func setETag(c *fiber.Ctx, version uint64) {
+	c.Set(fiber.HeaderETag, strconv.Quote(strconv.FormatUint(version, 10)))
+}
+
+// sendError sends the status for the database error.
+//
+// Version conflicts are returned with the current version, so that the client can refetch and retry.
+func sendError(c *fiber.Ctx, err error) error {
+	var conflict *db.VersionConflictError
+
+	if errors.As(err, &conflict) {
+		setETag(c, conflict.Current)
+
+		return c.Status(http.StatusConflict).JSON(fiber.Map{
+			"error":           db.ErrVersionConflict.Error(),
+			"expectedVersion": conflict.Expected,
+			"currentVersion":  conflict.Current,
+		})
+	}
+
+	return sendDBError(c, err)
+}
+
+// sendValidationError sends 422 with all the problems of the invalid node.
+func sendValidationError(c *fiber.Ctx, err error) error {
+	var verr *types.ValidationError
+
+	if !errors.As(err, &verr) {
+		return c.SendStatus(http.StatusUnprocessableEntity)
+	}
+
+	return c.Status(http.StatusUnprocessableEntity).JSON(fiber.Map{
+		"error":    "invalid node",
+		"problems": verr.Problems,
+	})
+}
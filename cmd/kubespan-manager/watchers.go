@@ -0,0 +1,140 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/talos-systems/kubespan-manager/pkg/types"
+)
+
+var (
+	watchersGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "discovery_cluster_watchers",
+		Help: "Number of clients currently waiting for the changes of the cluster.",
+	}, []string{"cluster"})
+
+	watchersTotal = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "discovery_watchers",
+		Help: "Number of clients currently waiting for the changes of any cluster.",
+	})
+
+	watchersLimit = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "discovery_watchers_limit",
+		Help: "Maximum number of concurrent watchers, globally and per cluster (0 is unlimited).",
+	}, []string{"scope"})
+
+	watcherLag = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "discovery_watcher_lag_revisions",
+		Help:    "Number of cluster revisions a watcher was behind when it picked up the changes.",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 10),
+	})
+
+	// deliveryLatency is not labelled by the cluster, as a histogram per cluster would never be removed
+	deliveryLatency = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "discovery_notification_delivery_seconds",
+		Help:    "Time from the earliest change of a cluster to the delivery of the change notification to the watcher.",
+		Buckets: []float64{0.005, 0.025, 0.1, 0.5, 2.5, 10, 60},
+	})
+)
+
+func init() {
+	prometheus.MustRegister(watchersGauge, watchersTotal, watchersLimit, watcherLag, deliveryLatency)
+}
+
+// watchers tracks the number of long-poll clients per cluster.
+//
+// Clusters without watchers are removed from the gauge to keep its cardinality bounded.
+var watchers = struct {
+	mu     sync.Mutex
+	counts map[string]int
+	total  int
+}{
+	counts: make(map[string]int),
+}
+
+// errTooManyWatchers means that the limit of the concurrent watchers is reached.
+var errTooManyWatchers = errors.New("too many subscriptions")
+
+// setWatcherLimits exports the configured limits of the concurrent watchers.
+func setWatcherLimits() {
+	watchersLimit.WithLabelValues("global").Set(float64(maxSubs))
+	watchersLimit.WithLabelValues("cluster").Set(float64(clusterSubs))
+}
+
+// watcherCount returns the number of the current watchers of the cluster.
+func watcherCount(cluster string) int {
+	watchers.mu.Lock()
+	defer watchers.mu.Unlock()
+
+	return watchers.counts[cluster]
+}
+
+// watchStart registers a watcher of the cluster, the returned function should be called once the watcher is done.
+//
+// It fails with errTooManyWatchers if the global or the per-cluster limit is reached.
+func watchStart(cluster string) (func(), error) {
+	watchers.mu.Lock()
+	defer watchers.mu.Unlock()
+
+	if maxSubs > 0 && watchers.total >= maxSubs {
+		return nil, fmt.Errorf("%w: limit of %d reached", errTooManyWatchers, maxSubs)
+	}
+
+	if clusterSubs > 0 && watchers.counts[cluster] >= clusterSubs {
+		return nil, fmt.Errorf("%w: limit of %d per cluster reached", errTooManyWatchers, clusterSubs)
+	}
+
+	watchers.total++
+	watchers.counts[cluster]++
+	watchersTotal.Set(float64(watchers.total))
+	watchersGauge.WithLabelValues(cluster).Set(float64(watchers.counts[cluster]))
+
+	return func() {
+		watchers.mu.Lock()
+		defer watchers.mu.Unlock()
+
+		watchers.total--
+		watchersTotal.Set(float64(watchers.total))
+
+		watchers.counts[cluster]--
+
+		if watchers.counts[cluster] <= 0 {
+			delete(watchers.counts, cluster)
+			watchersGauge.DeleteLabelValues(cluster)
+
+			return
+		}
+
+		watchersGauge.WithLabelValues(cluster).Set(float64(watchers.counts[cluster]))
+	}, nil
+}
+
+// observeLag records how far behind the watcher with the cursor was.
+//
+// Initial requests and resets are not counted, as the lag is unknown.
+func observeLag(since, cursor uint64, reset bool) {
+	if since == 0 || reset || cursor <= since {
+		return
+	}
+
+	watcherLag.Observe(float64(cursor - since))
+}
+
+// observeDelivery records the delivery latency of the changes.
+//
+// It includes the time spent by the watcher reconnecting, so slow subscribers show up as well as slow notifications.
+func observeDelivery(changes *types.Changes) {
+	if changes.Reset || changes.Changed.IsZero() {
+		return
+	}
+
+	deliveryLatency.Observe(time.Since(changes.Changed).Seconds())
+}
@@ -0,0 +1,177 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"go.uber.org/zap"
+
+	"github.com/talos-systems/kubespan-manager/pkg/types"
+)
+
+const (
+	// webhookTimeout bounds a single webhook delivery.
+	webhookTimeout = 5 * time.Second
+
+	// webhookQueueSize is the number of pending deliveries, the events are dropped once the queue is full.
+	webhookQueueSize = 128
+
+	// webhookAttempts is the number of deliveries of an event before it is dropped.
+	webhookAttempts = 4
+
+	// webhookBackoff is the delay before the first retry, doubled on every retry.
+	webhookBackoff = time.Second
+)
+
+// webhook delivers the events to the URL in the background, on a best-effort basis.
+//
+// Failed deliveries are retried with backoff, events queued meanwhile wait for their turn.
+type webhook struct {
+	url    string
+	logger *zap.Logger
+	client http.Client
+	queue  chan interface{}
+
+	mu     sync.Mutex
+	closed bool
+
+	// done is closed once the queue is drained after close.
+	done chan struct{}
+}
+
+// newWebhook starts the delivery of the events POSTed as JSON to the URL.
+func newWebhook(url, name string, logger *zap.Logger) *webhook {
+	w := &webhook{
+		url:    url,
+		logger: logger.With(zap.String("webhook", name)),
+		client: http.Client{
+			Timeout: webhookTimeout,
+		},
+		queue: make(chan interface{}, webhookQueueSize),
+		done:  make(chan struct{}),
+	}
+
+	go w.run()
+
+	return w
+}
+
+// send queues the event without blocking, the event is dropped if the queue is full.
+func (w *webhook) send(event interface{}) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		w.logger.Warn("webhook is closed, dropping event")
+
+		return
+	}
+
+	select {
+	case w.queue <- event:
+	default:
+		w.logger.Warn("webhook queue is full, dropping event")
+	}
+}
+
+// close stops accepting the events and waits for the queued ones to be delivered until the context is done.
+func (w *webhook) close(ctx context.Context) {
+	w.mu.Lock()
+
+	if !w.closed {
+		w.closed = true
+
+		close(w.queue)
+	}
+
+	w.mu.Unlock()
+
+	select {
+	case <-w.done:
+	case <-ctx.Done():
+		w.logger.Warn("webhook queue was not drained on shutdown, dropping events", zap.Int("pending", len(w.queue)))
+	}
+}
+
+func (w *webhook) run() {
+	defer close(w.done)
+
+	for event := range w.queue {
+		backoff := webhookBackoff
+
+		for attempt := 1; ; attempt++ {
+			err := w.deliver(event)
+			if err == nil {
+				break
+			}
+
+			if attempt == webhookAttempts {
+				w.logger.Warn("webhook delivery failed, dropping event", zap.Int("attempts", attempt), zap.Error(err))
+
+				break
+			}
+
+			w.logger.Debug("webhook delivery failed, retrying", zap.Int("attempt", attempt), zap.Duration("backoff", backoff), zap.Error(err))
+
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+}
+
+func (w *webhook) deliver(event interface{}) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	resp, err := w.client.Post(w.url, "application/json", bytes.NewReader(body)) //nolint:noctx
+	if err != nil {
+		return err
+	}
+
+	resp.Body.Close() //nolint:errcheck
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// onNodeJoin reports the new nodes of the comma-separated clusters (of all clusters if empty) to the webhook.
+func onNodeJoin(hook *webhook, clusters string) func(cluster string, n *types.Node) {
+	var filter map[string]struct{}
+
+	if clusters != "" {
+		filter = map[string]struct{}{}
+
+		for _, cluster := range strings.Split(clusters, ",") {
+			filter[strings.TrimSpace(cluster)] = struct{}{}
+		}
+	}
+
+	return func(cluster string, n *types.Node) {
+		if filter != nil {
+			if _, ok := filter[cluster]; !ok {
+				return
+			}
+		}
+
+		hook.send(fiber.Map{
+			"cluster": cluster,
+			"node":    n,
+		})
+	}
+}
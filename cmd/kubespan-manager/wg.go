@@ -0,0 +1,201 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/gofiber/fiber/v2"
+	"go.uber.org/zap"
+
+	"github.com/talos-systems/kubespan-manager/internal/db"
+	"github.com/talos-systems/kubespan-manager/pkg/types"
+)
+
+// defaultWireguardPort is used for the endpoints reported without the port.
+const defaultWireguardPort = 51820
+
+// wgPeer is the Wireguard peer entry of a node.
+type wgPeer struct {
+	PublicKey  string   `json:"publicKey"`
+	AllowedIPs []string `json:"allowedIPs"`
+	Endpoint   string   `json:"endpoint,omitempty"`
+	// Name is not part of the Wireguard config, it is returned for reference only.
+	Name string `json:"name,omitempty"`
+}
+
+// bestEndpoint picks the endpoint of the node: the address with the highest priority,
+// preferring the address family requested by the node among the addresses with the same priority.
+//
+// Addresses of the node are kept sorted by priority.
+// Wireguard endpoints are host:port, so the SRV services are skipped, they are resolved by the clients.
+func bestEndpoint(n *types.Node) *types.Address {
+	var best *types.Address
+
+	for _, addr := range n.Addresses {
+		if addr.Kind() == types.AddressKindSRV {
+			continue
+		}
+
+		if best == nil {
+			best = addr
+		}
+
+		if addr.Priority != best.Priority {
+			break
+		}
+
+		if addr.InFamily(n.AddressFamilyPreference) {
+			return addr
+		}
+	}
+
+	return best
+}
+
+// peerOf builds the Wireguard peer entry of the node.
+func peerOf(n *types.Node) *wgPeer {
+	peer := &wgPeer{
+		PublicKey:  n.ID,
+		AllowedIPs: []string{},
+		Name:       n.Name,
+	}
+
+	if !n.IP.IsZero() {
+		peer.AllowedIPs = append(peer.AllowedIPs, n.IP.String()+"/"+strconv.Itoa(int(n.IP.BitLen())))
+	}
+
+	if addr := bestEndpoint(n); addr != nil {
+		host := addr.Host()
+
+		port := addr.Port
+		if port == 0 {
+			port = defaultWireguardPort
+		}
+
+		peer.Endpoint = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	}
+
+	return peer
+}
+
+// dropControl drops the control characters in strings.Map.
+func dropControl(r rune) rune {
+	if unicode.IsControl(r) {
+		return -1
+	}
+
+	return r
+}
+
+// formatPeers renders the peers as the [Peer] sections of the wg-quick config.
+func formatPeers(peers []*wgPeer) string {
+	var b strings.Builder
+
+	for i, peer := range peers {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+
+		// names stored before they were validated might still carry line breaks, which would inject config lines
+		if name := strings.Map(dropControl, peer.Name); name != "" {
+			fmt.Fprintf(&b, "# %s\n", name)
+		}
+
+		fmt.Fprintf(&b, "[Peer]\nPublicKey = %s\n", peer.PublicKey)
+
+		if len(peer.AllowedIPs) > 0 {
+			fmt.Fprintf(&b, "AllowedIPs = %s\n", strings.Join(peer.AllowedIPs, ", "))
+		}
+
+		if peer.Endpoint != "" {
+			fmt.Fprintf(&b, "Endpoint = %s\n", peer.Endpoint)
+		}
+	}
+
+	return b.String()
+}
+
+// wgConfig handles GET /:cluster/:node/wg, returning the other nodes of the cluster as Wireguard peers.
+//
+// Peers are returned as JSON, or as wg-quick [Peer] sections if text/plain is accepted.
+// Address filters (e.g. ?family=) apply before the endpoint selection.
+func wgConfig(logger *zap.Logger) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		logger := requestLogger(c, logger)
+
+		cluster, node := c.Params("cluster"), nodeParam(c)
+
+		addrFilter, err := parseAddressFilter(c)
+		if err != nil {
+			logger.Error("bad address filter",
+				zap.String("cluster", cluster),
+				zap.Error(err),
+			)
+
+			return c.SendStatus(http.StatusBadRequest)
+		}
+
+		if _, err = nodeDB.Get(requestContext(c), cluster, node); err != nil {
+			if errors.Is(err, db.ErrNotFound) {
+				logger.Warn("node not found",
+					zap.String("cluster", cluster),
+					zap.String("node", node),
+					zap.Error(err),
+				)
+
+				return c.SendStatus(http.StatusNotFound)
+			}
+
+			logger.Error("failed to get node",
+				zap.String("cluster", cluster),
+				zap.String("node", node),
+				zap.Error(err),
+			)
+
+			return sendDBError(c, err)
+		}
+
+		list, err := nodeDB.List(requestContext(c), cluster)
+		if err != nil {
+			logger.Error("failed to list nodes",
+				zap.String("cluster", cluster),
+				zap.Error(err),
+			)
+
+			return sendDBError(c, err)
+		}
+
+		peers := make([]*wgPeer, 0, len(list))
+
+		for _, n := range list {
+			if n.ID == node {
+				continue
+			}
+
+			peers = append(peers, peerOf(addrFilter.node(n)))
+		}
+
+		// stable order, so that the config doesn't change unless the peers do
+		sort.Slice(peers, func(i, j int) bool {
+			return peers[i].PublicKey < peers[j].PublicKey
+		})
+
+		if c.Accepts(fiber.MIMEApplicationJSON, fiber.MIMETextPlain) == fiber.MIMETextPlain {
+			c.Set(fiber.HeaderContentType, fiber.MIMETextPlainCharsetUTF8)
+
+			return c.SendString(formatPeers(peers))
+		}
+
+		return c.JSON(peers)
+	}
+}
@@ -0,0 +1,19 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"github.com/gofiber/fiber/v2"
+)
+
+// whoami returns the IP address of the client as seen by the service.
+//
+// Agents behind NAT use it as the reflexive address to register as one of their endpoints.
+// The address respects the trusted proxies, see clientIP.
+func whoami(c *fiber.Ctx) error {
+	return c.JSON(fiber.Map{
+		"ip": clientIP(c),
+	})
+}
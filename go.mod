@@ -3,10 +3,13 @@ module github.com/talos-systems/kubespan-manager
 go 1.16
 
 require (
+	github.com/alicebob/miniredis/v2 v2.14.3
 	github.com/go-redis/redis/v8 v8.11.2
 	github.com/gofiber/fiber/v2 v2.8.0
 	github.com/google/uuid v1.3.0
+	github.com/prometheus/client_golang v1.11.0
 	go.uber.org/zap v1.16.0
 	golang.zx2c4.com/wireguard/wgctrl v0.0.0-20210803171230-4253848d036c
+	google.golang.org/protobuf v1.26.0-rc.1
 	inet.af/netaddr v0.0.0-20210525141459-c0eff8545de6
 )
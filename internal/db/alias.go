@@ -0,0 +1,259 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/talos-systems/kubespan-manager/pkg/types"
+)
+
+// ErrAliasConflict is returned when the cluster can't become an alias.
+var ErrAliasConflict = errors.New("cluster can't be aliased")
+
+// maxAliasHops bounds the resolution of the aliases pointing at other aliases.
+const maxAliasHops = 4
+
+// aliasDB redirects the operations on the alias cluster IDs to the target clusters.
+//
+// Aliases let a re-provisioned cluster with a new ID keep the peers registered under the old ID.
+// The alias table is kept by the backend, so that all the replicas sharing the backend see the aliases.
+type aliasDB struct {
+	DB
+}
+
+// NewAliases wraps the backend with the redirection of the cluster aliases.
+//
+// Every cluster operation resolves the alias first, which is an extra backend read.
+func NewAliases(backend DB) DB {
+	return &aliasDB{
+		DB: backend,
+	}
+}
+
+// resolve returns the cluster the ID points at, following the chain of the aliases.
+func (d *aliasDB) resolve(ctx context.Context, cluster string) (string, error) {
+	for i := 0; i < maxAliasHops; i++ {
+		target, err := d.DB.ResolveAlias(ctx, cluster)
+		if err != nil {
+			return "", err
+		}
+
+		if target == "" {
+			return cluster, nil
+		}
+
+		cluster = target
+	}
+
+	return "", fmt.Errorf("alias chain of cluster %q is longer than %d", cluster, maxAliasHops)
+}
+
+// ResolveAlias implements DB.
+func (d *aliasDB) ResolveAlias(ctx context.Context, cluster string) (string, error) {
+	target, err := d.resolve(ctx, cluster)
+	if err != nil || target == cluster {
+		return "", err
+	}
+
+	return target, nil
+}
+
+// SetAlias implements DB.
+//
+// The alias is stored pointing at the final target, and it can't be set on a cluster which has nodes.
+func (d *aliasDB) SetAlias(ctx context.Context, alias, target string) error {
+	if target == "" {
+		return d.DB.SetAlias(ctx, alias, "")
+	}
+
+	target, err := d.resolve(ctx, target)
+	if err != nil {
+		return err
+	}
+
+	if target == alias {
+		return fmt.Errorf("%w: cluster %q can't be an alias of itself", ErrAliasConflict, alias)
+	}
+
+	count, err := d.DB.Count(ctx, alias)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+
+	if count > 0 {
+		return fmt.Errorf("%w: cluster %q has %d nodes", ErrAliasConflict, alias, count)
+	}
+
+	return d.DB.SetAlias(ctx, alias, target)
+}
+
+// Add implements DB.
+func (d *aliasDB) Add(ctx context.Context, cluster string, n *types.Node) error {
+	cluster, err := d.resolve(ctx, cluster)
+	if err != nil {
+		return err
+	}
+
+	return d.DB.Add(ctx, cluster, n)
+}
+
+// Replace implements DB.
+func (d *aliasDB) Replace(ctx context.Context, cluster string, n *types.Node) error {
+	cluster, err := d.resolve(ctx, cluster)
+	if err != nil {
+		return err
+	}
+
+	return d.DB.Replace(ctx, cluster, n)
+}
+
+// AddAddresses implements DB.
+func (d *aliasDB) AddAddresses(ctx context.Context, cluster, id string, ep ...*types.Address) error {
+	cluster, err := d.resolve(ctx, cluster)
+	if err != nil {
+		return err
+	}
+
+	return d.DB.AddAddresses(ctx, cluster, id, ep...)
+}
+
+// RemoveAddress implements DB.
+func (d *aliasDB) RemoveAddress(ctx context.Context, cluster, id string, addr *types.Address) error {
+	cluster, err := d.resolve(ctx, cluster)
+	if err != nil {
+		return err
+	}
+
+	return d.DB.RemoveAddress(ctx, cluster, id, addr)
+}
+
+// Pin implements DB.
+func (d *aliasDB) Pin(ctx context.Context, cluster, id string, sticky bool) error {
+	cluster, err := d.resolve(ctx, cluster)
+	if err != nil {
+		return err
+	}
+
+	return d.DB.Pin(ctx, cluster, id, sticky)
+}
+
+// Touch implements DB.
+func (d *aliasDB) Touch(ctx context.Context, cluster, id string) error {
+	cluster, err := d.resolve(ctx, cluster)
+	if err != nil {
+		return err
+	}
+
+	return d.DB.Touch(ctx, cluster, id)
+}
+
+// Changes implements DB.
+func (d *aliasDB) Changes(ctx context.Context, cluster string, since uint64) (*types.Changes, error) {
+	cluster, err := d.resolve(ctx, cluster)
+	if err != nil {
+		return nil, err
+	}
+
+	return d.DB.Changes(ctx, cluster, since)
+}
+
+// ClusterConfig implements DB.
+func (d *aliasDB) ClusterConfig(ctx context.Context, cluster string) (*types.ClusterConfig, error) {
+	cluster, err := d.resolve(ctx, cluster)
+	if err != nil {
+		return nil, err
+	}
+
+	return d.DB.ClusterConfig(ctx, cluster)
+}
+
+// SetClusterConfig implements DB.
+func (d *aliasDB) SetClusterConfig(ctx context.Context, cluster string, cfg *types.ClusterConfig) error {
+	cluster, err := d.resolve(ctx, cluster)
+	if err != nil {
+		return err
+	}
+
+	return d.DB.SetClusterConfig(ctx, cluster, cfg)
+}
+
+// DeleteCluster implements DB.
+//
+// Deleting an alias removes the alias only, the target cluster is kept.
+func (d *aliasDB) DeleteCluster(ctx context.Context, cluster string) (int, error) {
+	target, err := d.DB.ResolveAlias(ctx, cluster)
+	if err != nil {
+		return 0, err
+	}
+
+	if target != "" {
+		return 0, d.DB.SetAlias(ctx, cluster, "")
+	}
+
+	return d.DB.DeleteCluster(ctx, cluster)
+}
+
+// DeleteNodes implements DB.
+func (d *aliasDB) DeleteNodes(ctx context.Context, cluster string, selector map[string]string) ([]string, error) {
+	cluster, err := d.resolve(ctx, cluster)
+	if err != nil {
+		return nil, err
+	}
+
+	return d.DB.DeleteNodes(ctx, cluster, selector)
+}
+
+// Get implements DB.
+func (d *aliasDB) Get(ctx context.Context, cluster, id string) (*types.Node, error) {
+	cluster, err := d.resolve(ctx, cluster)
+	if err != nil {
+		return nil, err
+	}
+
+	return d.DB.Get(ctx, cluster, id)
+}
+
+// List implements DB.
+func (d *aliasDB) List(ctx context.Context, cluster string) ([]*types.Node, error) {
+	cluster, err := d.resolve(ctx, cluster)
+	if err != nil {
+		return nil, err
+	}
+
+	return d.DB.List(ctx, cluster)
+}
+
+// Walk implements DB.
+func (d *aliasDB) Walk(ctx context.Context, cluster string, fn func(n *types.Node) error) error {
+	cluster, err := d.resolve(ctx, cluster)
+	if err != nil {
+		return err
+	}
+
+	return d.DB.Walk(ctx, cluster, fn)
+}
+
+// Count implements DB.
+func (d *aliasDB) Count(ctx context.Context, cluster string) (int, error) {
+	cluster, err := d.resolve(ctx, cluster)
+	if err != nil {
+		return 0, err
+	}
+
+	return d.DB.Count(ctx, cluster)
+}
+
+// Summarize implements DB.
+func (d *aliasDB) Summarize(ctx context.Context, cluster string) (*types.ClusterSummary, error) {
+	cluster, err := d.resolve(ctx, cluster)
+	if err != nil {
+		return nil, err
+	}
+
+	return d.DB.Summarize(ctx, cluster)
+}
@@ -0,0 +1,256 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package db
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/talos-systems/kubespan-manager/pkg/types"
+)
+
+// cacheSize is the maximum number of clusters kept in the cache.
+const cacheSize = 1024
+
+var (
+	cacheHits = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "discovery_db_cache_hits_total",
+		Help: "Number of database reads served from the cache.",
+	}, []string{"op"})
+
+	cacheMisses = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "discovery_db_cache_misses_total",
+		Help: "Number of database reads which missed the cache.",
+	}, []string{"op"})
+)
+
+func init() {
+	prometheus.MustRegister(cacheHits, cacheMisses)
+}
+
+// cachedDB is a read-through cache in front of another DB.
+//
+// Get and List results are cached per cluster for a short TTL, any mutation of a cluster invalidates its entry.
+// All other methods are passed through to the backend.
+type cachedDB struct {
+	DB
+
+	ttl time.Duration
+
+	mu       sync.Mutex
+	lru      *list.List
+	clusters map[string]*list.Element
+}
+
+// cacheEntry keeps the cached reads of a single cluster.
+type cacheEntry struct {
+	cluster string
+
+	list        []*types.Node
+	listExpires time.Time
+
+	nodes map[string]cachedNode
+}
+
+type cachedNode struct {
+	node    *types.Node
+	expires time.Time
+}
+
+// NewCached wraps the backend with a read-through cache with the given TTL.
+func NewCached(backend DB, ttl time.Duration) DB {
+	return &cachedDB{
+		DB:       backend,
+		ttl:      ttl,
+		lru:      list.New(),
+		clusters: make(map[string]*list.Element),
+	}
+}
+
+// entry returns the cache entry of the cluster, creating it and evicting the least recently used ones as needed.
+//
+// It should be called with the lock held.
+func (d *cachedDB) entry(cluster string) *cacheEntry {
+	if el, ok := d.clusters[cluster]; ok {
+		d.lru.MoveToFront(el)
+
+		return el.Value.(*cacheEntry) //nolint:forcetypeassert
+	}
+
+	e := &cacheEntry{
+		cluster: cluster,
+		nodes:   make(map[string]cachedNode),
+	}
+
+	d.clusters[cluster] = d.lru.PushFront(e)
+
+	for d.lru.Len() > cacheSize {
+		oldest := d.lru.Back()
+
+		d.lru.Remove(oldest)
+		delete(d.clusters, oldest.Value.(*cacheEntry).cluster) //nolint:forcetypeassert
+	}
+
+	return e
+}
+
+func (d *cachedDB) invalidate(cluster string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if el, ok := d.clusters[cluster]; ok {
+		d.lru.Remove(el)
+		delete(d.clusters, cluster)
+	}
+}
+
+func (d *cachedDB) invalidateAll() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.lru.Init()
+	d.clusters = make(map[string]*list.Element)
+}
+
+// Add implements DB.
+func (d *cachedDB) Add(ctx context.Context, cluster string, n *types.Node) error {
+	defer d.invalidate(cluster)
+
+	return d.DB.Add(ctx, cluster, n)
+}
+
+// Replace implements DB.
+func (d *cachedDB) Replace(ctx context.Context, cluster string, n *types.Node) error {
+	defer d.invalidate(cluster)
+
+	return d.DB.Replace(ctx, cluster, n)
+}
+
+// AddAddresses implements DB.
+func (d *cachedDB) AddAddresses(ctx context.Context, cluster, id string, ep ...*types.Address) error {
+	defer d.invalidate(cluster)
+
+	return d.DB.AddAddresses(ctx, cluster, id, ep...)
+}
+
+// RemoveAddress implements DB.
+func (d *cachedDB) RemoveAddress(ctx context.Context, cluster, id string, addr *types.Address) error {
+	defer d.invalidate(cluster)
+
+	return d.DB.RemoveAddress(ctx, cluster, id, addr)
+}
+
+// Pin implements DB.
+func (d *cachedDB) Pin(ctx context.Context, cluster, id string, sticky bool) error {
+	defer d.invalidate(cluster)
+
+	return d.DB.Pin(ctx, cluster, id, sticky)
+}
+
+// DeleteCluster implements DB.
+func (d *cachedDB) DeleteCluster(ctx context.Context, cluster string) (int, error) {
+	defer d.invalidate(cluster)
+
+	return d.DB.DeleteCluster(ctx, cluster)
+}
+
+// DeleteNodes implements DB.
+func (d *cachedDB) DeleteNodes(ctx context.Context, cluster string, selector map[string]string) ([]string, error) {
+	defer d.invalidate(cluster)
+
+	return d.DB.DeleteNodes(ctx, cluster, selector)
+}
+
+// SetClusterConfig implements DB.
+func (d *cachedDB) SetClusterConfig(ctx context.Context, cluster string, cfg *types.ClusterConfig) error {
+	defer d.invalidate(cluster)
+
+	return d.DB.SetClusterConfig(ctx, cluster, cfg)
+}
+
+// Clean implements DB.
+func (d *cachedDB) Clean() *CleanReport {
+	defer d.invalidateAll()
+
+	return d.DB.Clean()
+}
+
+// store updates the cache entry if it was not invalidated while the backend was queried.
+func (d *cachedDB) store(cluster string, e *cacheEntry, update func(e *cacheEntry)) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if el, ok := d.clusters[cluster]; ok && el.Value == e {
+		update(e)
+	}
+}
+
+// Get implements DB.
+func (d *cachedDB) Get(ctx context.Context, cluster, id string) (*types.Node, error) {
+	d.mu.Lock()
+
+	e := d.entry(cluster)
+
+	if cached, ok := e.nodes[id]; ok && time.Now().Before(cached.expires) {
+		d.mu.Unlock()
+
+		cacheHits.WithLabelValues("get").Inc()
+
+		return cached.node, nil
+	}
+
+	d.mu.Unlock()
+
+	cacheMisses.WithLabelValues("get").Inc()
+
+	n, err := d.DB.Get(ctx, cluster, id)
+	if err != nil {
+		return nil, err
+	}
+
+	d.store(cluster, e, func(e *cacheEntry) {
+		e.nodes[id] = cachedNode{
+			node:    n,
+			expires: time.Now().Add(d.ttl),
+		}
+	})
+
+	return n, nil
+}
+
+// List implements DB.
+func (d *cachedDB) List(ctx context.Context, cluster string) ([]*types.Node, error) {
+	d.mu.Lock()
+
+	e := d.entry(cluster)
+
+	if e.list != nil && time.Now().Before(e.listExpires) {
+		d.mu.Unlock()
+
+		cacheHits.WithLabelValues("list").Inc()
+
+		return e.list, nil
+	}
+
+	d.mu.Unlock()
+
+	cacheMisses.WithLabelValues("list").Inc()
+
+	list, err := d.DB.List(ctx, cluster)
+	if err != nil {
+		return nil, err
+	}
+
+	d.store(cluster, e, func(e *cacheEntry) {
+		e.list = list
+		e.listExpires = time.Now().Add(d.ttl)
+	})
+
+	return list, nil
+}
@@ -0,0 +1,76 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package db
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/talos-systems/kubespan-manager/pkg/types"
+)
+
+// Codec is the serialization format of the stored nodes.
+//
+// The stored nodes are decoded on every list and every change notification, so the codec affects the cost
+// of the read paths. The format of the HTTP API doesn't depend on the codec.
+type Codec string
+
+// Supported codecs.
+const (
+	// CodecJSON stores the nodes as JSON, the same way they are returned by the API.
+	CodecJSON Codec = "json"
+
+	// CodecProto stores the nodes in the protobuf encoding of types.proto, which is smaller and faster to decode.
+	CodecProto Codec = "proto"
+)
+
+// protoMagic prefixes the protobuf payloads, it never starts a JSON document or a gzip stream.
+var protoMagic = []byte{0x00, 'p'}
+
+// ParseCodec parses the codec name, empty name is parsed as JSON.
+func ParseCodec(s string) (Codec, error) {
+	switch c := Codec(s); c {
+	case "", CodecJSON:
+		return CodecJSON, nil
+	case CodecProto:
+		return c, nil
+	default:
+		return "", fmt.Errorf("unsupported codec %q", s)
+	}
+}
+
+func (c Codec) marshal(n *types.Node) ([]byte, error) {
+	if c == CodecProto {
+		data, err := n.MarshalProto()
+		if err != nil {
+			return nil, err
+		}
+
+		return append(append([]byte(nil), protoMagic...), data...), nil
+	}
+
+	return n.MarshalBinary()
+}
+
+// unmarshalNode decodes the node in any of the codecs, the codec is detected by the payload header.
+//
+// Detection allows the payloads of both codecs to coexist while the codec setting is being changed.
+func unmarshalNode(data []byte) (*types.Node, error) {
+	n := new(types.Node)
+
+	if bytes.HasPrefix(data, protoMagic) {
+		if err := n.UnmarshalProto(data[len(protoMagic):]); err != nil {
+			return nil, err
+		}
+
+		return n, nil
+	}
+
+	if err := n.UnmarshalBinary(data); err != nil {
+		return nil, err
+	}
+
+	return n, nil
+}
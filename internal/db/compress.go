@@ -0,0 +1,95 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package db
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/talos-systems/kubespan-manager/pkg/types"
+)
+
+// gzipMagic is the header of gzip streams, it never starts a JSON document.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// Compressors are reused across the calls, as allocating them dominates the cost of encoding a node.
+//
+// Pooled objects never escape encodeNode/decodeNode: the returned payloads are written to fresh buffers.
+var (
+	gzipWriters sync.Pool
+	gzipReaders sync.Pool
+)
+
+// encodeNode serializes the node with the codec, optionally compressing it.
+func encodeNode(n *types.Node, codec Codec, compress bool) ([]byte, error) {
+	data, err := codec.marshal(n)
+	if err != nil {
+		return nil, err
+	}
+
+	if !compress {
+		return data, nil
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, len(data)/2))
+
+	zw, ok := gzipWriters.Get().(*gzip.Writer)
+	if ok {
+		zw.Reset(buf)
+	} else {
+		zw = gzip.NewWriter(buf)
+	}
+
+	defer gzipWriters.Put(zw)
+
+	if _, err = zw.Write(data); err != nil {
+		return nil, err
+	}
+
+	if err = zw.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// decodeNode deserializes the node, compressed payloads are detected by the gzip header.
+//
+// Detection allows both compressed and plain payloads to coexist while the compression setting is being changed.
+func decodeNode(data []byte) (*types.Node, error) {
+	if bytes.HasPrefix(data, gzipMagic) {
+		var err error
+
+		if data, err = decompress(data); err != nil {
+			return nil, fmt.Errorf("failed to decompress node: %w", err)
+		}
+	}
+
+	return unmarshalNode(data)
+}
+
+func decompress(data []byte) ([]byte, error) {
+	zr, ok := gzipReaders.Get().(*gzip.Reader)
+	if ok {
+		if err := zr.Reset(bytes.NewReader(data)); err != nil {
+			gzipReaders.Put(zr)
+
+			return nil, err
+		}
+	} else {
+		var err error
+
+		if zr, err = gzip.NewReader(bytes.NewReader(data)); err != nil {
+			return nil, err
+		}
+	}
+
+	defer gzipReaders.Put(zr)
+
+	return io.ReadAll(zr)
+}
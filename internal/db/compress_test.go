@@ -0,0 +1,153 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package db
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"inet.af/netaddr"
+
+	"github.com/talos-systems/kubespan-manager/pkg/types"
+)
+
+func benchNode() *types.Node {
+	n := &types.Node{
+		Name: "worker-1.example.com",
+		ID:   "IHOPEfmiUG1kE832FAxm77J5WP0O1ZHp9OwqbGowL1E=",
+		IP:   netaddr.MustParseIP("fd50:8d60:4238:6302:f857:23ff:fe21:d1e0"),
+		Labels: map[string]string{
+			"topology.kubernetes.io/zone": "us-east-1a",
+		},
+	}
+
+	for i := 0; i < 16; i++ {
+		n.AddAddresses(&types.Address{
+			IP:   netaddr.MustParseIP(fmt.Sprintf("10.5.%d.%d", i, i+1)),
+			Port: 51820,
+		})
+	}
+
+	return n
+}
+
+var codecs = []Codec{CodecJSON, CodecProto}
+
+func TestEncodeNode(t *testing.T) {
+	n := benchNode()
+
+	for _, codec := range codecs {
+		for _, compress := range []bool{false, true} {
+			data, err := encodeNode(n, codec, compress)
+			if err != nil {
+				t.Fatalf("failed to encode node: %s", err)
+			}
+
+			decoded, err := decodeNode(data)
+			if err != nil {
+				t.Fatalf("failed to decode node: %s", err)
+			}
+
+			if decoded.ID != n.ID || decoded.Name != n.Name || decoded.IP != n.IP ||
+				len(decoded.Addresses) != len(n.Addresses) || decoded.Labels["topology.kubernetes.io/zone"] != "us-east-1a" {
+				t.Errorf("node mismatch after round trip (codec %s, compress %v): %+v", codec, compress, decoded)
+			}
+		}
+	}
+}
+
+// TestEncodeNodeConcurrent checks that the pooled compressors don't leak data between the calls, run with -race.
+func TestEncodeNodeConcurrent(t *testing.T) {
+	var wg sync.WaitGroup
+
+	for i := 0; i < 8; i++ {
+		i := i
+
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			n := benchNode()
+			n.Name = fmt.Sprintf("worker-%d", i)
+
+			for j := 0; j < 100; j++ {
+				data, err := encodeNode(n, CodecJSON, true)
+				if err != nil {
+					t.Errorf("failed to encode node: %s", err)
+
+					return
+				}
+
+				decoded, err := decodeNode(data)
+				if err != nil {
+					t.Errorf("failed to decode node: %s", err)
+
+					return
+				}
+
+				if decoded.Name != n.Name {
+					t.Errorf("decoded node %q, expected %q", decoded.Name, n.Name)
+
+					return
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+}
+
+// BenchmarkEncodeNode reports the stored payload size along with the encoding cost.
+func BenchmarkEncodeNode(b *testing.B) {
+	n := benchNode()
+
+	for _, codec := range codecs {
+		for _, compress := range []bool{false, true} {
+			codec, compress := codec, compress
+
+			b.Run(fmt.Sprintf("codec=%s/compress=%v", codec, compress), func(b *testing.B) {
+				b.ReportAllocs()
+
+				var size int
+
+				for i := 0; i < b.N; i++ {
+					data, err := encodeNode(n, codec, compress)
+					if err != nil {
+						b.Fatal(err)
+					}
+
+					size = len(data)
+				}
+
+				b.ReportMetric(float64(size), "stored-bytes")
+			})
+		}
+	}
+}
+
+func BenchmarkDecodeNode(b *testing.B) {
+	n := benchNode()
+
+	for _, codec := range codecs {
+		for _, compress := range []bool{false, true} {
+			data, err := encodeNode(n, codec, compress)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			b.Run(fmt.Sprintf("codec=%s/compress=%v", codec, compress), func(b *testing.B) {
+				b.ReportAllocs()
+
+				for i := 0; i < b.N; i++ {
+					if _, err := decodeNode(data); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,25 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package db
+
+import (
+	"context"
+
+	"go.uber.org/zap"
+)
+
+// CorrelationIDKey is the context key of the request correlation ID.
+//
+// The key is a string, as the fasthttp request context only exposes string-keyed user values via context.Context.
+const CorrelationIDKey = "discovery-correlation-id"
+
+// requestLogger returns the logger annotated with the correlation ID of the request, if any.
+func requestLogger(ctx context.Context, logger *zap.Logger) *zap.Logger {
+	if id, ok := ctx.Value(CorrelationIDKey).(string); ok && id != "" {
+		return logger.With(zap.String("correlation_id", id))
+	}
+
+	return logger
+}
@@ -6,12 +6,15 @@
 package db
 
 import (
+	"container/list"
 	"context"
 	"errors"
 	"fmt"
+	"sort"
 	"sync"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"go.uber.org/zap"
 
 	"github.com/talos-systems/kubespan-manager/pkg/types"
@@ -20,39 +23,541 @@ import (
 // ErrNotFound means that record is not found in DB.
 var ErrNotFound = errors.New("not found")
 
+// ErrUnavailable means that the storage backend is temporarily unreachable.
+var ErrUnavailable = errors.New("backend unavailable")
+
+// ErrTimeout means that the storage backend operation did not complete in time.
+var ErrTimeout = errors.New("backend operation timed out")
+
+// ErrClusterFull means that the cluster reached the maximum number of nodes.
+var ErrClusterFull = errors.New("cluster is full")
+
+// ErrKeyNotAllowed means that the node key is not allowed to register.
+var ErrKeyNotAllowed = errors.New("node key is not allowed")
+
+// ErrTooManyClusters means that the maximum number of clusters is reached and none of them can be evicted.
+var ErrTooManyClusters = errors.New("too many clusters")
+
+// clusterEvictionGrace protects recently active clusters from the eviction.
+const clusterEvictionGrace = time.Minute
+
+var evictedClusters = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "discovery_db_evicted_clusters_total",
+	Help: "Number of in-memory clusters evicted to stay within the clusters limit.",
+})
+
+var emptyClusters = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "discovery_db_empty_clusters_removed_total",
+	Help: "Number of clusters removed by the cleanup after their last node expired.",
+})
+
+var collectedNodes = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "discovery_db_gc_removed_nodes_total",
+	Help: "Number of expired in-memory nodes removed by the cleanup.",
+})
+
+func init() {
+	prometheus.MustRegister(evictedClusters, emptyClusters, collectedNodes)
+}
+
+// NodeCounter is implemented by the backends which count their nodes cheaply.
+type NodeCounter interface {
+	// NodeCount returns the number of the stored nodes, including the expired ones not cleaned up yet.
+	NodeCount() int
+}
+
+// NewNodesGauge returns the gauge of the number of the nodes, counted at the scrape time.
+func NewNodesGauge(counter NodeCounter) prometheus.GaugeFunc {
+	return prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "discovery_db_nodes",
+		Help: "Number of in-memory nodes.",
+	}, func() float64 {
+		return float64(counter.NodeCount())
+	})
+}
+
 // AddressExpirationTimeout is the amount of time after which addresses of a node should be expired.
 const AddressExpirationTimeout = 10 * time.Minute
 
 // DB manager state persistent storage interface.
 type DB interface {
 	// Add adds a set of known Endpoints to a node, creating the node, if it does not exist.
+	//
+	// If the node exists, its IP and metadata are updated and the addresses are merged with the known ones.
 	Add(ctx context.Context, cluster string, n *types.Node) error
 
+	// Replace stores the node as is, replacing any existing node with the same ID.
+	Replace(ctx context.Context, cluster string, n *types.Node) error
+
 	// AddAddresses adds a set of addresses for a node.
 	AddAddresses(ctx context.Context, cluster, id string, ep ...*types.Address) error
 
-	// Clean executes a database cleanup routine.
-	Clean()
+	// Changes returns the changes of the cluster after the given cursor.
+	//
+	// Cursor 0 returns all the nodes of the cluster.
+	// If the changes after the cursor are no longer known, a full snapshot is returned with the Reset flag set.
+	// If nothing changed after the cursor, Changes blocks until a change happens or the context is canceled;
+	// in the latter case empty changes are returned.
+	Changes(ctx context.Context, cluster string, since uint64) (*types.Changes, error)
+
+	// Clean executes a database cleanup routine, returning the summary of the removed entries.
+	//
+	// It is safe to call Clean concurrently with the other operations and with itself.
+	Clean() *CleanReport
+
+	// ClusterConfig returns the per-cluster overrides, nil if there are none.
+	ClusterConfig(ctx context.Context, cluster string) (*types.ClusterConfig, error)
+
+	// SetClusterConfig stores the per-cluster overrides.
+	//
+	// Overrides are consulted when adding nodes and expiring addresses.
+	SetClusterConfig(ctx context.Context, cluster string, cfg *types.ClusterConfig) error
+
+	// DeleteCluster removes all the nodes of the cluster, returning the number of removed nodes.
+	DeleteCluster(ctx context.Context, cluster string) (int, error)
+
+	// DeleteNodes removes the nodes of the cluster matching all the labels of the selector, returning the IDs
+	// of the removed nodes.
+	//
+	// The nodes are removed at once: either all of them or none, sticky nodes are removed as well.
+	// Removals are reported to the subscribers like the expired nodes.
+	DeleteNodes(ctx context.Context, cluster string, selector map[string]string) ([]string, error)
+
+	// ForEachCluster calls fn for every cluster with the list of its nodes, one cluster at a time.
+	ForEachCluster(ctx context.Context, fn func(cluster string, nodes []*types.Node) error) error
 
 	// Get returns the details of the node.
 	Get(ctx context.Context, cluster, id string) (*types.Node, error)
 
 	// List returns the set of Nodes for the given Cluster.
 	List(ctx context.Context, cluster string) ([]*types.Node, error)
+
+	// Walk calls fn for every Node of the Cluster ordered by the ID, as the nodes are read from the backend.
+	//
+	// Unlike List, the Cluster is never copied as a whole; the nodes passed to fn are copies fn might keep.
+	// Walk stops at the first error returned by fn, and fails with ErrNotFound if the Cluster doesn't exist.
+	Walk(ctx context.Context, cluster string, fn func(n *types.Node) error) error
+
+	// Count returns the number of Nodes in the Cluster without fetching them.
+	Count(ctx context.Context, cluster string) (int, error)
+
+	// ListClusters returns up to limit clusters with IDs greater than after, ordered by the ID.
+	//
+	// Pass the ID of the last returned cluster as after to get the next page, limit 0 returns all the clusters.
+	ListClusters(ctx context.Context, after string, limit int) ([]*types.ClusterInfo, error)
+
+	// Ping checks that the backend is reachable.
+	Ping(ctx context.Context) error
+
+	// Summarize returns the aggregate state of the cluster.
+	Summarize(ctx context.Context, cluster string) (*types.ClusterSummary, error)
+
+	// RemoveAddress removes a single address from a node.
+	//
+	// Removing the last address of a node is allowed, the node is kept without addresses.
+	RemoveAddress(ctx context.Context, cluster, id string, addr *types.Address) error
+
+	// Pin sets or clears the sticky flag of the node.
+	//
+	// Sticky nodes are never garbage collected and their addresses never expire.
+	// The flag is kept by Add and Replace, so that the node can't unpin itself.
+	Pin(ctx context.Context, cluster, id string, sticky bool) error
+
+	// Touch marks the node and its addresses as seen now, postponing their expiration.
+	//
+	// Nothing else changes: the node version stays the same and no change is reported to the subscribers.
+	Touch(ctx context.Context, cluster, id string) error
+
+	// SetAlias points the alias cluster ID at the target cluster, empty target removes the alias.
+	//
+	// Backends only store the alias table, the operations are redirected by the wrapper built with NewAliases.
+	SetAlias(ctx context.Context, alias, target string) error
+
+	// ResolveAlias returns the target of the alias, or empty string if the cluster is not an alias.
+	ResolveAlias(ctx context.Context, cluster string) (string, error)
+}
+
+// CleanReport summarizes the cleanup pass.
+type CleanReport struct {
+	// RemovedNodes is the number of expired nodes.
+	RemovedNodes int `json:"removedNodes"`
+
+	// RemovedClusters is the number of clusters removed once they became empty.
+	RemovedClusters int `json:"removedClusters"`
+}
+
+// add accumulates another report into the report.
+func (r *CleanReport) add(other *CleanReport) {
+	r.RemovedNodes += other.RemovedNodes
+	r.RemovedClusters += other.RemovedClusters
 }
 
 type ramDB struct {
 	logger *zap.Logger
-	db     map[string]map[string]*types.Node
+	db     map[string]*ramCluster
 	mu     sync.RWMutex
+
+	// lru orders the clusters by the last activity, most recently active first.
+	lru         *list.List
+	maxClusters int
+
+	onClusterEmpty func(cluster string)
+
+	// aliases maps the alias cluster IDs to the target clusters.
+	aliases map[string]string
+
+	tombstoneRetention time.Duration
+
+	// awaited keeps the waiters of the clusters which don't exist yet, so that reads never create clusters.
+	awaited map[string]*awaitedCluster
+}
+
+// awaitedCluster is the cluster waited for by the subscribers before it is created.
+type awaitedCluster struct {
+	// created is closed once the cluster is created.
+	created chan struct{}
+	waiters int
+}
+
+// RAMOptions configures the in-memory database.
+type RAMOptions struct {
+	// MaxClusters limits the number of clusters, evicting the least recently active ones (unlimited if 0).
+	//
+	// Clusters with waiters or with changes within the last minute are never evicted.
+	MaxClusters int
+
+	// OnClusterEmpty is called for every cluster removed by Clean after its last node expired.
+	//
+	// It is called without holding the database lock, but it should not block the cleanup.
+	OnClusterEmpty func(cluster string)
+
+	// Shards is the number of independently locked shards the clusters are spread over (single shard if 0 or 1).
+	//
+	// With several shards MaxClusters is enforced per shard, so the eviction is only approximately least recently active.
+	Shards int
+
+	// TombstoneRetention is how long the expired nodes are remembered (not remembered if 0).
+	//
+	// Snapshots of the cluster report the remembered nodes as removed, so that the clients and the replicas
+	// which merge the snapshot into their state drop the nodes instead of keeping the stale copies.
+	// The cluster is kept while it has tombstones, they are purged by the first Clean after the retention.
+	TombstoneRetention time.Duration
+}
+
+// ramCluster keeps the nodes of a single cluster along with the change tracking state.
+type ramCluster struct {
+	nodes map[string]*types.Node
+
+	// history keeps the recent changes of the cluster, revision is the revision of the last change.
+	history  changeHistory
+	revision uint64
+
+	// changed is closed (and replaced) on every change of the cluster.
+	changed chan struct{}
+
+	// config keeps the per-cluster overrides, if any.
+	config *types.ClusterConfig
+
+	// tombstones keep the removal time of the recently expired nodes.
+	//
+	// Tombstones outlive the nodes, so they are keyed by the compact keys instead of retaining the ID strings,
+	// tombstoneIDs keeps the IDs which can't be restored from the keys.
+	tombstones   map[nodeKey]time.Time
+	tombstoneIDs map[nodeKey]string
+
+	// el is the element of the cluster in the LRU, lastActive is the time of the last activity.
+	el         *list.Element
+	lastActive time.Time
+
+	// watchers is the number of clients waiting for the changes.
+	watchers int
+}
+
+func newRAMCluster() *ramCluster {
+	return &ramCluster{
+		nodes:   make(map[string]*types.Node),
+		changed: make(chan struct{}),
+	}
+}
+
+// touch records a change of the node and wakes up the waiters.
+//
+// The previous state of the node is used to record the changed fields, it is nil if the node was created.
+func (c *ramCluster) touch(n, prev *types.Node) {
+	c.record(change{id: n.ID, delta: n.Diff(prev)})
+}
+
+// remove removes the node, recording the change.
+func (c *ramCluster) remove(id string) {
+	c.nodes[id] = nil
+	delete(c.nodes, id)
+
+	c.record(change{id: id, removed: true})
+}
+
+// bury records the tombstone of the removed node.
+func (c *ramCluster) bury(id string, t time.Time) {
+	if c.tombstones == nil {
+		c.tombstones = make(map[nodeKey]time.Time)
+	}
+
+	k, canonical := keyOf(id)
+	if !canonical {
+		if c.tombstoneIDs == nil {
+			c.tombstoneIDs = make(map[nodeKey]string)
+		}
+
+		c.tombstoneIDs[k] = id
+	}
+
+	c.tombstones[k] = t
+}
+
+// unbury forgets the tombstone of the node which is back.
+func (c *ramCluster) unbury(id string) {
+	if len(c.tombstones) == 0 {
+		return
+	}
+
+	k, _ := keyOf(id)
+
+	delete(c.tombstones, k)
+	delete(c.tombstoneIDs, k)
+}
+
+// purgeTombstones forgets the nodes removed before the deadline.
+func (c *ramCluster) purgeTombstones(deadline time.Time) {
+	for k, t := range c.tombstones {
+		if t.Before(deadline) {
+			delete(c.tombstones, k)
+			delete(c.tombstoneIDs, k)
+		}
+	}
+}
+
+// buried returns the IDs of the removed nodes with tombstones.
+func (c *ramCluster) buried() []string {
+	ids := make([]string, 0, len(c.tombstones))
+
+	for k := range c.tombstones {
+		if id, ok := c.tombstoneIDs[k]; ok {
+			ids = append(ids, id)
+		} else {
+			ids = append(ids, k.String())
+		}
+	}
+
+	return ids
+}
+
+func (c *ramCluster) record(ch change) {
+	c.revision++
+
+	ch.revision = c.revision
+	ch.at = time.Now()
+	c.history.push(ch)
+
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// checkLimit verifies that another node can be added to the cluster.
+func (c *ramCluster) checkLimit() error {
+	if limit := c.config.NodeLimit(); limit > 0 && len(c.nodes) >= limit {
+		return fmt.Errorf("%w: limit of %d nodes reached", ErrClusterFull, limit)
+	}
+
+	return nil
+}
+
+// pinned reports whether the cluster has sticky nodes, which should never go away on their own.
+func (c *ramCluster) pinned() bool {
+	for _, n := range c.nodes {
+		if n.Sticky {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkKey verifies that the node key is allowed to register in the cluster.
+func (c *ramCluster) checkKey(id string) error {
+	if !c.config.AllowsKey(id) {
+		return fmt.Errorf("%w: key %q is not in the allowlist of the cluster", ErrKeyNotAllowed, id)
+	}
+
+	return nil
+}
+
+// changes returns the changes after the revision, or nil if there were no changes.
+func (c *ramCluster) changes(since uint64) *types.Changes {
+	result := &types.Changes{
+		Cursor: c.revision,
+	}
+
+	switch {
+	case since == c.revision:
+		return nil
+	case since == 0, since > c.revision, !c.history.covers(since):
+		// cursor from the future means that the cluster was re-created,
+		// and too old cursor means that the changes were evicted from the history
+		result.Reset = since != 0
+		result.Deltas = make(map[string]types.NodeDelta, len(c.nodes))
+
+		for id, n := range c.nodes {
+			result.Nodes = append(result.Nodes, n)
+			result.Deltas[id] = n.Diff(nil)
+		}
+
+		result.Removed = append(result.Removed, c.buried()...)
+
+		return result
+	}
+
+	removed := make(map[string]bool)
+	deltas := make(map[string]types.NodeDelta)
+
+	var order []string
+
+	c.history.since(since, func(ch change) {
+		if _, seen := removed[ch.id]; !seen {
+			order = append(order, ch.id)
+		}
+
+		removed[ch.id] = ch.removed
+		deltas[ch.id] = deltas[ch.id].Merge(ch.delta)
+
+		if result.Changed.IsZero() {
+			result.Changed = ch.at
+		}
+	})
+
+	for _, id := range order {
+		n, ok := c.nodes[id]
+
+		if removed[id] || !ok {
+			result.Removed = append(result.Removed, id)
+
+			continue
+		}
+
+		if result.Deltas == nil {
+			result.Deltas = make(map[string]types.NodeDelta)
+		}
+
+		result.Nodes = append(result.Nodes, n)
+		result.Deltas[id] = deltas[id]
+	}
+
+	return result
 }
 
 // New returns a new database.
 func New(logger *zap.Logger) DB {
+	return NewRAM(RAMOptions{}, logger)
+}
+
+// NewRAM returns a new in-memory database with the options.
+func NewRAM(opts RAMOptions, logger *zap.Logger) DB {
+	if opts.Shards > 1 {
+		return newShardedRAM(opts, logger)
+	}
+
+	return newRAM(opts, logger)
+}
+
+func newRAM(opts RAMOptions, logger *zap.Logger) *ramDB {
 	return &ramDB{
-		logger: logger,
-		db:     make(map[string]map[string]*types.Node),
+		logger:      logger,
+		db:          make(map[string]*ramCluster),
+		lru:         list.New(),
+		maxClusters: opts.MaxClusters,
+		aliases:     make(map[string]string),
+		awaited:     make(map[string]*awaitedCluster),
+
+		onClusterEmpty:     opts.OnClusterEmpty,
+		tombstoneRetention: opts.TombstoneRetention,
+	}
+}
+
+// cluster returns the cluster, creating it if it does not exist.
+//
+// It should be called with the write lock held.
+func (d *ramDB) cluster(cluster string) (*ramCluster, error) {
+	c, ok := d.db[cluster]
+	if !ok {
+		if d.maxClusters > 0 && len(d.db) >= d.maxClusters {
+			if err := d.evict(); err != nil {
+				return nil, err
+			}
+		}
+
+		c = newRAMCluster()
+		c.el = d.lru.PushFront(cluster)
+		d.db[cluster] = c
+
+		if a, ok := d.awaited[cluster]; ok {
+			close(a.created)
+			delete(d.awaited, cluster)
+		}
+	}
+
+	d.activate(c)
+
+	return c, nil
+}
+
+// activate marks the cluster as recently active.
+//
+// It should be called with the write lock held.
+func (d *ramDB) activate(c *ramCluster) {
+	c.lastActive = time.Now()
+	d.lru.MoveToFront(c.el)
+}
+
+// evict removes the least recently active cluster which has no waiters, no sticky nodes and no recent changes.
+//
+// It should be called with the write lock held.
+func (d *ramDB) evict() error {
+	for el := d.lru.Back(); el != nil; el = el.Prev() {
+		id := el.Value.(string) //nolint:forcetypeassert
+		c := d.db[id]
+
+		if time.Since(c.lastActive) < clusterEvictionGrace {
+			// the rest of the clusters are even more recent
+			break
+		}
+
+		if c.watchers > 0 || c.pinned() {
+			continue
+		}
+
+		d.logger.Info("evicting least recently active cluster",
+			zap.String("cluster", id),
+			zap.Int("nodes", len(c.nodes)),
+		)
+
+		evictedClusters.Inc()
+
+		d.remove(id)
+
+		return nil
 	}
+
+	return fmt.Errorf("%w: limit of %d clusters reached", ErrTooManyClusters, d.maxClusters)
+}
+
+// remove deletes the cluster, waking up the waiters, so that they pick up the new cluster.
+//
+// It should be called with the write lock held.
+func (d *ramDB) remove(cluster string) {
+	c := d.db[cluster]
+
+	close(c.changed)
+	d.lru.Remove(c.el)
+
+	delete(d.db, cluster)
 }
 
 // Add implements DB.
@@ -60,111 +565,849 @@ func (d *ramDB) Add(ctx context.Context, cluster string, n *types.Node) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	c, ok := d.db[cluster]
-	if !ok {
-		c = make(map[string]*types.Node)
-		d.db[cluster] = c
+	c, err := d.cluster(cluster)
+	if err != nil {
+		return err
+	}
+
+	if err = c.checkKey(n.ID); err != nil {
+		return err
 	}
 
-	if existing, ok := c[n.ID]; ok {
-		existing.AddAddresses(n.Addresses...)
+	stored, ok := c.nodes[n.ID]
 
-		return nil
+	if err = checkVersion(ctx, nodeVersion(stored)); err != nil {
+		return err
+	}
+
+	if err = checkGeneration(stored, n); err != nil {
+		return err
+	}
+
+	var prev *types.Node
+
+	if ok {
+		prev = stored.Snapshot()
+
+		stored.Merge(n)
+	} else {
+		if err = c.checkLimit(); err != nil {
+			return err
+		}
+
+		stored = newNode(n)
+		c.nodes[n.ID] = stored
+
+		c.unbury(n.ID)
 	}
 
-	c[n.ID] = n
+	now := time.Now()
+
+	stored.Version++
+	stored.MarkSeen(now)
+	stored.MarkModified(now)
+	c.touch(stored, prev)
 
 	return nil
 }
 
-func (d *ramDB) AddAddresses(ctx context.Context, cluster, id string, addresses ...*types.Address) error {
+// Replace implements DB.
+func (d *ramDB) Replace(ctx context.Context, cluster string, n *types.Node) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	c, ok := d.db[cluster]
-	if !ok {
-		return fmt.Errorf("cluster does not exist")
+	c, err := d.cluster(cluster)
+	if err != nil {
+		return err
+	}
+
+	if err = c.checkKey(n.ID); err != nil {
+		return err
+	}
+
+	existing, ok := c.nodes[n.ID]
+
+	if err = checkVersion(ctx, nodeVersion(existing)); err != nil {
+		return err
+	}
+
+	if err = checkGeneration(existing, n); err != nil {
+		return err
 	}
 
-	n, ok := c[id]
 	if !ok {
-		return fmt.Errorf("node does not exist")
+		if err = c.checkLimit(); err != nil {
+			return err
+		}
 	}
 
-	n.AddAddresses(addresses...)
+	stored := newNode(n)
+	stored.Version = nodeVersion(existing) + 1
+	stored.Sticky = existing != nil && existing.Sticky
+
+	now := time.Now()
+	stored.MarkSeen(now)
+	stored.MarkModified(now)
+
+	if stored.Generation == 0 && existing != nil {
+		stored.Generation = existing.Generation
+	}
+
+	c.nodes[n.ID] = stored
+	c.touch(stored, existing)
+
+	c.unbury(n.ID)
 
 	return nil
 }
 
-// List implements DB.
-func (d *ramDB) List(ctx context.Context, cluster string) (list []*types.Node, err error) {
-	c, ok := d.db[cluster]
-	if !ok {
-		return nil, fmt.Errorf("cluster %q not found", cluster)
+// nodeVersion returns the version of the node, 0 if the node doesn't exist.
+func nodeVersion(n *types.Node) uint64 {
+	if n == nil {
+		return 0
 	}
 
-	for _, n := range c {
-		n.ExpireAddressesOlderThan(AddressExpirationTimeout)
+	return n.Version
+}
 
-		if len(n.Addresses) > 0 {
-			list = append(list, n)
-		}
+// newNode builds a stored copy of the node, stamping addresses which have no report time yet.
+func newNode(n *types.Node) *types.Node {
+	stored := &types.Node{
+		Name:                    n.Name,
+		ID:                      n.ID,
+		IP:                      n.IP,
+		Labels:                  n.Labels,
+		AddressFamilyPreference: n.AddressFamilyPreference,
+		Role:                    n.Role,
+		Generation:              n.Generation,
 	}
 
-	if len(list) == 0 {
-		return nil, ErrNotFound
-	}
+	stored.AddAddresses(n.Addresses...)
 
-	return list, nil
+	return stored
 }
 
-// Get implements DB.
-func (d *ramDB) Get(ctx context.Context, cluster, id string) (*types.Node, error) {
-	d.mu.RLock()
+// AddAddresses implements DB.
+func (d *ramDB) AddAddresses(ctx context.Context, cluster, id string, addresses ...*types.Address) error {
+	d.mu.Lock()
 	defer d.mu.Unlock()
 
 	c, ok := d.db[cluster]
 	if !ok {
-		return nil, fmt.Errorf("cluster %q not found", cluster)
+		return fmt.Errorf("cluster %q: %w", cluster, ErrNotFound)
 	}
 
-	n, ok := c[id]
+	n, ok := c.nodes[id]
 	if !ok {
-		return nil, ErrNotFound
+		return ErrNotFound
 	}
 
-	return n, nil
+	if err := checkVersion(ctx, n.Version); err != nil {
+		return err
+	}
+
+	prev := n.Snapshot()
+
+	n.AddAddresses(addresses...)
+
+	now := time.Now()
+
+	n.Version++
+	n.MarkSeen(now)
+	n.MarkModified(now)
+
+	d.activate(c)
+	c.touch(n, prev)
+
+	return nil
 }
 
-// Clean runs the database cleanup routine.
-func (d *ramDB) Clean() {
-	d.mu.Lock()
-	defer d.mu.Unlock()
+// Changes implements DB.
+//
+// Waiting for an unknown cluster doesn't create it, so that the subscriptions can't fill up the clusters limit.
+func (d *ramDB) Changes(ctx context.Context, cluster string, since uint64) (*types.Changes, error) {
+	for {
+		d.mu.Lock()
 
-	var clusterDeleteList []string
+		c, ok := d.db[cluster]
+		if !ok {
+			if since != 0 {
+				d.mu.Unlock()
 
-	for clusterID, c := range d.db {
-		var nodeDeleteList []string
+				// the cluster is gone, so the subscriber starts over
+				return &types.Changes{Reset: true}, nil
+			}
 
-		for id, n := range c {
-			n.ExpireAddressesOlderThan(AddressExpirationTimeout)
+			d.awaitCluster(ctx, cluster)
 
-			if len(n.Addresses) < 1 {
-				nodeDeleteList = append(nodeDeleteList, id)
+			if ctx.Err() != nil {
+				return &types.Changes{}, nil
 			}
+
+			continue
 		}
 
-		for _, id := range nodeDeleteList {
-			c[id] = nil
-			delete(c, id)
+		d.activate(c)
+
+		if changes := c.changes(since); changes != nil {
+			d.mu.Unlock()
+
+			return changes, nil
 		}
 
-		if len(c) == 0 {
-			clusterDeleteList = append(clusterDeleteList, clusterID)
+		changed, revision := c.changed, c.revision
+		c.watchers++
+
+		d.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+		}
+
+		d.mu.Lock()
+		c.watchers--
+		d.mu.Unlock()
+
+		if ctx.Err() != nil {
+			return &types.Changes{Cursor: revision}, nil
 		}
 	}
+}
 
-	for _, id := range clusterDeleteList {
-		delete(d.db, id)
+// awaitCluster waits until the cluster is created or the context is done.
+//
+// It should be called with the write lock held, the lock is released.
+func (d *ramDB) awaitCluster(ctx context.Context, cluster string) {
+	a, ok := d.awaited[cluster]
+	if !ok {
+		a = &awaitedCluster{created: make(chan struct{})}
+		d.awaited[cluster] = a
 	}
+
+	a.waiters++
+
+	d.mu.Unlock()
+
+	select {
+	case <-a.created:
+	case <-ctx.Done():
+	}
+
+	d.mu.Lock()
+
+	a.waiters--
+
+	if a.waiters == 0 && d.awaited[cluster] == a {
+		delete(d.awaited, cluster)
+	}
+
+	d.mu.Unlock()
+}
+
+// DeleteCluster implements DB.
+func (d *ramDB) DeleteCluster(ctx context.Context, cluster string) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	c, ok := d.db[cluster]
+	if !ok {
+		return 0, ErrNotFound
+	}
+
+	d.remove(cluster)
+
+	return len(c.nodes), nil
+}
+
+// DeleteNodes implements DB.
+func (d *ramDB) DeleteNodes(ctx context.Context, cluster string, selector map[string]string) ([]string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	c, ok := d.db[cluster]
+	if !ok {
+		return nil, fmt.Errorf("cluster %q: %w", cluster, ErrNotFound)
+	}
+
+	var removed []string
+
+	for id, n := range c.nodes {
+		if n.MatchLabels(selector) {
+			removed = append(removed, id)
+		}
+	}
+
+	now := time.Now()
+
+	for _, id := range removed {
+		c.remove(id)
+
+		if d.tombstoneRetention > 0 {
+			c.bury(id, now)
+		}
+	}
+
+	if len(removed) > 0 {
+		d.activate(c)
+	}
+
+	return removed, nil
+}
+
+// ForEachCluster implements DB.
+func (d *ramDB) ForEachCluster(ctx context.Context, fn func(cluster string, nodes []*types.Node) error) error {
+	d.mu.RLock()
+
+	clusters := make([]string, 0, len(d.db))
+
+	for cluster := range d.db {
+		clusters = append(clusters, cluster)
+	}
+
+	d.mu.RUnlock()
+
+	for _, cluster := range clusters {
+		list, err := d.List(ctx, cluster)
+		if err != nil {
+			if errors.Is(err, ErrNotFound) {
+				continue
+			}
+
+			return err
+		}
+
+		if err = fn(cluster, list); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// List implements DB.
+func (d *ramDB) List(ctx context.Context, cluster string) (list []*types.Node, err error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	c, ok := d.db[cluster]
+	if !ok {
+		return nil, fmt.Errorf("cluster %q: %w", cluster, ErrNotFound)
+	}
+
+	ttl := c.config.AddressTTL(AddressExpirationTimeout)
+
+	for _, n := range c.nodes {
+		n.ExpireAddressesOlderThan(ttl)
+
+		if !nodeExpired(n, ttl) {
+			list = append(list, n)
+		}
+	}
+
+	if len(list) == 0 {
+		return nil, ErrNotFound
+	}
+
+	return list, nil
+}
+
+// walkPageSize is the number of nodes copied at once by Walk.
+const walkPageSize = 100
+
+// Walk implements DB.
+//
+// The nodes are copied in pages, so that the slow consumers never hold the lock.
+func (d *ramDB) Walk(ctx context.Context, cluster string, fn func(n *types.Node) error) error {
+	ids, err := d.nodeIDs(cluster)
+	if err != nil {
+		return err
+	}
+
+	for len(ids) > 0 {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+
+		page := ids
+		if len(page) > walkPageSize {
+			page = page[:walkPageSize]
+		}
+
+		ids = ids[len(page):]
+
+		for _, n := range d.snapshotNodes(cluster, page) {
+			if err = fn(n); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// nodeIDs returns the sorted IDs of the nodes of the cluster.
+func (d *ramDB) nodeIDs(cluster string) ([]string, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	c, ok := d.db[cluster]
+	if !ok || len(c.nodes) == 0 {
+		return nil, fmt.Errorf("cluster %q: %w", cluster, ErrNotFound)
+	}
+
+	ids := make([]string, 0, len(c.nodes))
+
+	for id := range c.nodes {
+		ids = append(ids, id)
+	}
+
+	sort.Strings(ids)
+
+	return ids, nil
+}
+
+// snapshotNodes returns the copies of the nodes with the IDs, the nodes removed or expired since are skipped.
+func (d *ramDB) snapshotNodes(cluster string, ids []string) []*types.Node {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	c, ok := d.db[cluster]
+	if !ok {
+		return nil
+	}
+
+	ttl := c.config.AddressTTL(AddressExpirationTimeout)
+	nodes := make([]*types.Node, 0, len(ids))
+
+	for _, id := range ids {
+		n, ok := c.nodes[id]
+		if !ok {
+			continue
+		}
+
+		// the stale addresses and the expired nodes are left out, as in List
+		n.ExpireAddressesOlderThan(ttl)
+
+		if !nodeExpired(n, ttl) {
+			nodes = append(nodes, n.Snapshot())
+		}
+	}
+
+	return nodes
+}
+
+// Count implements DB.
+func (d *ramDB) Count(ctx context.Context, cluster string) (int, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	c, ok := d.db[cluster]
+	if !ok {
+		return 0, fmt.Errorf("cluster %q: %w", cluster, ErrNotFound)
+	}
+
+	ttl := c.config.AddressTTL(AddressExpirationTimeout)
+
+	var count int
+
+	for _, n := range c.nodes {
+		n.ExpireAddressesOlderThan(ttl)
+
+		if !nodeExpired(n, ttl) {
+			count++
+		}
+	}
+
+	if count == 0 {
+		return 0, ErrNotFound
+	}
+
+	return count, nil
+}
+
+// ListClusters implements DB.
+func (d *ramDB) ListClusters(ctx context.Context, after string, limit int) ([]*types.ClusterInfo, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	ids := make([]string, 0, len(d.db))
+
+	for id, c := range d.db {
+		if id > after && len(c.nodes) > 0 {
+			ids = append(ids, id)
+		}
+	}
+
+	return pageClusters(ids, limit, func(id string) int {
+		return len(d.db[id].nodes)
+	}), nil
+}
+
+// pageClusters sorts the cluster IDs and returns the first page of them with the node counts.
+func pageClusters(ids []string, limit int, count func(id string) int) []*types.ClusterInfo {
+	sort.Strings(ids)
+
+	if limit > 0 && len(ids) > limit {
+		ids = ids[:limit]
+	}
+
+	clusters := make([]*types.ClusterInfo, 0, len(ids))
+
+	for _, id := range ids {
+		clusters = append(clusters, &types.ClusterInfo{
+			ID:    id,
+			Nodes: count(id),
+		})
+	}
+
+	return clusters
+}
+
+// ClusterConfig implements DB.
+func (d *ramDB) ClusterConfig(ctx context.Context, cluster string) (*types.ClusterConfig, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	c, ok := d.db[cluster]
+	if !ok || c.config == nil {
+		return nil, nil
+	}
+
+	cfg := *c.config
+	cfg.AllowedKeys = append([]string(nil), c.config.AllowedKeys...)
+
+	return &cfg, nil
+}
+
+// SetClusterConfig implements DB.
+func (d *ramDB) SetClusterConfig(ctx context.Context, cluster string, cfg *types.ClusterConfig) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if cfg.IsZero() {
+		if c, ok := d.db[cluster]; ok {
+			c.config = nil
+		}
+
+		return nil
+	}
+
+	c, err := d.cluster(cluster)
+	if err != nil {
+		return err
+	}
+
+	stored := *cfg
+	stored.AllowedKeys = append([]string(nil), cfg.AllowedKeys...)
+	c.config = &stored
+
+	return nil
+}
+
+// Summarize implements DB.
+func (d *ramDB) Summarize(ctx context.Context, cluster string) (*types.ClusterSummary, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	c, ok := d.db[cluster]
+	if !ok || len(c.nodes) == 0 {
+		return nil, fmt.Errorf("cluster %q: %w", cluster, ErrNotFound)
+	}
+
+	ttl := c.config.AddressTTL(AddressExpirationTimeout)
+	nodes := make([]*types.Node, 0, len(c.nodes))
+
+	// the stale addresses and the expired nodes are left out, as in List
+	for _, n := range c.nodes {
+		n.ExpireAddressesOlderThan(ttl)
+
+		if !nodeExpired(n, ttl) {
+			nodes = append(nodes, n)
+		}
+	}
+
+	if len(nodes) == 0 {
+		return nil, fmt.Errorf("cluster %q: %w", cluster, ErrNotFound)
+	}
+
+	return types.Summarize(nodes), nil
+}
+
+// Replay implements Replayer.
+//
+// The replay is bounded by the size of the change history.
+// The changed nodes are returned as of the cursor, so that the client can continue with the live changes.
+func (d *ramDB) Replay(ctx context.Context, cluster string) (*types.Replay, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	c, ok := d.db[cluster]
+	if !ok {
+		return nil, fmt.Errorf("cluster %q: %w", cluster, ErrNotFound)
+	}
+
+	replay := &types.Replay{
+		Events: []*types.ChangeEvent{},
+		Nodes:  []*types.Node{},
+		Cursor: c.revision,
+	}
+
+	ttl := c.config.AddressTTL(AddressExpirationTimeout)
+	seen := map[string]struct{}{}
+
+	c.history.since(0, func(ch change) {
+		if _, ok := seen[ch.id]; !ok {
+			seen[ch.id] = struct{}{}
+
+			if n, ok := c.nodes[ch.id]; ok {
+				snapshot := n.Snapshot()
+				snapshot.ExpireAddressesOlderThan(ttl)
+
+				if !nodeExpired(snapshot, ttl) {
+					replay.Nodes = append(replay.Nodes, snapshot)
+				}
+			}
+		}
+
+		replay.Events = append(replay.Events, &types.ChangeEvent{
+			Revision: ch.revision,
+			ID:       ch.id,
+			Created:  ch.delta.Created,
+			Removed:  ch.removed,
+			Time:     ch.at,
+			Delta:    ch.delta,
+		})
+	})
+
+	replay.Truncated = len(replay.Events) > 0 && replay.Events[0].Revision > 1
+
+	return replay, nil
+}
+
+// SetAlias implements DB.
+func (d *ramDB) SetAlias(ctx context.Context, alias, target string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if target == "" {
+		delete(d.aliases, alias)
+	} else {
+		d.aliases[alias] = target
+	}
+
+	return nil
+}
+
+// ResolveAlias implements DB.
+func (d *ramDB) ResolveAlias(ctx context.Context, cluster string) (string, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return d.aliases[cluster], nil
+}
+
+// Ping implements DB.
+func (d *ramDB) Ping(ctx context.Context) error {
+	return nil
+}
+
+// Get implements DB.
+func (d *ramDB) Get(ctx context.Context, cluster, id string) (*types.Node, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	c, ok := d.db[cluster]
+	if !ok {
+		return nil, fmt.Errorf("cluster %q: %w", cluster, ErrNotFound)
+	}
+
+	n, ok := c.nodes[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	return n, nil
+}
+
+// RemoveAddress implements DB.
+func (d *ramDB) RemoveAddress(ctx context.Context, cluster, id string, addr *types.Address) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	c, ok := d.db[cluster]
+	if !ok {
+		return fmt.Errorf("cluster %q: %w", cluster, ErrNotFound)
+	}
+
+	n, ok := c.nodes[id]
+	if !ok {
+		return ErrNotFound
+	}
+
+	prev := n.Snapshot()
+
+	if !n.RemoveAddress(addr) {
+		return ErrNotFound
+	}
+
+	n.Version++
+	n.MarkModified(time.Now())
+
+	d.activate(c)
+	c.touch(n, prev)
+
+	return nil
+}
+
+// nodeExpired reports whether the node should be removed.
+//
+// Stale addresses are pruned on their own, a node without addresses stays until it is not updated for the TTL.
+// Sticky nodes never expire.
+func nodeExpired(n *types.Node, ttl time.Duration) bool {
+	return !n.Sticky && len(n.Addresses) == 0 && time.Since(n.LastSeen) >= ttl
+}
+
+// Pin implements DB.
+func (d *ramDB) Pin(ctx context.Context, cluster, id string, sticky bool) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	c, ok := d.db[cluster]
+	if !ok {
+		return fmt.Errorf("cluster %q: %w", cluster, ErrNotFound)
+	}
+
+	n, ok := c.nodes[id]
+	if !ok {
+		return ErrNotFound
+	}
+
+	if n.Sticky == sticky {
+		return nil
+	}
+
+	prev := n.Snapshot()
+
+	n.Sticky = sticky
+	n.Version++
+	n.MarkModified(time.Now())
+
+	c.touch(n, prev)
+
+	return nil
+}
+
+// Touch implements DB.
+func (d *ramDB) Touch(ctx context.Context, cluster, id string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	c, ok := d.db[cluster]
+	if !ok {
+		return fmt.Errorf("cluster %q: %w", cluster, ErrNotFound)
+	}
+
+	n, ok := c.nodes[id]
+	if !ok {
+		return ErrNotFound
+	}
+
+	n.Heartbeat(time.Now())
+
+	d.activate(c)
+
+	return nil
+}
+
+// NodeCount implements NodeCounter.
+func (d *ramDB) NodeCount() int {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	var count int
+
+	for _, c := range d.db {
+		count += len(c.nodes)
+	}
+
+	return count
+}
+
+// Clean runs the database cleanup routine.
+func (d *ramDB) Clean() *CleanReport {
+	removed, nodes := d.clean()
+
+	collectedNodes.Add(float64(nodes))
+
+	for _, cluster := range removed {
+		emptyClusters.Inc()
+
+		d.logger.Info("removed empty cluster", zap.String("cluster", cluster))
+
+		if d.onClusterEmpty != nil {
+			d.onClusterEmpty(cluster)
+		}
+	}
+
+	return &CleanReport{
+		RemovedNodes:    nodes,
+		RemovedClusters: len(removed),
+	}
+}
+
+// clean expires the nodes and returns the removed empty clusters along with the number of expired nodes.
+//
+// Clusters which never had any nodes (e.g. left by the rejected registrations) are removed as well,
+// but they are not reported, as they were never in use.
+func (d *ramDB) clean() (emptied []string, nodes int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+
+	var clusterDeleteList []string
+
+	for clusterID, c := range d.db {
+		var nodeDeleteList []string
+
+		ttl := c.config.AddressTTL(AddressExpirationTimeout)
+
+		for id, n := range c.nodes {
+			n.ExpireAddressesOlderThan(ttl)
+
+			if nodeExpired(n, ttl) {
+				nodeDeleteList = append(nodeDeleteList, id)
+			}
+		}
+
+		c.purgeTombstones(now.Add(-d.tombstoneRetention))
+
+		for _, id := range nodeDeleteList {
+			c.remove(id)
+
+			if d.tombstoneRetention > 0 {
+				c.bury(id, now)
+			}
+		}
+
+		nodes += len(nodeDeleteList)
+
+		// clusters with overrides are kept, so that the overrides apply once the nodes come back,
+		// clusters with tombstones are kept until the removals are no longer reported
+		if len(c.nodes) == 0 && c.config == nil && len(c.tombstones) == 0 {
+			clusterDeleteList = append(clusterDeleteList, clusterID)
+
+			// every node change bumps the revision
+			if c.revision > 0 {
+				emptied = append(emptied, clusterID)
+			}
+		}
+	}
+
+	for _, id := range clusterDeleteList {
+		d.remove(id)
+	}
+
+	return emptied, nodes
 }
@@ -0,0 +1,1265 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package db_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"inet.af/netaddr"
+
+	"github.com/talos-systems/kubespan-manager/internal/db"
+	"github.com/talos-systems/kubespan-manager/pkg/types"
+)
+
+const (
+	testCluster = "0c5e1e9a-3c62-4f6e-9d59-8b2a0f0b2d4a"
+	testNode1   = "IHOPEfmiUG1kE832FAxm77J5WP0O1ZHp9OwqbGowL1E="
+	testNode2   = "9NqSzEoeNRqwCaBKdkxUR2dqvhxMyUe5nDm9yZ3JSn0="
+
+	testOtherCluster = "6f1d3a52-7b0e-4c5a-a1f3-2e9d8c7b6a50"
+)
+
+func testNode(id, ip string) *types.Node {
+	return &types.Node{
+		ID: id,
+		IP: netaddr.MustParseIP(ip),
+		Addresses: []*types.Address{
+			{IP: netaddr.MustParseIP(ip), Port: 51820},
+		},
+	}
+}
+
+func TestChanges(t *testing.T) {
+	ctx := context.Background()
+	d := db.New(zap.NewNop())
+
+	if err := d.Add(ctx, testCluster, testNode(testNode1, "10.0.0.1")); err != nil {
+		t.Fatalf("failed to add node: %s", err)
+	}
+
+	changes, err := d.Changes(ctx, testCluster, 0)
+	if err != nil {
+		t.Fatalf("failed to get changes: %s", err)
+	}
+
+	if len(changes.Nodes) != 1 || changes.Nodes[0].ID != testNode1 || changes.Reset {
+		t.Fatalf("unexpected initial changes: %+v", changes)
+	}
+
+	cursor := changes.Cursor
+
+	// nothing changed: should block until the timeout
+	waitCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+
+	changes, err = d.Changes(waitCtx, testCluster, cursor)
+	if err != nil {
+		t.Fatalf("failed to wait for changes: %s", err)
+	}
+
+	if !changes.Empty() || changes.Cursor != cursor {
+		t.Fatalf("expected no changes, got %+v", changes)
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+
+		d.Add(ctx, testCluster, testNode(testNode2, "10.0.0.2")) //nolint:errcheck
+	}()
+
+	waitCtx, cancel = context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	changes, err = d.Changes(waitCtx, testCluster, cursor)
+	if err != nil {
+		t.Fatalf("failed to wait for changes: %s", err)
+	}
+
+	if len(changes.Nodes) != 1 || changes.Nodes[0].ID != testNode2 {
+		t.Fatalf("expected only the new node to be changed, got %+v", changes)
+	}
+
+	if changes.Cursor <= cursor {
+		t.Errorf("cursor did not advance: %d -> %d", cursor, changes.Cursor)
+	}
+}
+
+func TestChangesReset(t *testing.T) {
+	ctx := context.Background()
+	d := db.New(zap.NewNop())
+
+	if err := d.Add(ctx, testCluster, testNode(testNode1, "10.0.0.1")); err != nil {
+		t.Fatalf("failed to add node: %s", err)
+	}
+
+	// overflow the change history
+	for i := 0; i < 1000; i++ {
+		if err := d.AddAddresses(ctx, testCluster, testNode1, &types.Address{IP: netaddr.MustParseIP("10.0.0.1")}); err != nil {
+			t.Fatalf("failed to add addresses: %s", err)
+		}
+	}
+
+	changes, err := d.Changes(ctx, testCluster, 1)
+	if err != nil {
+		t.Fatalf("failed to get changes: %s", err)
+	}
+
+	if !changes.Reset || len(changes.Nodes) != 1 {
+		t.Fatalf("expected a full snapshot with reset flag, got %+v", changes)
+	}
+
+	// cursor from the future
+	changes, err = d.Changes(ctx, testCluster, changes.Cursor+100)
+	if err != nil {
+		t.Fatalf("failed to get changes: %s", err)
+	}
+
+	if !changes.Reset {
+		t.Fatalf("expected a reset for cursor from the future, got %+v", changes)
+	}
+}
+
+func TestChangesDeltas(t *testing.T) {
+	ctx := context.Background()
+	d := db.New(zap.NewNop())
+
+	if err := d.Add(ctx, testCluster, testNode(testNode1, "10.0.0.1")); err != nil {
+		t.Fatalf("failed to add node: %s", err)
+	}
+
+	changes, err := d.Changes(ctx, testCluster, 0)
+	if err != nil {
+		t.Fatalf("failed to get changes: %s", err)
+	}
+
+	cursor := changes.Cursor
+
+	relabeled := testNode(testNode1, "10.0.0.1")
+	relabeled.Labels = map[string]string{"zone": "a"}
+
+	if err = d.Add(ctx, testCluster, relabeled); err != nil {
+		t.Fatalf("failed to update node: %s", err)
+	}
+
+	if err = d.Add(ctx, testCluster, testNode(testNode2, "10.0.0.2")); err != nil {
+		t.Fatalf("failed to add node: %s", err)
+	}
+
+	if changes, err = d.Changes(ctx, testCluster, cursor); err != nil {
+		t.Fatalf("failed to get changes: %s", err)
+	}
+
+	if delta := changes.Deltas[testNode1]; delta.Created || delta.Fields != types.FieldLabels {
+		t.Errorf("unexpected delta of the updated node: %+v", delta)
+	}
+
+	if delta := changes.Deltas[testNode2]; !delta.Created {
+		t.Errorf("unexpected delta of the added node: %+v", delta)
+	}
+}
+
+func TestFlapDampening(t *testing.T) {
+	ctx := context.Background()
+	d := db.NewFlapDetector(db.New(zap.NewNop()), zap.NewNop(), db.FlapOptions{
+		Window:    time.Minute,
+		Threshold: 2,
+		Dampen:    200 * time.Millisecond,
+	})
+
+	if err := d.Add(ctx, testCluster, testNode(testNode1, "10.0.0.1")); err != nil {
+		t.Fatalf("failed to add node: %s", err)
+	}
+
+	changes, err := d.Changes(ctx, testCluster, 0)
+	if err != nil {
+		t.Fatalf("failed to get changes: %s", err)
+	}
+
+	cursor := changes.Cursor
+
+	for _, ip := range []string{"10.0.0.2", "10.0.0.3"} {
+		if err = d.AddAddresses(ctx, testCluster, testNode1, &types.Address{IP: netaddr.MustParseIP(ip), Port: 51820}); err != nil {
+			t.Fatalf("failed to add address: %s", err)
+		}
+	}
+
+	// the final update lands within the dampening delay, and should not be lost
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+
+		d.AddAddresses(ctx, testCluster, testNode1, &types.Address{IP: netaddr.MustParseIP("10.0.0.4"), Port: 51820}) //nolint:errcheck
+	}()
+
+	changes, err = d.Changes(ctx, testCluster, cursor)
+	if err != nil {
+		t.Fatalf("failed to get changes: %s", err)
+	}
+
+	if len(changes.Nodes) != 1 || len(changes.Nodes[0].Addresses) != 4 {
+		t.Fatalf("expected the final state of the flapping node, got %+v", changes.Nodes)
+	}
+}
+
+func TestFlapDetectorIgnoresHeartbeats(t *testing.T) {
+	ctx := context.Background()
+	d := db.NewFlapDetector(db.New(zap.NewNop()), zap.NewNop(), db.FlapOptions{
+		Window:    time.Minute,
+		Threshold: 2,
+		Dampen:    time.Second,
+	})
+
+	// heartbeats re-report the same addresses
+	for i := 0; i < 5; i++ {
+		if err := d.Add(ctx, testCluster, testNode(testNode1, "10.0.0.1")); err != nil {
+			t.Fatalf("failed to add node: %s", err)
+		}
+	}
+
+	n := testNode(testNode1, "10.0.0.1")
+	n.Name = "renamed"
+
+	if err := d.Add(ctx, testCluster, n); err != nil {
+		t.Fatalf("failed to update node: %s", err)
+	}
+
+	start := time.Now()
+
+	if _, err := d.Changes(ctx, testCluster, 1); err != nil {
+		t.Fatalf("failed to get changes: %s", err)
+	}
+
+	if elapsed := time.Since(start); elapsed >= time.Second {
+		t.Fatalf("changes of the node which is not flapping were dampened for %s", elapsed)
+	}
+}
+
+func TestWriteBuffer(t *testing.T) {
+	ctx := context.Background()
+	backend := db.New(zap.NewNop())
+
+	d, err := db.NewWriteBuffer(backend, zap.NewNop(), db.WriteBufferOptions{
+		Window:     50 * time.Millisecond,
+		MaxPending: 10,
+		Ack:        db.WriteAckQueue,
+	})
+	if err != nil {
+		t.Fatalf("failed to create write buffer: %s", err)
+	}
+
+	if err = d.Add(ctx, testCluster, testNode(testNode1, "10.0.0.1")); err != nil {
+		t.Fatalf("failed to add node: %s", err)
+	}
+
+	if err = d.AddAddresses(ctx, testCluster, testNode1, &types.Address{IP: netaddr.MustParseIP("10.0.0.2"), Port: 51820}); err != nil {
+		t.Fatalf("failed to add address: %s", err)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+
+	n, err := backend.Get(ctx, testCluster, testNode1)
+	if err != nil {
+		t.Fatalf("buffered node was not flushed: %s", err)
+	}
+
+	// both writes are coalesced into a single one
+	if n.Version != 1 || len(n.Addresses) != 2 {
+		t.Fatalf("unexpected flushed node: version %d, addresses %v", n.Version, n.Addresses)
+	}
+}
+
+func TestWriteBufferClose(t *testing.T) {
+	ctx := context.Background()
+	backend := db.New(zap.NewNop())
+
+	d, err := db.NewWriteBuffer(backend, zap.NewNop(), db.WriteBufferOptions{
+		Window:     time.Hour,
+		MaxPending: 10,
+		Ack:        db.WriteAckQueue,
+	})
+	if err != nil {
+		t.Fatalf("failed to create write buffer: %s", err)
+	}
+
+	if err = d.Add(ctx, testCluster, testNode(testNode1, "10.0.0.1")); err != nil {
+		t.Fatalf("failed to add node: %s", err)
+	}
+
+	// the buffered write is flushed on close
+	if err = d.(io.Closer).Close(); err != nil {
+		t.Fatalf("failed to close write buffer: %s", err)
+	}
+
+	if _, err = backend.Get(ctx, testCluster, testNode1); err != nil {
+		t.Fatalf("buffered node was not flushed: %s", err)
+	}
+
+	// writes after close go directly to the backend
+	if err = d.Add(ctx, testCluster, testNode(testNode2, "10.0.0.2")); err != nil {
+		t.Fatalf("failed to add node: %s", err)
+	}
+
+	if _, err = backend.Get(ctx, testCluster, testNode2); err != nil {
+		t.Fatalf("node was not written through: %s", err)
+	}
+}
+
+func TestWriteBufferStaleGeneration(t *testing.T) {
+	ctx := context.Background()
+	backend := db.New(zap.NewNop())
+
+	d, err := db.NewWriteBuffer(backend, zap.NewNop(), db.WriteBufferOptions{
+		Window:     time.Hour,
+		MaxPending: 10,
+		Ack:        db.WriteAckQueue,
+	})
+	if err != nil {
+		t.Fatalf("failed to create write buffer: %s", err)
+	}
+
+	n := testNode(testNode1, "10.0.0.1")
+	n.Generation = 5
+
+	if err = d.Add(ctx, testCluster, n); err != nil {
+		t.Fatalf("failed to add node: %s", err)
+	}
+
+	stale := testNode(testNode1, "10.0.0.2")
+	stale.Generation = 3
+
+	if err = d.Add(ctx, testCluster, stale); !errors.Is(err, db.ErrStaleGeneration) {
+		t.Fatalf("expected stale generation error, got %v", err)
+	}
+
+	// flushes the buffer
+	if err = d.Touch(ctx, testCluster, testNode1); err != nil {
+		t.Fatalf("failed to touch node: %s", err)
+	}
+
+	flushed, err := backend.Get(ctx, testCluster, testNode1)
+	if err != nil {
+		t.Fatalf("buffered node was not flushed: %s", err)
+	}
+
+	if flushed.Generation != 5 || len(flushed.Addresses) != 1 {
+		t.Fatalf("stale write was merged: generation %d, addresses %v", flushed.Generation, flushed.Addresses)
+	}
+}
+
+func TestPin(t *testing.T) {
+	ctx := context.Background()
+	d := db.New(zap.NewNop())
+
+	n := testNode(testNode1, "10.0.0.1")
+	n.Addresses[0].TTLSeconds = 1
+	n.Addresses[0].LastReported = time.Now().Add(-2 * time.Second)
+
+	if err := d.Add(ctx, testCluster, n); err != nil {
+		t.Fatalf("failed to add node: %s", err)
+	}
+
+	if err := d.Pin(ctx, testCluster, testNode1, true); err != nil {
+		t.Fatalf("failed to pin node: %s", err)
+	}
+
+	// the pin survives the update by the node itself
+	if err := d.Replace(ctx, testCluster, testNode(testNode1, "10.0.0.1")); err != nil {
+		t.Fatalf("failed to replace node: %s", err)
+	}
+
+	d.Clean()
+
+	stored, err := d.Get(ctx, testCluster, testNode1)
+	if err != nil {
+		t.Fatalf("failed to get node: %s", err)
+	}
+
+	if !stored.Sticky {
+		t.Fatal("node pin was lost")
+	}
+
+	if err = d.Pin(ctx, testCluster, testNode2, true); !errors.Is(err, db.ErrNotFound) {
+		t.Fatalf("expected not found error, got %v", err)
+	}
+}
+
+func TestTouch(t *testing.T) {
+	ctx := context.Background()
+	d := db.New(zap.NewNop())
+
+	if err := d.Add(ctx, testCluster, testNode(testNode1, "10.0.0.1")); err != nil {
+		t.Fatalf("failed to add node: %s", err)
+	}
+
+	changes, err := d.Changes(ctx, testCluster, 0)
+	if err != nil {
+		t.Fatalf("failed to get changes: %s", err)
+	}
+
+	before, err := d.Get(ctx, testCluster, testNode1)
+	if err != nil {
+		t.Fatalf("failed to get node: %s", err)
+	}
+
+	version, lastSeen := before.Version, before.LastSeen
+
+	if err = d.Touch(ctx, testCluster, testNode1); err != nil {
+		t.Fatalf("failed to touch node: %s", err)
+	}
+
+	after, err := d.Get(ctx, testCluster, testNode1)
+	if err != nil {
+		t.Fatalf("failed to get node: %s", err)
+	}
+
+	if after.Version != version || !after.LastSeen.After(lastSeen) {
+		t.Fatalf("expected the same version and a later last seen time, got version %d, last seen %s", after.Version, after.LastSeen)
+	}
+
+	if !after.LastModified.Equal(before.LastModified) {
+		t.Fatalf("expected heartbeat to keep the modification time %s, got %s", before.LastModified, after.LastModified)
+	}
+
+	// heartbeats are not reported to the subscribers
+	waitCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+
+	if changes, err = d.Changes(waitCtx, testCluster, changes.Cursor); err != nil || len(changes.Nodes) != 0 {
+		t.Fatalf("expected no changes, got %+v (%v)", changes, err)
+	}
+
+	if err = d.Touch(ctx, testCluster, testNode2); !errors.Is(err, db.ErrNotFound) {
+		t.Fatalf("expected missing node, got %v", err)
+	}
+}
+
+func TestAliases(t *testing.T) {
+	ctx := context.Background()
+	d := db.NewAliases(db.New(zap.NewNop()))
+
+	if err := d.Add(ctx, testCluster, testNode(testNode1, "10.0.0.1")); err != nil {
+		t.Fatalf("failed to add node: %s", err)
+	}
+
+	if err := d.SetAlias(ctx, testOtherCluster, testCluster); err != nil {
+		t.Fatalf("failed to set alias: %s", err)
+	}
+
+	// nodes registered via the alias land in the target cluster
+	if err := d.Add(ctx, testOtherCluster, testNode(testNode2, "10.0.0.2")); err != nil {
+		t.Fatalf("failed to add node via alias: %s", err)
+	}
+
+	for _, cluster := range []string{testCluster, testOtherCluster} {
+		list, err := d.List(ctx, cluster)
+		if err != nil {
+			t.Fatalf("failed to list %s: %s", cluster, err)
+		}
+
+		if len(list) != 2 {
+			t.Fatalf("expected 2 nodes in %s, got %d", cluster, len(list))
+		}
+	}
+
+	if err := d.SetAlias(ctx, testCluster, testOtherCluster); !errors.Is(err, db.ErrAliasConflict) {
+		t.Fatalf("expected alias cycle to be rejected, got %v", err)
+	}
+
+	// deleting the alias keeps the target cluster
+	if _, err := d.DeleteCluster(ctx, testOtherCluster); err != nil {
+		t.Fatalf("failed to delete alias: %s", err)
+	}
+
+	if count, err := d.Count(ctx, testCluster); err != nil || count != 2 {
+		t.Fatalf("unexpected target cluster count %d: %v", count, err)
+	}
+
+	if _, err := d.List(ctx, testOtherCluster); !errors.Is(err, db.ErrNotFound) {
+		t.Fatalf("expected removed alias to be not found, got %v", err)
+	}
+}
+
+func TestJoinNotifier(t *testing.T) {
+	ctx := context.Background()
+
+	var joined []string
+
+	d := db.NewJoinNotifier(db.New(zap.NewNop()), func(cluster string, n *types.Node) {
+		joined = append(joined, cluster+"/"+n.ID)
+	})
+
+	for _, n := range []*types.Node{
+		testNode(testNode1, "10.0.0.1"),
+		testNode(testNode1, "10.0.0.2"), // update, not a join
+		testNode(testNode2, "10.0.0.3"),
+	} {
+		if err := d.Add(ctx, testCluster, n); err != nil {
+			t.Fatalf("failed to add node: %s", err)
+		}
+	}
+
+	if err := d.Replace(ctx, testCluster, testNode(testNode2, "10.0.0.4")); err != nil {
+		t.Fatalf("failed to replace node: %s", err)
+	}
+
+	expected := []string{testCluster + "/" + testNode1, testCluster + "/" + testNode2}
+
+	if !reflect.DeepEqual(joined, expected) {
+		t.Fatalf("expected joins %v, got %v", expected, joined)
+	}
+}
+
+func TestTombstones(t *testing.T) {
+	ctx := context.Background()
+	d := db.NewRAM(db.RAMOptions{TombstoneRetention: time.Hour}, zap.NewNop())
+
+	if err := d.SetClusterConfig(ctx, testCluster, &types.ClusterConfig{AddressTTLSeconds: 1}); err != nil {
+		t.Fatalf("failed to set cluster config: %s", err)
+	}
+
+	for _, n := range []*types.Node{testNode(testNode1, "10.0.0.1"), testNode(testNode2, "10.0.0.2")} {
+		if err := d.Add(ctx, testCluster, n); err != nil {
+			t.Fatalf("failed to add node: %s", err)
+		}
+	}
+
+	time.Sleep(1100 * time.Millisecond)
+
+	if err := d.Add(ctx, testCluster, testNode(testNode1, "10.0.0.1")); err != nil {
+		t.Fatalf("failed to add node: %s", err)
+	}
+
+	if report := d.Clean(); report.RemovedNodes != 1 {
+		t.Fatalf("unexpected cleanup report: %+v", report)
+	}
+
+	changes, err := d.Changes(ctx, testCluster, 0)
+	if err != nil {
+		t.Fatalf("failed to get changes: %s", err)
+	}
+
+	if len(changes.Nodes) != 1 || len(changes.Removed) != 1 || changes.Removed[0] != testNode2 {
+		t.Fatalf("expected the snapshot to report the expired node as removed: %+v", changes)
+	}
+
+	// re-registration clears the tombstone
+	if err = d.Add(ctx, testCluster, testNode(testNode2, "10.0.0.2")); err != nil {
+		t.Fatalf("failed to add node: %s", err)
+	}
+
+	if changes, err = d.Changes(ctx, testCluster, 0); err != nil || len(changes.Removed) != 0 {
+		t.Fatalf("unexpected snapshot after re-registration: %+v, %v", changes, err)
+	}
+}
+
+func TestKeyIndexReject(t *testing.T) {
+	ctx := context.Background()
+	d := db.NewKeyIndex(db.New(zap.NewNop()), zap.NewNop(), true)
+
+	if err := d.Add(ctx, testCluster, testNode(testNode1, "10.0.0.1")); err != nil {
+		t.Fatalf("failed to add node: %s", err)
+	}
+
+	// same key in the same cluster is fine
+	if err := d.Replace(ctx, testCluster, testNode(testNode1, "10.0.0.2")); err != nil {
+		t.Fatalf("failed to replace node: %s", err)
+	}
+
+	if err := d.Add(ctx, testOtherCluster, testNode(testNode1, "10.0.0.1")); !errors.Is(err, db.ErrDuplicateKey) {
+		t.Fatalf("expected duplicate key error, got %v", err)
+	}
+
+	if _, err := d.DeleteCluster(ctx, testCluster); err != nil {
+		t.Fatalf("failed to delete cluster: %s", err)
+	}
+
+	if err := d.Add(ctx, testOtherCluster, testNode(testNode1, "10.0.0.1")); err != nil {
+		t.Fatalf("failed to add node after the cluster was deleted: %s", err)
+	}
+}
+
+func TestKeyIndexConcurrent(t *testing.T) {
+	ctx := context.Background()
+
+	for i := 0; i < 50; i++ {
+		d := db.NewKeyIndex(db.New(zap.NewNop()), zap.NewNop(), true)
+
+		var (
+			wg       sync.WaitGroup
+			accepted int32
+		)
+
+		for _, cluster := range []string{testCluster, testOtherCluster} {
+			cluster := cluster
+
+			wg.Add(1)
+
+			go func() {
+				defer wg.Done()
+
+				if d.Add(ctx, cluster, testNode(testNode1, "10.0.0.1")) == nil {
+					atomic.AddInt32(&accepted, 1)
+				}
+			}()
+		}
+
+		wg.Wait()
+
+		if accepted != 1 {
+			t.Fatalf("the key should be registered in exactly one cluster, got %d", accepted)
+		}
+	}
+}
+
+func TestClusterConfigLimit(t *testing.T) {
+	ctx := context.Background()
+	d := db.New(zap.NewNop())
+
+	if err := d.SetClusterConfig(ctx, testCluster, &types.ClusterConfig{MaxNodes: 1}); err != nil {
+		t.Fatalf("failed to set cluster config: %s", err)
+	}
+
+	if err := d.Add(ctx, testCluster, testNode(testNode1, "10.0.0.1")); err != nil {
+		t.Fatalf("failed to add node: %s", err)
+	}
+
+	// updating the existing node is still allowed
+	if err := d.Add(ctx, testCluster, testNode(testNode1, "10.0.0.2")); err != nil {
+		t.Fatalf("failed to update node: %s", err)
+	}
+
+	if err := d.Add(ctx, testCluster, testNode(testNode2, "10.0.0.3")); !errors.Is(err, db.ErrClusterFull) {
+		t.Fatalf("expected cluster full error, got %v", err)
+	}
+
+	if err := d.SetClusterConfig(ctx, testCluster, &types.ClusterConfig{}); err != nil {
+		t.Fatalf("failed to reset cluster config: %s", err)
+	}
+
+	if err := d.Add(ctx, testCluster, testNode(testNode2, "10.0.0.3")); err != nil {
+		t.Fatalf("failed to add node after the limit was removed: %s", err)
+	}
+}
+
+func TestKeyAllowlist(t *testing.T) {
+	ctx := context.Background()
+	d := db.New(zap.NewNop())
+
+	if err := d.SetClusterConfig(ctx, testCluster, &types.ClusterConfig{AllowedKeys: []string{testNode1}}); err != nil {
+		t.Fatalf("failed to set cluster config: %s", err)
+	}
+
+	if err := d.Add(ctx, testCluster, testNode(testNode1, "10.0.0.1")); err != nil {
+		t.Fatalf("failed to add allowed node: %s", err)
+	}
+
+	if err := d.Add(ctx, testCluster, testNode(testNode2, "10.0.0.2")); !errors.Is(err, db.ErrKeyNotAllowed) {
+		t.Fatalf("expected key not allowed error, got %v", err)
+	}
+
+	// other clusters keep the open registration
+	if err := d.Add(ctx, testOtherCluster, testNode(testNode2, "10.0.0.2")); err != nil {
+		t.Fatalf("failed to add node to another cluster: %s", err)
+	}
+
+	denied := db.NewDenylist(d, []string{testNode2})
+
+	if err := denied.Replace(ctx, testOtherCluster, testNode(testNode2, "10.0.0.3")); !errors.Is(err, db.ErrKeyNotAllowed) {
+		t.Fatalf("expected denied key error, got %v", err)
+	}
+
+	if err := denied.Touch(ctx, testOtherCluster, testNode2); !errors.Is(err, db.ErrKeyNotAllowed) {
+		t.Fatalf("expected denied key error on heartbeat, got %v", err)
+	}
+}
+
+func TestDeleteNodes(t *testing.T) {
+	ctx := context.Background()
+	d := db.New(zap.NewNop())
+
+	n1 := testNode(testNode1, "10.0.0.1")
+	n1.Labels = map[string]string{"zone": "us-east-1"}
+
+	n2 := testNode(testNode2, "10.0.0.2")
+	n2.Labels = map[string]string{"zone": "us-west-1"}
+
+	for _, n := range []*types.Node{n1, n2} {
+		if err := d.Add(ctx, testCluster, n); err != nil {
+			t.Fatalf("failed to add node: %s", err)
+		}
+	}
+
+	changes, err := d.Changes(ctx, testCluster, 0)
+	if err != nil {
+		t.Fatalf("failed to get changes: %s", err)
+	}
+
+	removed, err := d.DeleteNodes(ctx, testCluster, map[string]string{"zone": "us-east-1"})
+	if err != nil {
+		t.Fatalf("failed to delete nodes: %s", err)
+	}
+
+	if !reflect.DeepEqual(removed, []string{testNode1}) {
+		t.Fatalf("unexpected removed nodes: %v", removed)
+	}
+
+	changes, err = d.Changes(ctx, testCluster, changes.Cursor)
+	if err != nil {
+		t.Fatalf("failed to get changes: %s", err)
+	}
+
+	if !reflect.DeepEqual(changes.Removed, []string{testNode1}) || len(changes.Nodes) != 0 {
+		t.Fatalf("removal should be reported: %+v", changes)
+	}
+
+	if removed, err = d.DeleteNodes(ctx, testCluster, map[string]string{"zone": "eu-west-1"}); err != nil || len(removed) != 0 {
+		t.Fatalf("nothing should be removed: %v, %v", removed, err)
+	}
+
+	if _, err = d.DeleteNodes(ctx, testOtherCluster, map[string]string{"zone": "us-west-1"}); !errors.Is(err, db.ErrNotFound) {
+		t.Fatalf("expected not found error, got %v", err)
+	}
+}
+
+func TestMaxClusters(t *testing.T) {
+	ctx := context.Background()
+	d := db.NewRAM(db.RAMOptions{MaxClusters: 1}, zap.NewNop())
+
+	if err := d.Add(ctx, testCluster, testNode(testNode1, "10.0.0.1")); err != nil {
+		t.Fatalf("failed to add node: %s", err)
+	}
+
+	// recently active cluster is protected from the eviction
+	if err := d.Add(ctx, testOtherCluster, testNode(testNode2, "10.0.0.2")); !errors.Is(err, db.ErrTooManyClusters) {
+		t.Fatalf("expected too many clusters error, got %v", err)
+	}
+
+	if _, err := d.Get(ctx, testCluster, testNode1); err != nil {
+		t.Fatalf("protected cluster was evicted: %s", err)
+	}
+}
+
+func TestChangesUnknownCluster(t *testing.T) {
+	ctx := context.Background()
+	d := db.NewRAM(db.RAMOptions{MaxClusters: 1}, zap.NewNop())
+
+	// waiting for an unknown cluster doesn't take the only cluster slot
+	waitCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+
+	changes, err := d.Changes(waitCtx, testOtherCluster, 0)
+	if err != nil {
+		t.Fatalf("failed to get changes: %s", err)
+	}
+
+	if changes.Cursor != 0 || len(changes.Nodes) != 0 {
+		t.Fatalf("unexpected changes: %+v", changes)
+	}
+
+	if err = d.Add(ctx, testCluster, testNode(testNode1, "10.0.0.1")); err != nil {
+		t.Fatalf("failed to add node: %s", err)
+	}
+
+	if _, err = d.Get(ctx, testOtherCluster, testNode1); !errors.Is(err, db.ErrNotFound) {
+		t.Fatalf("expected not found error, got %v", err)
+	}
+
+	// the waiter is woken up once the cluster is created
+	d2 := db.NewRAM(db.RAMOptions{}, zap.NewNop())
+	done := make(chan *types.Changes, 1)
+
+	go func() {
+		c, _ := d2.Changes(ctx, testOtherCluster, 0) //nolint:errcheck
+
+		done <- c
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+
+	if err = d2.Add(ctx, testOtherCluster, testNode(testNode2, "10.0.0.2")); err != nil {
+		t.Fatalf("failed to add node: %s", err)
+	}
+
+	select {
+	case c := <-done:
+		if len(c.Nodes) != 1 || c.Nodes[0].ID != testNode2 {
+			t.Fatalf("unexpected changes: %+v", c)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("waiter was not woken up")
+	}
+}
+
+func TestReplay(t *testing.T) {
+	ctx := context.Background()
+	d := db.NewRAM(db.RAMOptions{}, zap.NewNop())
+
+	n2 := testNode(testNode2, "10.0.0.2")
+	n2.Labels = map[string]string{"zone": "us-east-1"}
+
+	for _, n := range []*types.Node{testNode(testNode1, "10.0.0.1"), n2, testNode(testNode1, "10.0.0.3")} {
+		if err := d.Add(ctx, testCluster, n); err != nil {
+			t.Fatalf("failed to add node: %s", err)
+		}
+	}
+
+	if _, err := d.DeleteNodes(ctx, testCluster, map[string]string{"zone": "us-east-1"}); err != nil {
+		t.Fatalf("failed to delete nodes: %s", err)
+	}
+
+	replay, err := d.(db.Replayer).Replay(ctx, testCluster)
+	if err != nil {
+		t.Fatalf("failed to replay changes: %s", err)
+	}
+
+	if len(replay.Events) != 4 || !replay.Events[3].Removed {
+		t.Fatalf("unexpected events: %+v", replay.Events)
+	}
+
+	// the replay carries the state of the changed nodes, the removed ones are left out
+	if len(replay.Nodes) != 1 || replay.Nodes[0].ID != testNode1 || len(replay.Nodes[0].Addresses) != 2 {
+		t.Fatalf("unexpected replayed nodes: %+v", replay.Nodes)
+	}
+}
+
+func TestSelfTest(t *testing.T) {
+	ctx := context.Background()
+	d := db.NewRAM(db.RAMOptions{}, zap.NewNop())
+
+	if err := db.SelfTest(ctx, d); err != nil {
+		t.Fatalf("self-test failed: %s", err)
+	}
+
+	// the sentinel cluster is removed
+	if err := d.ForEachCluster(ctx, func(cluster string, _ []*types.Node) error {
+		return fmt.Errorf("unexpected cluster %q left after the self-test", cluster)
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestShardedForEachCluster(t *testing.T) {
+	ctx := context.Background()
+	d := db.NewRAM(db.RAMOptions{Shards: 8}, zap.NewNop())
+
+	clusters := map[string]bool{}
+
+	for i := 0; i < 32; i++ {
+		cluster := fmt.Sprintf("cluster-%d", i)
+		clusters[cluster] = true
+
+		if err := d.Add(ctx, cluster, testNode(testNode1, "10.0.0.1")); err != nil {
+			t.Fatalf("failed to add node: %s", err)
+		}
+	}
+
+	if err := d.ForEachCluster(ctx, func(cluster string, nodes []*types.Node) error {
+		if !clusters[cluster] || len(nodes) != 1 {
+			t.Errorf("unexpected cluster %q with %d nodes", cluster, len(nodes))
+		}
+
+		delete(clusters, cluster)
+
+		return nil
+	}); err != nil {
+		t.Fatalf("failed to iterate clusters: %s", err)
+	}
+
+	if len(clusters) != 0 {
+		t.Errorf("clusters were not visited: %v", clusters)
+	}
+}
+
+func TestVersionConflict(t *testing.T) {
+	ctx := context.Background()
+	d := db.New(zap.NewNop())
+
+	if err := d.Add(db.ExpectVersion(ctx, 0), testCluster, testNode(testNode1, "10.0.0.1")); err != nil {
+		t.Fatalf("failed to add node: %s", err)
+	}
+
+	n, err := d.Get(ctx, testCluster, testNode1)
+	if err != nil {
+		t.Fatalf("failed to get node: %s", err)
+	}
+
+	version := n.Version
+
+	if err = d.Add(db.ExpectVersion(ctx, version), testCluster, testNode(testNode1, "10.0.0.2")); err != nil {
+		t.Fatalf("failed to update node with the current version: %s", err)
+	}
+
+	var conflict *db.VersionConflictError
+
+	err = d.Replace(db.ExpectVersion(ctx, version), testCluster, testNode(testNode1, "10.0.0.3"))
+	if !errors.As(err, &conflict) || conflict.Current != version+1 {
+		t.Fatalf("expected version conflict with current version %d, got %v", version+1, err)
+	}
+}
+
+func TestStaleGeneration(t *testing.T) {
+	ctx := context.Background()
+	d := db.New(zap.NewNop())
+
+	n := testNode(testNode1, "10.0.0.1")
+	n.Generation = 2
+
+	if err := d.Add(ctx, testCluster, n); err != nil {
+		t.Fatalf("failed to add node: %s", err)
+	}
+
+	stale := testNode(testNode1, "10.0.0.2")
+	stale.Generation = 1
+
+	if err := d.Add(ctx, testCluster, stale); !errors.Is(err, db.ErrStaleGeneration) {
+		t.Fatalf("expected stale generation to be rejected, got %v", err)
+	}
+
+	// not reported generation keeps the stored one
+	if err := d.Replace(ctx, testCluster, testNode(testNode1, "10.0.0.3")); err != nil {
+		t.Fatalf("failed to replace node: %s", err)
+	}
+
+	stored, err := d.Get(ctx, testCluster, testNode1)
+	if err != nil {
+		t.Fatalf("failed to get node: %s", err)
+	}
+
+	if stored.Generation != 2 || stored.IP.String() != "10.0.0.3" {
+		t.Fatalf("unexpected node after updates: generation %d, IP %s", stored.Generation, stored.IP)
+	}
+}
+
+func TestAddressTTL(t *testing.T) {
+	ctx := context.Background()
+	d := db.New(zap.NewNop())
+
+	n := testNode(testNode1, "10.0.0.1")
+	n.Addresses = append(n.Addresses, &types.Address{
+		Name:         "stale.mydomain.com",
+		TTLSeconds:   1,
+		LastReported: time.Now().Add(-2 * time.Second),
+	})
+
+	if err := d.Add(ctx, testCluster, n); err != nil {
+		t.Fatalf("failed to add node: %s", err)
+	}
+
+	stale := testNode(testNode2, "10.0.0.2")
+	stale.Addresses[0].TTLSeconds = 1
+	stale.Addresses[0].LastReported = time.Now().Add(-2 * time.Second)
+
+	if err := d.Add(ctx, testCluster, stale); err != nil {
+		t.Fatalf("failed to add node: %s", err)
+	}
+
+	if report := d.Clean(); report.RemovedNodes != 0 || report.RemovedClusters != 0 {
+		t.Fatalf("unexpected cleanup report: %+v", report)
+	}
+
+	list, err := d.List(ctx, testCluster)
+	if err != nil {
+		t.Fatalf("failed to list nodes: %s", err)
+	}
+
+	if len(list) != 2 {
+		t.Fatalf("nodes with pruned addresses should be kept: %v", list)
+	}
+
+	for _, n := range list {
+		switch n.ID {
+		case testNode1:
+			if len(n.Addresses) != 1 || n.Addresses[0].Name != "" {
+				t.Errorf("stale address was not pruned: %v", n.Addresses)
+			}
+		case testNode2:
+			if len(n.Addresses) != 0 {
+				t.Errorf("stale address was not pruned: %v", n.Addresses)
+			}
+		}
+	}
+}
+
+// BenchmarkRAMConcurrentClusters updates many clusters in parallel, each goroutine working on its own set of clusters.
+func BenchmarkRAMConcurrentClusters(b *testing.B) {
+	for _, shards := range []int{1, 16} {
+		shards := shards
+
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			ctx := context.Background()
+			d := db.NewRAM(db.RAMOptions{Shards: shards}, zap.NewNop())
+
+			var worker int32
+
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			b.RunParallel(func(pb *testing.PB) {
+				id := atomic.AddInt32(&worker, 1)
+
+				for i := 0; pb.Next(); i++ {
+					cluster := fmt.Sprintf("cluster-%d-%d", id, i%64)
+
+					if err := d.Add(ctx, cluster, testNode(testNode1, "10.0.0.1")); err != nil {
+						b.Fatal(err)
+					}
+
+					if _, err := d.List(ctx, cluster); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestInspect(t *testing.T) {
+	ctx := context.Background()
+	d := db.New(zap.NewNop())
+
+	if err := d.Add(ctx, testCluster, testNode(testNode1, "10.0.0.1")); err != nil {
+		t.Fatalf("failed to add node: %s", err)
+	}
+
+	state, err := d.(db.Inspector).Inspect(ctx, testCluster)
+	if err != nil {
+		t.Fatalf("failed to inspect cluster: %s", err)
+	}
+
+	if state.Revision != 1 || len(state.Nodes) != 1 {
+		t.Fatalf("unexpected cluster state: %+v", state)
+	}
+
+	n := state.Nodes[0]
+
+	if n.LastChange == nil || !n.LastChange.Created || n.LastChange.Revision != 1 {
+		t.Errorf("unexpected last change of the node: %+v", n.LastChange)
+	}
+
+	if !n.CollectableAt.After(n.LastSeen) {
+		t.Errorf("expected the node to be collectable after it was last seen, got %s", n.CollectableAt)
+	}
+
+	if _, err = d.(db.Inspector).Inspect(ctx, testOtherCluster); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("expected not found error, got %v", err)
+	}
+}
+
+func TestNodeCount(t *testing.T) {
+	ctx := context.Background()
+
+	for _, shards := range []int{1, 4} {
+		d := db.NewRAM(db.RAMOptions{Shards: shards}, zap.NewNop())
+
+		for i, cluster := range []string{testCluster, testOtherCluster} {
+			if err := d.Add(ctx, cluster, testNode(testNode1, fmt.Sprintf("10.0.0.%d", i+1))); err != nil {
+				t.Fatalf("failed to add node: %s", err)
+			}
+		}
+
+		if err := d.Add(ctx, testCluster, testNode(testNode2, "10.0.0.3")); err != nil {
+			t.Fatalf("failed to add node: %s", err)
+		}
+
+		// the count is up to date without a cleanup
+		if count := d.(db.NodeCounter).NodeCount(); count != 3 {
+			t.Errorf("%d shards: expected 3 nodes, got %d", shards, count)
+		}
+	}
+}
+
+func TestCleanReportsEmptiedClusters(t *testing.T) {
+	ctx := context.Background()
+
+	var emptied []string
+
+	d := db.NewRAM(db.RAMOptions{
+		OnClusterEmpty: func(cluster string) {
+			emptied = append(emptied, cluster)
+		},
+	}, zap.NewNop())
+
+	n := testNode(testNode1, "10.0.0.1")
+	n.Labels = map[string]string{"zone": "us-east-1"}
+
+	if err := d.Add(ctx, testCluster, n); err != nil {
+		t.Fatalf("failed to add node: %s", err)
+	}
+
+	if _, err := d.DeleteNodes(ctx, testCluster, n.Labels); err != nil {
+		t.Fatalf("failed to delete nodes: %s", err)
+	}
+
+	// the rejected registration leaves the cluster which never had any nodes
+	if err := d.Add(db.ExpectVersion(ctx, 3), testOtherCluster, testNode(testNode2, "10.0.0.2")); !errors.Is(err, db.ErrVersionConflict) {
+		t.Fatalf("expected version conflict, got %v", err)
+	}
+
+	report := d.Clean()
+
+	if report.RemovedClusters != 1 || !reflect.DeepEqual(emptied, []string{testCluster}) {
+		t.Fatalf("only the cluster which had nodes should be reported: %+v, %v", report, emptied)
+	}
+
+	clusters, err := d.ListClusters(ctx, "", 0)
+	if err != nil || len(clusters) != 0 {
+		t.Fatalf("unexpected clusters left: %v, %v", clusters, err)
+	}
+}
+
+func TestSummarizeExpiresStaleAddresses(t *testing.T) {
+	ctx := context.Background()
+	d := db.New(zap.NewNop())
+
+	n := testNode(testNode1, "10.0.0.1")
+	n.Addresses = append(n.Addresses, &types.Address{
+		IP:           netaddr.MustParseIP("10.0.0.2"),
+		Port:         51820,
+		TTLSeconds:   1,
+		LastReported: time.Now().Add(-2 * time.Second),
+	})
+
+	if err := d.Add(ctx, testCluster, n); err != nil {
+		t.Fatalf("failed to add node: %s", err)
+	}
+
+	summary, err := d.Summarize(ctx, testCluster)
+	if err != nil {
+		t.Fatalf("failed to summarize cluster: %s", err)
+	}
+
+	if summary.Nodes != 1 || summary.Endpoints != 1 {
+		t.Fatalf("stale address should not be summarized: %+v", summary)
+	}
+}
+
+func TestListClustersPaging(t *testing.T) {
+	ctx := context.Background()
+	d := db.New(zap.NewNop())
+
+	for i, cluster := range []string{"cluster-c", "cluster-a", "cluster-b"} {
+		for j := 0; j <= i; j++ {
+			if err := d.Add(ctx, cluster, testNode(fmt.Sprintf("node-%d", j), fmt.Sprintf("10.0.0.%d", j+1))); err != nil {
+				t.Fatalf("failed to add node: %s", err)
+			}
+		}
+	}
+
+	// the cluster without nodes is not listed
+	if err := d.Add(ctx, "cluster-0", testNode(testNode1, "10.0.0.1")); err != nil {
+		t.Fatalf("failed to add node: %s", err)
+	}
+
+	if _, err := d.DeleteNodes(ctx, "cluster-0", nil); err != nil {
+		t.Fatalf("failed to delete nodes: %s", err)
+	}
+
+	var pages [][]types.ClusterInfo
+
+	for after := ""; ; {
+		clusters, err := d.ListClusters(ctx, after, 2)
+		if err != nil {
+			t.Fatalf("failed to list clusters: %s", err)
+		}
+
+		if len(clusters) == 0 {
+			break
+		}
+
+		page := make([]types.ClusterInfo, 0, len(clusters))
+
+		for _, c := range clusters {
+			page = append(page, *c)
+		}
+
+		pages = append(pages, page)
+		after = clusters[len(clusters)-1].ID
+	}
+
+	expected := [][]types.ClusterInfo{
+		{{ID: "cluster-a", Nodes: 2}, {ID: "cluster-b", Nodes: 3}},
+		{{ID: "cluster-c", Nodes: 1}},
+	}
+
+	if !reflect.DeepEqual(pages, expected) {
+		t.Fatalf("unexpected pages %v, expected %v", pages, expected)
+	}
+
+	// zero limit lists all clusters
+	clusters, err := d.ListClusters(ctx, "", 0)
+	if err != nil || len(clusters) != 3 {
+		t.Fatalf("unexpected clusters %v, %v", clusters, err)
+	}
+}
+
+func TestWalk(t *testing.T) {
+	ctx := context.Background()
+	d := db.New(zap.NewNop())
+
+	// more than a single page of nodes
+	const count = 250
+
+	for i := 0; i < count; i++ {
+		if err := d.Add(ctx, testCluster, testNode(fmt.Sprintf("node-%03d", i), fmt.Sprintf("10.0.%d.%d", i/200, i%200+1))); err != nil {
+			t.Fatalf("failed to add node: %s", err)
+		}
+	}
+
+	var ids []string
+
+	if err := d.Walk(ctx, testCluster, func(n *types.Node) error {
+		ids = append(ids, n.ID)
+
+		// the walked nodes are copies
+		n.Name = "changed"
+		n.Addresses = nil
+
+		return nil
+	}); err != nil {
+		t.Fatalf("failed to walk the cluster: %s", err)
+	}
+
+	if len(ids) != count {
+		t.Fatalf("unexpected number of walked nodes %d", len(ids))
+	}
+
+	for i, id := range ids {
+		if expected := fmt.Sprintf("node-%03d", i); id != expected {
+			t.Fatalf("unexpected node %q at %d, expected %q", id, i, expected)
+		}
+	}
+
+	n, err := d.Get(ctx, testCluster, "node-000")
+	if err != nil {
+		t.Fatalf("failed to get node: %s", err)
+	}
+
+	if n.Name == "changed" || len(n.Addresses) != 1 {
+		t.Errorf("the stored node was changed through the walk: %+v", n)
+	}
+
+	errStop := errors.New("stop")
+	walked := 0
+
+	if err = d.Walk(ctx, testCluster, func(*types.Node) error {
+		walked++
+
+		return errStop
+	}); !errors.Is(err, errStop) || walked != 1 {
+		t.Errorf("unexpected walk stop after %d nodes: %v", walked, err)
+	}
+
+	if err = d.Walk(ctx, testOtherCluster, func(*types.Node) error { return nil }); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("unexpected error walking an unknown cluster: %v", err)
+	}
+}
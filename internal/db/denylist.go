@@ -0,0 +1,83 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package db
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/talos-systems/kubespan-manager/pkg/types"
+)
+
+// denylistDB rejects the writes of the banned node keys in every cluster.
+//
+// The denylist bans compromised keys service-wide, the per-cluster allowlists are kept in the cluster config.
+type denylistDB struct {
+	DB
+
+	denied map[string]struct{}
+}
+
+// NewDenylist wraps the backend, rejecting the writes of the denied node keys with ErrKeyNotAllowed.
+//
+// Keys should be in the canonical form, see types.NormalizeKey.
+func NewDenylist(backend DB, keys []string) DB {
+	denied := make(map[string]struct{}, len(keys))
+
+	for _, key := range keys {
+		denied[key] = struct{}{}
+	}
+
+	return &denylistDB{
+		DB:     backend,
+		denied: denied,
+	}
+}
+
+func (d *denylistDB) check(id string) error {
+	if _, ok := d.denied[id]; ok {
+		return fmt.Errorf("%w: key %q is denied", ErrKeyNotAllowed, id)
+	}
+
+	return nil
+}
+
+// Add implements DB.
+func (d *denylistDB) Add(ctx context.Context, cluster string, n *types.Node) error {
+	if err := d.check(n.ID); err != nil {
+		return err
+	}
+
+	return d.DB.Add(ctx, cluster, n)
+}
+
+// Replace implements DB.
+func (d *denylistDB) Replace(ctx context.Context, cluster string, n *types.Node) error {
+	if err := d.check(n.ID); err != nil {
+		return err
+	}
+
+	return d.DB.Replace(ctx, cluster, n)
+}
+
+// AddAddresses implements DB.
+func (d *denylistDB) AddAddresses(ctx context.Context, cluster, id string, ep ...*types.Address) error {
+	if err := d.check(id); err != nil {
+		return err
+	}
+
+	return d.DB.AddAddresses(ctx, cluster, id, ep...)
+}
+
+// Touch implements DB.
+//
+// Heartbeats of the denied keys are rejected as well, so that the nodes registered before the ban expire.
+func (d *denylistDB) Touch(ctx context.Context, cluster, id string) error {
+	if err := d.check(id); err != nil {
+		return err
+	}
+
+	return d.DB.Touch(ctx, cluster, id)
+}
@@ -0,0 +1,259 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package db
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+
+	"github.com/talos-systems/kubespan-manager/pkg/types"
+)
+
+var (
+	nodeUpdateRate = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "discovery_node_updates_per_window",
+		Help:    "Number of updates of a node within the flapping detection window, observed on every update.",
+		Buckets: []float64{1, 2, 5, 10, 20, 50, 100},
+	})
+
+	flappingNodes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "discovery_flapping_nodes",
+		Help: "Number of nodes updated more often than the flapping threshold within the detection window.",
+	})
+
+	dampenedNotifications = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "discovery_dampened_notifications_total",
+		Help: "Number of change notifications delayed because of flapping nodes.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(nodeUpdateRate, flappingNodes, dampenedNotifications)
+}
+
+// FlapOptions configures the detection of flapping nodes.
+type FlapOptions struct {
+	// Window is the sliding window the node updates are counted in.
+	Window time.Duration
+
+	// Threshold is the number of updates within the window above which the node is considered flapping.
+	Threshold int
+
+	// Dampen is the delay of the change notifications involving flapping nodes, zero disables the dampening.
+	//
+	// Changes are read again after the delay, so the subscribers always get the latest state.
+	Dampen time.Duration
+}
+
+// flapDB tracks the update frequency of the nodes, detecting the nodes which rapidly change their endpoints
+// (e.g. NAT rebinding, mobile links).
+//
+// Only the writes changing the addresses of the node are counted, so the heartbeats re-reporting
+// the same addresses don't make the node flapping. The node is read before and after the write to tell.
+type flapDB struct {
+	DB
+
+	logger *zap.Logger
+	opts   FlapOptions
+
+	mu      sync.Mutex
+	updates map[string]*nodeUpdates
+}
+
+// nodeUpdates is the update history of a single node within the window.
+type nodeUpdates struct {
+	times    []time.Time
+	flapping bool
+}
+
+// NewFlapDetector wraps the backend with the detection of flapping nodes.
+func NewFlapDetector(backend DB, logger *zap.Logger, opts FlapOptions) DB {
+	return &flapDB{
+		DB:      backend,
+		logger:  logger,
+		opts:    opts,
+		updates: make(map[string]*nodeUpdates),
+	}
+}
+
+func flapKey(cluster, id string) string {
+	return cluster + "/" + id
+}
+
+// trim drops the updates which fell out of the window, and updates the flapping state of the node.
+//
+// It should be called with the mutex held.
+func (d *flapDB) trim(u *nodeUpdates, now time.Time) {
+	var i int
+
+	for i < len(u.times) && now.Sub(u.times[i]) > d.opts.Window {
+		i++
+	}
+
+	u.times = u.times[i:]
+
+	flapping := len(u.times) > d.opts.Threshold
+
+	switch {
+	case flapping && !u.flapping:
+		flappingNodes.Inc()
+	case !flapping && u.flapping:
+		flappingNodes.Dec()
+	}
+
+	u.flapping = flapping
+}
+
+// write runs the write of the node, and records the update if the write changed the addresses of the node.
+func (d *flapDB) write(ctx context.Context, cluster, id string, write func() error) error {
+	prev, err := d.DB.Get(ctx, cluster, id)
+
+	switch {
+	case err == nil:
+		// the in-memory backend returns the live node, which is changed by the write
+		prev = prev.Snapshot()
+	case errors.Is(err, ErrNotFound):
+	default:
+		// the change can't be told, so the write is not counted
+		return write()
+	}
+
+	if err = write(); err != nil {
+		return err
+	}
+
+	n, err := d.DB.Get(ctx, cluster, id)
+	if err != nil {
+		// the write itself succeeded
+		return nil //nolint:nilerr
+	}
+
+	if n.Diff(prev).Fields&types.FieldAddresses != 0 {
+		d.record(ctx, cluster, id)
+	}
+
+	return nil
+}
+
+// record tracks the update of the node.
+func (d *flapDB) record(ctx context.Context, cluster, id string) {
+	now := time.Now()
+	key := flapKey(cluster, id)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	u, ok := d.updates[key]
+	if !ok {
+		u = &nodeUpdates{}
+		d.updates[key] = u
+	}
+
+	wasFlapping := u.flapping
+
+	u.times = append(u.times, now)
+	d.trim(u, now)
+
+	nodeUpdateRate.Observe(float64(len(u.times)))
+
+	if u.flapping && !wasFlapping {
+		requestLogger(ctx, d.logger).Warn("node is flapping",
+			zap.String("cluster", cluster),
+			zap.String("node", id),
+			zap.Int("updates", len(u.times)),
+			zap.Duration("window", d.opts.Window),
+		)
+	}
+}
+
+// flapping reports whether any of the nodes is flapping.
+func (d *flapDB) flapping(cluster string, nodes []*types.Node) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, n := range nodes {
+		if u, ok := d.updates[flapKey(cluster, n.ID)]; ok && u.flapping {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Add implements DB.
+func (d *flapDB) Add(ctx context.Context, cluster string, n *types.Node) error {
+	return d.write(ctx, cluster, n.ID, func() error {
+		return d.DB.Add(ctx, cluster, n)
+	})
+}
+
+// Replace implements DB.
+func (d *flapDB) Replace(ctx context.Context, cluster string, n *types.Node) error {
+	return d.write(ctx, cluster, n.ID, func() error {
+		return d.DB.Replace(ctx, cluster, n)
+	})
+}
+
+// AddAddresses implements DB.
+func (d *flapDB) AddAddresses(ctx context.Context, cluster, id string, ep ...*types.Address) error {
+	return d.write(ctx, cluster, id, func() error {
+		return d.DB.AddAddresses(ctx, cluster, id, ep...)
+	})
+}
+
+// RemoveAddress implements DB.
+func (d *flapDB) RemoveAddress(ctx context.Context, cluster, id string, addr *types.Address) error {
+	return d.write(ctx, cluster, id, func() error {
+		return d.DB.RemoveAddress(ctx, cluster, id, addr)
+	})
+}
+
+// Changes implements DB.
+//
+// If dampening is enabled and the changes involve a flapping node, the changes are read again
+// after the dampening delay, coalescing the updates of the delay into a single notification.
+func (d *flapDB) Changes(ctx context.Context, cluster string, since uint64) (*types.Changes, error) {
+	changes, err := d.DB.Changes(ctx, cluster, since)
+	if err != nil || d.opts.Dampen <= 0 || changes.Reset || !d.flapping(cluster, changes.Nodes) {
+		return changes, err
+	}
+
+	dampenedNotifications.Inc()
+
+	select {
+	case <-time.After(d.opts.Dampen):
+	case <-ctx.Done():
+		return changes, nil
+	}
+
+	return d.DB.Changes(ctx, cluster, since)
+}
+
+// Clean implements DB.
+//
+// Nodes which were not updated within the window are forgotten.
+func (d *flapDB) Clean() *CleanReport {
+	report := d.DB.Clean()
+
+	now := time.Now()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for key, u := range d.updates {
+		d.trim(u, now)
+
+		if len(u.times) == 0 {
+			delete(d.updates, key)
+		}
+	}
+
+	return report
+}
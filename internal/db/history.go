@@ -0,0 +1,74 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package db
+
+import (
+	"context"
+	"time"
+
+	"github.com/talos-systems/kubespan-manager/pkg/types"
+)
+
+// Replayer is implemented by the backends which keep the individual recent changes of the clusters.
+type Replayer interface {
+	// Replay returns the retained changes of the cluster in the order they happened.
+	Replay(ctx context.Context, cluster string) (*types.Replay, error)
+}
+
+// historySize is the number of recent changes kept per cluster to replay them to clients resuming from a cursor.
+const historySize = 256
+
+// change is a single change of a cluster node.
+type change struct {
+	id       string
+	revision uint64
+	removed  bool
+
+	// at is the time the change was recorded
+	at time.Time
+
+	// delta tells which fields of the node changed
+	delta types.NodeDelta
+}
+
+// changeHistory is a bounded ring buffer of the recent changes of a cluster.
+type changeHistory struct {
+	buf  [historySize]change
+	next int
+	len  int
+}
+
+func (h *changeHistory) push(c change) {
+	h.buf[h.next] = c
+	h.next = (h.next + 1) % historySize
+
+	if h.len < historySize {
+		h.len++
+	}
+}
+
+// covers indicates whether all the changes after the revision are still in the buffer.
+func (h *changeHistory) covers(revision uint64) bool {
+	if h.len < historySize {
+		return true
+	}
+
+	oldest := h.buf[h.next].revision
+
+	return oldest <= revision+1
+}
+
+// since calls fn for every buffered change after the revision, from the oldest to the newest.
+func (h *changeHistory) since(revision uint64, fn func(c change)) {
+	start := (h.next - h.len + historySize) % historySize
+
+	for i := 0; i < h.len; i++ {
+		c := h.buf[(start+i)%historySize]
+
+		if c.revision > revision {
+			fn(c)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package db
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/talos-systems/kubespan-manager/pkg/types"
+)
+
+// Inspector is implemented by the backends which can dump the internal state of a cluster.
+type Inspector interface {
+	// Inspect returns the internal state of the cluster.
+	Inspect(ctx context.Context, cluster string) (*ClusterState, error)
+}
+
+// ClusterState is the internal state of a cluster.
+//
+// It is meant for debugging only, the format is not stable and might change without notice.
+type ClusterState struct {
+	Config *types.ClusterConfig `json:"config"`
+
+	// Revision is the revision of the last change, History is the number of the retained changes.
+	Revision uint64 `json:"revision"`
+	History  int    `json:"history"`
+
+	// Waiters is the number of the pending Changes calls of the cluster.
+	Waiters int `json:"waiters"`
+
+	LastActive        time.Time `json:"lastActive"`
+	AddressTTLSeconds int       `json:"addressTTLSeconds"`
+
+	Nodes      []*NodeState      `json:"nodes"`
+	Tombstones []*TombstoneState `json:"tombstones"`
+}
+
+// NodeState is the internal state of a cluster node.
+type NodeState struct {
+	ID           string    `json:"id"`
+	Version      uint64    `json:"version"`
+	Sticky       bool      `json:"sticky,omitempty"`
+	Addresses    int       `json:"addresses"`
+	LastSeen     time.Time `json:"lastSeen"`
+	LastModified time.Time `json:"lastModified"`
+
+	// CollectableAt is the time after which the node is removed by the next cleanup,
+	// unless it is updated before, zero for the sticky nodes.
+	CollectableAt time.Time `json:"collectableAt"`
+
+	// LastChange is the last retained change of the node, nil if it is no longer retained.
+	LastChange *types.ChangeEvent `json:"lastChange,omitempty"`
+}
+
+// TombstoneState is the tombstone of a recently expired node.
+type TombstoneState struct {
+	ID      string    `json:"id"`
+	Removed time.Time `json:"removed"`
+	PurgeAt time.Time `json:"purgeAt"`
+}
+
+// collectableAt returns the time the node becomes eligible for the removal: once its last address expires
+// and the node is not seen for the TTL.
+func collectableAt(n *types.Node, ttl time.Duration) time.Time {
+	if n.Sticky {
+		return time.Time{}
+	}
+
+	at := n.LastSeen.Add(ttl)
+
+	for _, a := range n.Addresses {
+		if expires := a.LastReported.Add(a.TTL(ttl)); expires.After(at) {
+			at = expires
+		}
+	}
+
+	return at
+}
+
+// Inspect implements Inspector.
+func (d *ramDB) Inspect(ctx context.Context, cluster string) (*ClusterState, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	c, ok := d.db[cluster]
+	if !ok {
+		return nil, fmt.Errorf("cluster %q: %w", cluster, ErrNotFound)
+	}
+
+	ttl := c.config.AddressTTL(AddressExpirationTimeout)
+
+	state := &ClusterState{
+		Revision:          c.revision,
+		History:           c.history.len,
+		Waiters:           c.watchers,
+		LastActive:        c.lastActive,
+		AddressTTLSeconds: int(ttl / time.Second),
+		Nodes:             make([]*NodeState, 0, len(c.nodes)),
+		Tombstones:        make([]*TombstoneState, 0, len(c.tombstones)),
+	}
+
+	if c.config != nil {
+		cfg := *c.config
+		state.Config = &cfg
+	}
+
+	lastChanges := make(map[string]*types.ChangeEvent)
+
+	c.history.since(0, func(ch change) {
+		lastChanges[ch.id] = &types.ChangeEvent{
+			Revision: ch.revision,
+			ID:       ch.id,
+			Created:  ch.delta.Created,
+			Removed:  ch.removed,
+			Time:     ch.at,
+			Delta:    ch.delta,
+		}
+	})
+
+	for id, stored := range c.nodes {
+		n := stored.Snapshot()
+
+		state.Nodes = append(state.Nodes, &NodeState{
+			ID:            id,
+			Version:       n.Version,
+			Sticky:        n.Sticky,
+			Addresses:     len(n.Addresses),
+			LastSeen:      n.LastSeen,
+			LastModified:  n.LastModified,
+			CollectableAt: collectableAt(n, ttl),
+			LastChange:    lastChanges[id],
+		})
+	}
+
+	for k, removed := range c.tombstones {
+		id, ok := c.tombstoneIDs[k]
+		if !ok {
+			id = k.String()
+		}
+
+		state.Tombstones = append(state.Tombstones, &TombstoneState{
+			ID:      id,
+			Removed: removed,
+			PurgeAt: removed.Add(d.tombstoneRetention),
+		})
+	}
+
+	sort.Slice(state.Nodes, func(i, j int) bool {
+		return state.Nodes[i].ID < state.Nodes[j].ID
+	})
+
+	sort.Slice(state.Tombstones, func(i, j int) bool {
+		return state.Tombstones[i].ID < state.Tombstones[j].ID
+	})
+
+	return state, nil
+}
@@ -0,0 +1,52 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package db
+
+import (
+	"context"
+
+	"github.com/talos-systems/kubespan-manager/pkg/types"
+)
+
+// joinDB reports the nodes which join the clusters.
+type joinDB struct {
+	DB
+
+	onJoin func(cluster string, n *types.Node)
+}
+
+// NewJoinNotifier wraps the backend, calling onJoin for every node created by Add or Replace (but not updated).
+//
+// The node is read back after the write: the first version of the node means that the write created it.
+// A node re-registering after it expired joins again. onJoin is called synchronously, so it should not block.
+func NewJoinNotifier(backend DB, onJoin func(cluster string, n *types.Node)) DB {
+	return &joinDB{
+		DB:     backend,
+		onJoin: onJoin,
+	}
+}
+
+func (d *joinDB) check(ctx context.Context, cluster, id string, err error) error {
+	if err != nil {
+		return err
+	}
+
+	n, e := d.DB.Get(ctx, cluster, id)
+	if e == nil && n.Version == 1 {
+		d.onJoin(cluster, n)
+	}
+
+	return nil
+}
+
+// Add implements DB.
+func (d *joinDB) Add(ctx context.Context, cluster string, n *types.Node) error {
+	return d.check(ctx, cluster, n.ID, d.DB.Add(ctx, cluster, n))
+}
+
+// Replace implements DB.
+func (d *joinDB) Replace(ctx context.Context, cluster string, n *types.Node) error {
+	return d.check(ctx, cluster, n.ID, d.DB.Replace(ctx, cluster, n))
+}
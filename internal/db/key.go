@@ -0,0 +1,49 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package db
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+)
+
+// keyEncoding is the canonical textual form of the node IDs, see types.NormalizeKey.
+var keyEncoding = base64.StdEncoding.Strict()
+
+// nodeKey is the compact form of the node ID, used by the in-memory backend for the state which outlives the nodes.
+//
+// Node IDs are Wireguard public keys, 44 bytes in the textual form: the key holds the 32 raw bytes inline
+// instead of a pointer to a separately allocated string.
+// The live nodes are still keyed by the ID strings, which are shared with the stored nodes, so they take no extra space.
+//
+// IDs which are not canonical keys (e.g. the self-test sentinel) are keyed by their hash.
+type nodeKey [32]byte
+
+// keyOf returns the key of the node ID, and whether the ID is a canonical key which can be restored from the key.
+func keyOf(id string) (nodeKey, bool) {
+	var (
+		k   nodeKey
+		src [44]byte
+		buf [33]byte
+	)
+
+	// copied to the buffers on the stack, so that the lookups don't allocate
+	if len(id) == len(src) {
+		copy(src[:], id)
+
+		if n, err := keyEncoding.Decode(buf[:], src[:]); err == nil && n == len(k) {
+			copy(k[:], buf[:n])
+
+			return k, true
+		}
+	}
+
+	return sha256.Sum256([]byte(id)), false
+}
+
+// String returns the textual form of the canonical key.
+func (k nodeKey) String() string {
+	return keyEncoding.EncodeToString(k[:])
+}
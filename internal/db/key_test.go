@@ -0,0 +1,76 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package db
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"runtime"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestKeyOf(t *testing.T) {
+	for _, id := range []string{
+		"IHOPEfmiUG1kE832FAxm77J5WP0O1ZHp9OwqbGowL1E=",
+		"9NqSzEoeNRqwCaBKdkxUR2dqvhxMyUe5nDm9yZ3JSn0=",
+	} {
+		k, canonical := keyOf(id)
+		if !canonical || k.String() != id {
+			t.Errorf("expected %q to round trip, got %q (canonical %v)", id, k.String(), canonical)
+		}
+	}
+
+	// not canonical: URL-safe alphabet, missing padding, non-zero padding bits, not a key at all
+	for _, id := range []string{
+		"IHOPEfmiUG1kE832FAxm77J5WP0O1ZHp9OwqbGowL1E",
+		"-NqSzEoeNRqwCaBKdkxUR2dqvhxMyUe5nDm9yZ3JSn0=",
+		"IHOPEfmiUG1kE832FAxm77J5WP0O1ZHp9OwqbGowL1F=",
+		"self-test",
+	} {
+		if _, canonical := keyOf(id); canonical {
+			t.Errorf("expected %q not to be canonical", id)
+		}
+	}
+}
+
+func heapInUse() uint64 {
+	runtime.GC()
+
+	var stats runtime.MemStats
+
+	runtime.ReadMemStats(&stats)
+
+	return stats.HeapAlloc
+}
+
+// BenchmarkTombstoneMemory reports the heap retained per tombstone by a cluster of 10k expired nodes.
+//
+// The IDs are decoded for every node as they would be from the request bodies.
+func BenchmarkTombstoneMemory(b *testing.B) {
+	const size = 10000
+
+	for i := 0; i < b.N; i++ {
+		before := heapInUse()
+
+		d := newRAM(RAMOptions{TombstoneRetention: time.Hour}, zap.NewNop())
+		c := newRAMCluster()
+		d.db["cluster"] = c
+
+		for j := 0; j < size; j++ {
+			var k [32]byte
+
+			binary.BigEndian.PutUint64(k[:], uint64(j)+1)
+
+			c.bury(base64.StdEncoding.EncodeToString(k[:]), time.Now())
+		}
+
+		b.ReportMetric(float64(heapInUse()-before)/size, "B/tombstone")
+
+		runtime.KeepAlive(d)
+	}
+}
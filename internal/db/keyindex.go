@@ -0,0 +1,246 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+
+	"github.com/talos-systems/kubespan-manager/pkg/types"
+)
+
+// ErrDuplicateKey means that the node key is already registered in another cluster.
+var ErrDuplicateKey = errors.New("node key is registered in another cluster")
+
+var duplicateKeys = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "discovery_duplicate_keys_total",
+	Help: "Number of node registrations with a key already registered in another cluster.",
+}, []string{"action"})
+
+func init() {
+	prometheus.MustRegister(duplicateKeys)
+}
+
+// keyLockStripes is the number of the locks serializing the registrations of the same key.
+const keyLockStripes = 64
+
+// keyIndexDB tracks the cluster each node key is registered in, detecting the same key used in several clusters.
+//
+// The index is kept in memory and is rebuilt from the registrations seen by this instance.
+// Index entries are verified against the backend before being reported, so that expired nodes don't count,
+// and the entries of the expired nodes are pruned on Clean.
+type keyIndexDB struct {
+	DB
+
+	logger *zap.Logger
+	reject bool
+
+	mu   sync.Mutex
+	keys map[string]string
+
+	// keyLocks are held across the check and the write of the key, so that the same key registering
+	// in two clusters at once is still detected.
+	keyLocks [keyLockStripes]sync.Mutex
+}
+
+// NewKeyIndex wraps the backend with the index of node keys.
+//
+// Registering a key which is already known in another cluster is logged, and rejected with ErrDuplicateKey
+// if reject is set.
+func NewKeyIndex(backend DB, logger *zap.Logger, reject bool) DB {
+	return &keyIndexDB{
+		DB:     backend,
+		logger: logger,
+		reject: reject,
+		keys:   make(map[string]string),
+	}
+}
+
+// check verifies that the key is not registered in another cluster.
+func (d *keyIndexDB) check(ctx context.Context, cluster, id string) error {
+	d.mu.Lock()
+	other, ok := d.keys[id]
+	d.mu.Unlock()
+
+	if !ok || other == cluster {
+		return nil
+	}
+
+	if _, err := d.DB.Get(ctx, other, id); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			// stale entry, the node is gone from the other cluster
+			return nil
+		}
+
+		return err
+	}
+
+	action := "warn"
+	if d.reject {
+		action = "reject"
+	}
+
+	duplicateKeys.WithLabelValues(action).Inc()
+
+	requestLogger(ctx, d.logger).Warn("node key is registered in another cluster",
+		zap.String("cluster", cluster),
+		zap.String("node", id),
+		zap.String("other_cluster", other),
+		zap.String("action", action),
+	)
+
+	if d.reject {
+		return fmt.Errorf("cluster %q: %w", other, ErrDuplicateKey)
+	}
+
+	return nil
+}
+
+// lockKey locks the registrations of the key, the returned function unlocks them.
+func (d *keyIndexDB) lockKey(id string) func() {
+	h := fnv.New32a()
+	h.Write([]byte(id)) //nolint:errcheck
+
+	l := &d.keyLocks[h.Sum32()%keyLockStripes]
+	l.Lock()
+
+	return l.Unlock
+}
+
+func (d *keyIndexDB) index(cluster, id string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.keys[id] = cluster
+}
+
+// Add implements DB.
+func (d *keyIndexDB) Add(ctx context.Context, cluster string, n *types.Node) error {
+	defer d.lockKey(n.ID)()
+
+	if err := d.check(ctx, cluster, n.ID); err != nil {
+		return err
+	}
+
+	if err := d.DB.Add(ctx, cluster, n); err != nil {
+		return err
+	}
+
+	d.index(cluster, n.ID)
+
+	return nil
+}
+
+// Replace implements DB.
+func (d *keyIndexDB) Replace(ctx context.Context, cluster string, n *types.Node) error {
+	defer d.lockKey(n.ID)()
+
+	if err := d.check(ctx, cluster, n.ID); err != nil {
+		return err
+	}
+
+	if err := d.DB.Replace(ctx, cluster, n); err != nil {
+		return err
+	}
+
+	d.index(cluster, n.ID)
+
+	return nil
+}
+
+// Clean implements DB.
+//
+// Index entries of the nodes which are gone from the backend are pruned, one cluster listing per indexed cluster.
+func (d *keyIndexDB) Clean() *CleanReport {
+	report := d.DB.Clean()
+
+	d.mu.Lock()
+
+	clusters := make(map[string][]string)
+
+	for id, cluster := range d.keys {
+		clusters[cluster] = append(clusters[cluster], id)
+	}
+
+	d.mu.Unlock()
+
+	for cluster, ids := range clusters {
+		nodes, err := d.DB.List(context.Background(), cluster)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			d.logger.Warn("failed to prune the key index",
+				zap.String("cluster", cluster),
+				zap.Error(err),
+			)
+
+			continue
+		}
+
+		live := make(map[string]struct{}, len(nodes))
+
+		for _, n := range nodes {
+			live[n.ID] = struct{}{}
+		}
+
+		for _, id := range ids {
+			if _, ok := live[id]; ok {
+				continue
+			}
+
+			unlock := d.lockKey(id)
+
+			d.mu.Lock()
+
+			if d.keys[id] == cluster {
+				delete(d.keys, id)
+			}
+
+			d.mu.Unlock()
+
+			unlock()
+		}
+	}
+
+	return report
+}
+
+// DeleteCluster implements DB.
+func (d *keyIndexDB) DeleteCluster(ctx context.Context, cluster string) (int, error) {
+	count, err := d.DB.DeleteCluster(ctx, cluster)
+
+	d.mu.Lock()
+
+	for id, c := range d.keys {
+		if c == cluster {
+			delete(d.keys, id)
+		}
+	}
+
+	d.mu.Unlock()
+
+	return count, err
+}
+
+// DeleteNodes implements DB.
+func (d *keyIndexDB) DeleteNodes(ctx context.Context, cluster string, selector map[string]string) ([]string, error) {
+	removed, err := d.DB.DeleteNodes(ctx, cluster, selector)
+
+	d.mu.Lock()
+
+	for _, id := range removed {
+		if d.keys[id] == cluster {
+			delete(d.keys, id)
+		}
+	}
+
+	d.mu.Unlock()
+
+	return removed, err
+}
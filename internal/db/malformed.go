@@ -0,0 +1,114 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package db
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+// ErrMalformed means that the stored node can't be decoded.
+var ErrMalformed = errors.New("malformed node entry")
+
+var deserializeErrors = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "discovery_db_deserialize_errors_total",
+	Help: "Number of stored node entries which failed to decode.",
+})
+
+func init() {
+	prometheus.MustRegister(deserializeErrors)
+}
+
+// malformedTracker records the first decode failure of the stored entries.
+//
+// Entries which keep failing to decode for longer than the grace period are deleted.
+type malformedTracker struct {
+	grace time.Duration
+
+	mu    sync.Mutex
+	since map[string]time.Time
+}
+
+// fail records the decode failure of the key and reports whether the entry should be deleted.
+func (t *malformedTracker) fail(key string) bool {
+	if t.grace <= 0 {
+		return false
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.since == nil {
+		t.since = make(map[string]time.Time)
+	}
+
+	first, ok := t.since[key]
+	if !ok {
+		t.since[key] = time.Now()
+
+		return false
+	}
+
+	if time.Since(first) < t.grace {
+		return false
+	}
+
+	delete(t.since, key)
+
+	return true
+}
+
+// ok forgets the failure of the key once it decodes successfully (e.g. after being overwritten).
+func (t *malformedTracker) ok(key string) {
+	if t.grace <= 0 {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.since, key)
+}
+
+// malformed handles the node entry which failed to decode.
+//
+// The failure is logged and counted, and the entry is removed once the grace period expires.
+func (d *redisDB) malformed(ctx context.Context, cluster, id string, err error) {
+	key := d.clusterNodeKey(cluster, id)
+	logger := requestLogger(ctx, d.logger)
+
+	deserializeErrors.Inc()
+
+	logger.Warn("skipping malformed node entry",
+		zap.String("key", key),
+		zap.String("cluster", cluster),
+		zap.String("node", id),
+		zap.Error(err),
+	)
+
+	if !d.malformedNodes.fail(key) {
+		return
+	}
+
+	tx := d.rc.TxPipeline()
+	tx.Del(ctx, key)
+	tx.SRem(ctx, d.clusterNodesKey(cluster), id)
+
+	if _, err = tx.Exec(ctx); err != nil {
+		logger.Warn("failed to delete malformed node entry",
+			zap.String("key", key),
+			zap.Error(d.breaker.observe(err)),
+		)
+
+		return
+	}
+
+	logger.Info("deleted malformed node entry", zap.String("key", key))
+}
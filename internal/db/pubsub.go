@@ -0,0 +1,93 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package db
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// redisNotifier wakes up the local long-poll waiters on the changes published by any replica.
+type redisNotifier struct {
+	mu      sync.Mutex
+	waiters map[string]*redisWaiters
+}
+
+// redisWaiters is the set of waiters of a cluster, the channel is closed on the next change.
+type redisWaiters struct {
+	ch   chan struct{}
+	refs int
+}
+
+// wait returns the channel which is closed on the next change of the cluster.
+//
+// The release function should be called once the caller stops waiting.
+func (n *redisNotifier) wait(cluster string) (<-chan struct{}, func()) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.waiters == nil {
+		n.waiters = make(map[string]*redisWaiters)
+	}
+
+	w, ok := n.waiters[cluster]
+	if !ok {
+		w = &redisWaiters{
+			ch: make(chan struct{}),
+		}
+
+		n.waiters[cluster] = w
+	}
+
+	w.refs++
+
+	return w.ch, func() {
+		n.mu.Lock()
+		defer n.mu.Unlock()
+
+		w.refs--
+
+		if w.refs == 0 && n.waiters[cluster] == w {
+			delete(n.waiters, cluster)
+		}
+	}
+}
+
+// notify wakes up all the waiters of the cluster.
+func (n *redisNotifier) notify(cluster string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if w, ok := n.waiters[cluster]; ok {
+		close(w.ch)
+		delete(n.waiters, cluster)
+	}
+}
+
+// clusterChannel is the pub/sub channel the changes of the cluster are published to.
+func (d *redisDB) clusterChannel(cluster string) string {
+	return fmt.Sprintf("%s:changed", d.clusterPrefix(cluster))
+}
+
+// subscribe forwards the changes published by all the replicas to the local waiters.
+//
+// The subscription is re-established by the client after connection failures, the messages
+// published in between are lost, so the waiters still poll the revision as a fallback.
+func (d *redisDB) subscribe(ctx context.Context) {
+	ps := d.rc.PSubscribe(ctx, d.clusterChannel("*"))
+
+	defer ps.Close() //nolint:errcheck
+
+	d.logger.Debug("subscribed to cluster changes")
+
+	for msg := range ps.Channel() {
+		d.notifier.notify(d.clusterFromKey(msg.Channel, "changed"))
+	}
+
+	d.logger.Debug("cluster changes subscription closed", zap.Error(ctx.Err()))
+}
@@ -0,0 +1,170 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"go.uber.org/zap"
+)
+
+const (
+	reconnectMinBackoff  = 100 * time.Millisecond
+	reconnectMaxBackoff  = 30 * time.Second
+	reconnectPingTimeout = 5 * time.Second
+)
+
+// UnavailableError is ErrUnavailable carrying the time until the backend is probed again.
+type UnavailableError struct {
+	// RetryAfter is the time until the next reconnect attempt.
+	RetryAfter time.Duration
+
+	// cause is the connection error which opened the breaker, nil if the breaker was already open.
+	cause error
+}
+
+func (e *UnavailableError) Error() string {
+	if e.cause == nil {
+		return ErrUnavailable.Error()
+	}
+
+	return fmt.Sprintf("%s: %s", ErrUnavailable, e.cause)
+}
+
+// Unwrap implements errors unwrapping.
+func (e *UnavailableError) Unwrap() error {
+	return ErrUnavailable
+}
+
+// breaker is a circuit breaker guarding the Redis connection.
+//
+// Once a connection-level error is observed, the breaker opens and every operation fails fast with ErrUnavailable,
+// while a background goroutine pings Redis with exponential backoff until it becomes reachable again.
+type breaker struct {
+	logger *zap.Logger
+	ping   func(ctx context.Context) error
+
+	mu   sync.Mutex
+	open bool
+
+	// probeAt is the time of the next reconnect attempt while the breaker is open.
+	probeAt time.Time
+}
+
+// check returns UnavailableError if the breaker is open.
+func (b *breaker) check() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.open {
+		return &UnavailableError{RetryAfter: time.Until(b.probeAt)}
+	}
+
+	return nil
+}
+
+// observe inspects the result of an operation, opening the breaker on connection errors.
+//
+// Connection errors are returned as UnavailableError, all other errors are returned as is.
+func (b *breaker) observe(err error) error {
+	if !isConnectionError(err) {
+		return err
+	}
+
+	b.trip(err)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return &UnavailableError{
+		RetryAfter: time.Until(b.probeAt),
+		cause:      err,
+	}
+}
+
+// trip opens the breaker and starts the reconnect loop, if it is not running yet.
+func (b *breaker) trip(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.open {
+		return
+	}
+
+	b.open = true
+	b.probeAt = time.Now().Add(reconnectMinBackoff)
+
+	b.logger.Error("redis connection lost, failing operations until it is restored", zap.Error(err))
+
+	go b.reconnect()
+}
+
+func (b *breaker) reconnect() {
+	backoff := reconnectMinBackoff
+
+	for {
+		time.Sleep(backoff)
+
+		ctx, cancel := context.WithTimeout(context.Background(), reconnectPingTimeout)
+		err := b.ping(ctx)
+
+		cancel()
+
+		if err == nil {
+			b.mu.Lock()
+			b.open = false
+			b.mu.Unlock()
+
+			b.logger.Info("redis connection restored")
+
+			return
+		}
+
+		b.logger.Warn("failed to reconnect to redis",
+			zap.Duration("backoff", backoff),
+			zap.Error(err),
+		)
+
+		backoff *= 2
+		if backoff > reconnectMaxBackoff {
+			backoff = reconnectMaxBackoff
+		}
+
+		b.mu.Lock()
+		b.probeAt = time.Now().Add(backoff)
+		b.mu.Unlock()
+	}
+}
+
+// isConnectionError checks whether the error indicates that Redis itself is unreachable,
+// as opposed to a missing key, a server-side error reply or a cancelled request.
+func isConnectionError(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, redis.ErrClosed) {
+		return true
+	}
+
+	var opErr *net.OpError
+
+	// the server which can't be dialed is unreachable, even if the dial has timed out
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return !errors.Is(err, context.Canceled)
+	}
+
+	var netErr net.Error
+
+	// timeouts of the commands are caused by the operation deadline rather than by the lost connection
+	return errors.As(err, &netErr) && !netErr.Timeout()
+}
@@ -0,0 +1,42 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package db
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/go-redis/redis/v8"
+)
+
+func TestIsConnectionError(t *testing.T) {
+	for _, tt := range []struct {
+		err        error
+		connection bool
+	}{
+		{nil, false},
+		{io.EOF, true},
+		{fmt.Errorf("failed to get node: %w", redis.ErrClosed), true},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}, true},
+		// the unreachable server times out the dial
+		{&net.OpError{Op: "dial", Net: "tcp", Err: testTimeoutError{}}, true},
+		{fmt.Errorf("failed to get node: %w", &net.OpError{Op: "dial", Net: "tcp", Err: testTimeoutError{}}), true},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: context.Canceled}, false},
+		{&net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}, true},
+		// the slow command times out the read
+		{&net.OpError{Op: "read", Net: "tcp", Err: testTimeoutError{}}, false},
+		{redis.Nil, false},
+		{testRedisError("WRONGTYPE Operation against a key holding the wrong kind of value"), false},
+		{context.DeadlineExceeded, false},
+	} {
+		if connection := isConnectionError(tt.err); connection != tt.connection {
+			t.Errorf("isConnectionError(%v) = %v, expected %v", tt.err, connection, tt.connection)
+		}
+	}
+}
@@ -6,8 +6,13 @@ package db
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-redis/redis/v8"
@@ -16,100 +21,1160 @@ import (
 	"github.com/talos-systems/kubespan-manager/pkg/types"
 )
 
-const redisTTL = 12 * time.Minute
+const (
+	redisTTL = 12 * time.Minute
+
+	// redisChangesPollInterval is the interval at which the cluster revision is polled while waiting for changes.
+	//
+	// Waiters are woken up by the published changes, polling only covers the messages lost on reconnects.
+	redisChangesPollInterval = 10 * time.Second
+)
+
+// redisTouchScript bumps the cluster revision, records it as the revision of the node and publishes the change.
+const redisTouchScript = `
+local rev = redis.call("INCR", KEYS[1])
+redis.call("ZADD", KEYS[2], rev, ARGV[1])
+redis.call("EXPIRE", KEYS[1], ARGV[2])
+redis.call("EXPIRE", KEYS[2], ARGV[2])
+redis.call("PUBLISH", ARGV[3], rev)
+return rev
+`
 
 type redisDB struct {
 	logger *zap.Logger
 
-	rc *redis.Client
+	rc redis.UniversalClient
+
+	breaker *breaker
+
+	compress bool
+	codec    Codec
+
+	malformedNodes malformedTracker
+
+	notifier redisNotifier
+
+	retries      int
+	retryBackoff time.Duration
+	deadLetters  *deadLetterLog
+
+	ttlJitter float64
+
+	// hashTag wraps the cluster ID in the keys into the {hash tag}, see clusterPrefix.
+	hashTag bool
+}
+
+// redisExpireNodesScript expires the cluster node list unless the cluster has sticky nodes, which never expire.
+const redisExpireNodesScript = `
+if redis.call("SCARD", KEYS[2]) == 0 then
+	redis.call("PEXPIRE", KEYS[1], ARGV[1])
+else
+	redis.call("PERSIST", KEYS[1])
+end
+return 0
+`
+
+// RedisMode is the Redis deployment topology.
+type RedisMode string
+
+// Supported Redis modes.
+const (
+	RedisModeSingle   RedisMode = "single"
+	RedisModeSentinel RedisMode = "sentinel"
+	RedisModeCluster  RedisMode = "cluster"
+)
+
+// RedisOptions configures the connection to Redis.
+type RedisOptions struct {
+	// Mode is the Redis deployment topology, defaults to single.
+	Mode RedisMode
+
+	// Addrs is the list of Redis addresses: a single server, the Sentinels or the Cluster seed nodes.
+	Addrs []string
+
+	// MasterName is the name of the master monitored by Sentinel.
+	MasterName string
+
+	// Compress enables gzip compression of the stored nodes.
+	Compress bool
+
+	// Codec is the serialization format of the stored nodes, defaults to JSON.
+	Codec Codec
+
+	// MalformedGrace is the time after which node entries failing to decode are deleted, zero disables the deletion.
+	MalformedGrace time.Duration
+
+	// Retries is the number of times the idempotent operations are retried on transient failures (timeouts,
+	// slot migrations, failovers) before the error is returned, zero disables the retries.
+	Retries int
+
+	// RetryBackoff is the delay before the first retry, doubled on every next one.
+	RetryBackoff time.Duration
+
+	// DeadLetter receives the node writes which failed permanently as JSON lines, for later inspection.
+	DeadLetter io.Writer
+
+	// TTLJitter extends the expiration of the node and address keys randomly by up to TTLJitter of the TTL,
+	// as a fraction in [0, 1), zero disables the jitter.
+	TTLJitter float64
+}
+
+func (opts RedisOptions) client() (redis.UniversalClient, error) {
+	if len(opts.Addrs) == 0 {
+		return nil, fmt.Errorf("no redis addresses specified")
+	}
+
+	switch opts.Mode {
+	case RedisModeSingle, "":
+		if len(opts.Addrs) > 1 {
+			return nil, fmt.Errorf("single redis mode accepts exactly one address, got %d", len(opts.Addrs))
+		}
+
+		return redis.NewClient(&redis.Options{
+			Addr: opts.Addrs[0],
+		}), nil
+	case RedisModeSentinel:
+		if opts.MasterName == "" {
+			return nil, fmt.Errorf("sentinel master name is required in sentinel redis mode")
+		}
+
+		return redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:    opts.MasterName,
+			SentinelAddrs: opts.Addrs,
+		}), nil
+	case RedisModeCluster:
+		return redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs: opts.Addrs,
+		}), nil
+	default:
+		return nil, fmt.Errorf("unsupported redis mode %q", opts.Mode)
+	}
 }
 
 // NewRedis creates new redis DB.
-func NewRedis(addr string, logger *zap.Logger) (DB, error) {
+//
+// If Redis is not reachable, the DB is still returned: operations fail with ErrUnavailable
+// until the connection is re-established in the background.
+func NewRedis(opts RedisOptions, logger *zap.Logger) (DB, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	rc := redis.NewClient(&redis.Options{
-		Addr: addr,
-	})
+	rc, err := opts.client()
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.TTLJitter < 0 || opts.TTLJitter >= 1 {
+		return nil, fmt.Errorf("ttl jitter should be in [0, 1), got %v", opts.TTLJitter)
+	}
+
+	codec, err := ParseCodec(string(opts.Codec))
+	if err != nil {
+		return nil, err
+	}
+
+	d := &redisDB{
+		rc:       rc,
+		logger:   logger,
+		compress: opts.Compress,
+		codec:    codec,
+		malformedNodes: malformedTracker{
+			grace: opts.MalformedGrace,
+		},
+		retries:      opts.Retries,
+		retryBackoff: opts.RetryBackoff,
+		ttlJitter:    opts.TTLJitter,
+		hashTag:      opts.Mode == RedisModeCluster,
+		breaker: &breaker{
+			logger: logger,
+			ping: func(ctx context.Context) error {
+				return rc.Ping(ctx).Err()
+			},
+		},
+	}
+
+	if d.retryBackoff <= 0 {
+		d.retryBackoff = defaultRetryBackoff
+	}
+
+	if opts.DeadLetter != nil {
+		d.deadLetters = &deadLetterLog{w: opts.DeadLetter}
+	}
 
 	if err := rc.Ping(ctx).Err(); err != nil {
-		return nil, fmt.Errorf("failed to connect to redis: %w", err)
+		d.breaker.trip(fmt.Errorf("failed to connect to redis: %w", err))
+	}
+
+	go d.subscribe(context.Background())
+
+	return d, nil
+}
+
+// clusterPrefix is the common prefix of all the keys of the cluster.
+//
+// In Redis Cluster mode the cluster ID is the {hash tag} of the keys, so that they are colocated in a single slot,
+// which is required by transactions and scripts. Other modes keep the plain keys, as written by the previous releases.
+func (d *redisDB) clusterPrefix(cluster string) string {
+	if d.hashTag {
+		return "cluster:{" + cluster + "}"
 	}
 
-	return &redisDB{
-		rc:     rc,
-		logger: logger,
-	}, nil
+	return "cluster:" + cluster
 }
 
 func (d *redisDB) clusterNodesKey(cluster string) string {
-	return fmt.Sprintf("cluster:%s:nodelist", cluster)
+	return fmt.Sprintf("%s:nodelist", d.clusterPrefix(cluster))
 }
 
 func (d *redisDB) clusterNodeKey(cluster, id string) string {
-	return fmt.Sprintf("cluster:%s:node:%s", cluster, id)
+	return fmt.Sprintf("%s:node:%s", d.clusterPrefix(cluster), id)
 }
 
-func (d *redisDB) clusterAddressKey(cluster string, addr *types.Address) string {
-	if !addr.IP.IsZero() {
-		return fmt.Sprintf("cluster:%s:address:%s", cluster, addr.IP.String())
-	}
+// clusterPinnedKey is the set of the sticky nodes of the cluster.
+func (d *redisDB) clusterPinnedKey(cluster string) string {
+	return fmt.Sprintf("%s:pinned", d.clusterPrefix(cluster))
+}
+
+func (d *redisDB) clusterRevisionKey(cluster string) string {
+	return fmt.Sprintf("%s:revision", d.clusterPrefix(cluster))
+}
+
+func (d *redisDB) clusterChangesKey(cluster string) string {
+	return fmt.Sprintf("%s:changes", d.clusterPrefix(cluster))
+}
+
+func (d *redisDB) clusterConfigKey(cluster string) string {
+	return fmt.Sprintf("%s:config", d.clusterPrefix(cluster))
+}
+
+// clusterAliasKey keeps the target cluster ID of the alias.
+func (d *redisDB) clusterAliasKey(cluster string) string {
+	return fmt.Sprintf("%s:alias", d.clusterPrefix(cluster))
+}
+
+// touch records a change of the node in the transaction.
+func (d *redisDB) touch(ctx context.Context, tx redis.Pipeliner, cluster, id string) {
+	tx.Eval(ctx, redisTouchScript,
+		[]string{d.clusterRevisionKey(cluster), d.clusterChangesKey(cluster)},
+		id, int(redisTTL.Seconds()), d.clusterChannel(cluster),
+	)
+}
 
-	return fmt.Sprintf("cluster:%s:address:%s", cluster, addr.Name)
+func (d *redisDB) clusterAddressKey(cluster string, addr *types.Address) string {
+	return fmt.Sprintf("%s:address:%s", d.clusterPrefix(cluster), addr.Host())
 }
 
 // Add implements db.DB.
+//
+// Malformed entries are overwritten as if the node didn't exist.
 func (d *redisDB) Add(ctx context.Context, cluster string, n *types.Node) error {
-	tx := d.rc.TxPipeline()
+	return d.update(ctx, cluster, n.ID, func(tx *redis.Tx) error {
+		existing, err := d.Get(ctx, cluster, n.ID)
+		if err != nil {
+			// the malformed entry is still in the cluster set, so it doesn't count against the node limit again
+			malformed := errors.Is(err, ErrMalformed)
+
+			if !errors.Is(err, ErrNotFound) && !malformed {
+				return fmt.Errorf("failed to retrieve node %q from cluster %q: %w", n.ID, cluster, err)
+			}
+
+			if err = checkVersion(ctx, 0); err != nil {
+				return err
+			}
+
+			if err = d.admit(ctx, cluster, n.ID, !malformed); err != nil {
+				return err
+			}
+
+			n.Version = 0
+			n.Sticky = false
+
+			return d.storeWith(ctx, tx, cluster, n, true)
+		}
+
+		if err = checkVersion(ctx, existing.Version); err != nil {
+			return err
+		}
+
+		if err = checkGeneration(existing, n); err != nil {
+			return err
+		}
+
+		if err = d.admit(ctx, cluster, n.ID, false); err != nil {
+			return err
+		}
+
+		existing.Merge(n)
+
+		return d.storeWith(ctx, tx, cluster, existing, true)
+	})
+}
+
+// Replace implements db.DB.
+//
+// Malformed entries are overwritten as if the node didn't exist.
+func (d *redisDB) Replace(ctx context.Context, cluster string, n *types.Node) error {
+	return d.update(ctx, cluster, n.ID, func(tx *redis.Tx) error {
+		existing, err := d.Get(ctx, cluster, n.ID)
+
+		malformed := errors.Is(err, ErrMalformed)
+
+		if err != nil && !errors.Is(err, ErrNotFound) && !malformed {
+			return fmt.Errorf("failed to retrieve node %q from cluster %q: %w", n.ID, cluster, err)
+		}
+
+		if err = checkVersion(ctx, nodeVersion(existing)); err != nil {
+			return err
+		}
+
+		if err = checkGeneration(existing, n); err != nil {
+			return err
+		}
+
+		if err = d.admit(ctx, cluster, n.ID, existing == nil && !malformed); err != nil {
+			return err
+		}
+
+		n.Version = nodeVersion(existing)
+		n.Sticky = existing != nil && existing.Sticky
+
+		if n.Generation == 0 && existing != nil {
+			n.Generation = existing.Generation
+		}
+
+		return d.storeWith(ctx, tx, cluster, n, true)
+	})
+}
+
+// updateAttempts bounds the attempts of a read-modify-write racing the other writes of the node.
+const updateAttempts = 3
+
+// update runs the read-modify-write of the node watching the node key.
+//
+// If the node is updated, removed or expires between the read and the write, the transaction fails
+// and fn starts over with the fresh node, so the version checks can't be raced past.
+func (d *redisDB) update(ctx context.Context, cluster, id string, fn func(tx *redis.Tx) error) error {
+	for attempt := 0; attempt < updateAttempts; attempt++ {
+		err := d.rc.Watch(ctx, fn, d.clusterNodeKey(cluster, id))
+		if !errors.Is(err, redis.TxFailedErr) {
+			return err
+		}
+	}
+
+	return fmt.Errorf("%w: node %q of cluster %q kept changing during the update", ErrVersionConflict, id, cluster)
+}
+
+// admit verifies that the node key is allowed to register in the cluster, and that another node
+// can be added to the cluster if the node is new.
+//
+// The check is not atomic with the following write, so concurrent additions might exceed the limit slightly.
+func (d *redisDB) admit(ctx context.Context, cluster, id string, added bool) error {
+	cfg, err := d.ClusterConfig(ctx, cluster)
+	if err != nil {
+		return err
+	}
+
+	if !cfg.AllowsKey(id) {
+		return fmt.Errorf("%w: key %q is not in the allowlist of the cluster", ErrKeyNotAllowed, id)
+	}
+
+	limit := cfg.NodeLimit()
+	if !added || limit == 0 {
+		return nil
+	}
+
+	count, err := d.rc.SCard(ctx, d.clusterNodesKey(cluster)).Result()
+	if err != nil {
+		return fmt.Errorf("failed to count nodes of cluster %q: %w", cluster, d.breaker.observe(err))
+	}
+
+	if count >= int64(limit) {
+		return fmt.Errorf("%w: limit of %d nodes reached", ErrClusterFull, limit)
+	}
 
-	// Store the node data
-	tx.Set(ctx, d.clusterNodeKey(cluster, n.ID), n, redisTTL)
+	return nil
+}
+
+// ttls returns the TTL of the address assignments and of the node records of the cluster.
+//
+// Node records never expire before their addresses.
+func (d *redisDB) ttls(ctx context.Context, cluster string) (addressTTL, nodeTTL time.Duration, err error) {
+	cfg, err := d.ClusterConfig(ctx, cluster)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	addressTTL = cfg.AddressTTL(redisTTL)
+	nodeTTL = redisTTL
+
+	if addressTTL > nodeTTL {
+		nodeTTL = addressTTL
+	}
+
+	return addressTTL, nodeTTL, nil
+}
+
+// ClusterConfig implements db.DB.
+func (d *redisDB) ClusterConfig(ctx context.Context, cluster string) (*types.ClusterConfig, error) {
+	if err := d.breaker.check(); err != nil {
+		return nil, err
+	}
+
+	data, err := d.rc.Get(ctx, d.clusterConfigKey(cluster)).Bytes()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return nil, nil
+		}
 
-	// Add the node to the cluster
-	if err := tx.SAdd(ctx, d.clusterNodesKey(cluster), n.ID).Err(); err != nil {
-		return fmt.Errorf("failed to add node %s to cluster %q: %w", n.Name, cluster, err)
+		return nil, fmt.Errorf("failed to get config of cluster %q: %w", cluster, d.breaker.observe(err))
 	}
 
-	tx.Expire(ctx, d.clusterNodesKey(cluster), redisTTL)
+	cfg := new(types.ClusterConfig)
+
+	if err = json.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse config of cluster %q: %w", cluster, err)
+	}
+
+	return cfg, nil
+}
+
+// SetClusterConfig implements db.DB.
+func (d *redisDB) SetClusterConfig(ctx context.Context, cluster string, cfg *types.ClusterConfig) error {
+	if err := d.breaker.check(); err != nil {
+		return err
+	}
+
+	if cfg.IsZero() {
+		return d.breaker.observe(d.rc.Del(ctx, d.clusterConfigKey(cluster)).Err())
+	}
+
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+
+	return d.breaker.observe(d.rc.Set(ctx, d.clusterConfigKey(cluster), data, 0).Err())
+}
+
+// put stores the node and its address assignments as the new version of the node.
+func (d *redisDB) put(ctx context.Context, cluster string, n *types.Node) error {
+	return d.store(ctx, cluster, n, true)
+}
+
+// txPipeliner runs the MULTI/EXEC transactions: the client itself, or the transaction watching the keys.
+type txPipeliner interface {
+	TxPipelined(ctx context.Context, fn func(redis.Pipeliner) error) ([]redis.Cmder, error)
+}
+
+// store writes the node and its address assignments, resetting their expiration.
+//
+// Changed nodes get the next version and the change is reported to the subscribers,
+// unchanged nodes (heartbeats) only have their expiration postponed.
+func (d *redisDB) store(ctx context.Context, cluster string, n *types.Node, changed bool) error {
+	return d.storeWith(ctx, d.rc, cluster, n, changed)
+}
+
+// storeWith is store running the transaction with the given pipeliner.
+func (d *redisDB) storeWith(ctx context.Context, rc txPipeliner, cluster string, n *types.Node, changed bool) error {
+	if err := d.breaker.check(); err != nil {
+		return err
+	}
+
+	addressTTL, nodeTTL, err := d.ttls(ctx, cluster)
+	if err != nil {
+		return err
+	}
+
+	if changed {
+		now := time.Now()
+
+		n.Version++
+		n.MarkSeen(now)
+		n.MarkModified(now)
+	}
+
+	n.SortAddresses()
+
+	// stale addresses are dropped, the rest expire according to their last report rather than the last node update
+	n.ExpireAddressesOlderThan(addressTTL)
+
+	addressTTLs := make([]time.Duration, len(n.Addresses))
+	nodeTTL = jitterTTL(nodeTTL, d.ttlJitter)
+
+	for i, addr := range n.Addresses {
+		// probe results are attached to the responses only, never stored
+		addr.Reachability = nil
+
+		addressTTLs[i] = jitterTTL(addr.ExpiresIn(addressTTL), d.ttlJitter)
+
+		if addressTTLs[i] < time.Second {
+			addressTTLs[i] = time.Second
+		}
+
+		if addressTTLs[i] > nodeTTL {
+			nodeTTL = addressTTLs[i]
+		}
+	}
+
+	// sticky nodes and their addresses are stored without the expiration
+	if n.Sticky {
+		nodeTTL = 0
+
+		for i := range addressTTLs {
+			addressTTLs[i] = 0
+		}
+	}
+
+	data, err := encodeNode(n, d.codec, d.compress)
+	if err != nil {
+		return fmt.Errorf("failed to encode node %q: %w", n.ID, err)
+	}
+
+	// the transaction is rebuilt on every attempt, as an executed pipeline is empty
+	err = d.retry(ctx, func() error {
+		_, err := rc.TxPipelined(ctx, func(tx redis.Pipeliner) error {
+			// Store the node data
+			tx.Set(ctx, d.clusterNodeKey(cluster, n.ID), data, nodeTTL)
+
+			// Add the node to the cluster
+			tx.SAdd(ctx, d.clusterNodesKey(cluster), n.ID)
+
+			if n.Sticky {
+				tx.SAdd(ctx, d.clusterPinnedKey(cluster), n.ID)
+			} else {
+				tx.SRem(ctx, d.clusterPinnedKey(cluster), n.ID)
+			}
+
+			tx.Eval(ctx, redisExpireNodesScript,
+				[]string{d.clusterNodesKey(cluster), d.clusterPinnedKey(cluster)},
+				nodeTTL.Milliseconds(),
+			)
+
+			// Update the address assignments
+			for i, addr := range n.Addresses {
+				tx.Set(ctx, d.clusterAddressKey(cluster, addr), n.ID, addressTTLs[i])
+			}
+
+			if changed {
+				d.touch(ctx, tx, cluster, n.ID)
+			}
+
+			return nil
+		})
 
-	// Update the address assignments
-	for _, addr := range n.Addresses {
-		tx.Set(ctx, d.clusterAddressKey(cluster, addr), n.ID, redisTTL)
+		return err
+	})
+	if err != nil && !errors.Is(err, redis.TxFailedErr) {
+		d.failedWrite(ctx, "put", cluster, n, err)
 	}
 
-	_, err := tx.Exec(ctx)
+	return d.breaker.observe(err)
+}
+
+// Touch implements db.DB.
+//
+// The node is rewritten with the same version, so that the stored last seen time matches the new expiration.
+// The rewrite watches the node key, so the heartbeat never overwrites a concurrent change with the node read
+// (or resurrects the removed node).
+func (d *redisDB) Touch(ctx context.Context, cluster, id string) error {
+	return d.update(ctx, cluster, id, func(tx *redis.Tx) error {
+		n, err := d.Get(ctx, cluster, id)
+		if err != nil {
+			return fmt.Errorf("failed to retrieve node %q from cluster %q: %w", id, cluster, err)
+		}
+
+		n.Heartbeat(time.Now())
 
-	return err
+		return d.storeWith(ctx, tx, cluster, n, false)
+	})
 }
 
 // AddAddresses implements db.DB.
 func (d *redisDB) AddAddresses(ctx context.Context, cluster, id string, ep ...*types.Address) error {
+	return d.update(ctx, cluster, id, func(tx *redis.Tx) error {
+		n, err := d.Get(ctx, cluster, id)
+		if err != nil {
+			return fmt.Errorf("failed to retrieve node %q from cluster %q: %w", id, cluster, err)
+		}
+
+		if err = checkVersion(ctx, n.Version); err != nil {
+			return err
+		}
+
+		n.AddAddresses(ep...)
+
+		return d.storeWith(ctx, tx, cluster, n, true)
+	})
+}
+
+// RemoveAddress implements db.DB.
+//
+// The node is stored along with the remaining addresses, so its expiration keeps following them.
+// The removed address assignment is deleted afterwards, a leftover one is ignored as the node no longer lists the address.
+func (d *redisDB) RemoveAddress(ctx context.Context, cluster, id string, addr *types.Address) error {
+	return d.update(ctx, cluster, id, func(tx *redis.Tx) error {
+		n, err := d.Get(ctx, cluster, id)
+		if err != nil {
+			return fmt.Errorf("failed to retrieve node %q from cluster %q: %w", id, cluster, err)
+		}
+
+		if !n.RemoveAddress(addr) {
+			return ErrNotFound
+		}
+
+		if err = d.storeWith(ctx, tx, cluster, n, true); err != nil {
+			return err
+		}
+
+		if err = d.rc.Del(ctx, d.clusterAddressKey(cluster, addr)).Err(); err != nil {
+			return fmt.Errorf("failed to unassign address of node %q from cluster %q: %w", id, cluster, d.breaker.observe(err))
+		}
+
+		return nil
+	})
+}
+
+// Changes implements db.DB.
+//
+// Waiters are woken up by the changes published by any replica sharing the Redis.
+func (d *redisDB) Changes(ctx context.Context, cluster string, since uint64) (*types.Changes, error) {
+	for {
+		if err := d.breaker.check(); err != nil {
+			return nil, err
+		}
+
+		// start waiting before reading the revision, so that the changes in between are not missed
+		changed, release := d.notifier.wait(cluster)
+
+		revision, err := d.rc.Get(ctx, d.clusterRevisionKey(cluster)).Uint64()
+		if err != nil && !errors.Is(err, redis.Nil) {
+			release()
+
+			return nil, fmt.Errorf("failed to get revision of cluster %q: %w", cluster, d.breaker.observe(err))
+		}
+
+		if revision != since {
+			release()
+
+			changes := &types.Changes{
+				Cursor: revision,
+			}
+
+			// cursor from the future means that the cluster was re-created, so start over
+			if since > revision {
+				changes.Reset = true
+				since = 0
+			}
+
+			if err = d.changedSince(ctx, cluster, since, changes); err != nil {
+				return nil, err
+			}
+
+			return changes, nil
+		}
+
+		select {
+		case <-changed:
+		case <-time.After(redisChangesPollInterval):
+		case <-ctx.Done():
+			release()
+
+			return &types.Changes{Cursor: revision}, nil
+		}
+
+		release()
+	}
+}
+
+// changedSince fills in the nodes changed after the revision.
+//
+// Nodes which were changed, but no longer exist are reported as removed.
+func (d *redisDB) changedSince(ctx context.Context, cluster string, since uint64, changes *types.Changes) error {
+	ids, err := d.rc.ZRangeByScore(ctx, d.clusterChangesKey(cluster), &redis.ZRangeBy{
+		Min: fmt.Sprintf("(%d", since),
+		Max: "+inf",
+	}).Result()
+	if err != nil {
+		return fmt.Errorf("failed to get changes of cluster %q: %w", cluster, d.breaker.observe(err))
+	}
+
+	for _, id := range ids {
+		n, err := d.Get(ctx, cluster, id)
+		if err != nil {
+			if errors.Is(err, ErrNotFound) {
+				if since > 0 {
+					changes.Removed = append(changes.Removed, id)
+				}
+
+				continue
+			}
+
+			if errors.Is(err, ErrMalformed) {
+				continue
+			}
+
+			return err
+		}
+
+		changes.Nodes = append(changes.Nodes, n)
+
+		// the changes log doesn't keep the time, every write stamps the node instead
+		changed := n.LastModified
+		if changed.IsZero() {
+			// stored before the modification time was tracked
+			changed = n.LastSeen
+		}
+
+		if since > 0 && (changes.Changed.IsZero() || changed.Before(changes.Changed)) {
+			changes.Changed = changed
+		}
+	}
+
+	return nil
+}
+
+// DeleteCluster implements db.DB.
+func (d *redisDB) DeleteCluster(ctx context.Context, cluster string) (int, error) {
+	if err := d.breaker.check(); err != nil {
+		return 0, err
+	}
+
+	nodeList, err := d.rc.SMembers(ctx, d.clusterNodesKey(cluster)).Result()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get members of cluster %q: %w", cluster, d.breaker.observe(err))
+	}
+
+	keys := []string{
+		d.clusterNodesKey(cluster),
+		d.clusterPinnedKey(cluster),
+		d.clusterRevisionKey(cluster),
+		d.clusterChangesKey(cluster),
+		d.clusterConfigKey(cluster),
+	}
+
+	var count int
+
+	for _, id := range nodeList {
+		n, err := d.Get(ctx, cluster, id)
+		if err != nil {
+			if errors.Is(err, ErrNotFound) {
+				continue
+			}
+
+			if errors.Is(err, ErrMalformed) {
+				// the address assignments are unknown, they expire on their own
+				keys = append(keys, d.clusterNodeKey(cluster, id))
+
+				continue
+			}
+
+			return 0, err
+		}
+
+		count++
+
+		keys = append(keys, d.clusterNodeKey(cluster, id))
+
+		for _, addr := range n.Addresses {
+			keys = append(keys, d.clusterAddressKey(cluster, addr))
+		}
+	}
+
+	if len(nodeList) == 0 {
+		return 0, ErrNotFound
+	}
+
+	tx := d.rc.TxPipeline()
+
+	tx.Del(ctx, keys...)
+
+	// wake up the waiters, so that they see the cluster reset
+	tx.Publish(ctx, d.clusterChannel(cluster), 0)
+
+	if _, err = tx.Exec(ctx); err != nil {
+		return 0, fmt.Errorf("failed to delete cluster %q: %w", cluster, d.breaker.observe(err))
+	}
+
+	return count, nil
+}
+
+// DeleteNodes implements db.DB.
+//
+// The matching nodes are removed in a single transaction, the nodes updated by other replicas
+// between the read and the transaction are removed regardless.
+func (d *redisDB) DeleteNodes(ctx context.Context, cluster string, selector map[string]string) ([]string, error) {
+	list, err := d.List(ctx, cluster)
+	if err != nil {
+		return nil, err
+	}
+
+	var matched []*types.Node
+
+	for _, n := range list {
+		if n.MatchLabels(selector) {
+			matched = append(matched, n)
+		}
+	}
+
+	if len(matched) == 0 {
+		return nil, nil
+	}
+
+	err = d.retry(ctx, func() error {
+		_, err := d.rc.TxPipelined(ctx, func(tx redis.Pipeliner) error {
+			for _, n := range matched {
+				tx.Del(ctx, d.clusterNodeKey(cluster, n.ID))
+				tx.SRem(ctx, d.clusterNodesKey(cluster), n.ID)
+				tx.SRem(ctx, d.clusterPinnedKey(cluster), n.ID)
+
+				for _, addr := range n.Addresses {
+					tx.Del(ctx, d.clusterAddressKey(cluster, addr))
+				}
+
+				// the node is gone, so the change is reported as a removal
+				d.touch(ctx, tx, cluster, n.ID)
+			}
+
+			return nil
+		})
+
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to delete nodes of cluster %q: %w", cluster, d.breaker.observe(err))
+	}
+
+	removed := make([]string, 0, len(matched))
+
+	for _, n := range matched {
+		removed = append(removed, n.ID)
+	}
+
+	return removed, nil
+}
+
+// ForEachCluster implements db.DB.
+func (d *redisDB) ForEachCluster(ctx context.Context, fn func(cluster string, nodes []*types.Node) error) error {
+	if err := d.breaker.check(); err != nil {
+		return err
+	}
+
+	return d.scan(ctx, d.clusterNodesKey("*"), func(key string) error {
+		cluster := d.clusterFromKey(key, "nodelist")
+
+		list, err := d.List(ctx, cluster)
+		if err != nil {
+			if errors.Is(err, ErrNotFound) {
+				return nil
+			}
+
+			return err
+		}
+
+		return fn(cluster, list)
+	})
+}
+
+// ListClusters implements db.DB.
+//
+// All the cluster sets are scanned to order the clusters, the node counts are fetched for the returned page only.
+func (d *redisDB) ListClusters(ctx context.Context, after string, limit int) ([]*types.ClusterInfo, error) {
+	if err := d.breaker.check(); err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]struct{})
+
+	var ids []string
+
+	if err := d.scan(ctx, d.clusterNodesKey("*"), func(key string) error {
+		cluster := d.clusterFromKey(key, "nodelist")
+
+		// keys might be returned more than once by SCAN
+		if _, dup := seen[cluster]; cluster > after && !dup {
+			seen[cluster] = struct{}{}
+			ids = append(ids, cluster)
+		}
+
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("failed to scan clusters: %w", err)
+	}
+
+	var countErr error
+
+	clusters := pageClusters(ids, limit, func(id string) int {
+		count, err := d.rc.SCard(ctx, d.clusterNodesKey(id)).Result()
+		if err != nil && countErr == nil {
+			countErr = fmt.Errorf("failed to count members of cluster %q: %w", id, d.breaker.observe(err))
+		}
+
+		return int(count)
+	})
+
+	return clusters, countErr
+}
+
+// scan calls fn for every key matching the pattern.
+//
+// In Redis Cluster mode all the masters are scanned, fn is never called concurrently.
+func (d *redisDB) scan(ctx context.Context, match string, fn func(key string) error) error {
+	var mu sync.Mutex
+
+	scanClient := func(ctx context.Context, c redis.Cmdable) error {
+		iter := c.Scan(ctx, 0, match, 100).Iterator()
+
+		for iter.Next(ctx) {
+			mu.Lock()
+			err := fn(iter.Val())
+			mu.Unlock()
+
+			if err != nil {
+				return err
+			}
+		}
+
+		return d.breaker.observe(iter.Err())
+	}
+
+	if cc, ok := d.rc.(*redis.ClusterClient); ok {
+		return cc.ForEachMaster(ctx, func(ctx context.Context, c *redis.Client) error {
+			return scanClient(ctx, c)
+		})
+	}
+
+	return scanClient(ctx, d.rc)
+}
+
+// clusterFromKey extracts the cluster ID from the key of the kind, e.g. "nodelist".
+//
+// Without the hash tag the cluster ID might contain colons, so the key is split at the last kind marker.
+func (d *redisDB) clusterFromKey(key, kind string) string {
+	if d.hashTag {
+		start := strings.IndexByte(key, '{')
+		end := strings.IndexByte(key, '}')
+
+		if start < 0 || end < start {
+			return ""
+		}
+
+		return key[start+1 : end]
+	}
+
+	key = strings.TrimPrefix(key, "cluster:")
+
+	end := strings.LastIndex(key, ":"+kind)
+	if end < 0 {
+		return ""
+	}
+
+	return key[:end]
+}
+
+// Pin implements db.DB.
+//
+// Sticky nodes are stored without the expiration, and the cluster node list doesn't expire while it has sticky nodes.
+func (d *redisDB) Pin(ctx context.Context, cluster, id string, sticky bool) error {
 	n, err := d.Get(ctx, cluster, id)
 	if err != nil {
 		return fmt.Errorf("failed to retrieve node %q from cluster %q: %w", id, cluster, err)
 	}
 
-	n.AddAddresses(ep...)
+	if n.Sticky == sticky {
+		return nil
+	}
+
+	n.Sticky = sticky
 
-	return d.Add(ctx, cluster, n)
+	return d.put(ctx, cluster, n)
 }
 
 // Clean implements db.DB.
-func (d *redisDB) Clean() {} // no-op
+//
+// Redis expires the keys by itself, so there is nothing to clean.
+func (d *redisDB) Clean() *CleanReport {
+	return &CleanReport{}
+}
+
+// Count implements db.DB.
+//
+// The count is the size of the cluster set, so it might include the nodes which expired since the last cleanup.
+func (d *redisDB) Count(ctx context.Context, cluster string) (int, error) {
+	if err := d.breaker.check(); err != nil {
+		return 0, err
+	}
+
+	count, err := d.rc.SCard(ctx, d.clusterNodesKey(cluster)).Result()
+	if err != nil {
+		return 0, fmt.Errorf("failed to count members of cluster %q: %w", cluster, d.breaker.observe(err))
+	}
+
+	if count == 0 {
+		return 0, fmt.Errorf("cluster %q: %w", cluster, ErrNotFound)
+	}
+
+	return int(count), nil
+}
+
+// Summarize implements db.DB.
+//
+// Node records and then their address assignments are fetched in a single round trip each.
+// As in List, the addresses reassigned to other nodes and the stale ones are left out.
+func (d *redisDB) Summarize(ctx context.Context, cluster string) (*types.ClusterSummary, error) {
+	if err := d.breaker.check(); err != nil {
+		return nil, err
+	}
+
+	nodeList, err := d.rc.SMembers(ctx, d.clusterNodesKey(cluster)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get members of cluster %q: %w", cluster, d.breaker.observe(err))
+	}
+
+	if len(nodeList) == 0 {
+		return nil, fmt.Errorf("cluster %q: %w", cluster, ErrNotFound)
+	}
+
+	addressTTL, _, err := d.ttls(ctx, cluster)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, 0, len(nodeList))
+
+	for _, id := range nodeList {
+		keys = append(keys, d.clusterNodeKey(cluster, id))
+	}
+
+	values, err := d.rc.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get nodes of cluster %q: %w", cluster, d.breaker.observe(err))
+	}
+
+	nodes := make([]*types.Node, 0, len(values))
+
+	var addressKeys []string
+
+	for i, v := range values {
+		data, ok := v.(string)
+		if !ok {
+			// expired node
+			continue
+		}
+
+		n, err := decodeNode([]byte(data))
+		if err != nil {
+			d.malformed(ctx, cluster, nodeList[i], err)
+
+			continue
+		}
+
+		n.ExpireAddressesOlderThan(addressTTL)
+
+		for _, a := range n.Addresses {
+			addressKeys = append(addressKeys, d.clusterAddressKey(cluster, a))
+		}
+
+		nodes = append(nodes, n)
+	}
+
+	if len(nodes) == 0 {
+		return nil, fmt.Errorf("cluster %q: %w", cluster, ErrNotFound)
+	}
+
+	if len(addressKeys) > 0 {
+		owners, err := d.rc.MGet(ctx, addressKeys...).Result()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get address owners of cluster %q: %w", cluster, d.breaker.observe(err))
+		}
+
+		for _, n := range nodes {
+			var validAddresses []*types.Address
+
+			for _, a := range n.Addresses {
+				if owner, ok := owners[0].(string); ok && owner == n.ID {
+					validAddresses = append(validAddresses, a)
+				}
+
+				owners = owners[1:]
+			}
+
+			n.Addresses = validAddresses
+		}
+	}
+
+	return types.Summarize(nodes), nil
+}
+
+// SetAlias implements db.DB.
+func (d *redisDB) SetAlias(ctx context.Context, alias, target string) error {
+	if err := d.breaker.check(); err != nil {
+		return err
+	}
+
+	if target == "" {
+		return d.breaker.observe(d.rc.Del(ctx, d.clusterAliasKey(alias)).Err())
+	}
+
+	return d.breaker.observe(d.rc.Set(ctx, d.clusterAliasKey(alias), target, 0).Err())
+}
+
+// ResolveAlias implements db.DB.
+func (d *redisDB) ResolveAlias(ctx context.Context, cluster string) (string, error) {
+	if err := d.breaker.check(); err != nil {
+		return "", err
+	}
+
+	target, err := d.rc.Get(ctx, d.clusterAliasKey(cluster)).Result()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return "", nil
+		}
+
+		return "", fmt.Errorf("failed to resolve alias %q: %w", cluster, d.breaker.observe(err))
+	}
+
+	return target, nil
+}
+
+// Ping implements db.DB.
+func (d *redisDB) Ping(ctx context.Context) error {
+	if err := d.breaker.check(); err != nil {
+		return err
+	}
+
+	return d.breaker.observe(d.rc.Ping(ctx).Err())
+}
 
 // Get implements db.DB.
 func (d *redisDB) Get(ctx context.Context, cluster, id string) (*types.Node, error) {
-	n := new(types.Node)
+	if err := d.breaker.check(); err != nil {
+		return nil, err
+	}
 
-	if err := d.rc.Get(ctx, d.clusterNodeKey(cluster, id)).Scan(n); err != nil {
+	var data []byte
+
+	err := d.retry(ctx, func() (err error) {
+		data, err = d.rc.Get(ctx, d.clusterNodeKey(cluster, id)).Bytes()
+
+		return err
+	})
+	if err != nil {
 		if errors.Is(redis.Nil, err) {
 			return nil, ErrNotFound
 		}
 
-		return nil, fmt.Errorf("failed to parse node %q of cluster %q: %w", id, cluster, err)
+		return nil, fmt.Errorf("failed to get node %q of cluster %q: %w", id, cluster, d.breaker.observe(err))
 	}
 
+	n, err := decodeNode(data)
+	if err != nil {
+		d.malformed(ctx, cluster, id, err)
+
+		return nil, fmt.Errorf("node %q of cluster %q: %w", id, cluster, ErrMalformed)
+	}
+
+	d.malformedNodes.ok(d.clusterNodeKey(cluster, id))
+
 	var validAddresses []*types.Address
 
 	for _, a := range n.Addresses {
@@ -126,35 +1191,73 @@ func (d *redisDB) Get(ctx context.Context, cluster, id string) (*types.Node, err
 
 // List implements db.DB.
 func (d *redisDB) List(ctx context.Context, cluster string) ([]*types.Node, error) {
+	var ret []*types.Node
+
+	if err := d.Walk(ctx, cluster, func(n *types.Node) error {
+		ret = append(ret, n)
+
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	if len(ret) == 0 {
+		return nil, ErrNotFound
+	}
+
+	return ret, nil
+}
+
+// Walk implements db.DB.
+//
+// Only the IDs of the nodes are fetched at once, the nodes are fetched one by one.
+func (d *redisDB) Walk(ctx context.Context, cluster string, fn func(n *types.Node) error) error {
+	if err := d.breaker.check(); err != nil {
+		return err
+	}
+
 	nodeList, err := d.rc.SMembers(ctx, d.clusterNodesKey(cluster)).Result()
 	if err != nil {
 		if errors.Is(redis.Nil, err) {
-			return nil, ErrNotFound
+			return ErrNotFound
 		}
 
-		return nil, fmt.Errorf("failed to get members of cluster %q: %w", cluster, err)
+		return fmt.Errorf("failed to get members of cluster %q: %w", cluster, d.breaker.observe(err))
+	}
+
+	if len(nodeList) == 0 {
+		return fmt.Errorf("cluster %q: %w", cluster, ErrNotFound)
 	}
 
-	ret := make([]*types.Node, 0, len(nodeList))
+	sort.Strings(nodeList)
 
 	for _, id := range nodeList {
 		n, err := d.Get(ctx, cluster, id)
 		if err != nil {
+			if errors.Is(err, ErrUnavailable) {
+				return err
+			}
+
+			if errors.Is(err, ErrMalformed) {
+				// already logged and counted
+				continue
+			}
+
 			if errors.Is(redis.Nil, err) {
-				d.logger.Debug("removing stale node from cluster",
+				requestLogger(ctx, d.logger).Debug("removing stale node from cluster",
 					zap.String("node", id),
 					zap.String("cluster", cluster),
 				)
 
 				if err = d.rc.SRem(ctx, d.clusterNodesKey(cluster), id).Err(); err != nil {
-					d.logger.Warn("failed to remove node from cluster set which did not exist",
+					requestLogger(ctx, d.logger).Warn("failed to remove node from cluster set which did not exist",
 						zap.String("node", id),
 						zap.String("cluster", cluster),
 						zap.Error(err),
 					)
 				}
 			} else {
-				d.logger.Error("failed to get node listen in nodeList",
+				requestLogger(ctx, d.logger).Error("failed to get node listen in nodeList",
 					zap.String("node", id),
 					zap.String("cluster", cluster),
 					zap.Error(err),
@@ -164,12 +1267,10 @@ func (d *redisDB) List(ctx context.Context, cluster string) ([]*types.Node, erro
 			continue
 		}
 
-		ret = append(ret, n)
-	}
-
-	if len(ret) == 0 {
-		return nil, ErrNotFound
+		if err = fn(n); err != nil {
+			return err
+		}
 	}
 
-	return ret, nil
+	return nil
 }
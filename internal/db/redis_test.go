@@ -0,0 +1,413 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package db
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"go.uber.org/zap"
+	"inet.af/netaddr"
+
+	"github.com/talos-systems/kubespan-manager/pkg/types"
+)
+
+const testRedisCluster = "0c5e1e9a-3c62-4f6e-9d59-8b2a0f0b2d4a"
+
+// newTestRedis runs the in-process Redis server and connects the DB to it.
+func newTestRedis(t *testing.T, opts RedisOptions) (*redisDB, *miniredis.Miniredis) {
+	t.Helper()
+
+	m, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("failed to start redis: %s", err)
+	}
+
+	t.Cleanup(m.Close)
+
+	opts.Addrs = []string{m.Addr()}
+
+	d, err := NewRedis(opts, zap.NewNop())
+	if err != nil {
+		t.Fatalf("failed to create redis db: %s", err)
+	}
+
+	t.Cleanup(func() { d.(*redisDB).rc.Close() }) //nolint:errcheck
+
+	return d.(*redisDB), m
+}
+
+func testRedisNode(id, ip string) *types.Node {
+	return &types.Node{
+		ID: id,
+		IP: netaddr.MustParseIP("fd00::1"),
+		Addresses: []*types.Address{
+			{IP: netaddr.MustParseIP(ip), Port: 51820, LastReported: time.Now()},
+		},
+	}
+}
+
+// flakyPipeliner fails the first transactions with the configured error.
+type flakyPipeliner struct {
+	txPipeliner
+
+	failures int
+	err      error
+}
+
+func (p *flakyPipeliner) TxPipelined(ctx context.Context, fn func(redis.Pipeliner) error) ([]redis.Cmder, error) {
+	if p.failures > 0 {
+		p.failures--
+
+		return nil, p.err
+	}
+
+	return p.txPipeliner.TxPipelined(ctx, fn)
+}
+
+func TestRedisStoreRetry(t *testing.T) {
+	ctx := context.Background()
+	d, _ := newTestRedis(t, RedisOptions{Retries: 2, RetryBackoff: time.Millisecond})
+
+	var deadLetters bytes.Buffer
+
+	d.deadLetters = &deadLetterLog{w: &deadLetters}
+
+	rc := &flakyPipeliner{
+		txPipeliner: d.rc,
+		failures:    2,
+		err:         testRedisError("LOADING Redis is loading the dataset in memory"),
+	}
+
+	if err := d.storeWith(ctx, rc, testRedisCluster, testRedisNode("node-1", "10.0.0.1"), true); err != nil {
+		t.Fatalf("transient failures should be retried: %s", err)
+	}
+
+	if n, err := d.Get(ctx, testRedisCluster, "node-1"); err != nil || n.Version != 1 {
+		t.Fatalf("unexpected node stored on retry: %v, %v", n, err)
+	}
+
+	if deadLetters.Len() != 0 {
+		t.Fatalf("the write which succeeded on retry was recorded as dead letter: %s", deadLetters.String())
+	}
+
+	rc = &flakyPipeliner{
+		txPipeliner: d.rc,
+		failures:    1,
+		err:         testRedisError("WRONGTYPE Operation against a key holding the wrong kind of value"),
+	}
+
+	if err := d.storeWith(ctx, rc, testRedisCluster, testRedisNode("node-2", "10.0.0.2"), true); err == nil {
+		t.Fatal("permanent failure should not be retried")
+	}
+
+	var letter deadLetter
+
+	if err := json.Unmarshal(deadLetters.Bytes(), &letter); err != nil {
+		t.Fatalf("failed to decode the dead letter %q: %s", deadLetters.String(), err)
+	}
+
+	if letter.Op != "put" || letter.Cluster != testRedisCluster || letter.Node.ID != "node-2" || letter.Error != string(rc.err.(testRedisError)) {
+		t.Fatalf("unexpected dead letter %+v", letter)
+	}
+
+	if _, err := d.Get(ctx, testRedisCluster, "node-2"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("failed write should not be stored: %v", err)
+	}
+}
+
+func TestRedisAddOverwritesMalformed(t *testing.T) {
+	ctx := context.Background()
+	d, m := newTestRedis(t, RedisOptions{})
+
+	if err := d.SetClusterConfig(ctx, testRedisCluster, &types.ClusterConfig{MaxNodes: 1}); err != nil {
+		t.Fatalf("failed to set cluster config: %s", err)
+	}
+
+	// the entry which can't be decoded occupies the only slot of the cluster
+	if err := m.Set(d.clusterNodeKey(testRedisCluster, "node-1"), "garbage"); err != nil {
+		t.Fatalf("failed to store malformed node: %s", err)
+	}
+
+	if _, err := m.SAdd(d.clusterNodesKey(testRedisCluster), "node-1"); err != nil {
+		t.Fatalf("failed to add malformed node to the cluster: %s", err)
+	}
+
+	if _, err := d.Get(ctx, testRedisCluster, "node-1"); !errors.Is(err, ErrMalformed) {
+		t.Fatalf("expected malformed node, got %v", err)
+	}
+
+	if err := d.Add(ctx, testRedisCluster, testRedisNode("node-1", "10.0.0.1")); err != nil {
+		t.Fatalf("malformed node should be overwritten: %s", err)
+	}
+
+	if err := d.Add(ctx, testRedisCluster, testRedisNode("node-2", "10.0.0.2")); !errors.Is(err, ErrClusterFull) {
+		t.Fatalf("expected full cluster, got %v", err)
+	}
+
+	if n, err := d.Get(ctx, testRedisCluster, "node-1"); err != nil || len(n.Addresses) != 1 {
+		t.Fatalf("unexpected node %v, %v", n, err)
+	}
+}
+
+func TestRedisTouch(t *testing.T) {
+	ctx := context.Background()
+	d, m := newTestRedis(t, RedisOptions{})
+
+	if err := d.Add(ctx, testRedisCluster, testRedisNode("node-1", "10.0.0.1")); err != nil {
+		t.Fatalf("failed to add node: %s", err)
+	}
+
+	m.FastForward(time.Minute)
+
+	if err := d.Touch(ctx, testRedisCluster, "node-1"); err != nil {
+		t.Fatalf("failed to touch node: %s", err)
+	}
+
+	n, err := d.Get(ctx, testRedisCluster, "node-1")
+	if err != nil || n.Version != 1 {
+		t.Fatalf("heartbeat should keep the version: %v, %v", n, err)
+	}
+
+	if ttl := m.TTL(d.clusterNodeKey(testRedisCluster, "node-1")); ttl < redisTTL-time.Second {
+		t.Fatalf("heartbeat should reset the expiration, got %s", ttl)
+	}
+
+	// the removed node is not resurrected by the heartbeat
+	if _, err = d.DeleteNodes(ctx, testRedisCluster, nil); err != nil {
+		t.Fatalf("failed to delete nodes: %s", err)
+	}
+
+	if err = d.Touch(ctx, testRedisCluster, "node-1"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected not found, got %v", err)
+	}
+
+	if m.Exists(d.clusterNodeKey(testRedisCluster, "node-1")) {
+		t.Fatal("heartbeat recreated the removed node")
+	}
+}
+
+func TestRedisVersionConflict(t *testing.T) {
+	ctx := context.Background()
+	d, _ := newTestRedis(t, RedisOptions{})
+
+	if err := d.Add(ctx, testRedisCluster, testRedisNode("node-1", "10.0.0.1")); err != nil {
+		t.Fatalf("failed to add node: %s", err)
+	}
+
+	const writers = 8
+
+	var (
+		wg        sync.WaitGroup
+		succeeded int32
+	)
+
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			err := d.Add(ExpectVersion(ctx, 1), testRedisCluster, testRedisNode("node-1", fmt.Sprintf("10.0.1.%d", i)))
+
+			switch {
+			case err == nil:
+				atomic.AddInt32(&succeeded, 1)
+			case !errors.Is(err, ErrVersionConflict):
+				t.Errorf("unexpected error: %s", err)
+			}
+		}(i)
+	}
+
+	wg.Wait()
+
+	// writers sending the same If-Match can't both pass the check
+	if succeeded != 1 {
+		t.Fatalf("expected exactly one write to succeed, got %d", succeeded)
+	}
+
+	if n, err := d.Get(ctx, testRedisCluster, "node-1"); err != nil || n.Version != 2 || len(n.Addresses) != 2 {
+		t.Fatalf("unexpected node %v, %v", n, err)
+	}
+}
+
+func TestRedisRemoveAddress(t *testing.T) {
+	ctx := context.Background()
+	d, m := newTestRedis(t, RedisOptions{})
+
+	n := testRedisNode("node-1", "10.0.0.1")
+	n.Addresses = append(n.Addresses, &types.Address{
+		IP:           netaddr.MustParseIP("10.0.0.2"),
+		Port:         51820,
+		TTLSeconds:   int((24 * time.Hour).Seconds()),
+		LastReported: time.Now(),
+	})
+
+	if err := d.Add(ctx, testRedisCluster, n); err != nil {
+		t.Fatalf("failed to add node: %s", err)
+	}
+
+	removed := &types.Address{IP: netaddr.MustParseIP("10.0.0.1"), Port: 51820}
+
+	if err := d.RemoveAddress(ctx, testRedisCluster, "node-1", removed); err != nil {
+		t.Fatalf("failed to remove address: %s", err)
+	}
+
+	if m.Exists(d.clusterAddressKey(testRedisCluster, removed)) {
+		t.Fatal("removed address is still assigned")
+	}
+
+	// the node record outlives the remaining address
+	nodeTTL := m.TTL(d.clusterNodeKey(testRedisCluster, "node-1"))
+	addressTTL := m.TTL(d.clusterAddressKey(testRedisCluster, n.Addresses[1]))
+
+	if addressTTL < 23*time.Hour || nodeTTL < addressTTL {
+		t.Fatalf("node expires in %s before its address expiring in %s", nodeTTL, addressTTL)
+	}
+
+	got, err := d.Get(ctx, testRedisCluster, "node-1")
+	if err != nil || got.Version != 2 || len(got.Addresses) != 1 || got.Addresses[0].IP != netaddr.MustParseIP("10.0.0.2") {
+		t.Fatalf("unexpected node %v, %v", got, err)
+	}
+
+	if err = d.RemoveAddress(ctx, testRedisCluster, "node-1", removed); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected not found, got %v", err)
+	}
+}
+
+func TestRedisKeys(t *testing.T) {
+	ctx := context.Background()
+	d, m := newTestRedis(t, RedisOptions{})
+
+	// opaque cluster IDs might contain colons
+	const cluster = "tenant:a"
+
+	if err := d.Add(ctx, cluster, testRedisNode("node-1", "fd00::2")); err != nil {
+		t.Fatalf("failed to add node: %s", err)
+	}
+
+	// single mode keeps the keys written by the previous releases
+	for _, key := range []string{"cluster:tenant:a:nodelist", "cluster:tenant:a:node:node-1", "cluster:tenant:a:address:fd00::2"} {
+		if !m.Exists(key) {
+			t.Errorf("key %q doesn't exist, keys: %v", key, m.Keys())
+		}
+	}
+
+	clusters, err := d.ListClusters(ctx, "", 0)
+	if err != nil || len(clusters) != 1 || clusters[0].ID != cluster {
+		t.Fatalf("unexpected clusters %v, %v", clusters, err)
+	}
+
+	tagged := &redisDB{hashTag: true}
+
+	for _, tt := range []struct {
+		key, kind string
+	}{
+		{tagged.clusterNodesKey(cluster), "nodelist"},
+		{tagged.clusterAddressKey(cluster, &types.Address{IP: netaddr.MustParseIP("fd00::2")}), "address"},
+		{tagged.clusterChannel(cluster), "changed"},
+	} {
+		if !strings.HasPrefix(tt.key, "cluster:{tenant:a}:") {
+			t.Errorf("key %q is not tagged with the cluster ID", tt.key)
+		}
+
+		if got := tagged.clusterFromKey(tt.key, tt.kind); got != cluster {
+			t.Errorf("unexpected cluster %q of key %q", got, tt.key)
+		}
+
+		untagged := strings.Replace(strings.Replace(tt.key, "{", "", 1), "}", "", 1)
+
+		if got := d.clusterFromKey(untagged, tt.kind); got != cluster {
+			t.Errorf("unexpected cluster %q of key %q", got, untagged)
+		}
+	}
+}
+
+func TestRedisSummarize(t *testing.T) {
+	ctx := context.Background()
+	d, m := newTestRedis(t, RedisOptions{})
+
+	n1 := testRedisNode("node-1", "10.0.0.2")
+
+	// the address is reassigned to the other node
+	n2 := testRedisNode("node-2", "10.0.0.2")
+	n2.Addresses[0].Port = 51821
+
+	for _, n := range []*types.Node{n1, n2} {
+		if err := d.Add(ctx, testRedisCluster, n); err != nil {
+			t.Fatalf("failed to add node: %s", err)
+		}
+	}
+
+	// the stale address is still stored along with its assignment
+	n3 := testRedisNode("node-3", "10.0.0.3")
+	n3.Addresses[0].LastReported = time.Now().Add(-time.Hour)
+
+	data, err := encodeNode(n3, d.codec, d.compress)
+	if err != nil {
+		t.Fatalf("failed to encode node: %s", err)
+	}
+
+	for key, value := range map[string]string{
+		d.clusterNodeKey(testRedisCluster, "node-3"):           string(data),
+		d.clusterAddressKey(testRedisCluster, n3.Addresses[0]): "node-3",
+	} {
+		if err = m.Set(key, value); err != nil {
+			t.Fatalf("failed to set %q: %s", key, err)
+		}
+	}
+
+	if _, err = m.SAdd(d.clusterNodesKey(testRedisCluster), "node-3"); err != nil {
+		t.Fatalf("failed to add node to the cluster: %s", err)
+	}
+
+	summary, err := d.Summarize(ctx, testRedisCluster)
+	if err != nil {
+		t.Fatalf("failed to summarize cluster: %s", err)
+	}
+
+	if summary.Nodes != 3 || summary.NodesWithAddresses != 1 || summary.Endpoints != 1 {
+		t.Fatalf("unexpected summary %+v", summary)
+	}
+}
+
+func TestRedisWalk(t *testing.T) {
+	ctx := context.Background()
+	d, _ := newTestRedis(t, RedisOptions{})
+
+	for _, id := range []string{"node-c", "node-a", "node-b"} {
+		if err := d.Add(ctx, testRedisCluster, testRedisNode(id, "10.0.0.1")); err != nil {
+			t.Fatalf("failed to add node: %s", err)
+		}
+	}
+
+	var ids []string
+
+	if err := d.Walk(ctx, testRedisCluster, func(n *types.Node) error {
+		ids = append(ids, n.ID)
+
+		return nil
+	}); err != nil {
+		t.Fatalf("failed to walk the cluster: %s", err)
+	}
+
+	if strings.Join(ids, ",") != "node-a,node-b,node-c" {
+		t.Errorf("unexpected walked nodes %v", ids)
+	}
+
+	if err := d.Walk(ctx, "unknown", func(*types.Node) error { return nil }); !errors.Is(err, ErrNotFound) {
+		t.Errorf("unexpected error walking an unknown cluster: %v", err)
+	}
+}
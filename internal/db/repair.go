@@ -0,0 +1,176 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+	"go.uber.org/zap"
+)
+
+// Repairer is implemented by the backends which can check and repair their consistency.
+type Repairer interface {
+	// Repair scans the storage for inconsistent entries, removing them unless dryRun is set.
+	Repair(ctx context.Context, dryRun bool) (*RepairReport, error)
+}
+
+// RepairReport summarizes the consistency check.
+type RepairReport struct {
+	// DryRun is set if the inconsistencies were only reported.
+	DryRun bool `json:"dryRun"`
+
+	// ScannedNodes is the number of node records checked.
+	ScannedNodes int `json:"scannedNodes"`
+
+	// MalformedNodes is the number of node records which can't be decoded or don't match their key.
+	MalformedNodes int `json:"malformedNodes"`
+
+	// ScannedAddresses is the number of address assignments checked.
+	ScannedAddresses int `json:"scannedAddresses"`
+
+	// OrphanedAddresses is the number of address assignments of nodes which no longer exist.
+	OrphanedAddresses int `json:"orphanedAddresses"`
+
+	// StaleMembers is the number of cluster node list entries without the node record.
+	StaleMembers int `json:"staleMembers"`
+
+	// Removed is the number of removed entries.
+	Removed int `json:"removed"`
+}
+
+// Repair implements Repairer.
+//
+// The keyspace is scanned incrementally, so that Redis is not blocked for the duration of the check.
+func (d *redisDB) Repair(ctx context.Context, dryRun bool) (*RepairReport, error) {
+	if err := d.breaker.check(); err != nil {
+		return nil, err
+	}
+
+	report := &RepairReport{
+		DryRun: dryRun,
+	}
+
+	remove := func(key string, reason string) error {
+		d.logger.Info("inconsistent redis entry",
+			zap.String("key", key),
+			zap.String("reason", reason),
+			zap.Bool("dry_run", dryRun),
+		)
+
+		if dryRun {
+			return nil
+		}
+
+		if err := d.rc.Del(ctx, key).Err(); err != nil {
+			return fmt.Errorf("failed to remove %q: %w", key, d.breaker.observe(err))
+		}
+
+		report.Removed++
+
+		return nil
+	}
+
+	if err := d.scan(ctx, d.clusterNodeKey("*", "*"), func(key string) error {
+		report.ScannedNodes++
+
+		data, err := d.rc.Get(ctx, key).Bytes()
+		if err != nil {
+			if errors.Is(err, redis.Nil) {
+				return nil
+			}
+
+			return fmt.Errorf("failed to get %q: %w", key, d.breaker.observe(err))
+		}
+
+		n, err := decodeNode(data)
+		if err == nil && n.ID != key[strings.LastIndex(key, ":node:")+len(":node:"):] {
+			err = fmt.Errorf("node ID %q doesn't match the key", n.ID)
+		}
+
+		if err != nil {
+			report.MalformedNodes++
+
+			return remove(key, err.Error())
+		}
+
+		return nil
+	}); err != nil {
+		return report, err
+	}
+
+	if err := d.scan(ctx, d.clusterPrefix("*")+":address:*", func(key string) error {
+		report.ScannedAddresses++
+
+		owner, err := d.rc.Get(ctx, key).Result()
+		if err != nil {
+			if errors.Is(err, redis.Nil) {
+				return nil
+			}
+
+			return fmt.Errorf("failed to get %q: %w", key, d.breaker.observe(err))
+		}
+
+		exists, err := d.rc.Exists(ctx, d.clusterNodeKey(d.clusterFromKey(key, "address"), owner)).Result()
+		if err != nil {
+			return fmt.Errorf("failed to check owner of %q: %w", key, d.breaker.observe(err))
+		}
+
+		if exists == 0 {
+			report.OrphanedAddresses++
+
+			return remove(key, "owner node doesn't exist")
+		}
+
+		return nil
+	}); err != nil {
+		return report, err
+	}
+
+	err := d.scan(ctx, d.clusterNodesKey("*"), func(key string) error {
+		cluster := d.clusterFromKey(key, "nodelist")
+
+		members, err := d.rc.SMembers(ctx, key).Result()
+		if err != nil {
+			return fmt.Errorf("failed to get members of %q: %w", key, d.breaker.observe(err))
+		}
+
+		for _, id := range members {
+			exists, err := d.rc.Exists(ctx, d.clusterNodeKey(cluster, id)).Result()
+			if err != nil {
+				return fmt.Errorf("failed to check member %q of %q: %w", id, key, d.breaker.observe(err))
+			}
+
+			if exists > 0 {
+				continue
+			}
+
+			report.StaleMembers++
+
+			d.logger.Info("stale cluster member",
+				zap.String("cluster", cluster),
+				zap.String("node", id),
+				zap.Bool("dry_run", dryRun),
+			)
+
+			if dryRun {
+				continue
+			}
+
+			if err = d.rc.SRem(ctx, key, id).Err(); err != nil {
+				return fmt.Errorf("failed to remove member %q of %q: %w", id, key, d.breaker.observe(err))
+			}
+
+			report.Removed++
+		}
+
+		return nil
+	})
+
+	return report, err
+}
@@ -0,0 +1,157 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+
+	"github.com/talos-systems/kubespan-manager/pkg/types"
+)
+
+// defaultRetryBackoff is the delay before the first retry, it doubles on every next one.
+const defaultRetryBackoff = 50 * time.Millisecond
+
+var (
+	redisRetries = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "discovery_redis_retries_total",
+		Help: "Number of Redis operations retried after a transient failure.",
+	})
+
+	redisDeadLetters = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "discovery_redis_dead_letters_total",
+		Help: "Number of Redis writes which failed permanently and were recorded to the dead-letter log.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(redisRetries, redisDeadLetters)
+}
+
+// transientErrors are the prefixes of the Redis error replies which are expected to go away on retry:
+// the server is loading the dataset, the slot is migrating or the cluster is failing over.
+//
+// The MOVED and ASK redirects are not listed, the cluster client follows them itself.
+var transientErrors = []string{"LOADING", "TRYAGAIN", "CLUSTERDOWN", "READONLY", "MASTERDOWN"}
+
+// isTransientError checks whether the failed operation might succeed if retried as is.
+//
+// Connection-level errors are handled by the breaker instead.
+func isTransientError(err error) bool {
+	var netErr net.Error
+
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+
+	var redisErr redis.Error
+
+	if errors.As(err, &redisErr) {
+		for _, prefix := range transientErrors {
+			if strings.HasPrefix(redisErr.Error(), prefix+" ") {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// retry runs the idempotent operation, retrying the transient failures with exponential backoff.
+//
+// The operation is not retried once the context is done, the last error is returned.
+func (d *redisDB) retry(ctx context.Context, op func() error) error {
+	backoff := d.retryBackoff
+
+	for attempt := 0; ; attempt++ {
+		err := op()
+		if err == nil || attempt >= d.retries || ctx.Err() != nil || !isTransientError(err) {
+			return err
+		}
+
+		redisRetries.Inc()
+
+		requestLogger(ctx, d.logger).Debug("retrying redis operation",
+			zap.Int("attempt", attempt+1),
+			zap.Duration("backoff", backoff),
+			zap.Error(err),
+		)
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return err
+		}
+
+		backoff *= 2
+	}
+}
+
+// deadLetterLog records the writes which failed permanently, one JSON object per line.
+type deadLetterLog struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+type deadLetter struct {
+	Time    time.Time   `json:"time"`
+	Op      string      `json:"op"`
+	Cluster string      `json:"cluster"`
+	Node    *types.Node `json:"node"`
+	Error   string      `json:"error"`
+}
+
+// record appends the failed write to the log, if it is configured.
+func (l *deadLetterLog) record(op, cluster string, n *types.Node, err error) error {
+	if l == nil {
+		return nil
+	}
+
+	data, e := json.Marshal(deadLetter{
+		Time:    time.Now(),
+		Op:      op,
+		Cluster: cluster,
+		Node:    n,
+		Error:   err.Error(),
+	})
+	if e != nil {
+		return e
+	}
+
+	redisDeadLetters.Inc()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	_, e = l.w.Write(append(data, '\n'))
+
+	return e
+}
+
+// failedWrite records the write which failed after the retries to the dead-letter log.
+func (d *redisDB) failedWrite(ctx context.Context, op, cluster string, n *types.Node, err error) {
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+
+	if e := d.deadLetters.record(op, cluster, n, err); e != nil {
+		requestLogger(ctx, d.logger).Error("failed to record dead letter",
+			zap.String("op", op),
+			zap.String("cluster", cluster),
+			zap.String("node", n.ID),
+			zap.Error(e),
+		)
+	}
+}
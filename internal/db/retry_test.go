@@ -0,0 +1,101 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// testRedisError is the error reply of the Redis server.
+type testRedisError string
+
+func (e testRedisError) Error() string { return string(e) }
+
+func (testRedisError) RedisError() {}
+
+// testTimeoutError is the network timeout.
+type testTimeoutError struct{}
+
+func (testTimeoutError) Error() string   { return "i/o timeout" }
+func (testTimeoutError) Timeout() bool   { return true }
+func (testTimeoutError) Temporary() bool { return true }
+
+func TestIsTransientError(t *testing.T) {
+	for _, tt := range []struct {
+		err       error
+		transient bool
+	}{
+		{testRedisError("LOADING Redis is loading the dataset in memory"), true},
+		{testRedisError("TRYAGAIN Multiple keys request during rehashing of slot"), true},
+		{testRedisError("CLUSTERDOWN The cluster is down"), true},
+		{testRedisError("READONLY You can't write against a read only replica."), true},
+		{testRedisError("MASTERDOWN Link with MASTER is down"), true},
+		{fmt.Errorf("failed to add node: %w", testRedisError("LOADING Redis is loading the dataset in memory")), true},
+		{fmt.Errorf("failed to add node: %w", testTimeoutError{}), true},
+		// the redirects are followed by the cluster client
+		{testRedisError("MOVED 3999 127.0.0.1:6381"), false},
+		{testRedisError("ASK 3999 127.0.0.1:6381"), false},
+		{testRedisError("LOADINGX not a transient error"), false},
+		{testRedisError("WRONGTYPE Operation against a key holding the wrong kind of value"), false},
+		{errors.New("LOADING not a redis error"), false},
+		{context.Canceled, false},
+	} {
+		if transient := isTransientError(tt.err); transient != tt.transient {
+			t.Errorf("isTransientError(%q) = %v, expected %v", tt.err, transient, tt.transient)
+		}
+	}
+}
+
+func TestRetry(t *testing.T) {
+	d := &redisDB{
+		logger:       zap.NewNop(),
+		retries:      2,
+		retryBackoff: time.Millisecond,
+	}
+
+	for _, tt := range []struct {
+		name     string
+		err      error
+		attempts int
+	}{
+		{"transient", testRedisError("LOADING Redis is loading the dataset in memory"), 3},
+		{"permanent", testRedisError("WRONGTYPE Operation against a key holding the wrong kind of value"), 1},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			attempts := 0
+
+			err := d.retry(context.Background(), func() error {
+				attempts++
+
+				return tt.err
+			})
+
+			if !errors.Is(err, tt.err) || attempts != tt.attempts {
+				t.Errorf("expected %d attempts failing with %q, got %d with %v", tt.attempts, tt.err, attempts, err)
+			}
+		})
+	}
+
+	// the operation succeeding on retry
+	attempts := 0
+
+	if err := d.retry(context.Background(), func() error {
+		attempts++
+
+		if attempts < 2 {
+			return testRedisError("TRYAGAIN Multiple keys request during rehashing of slot")
+		}
+
+		return nil
+	}); err != nil || attempts != 2 {
+		t.Errorf("expected success on the second attempt, got %d attempts with %v", attempts, err)
+	}
+}
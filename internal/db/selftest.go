@@ -0,0 +1,49 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package db
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/google/uuid"
+
+	"github.com/talos-systems/kubespan-manager/pkg/types"
+)
+
+// selfTestNodeID is the ID of the sentinel node written by SelfTest.
+const selfTestNodeID = "self-test"
+
+// SelfTest verifies that the backend is usable: it writes a sentinel node into a random cluster,
+// reads it back and deletes the cluster.
+//
+// It is meant to be run at startup, so that a misconfigured backend is detected before serving any request.
+func SelfTest(ctx context.Context, d DB) error {
+	cluster := "self-test-" + uuid.New().String()
+
+	sentinel := &types.Node{
+		ID:   selfTestNodeID,
+		Name: cluster,
+	}
+
+	if err := d.Add(ctx, cluster, sentinel); err != nil {
+		return fmt.Errorf("failed to write sentinel node: %w", err)
+	}
+
+	n, err := d.Get(ctx, cluster, selfTestNodeID)
+	if err != nil {
+		return fmt.Errorf("failed to read sentinel node back: %w", err)
+	}
+
+	if n.Name != cluster {
+		return fmt.Errorf("sentinel node read back doesn't match: got %q, expected %q", n.Name, cluster)
+	}
+
+	if _, err = d.DeleteCluster(ctx, cluster); err != nil {
+		return fmt.Errorf("failed to delete sentinel node: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,214 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package db
+
+import (
+	"context"
+	"hash/fnv"
+	"sort"
+
+	"go.uber.org/zap"
+
+	"github.com/talos-systems/kubespan-manager/pkg/types"
+)
+
+// shardedDB spreads the clusters over several in-memory databases, each with its own lock.
+//
+// Every cluster lives in a single shard picked by the hash of the cluster ID,
+// so that the operations on the different clusters don't contend on the lock.
+type shardedDB struct {
+	shards []*ramDB
+}
+
+func newShardedRAM(opts RAMOptions, logger *zap.Logger) *shardedDB {
+	d := &shardedDB{
+		shards: make([]*ramDB, opts.Shards),
+	}
+
+	shardOpts := opts
+
+	// the clusters limit is enforced per shard, rounding up
+	if opts.MaxClusters > 0 {
+		shardOpts.MaxClusters = (opts.MaxClusters + opts.Shards - 1) / opts.Shards
+	}
+
+	for i := range d.shards {
+		d.shards[i] = newRAM(shardOpts, logger)
+	}
+
+	return d
+}
+
+func (d *shardedDB) shard(cluster string) *ramDB {
+	h := fnv.New32a()
+	h.Write([]byte(cluster)) //nolint:errcheck
+
+	return d.shards[h.Sum32()%uint32(len(d.shards))]
+}
+
+// Add implements DB.
+func (d *shardedDB) Add(ctx context.Context, cluster string, n *types.Node) error {
+	return d.shard(cluster).Add(ctx, cluster, n)
+}
+
+// Replace implements DB.
+func (d *shardedDB) Replace(ctx context.Context, cluster string, n *types.Node) error {
+	return d.shard(cluster).Replace(ctx, cluster, n)
+}
+
+// AddAddresses implements DB.
+func (d *shardedDB) AddAddresses(ctx context.Context, cluster, id string, addresses ...*types.Address) error {
+	return d.shard(cluster).AddAddresses(ctx, cluster, id, addresses...)
+}
+
+// Changes implements DB.
+func (d *shardedDB) Changes(ctx context.Context, cluster string, since uint64) (*types.Changes, error) {
+	return d.shard(cluster).Changes(ctx, cluster, since)
+}
+
+// Clean implements DB.
+func (d *shardedDB) Clean() *CleanReport {
+	report := &CleanReport{}
+
+	for _, shard := range d.shards {
+		report.add(shard.Clean())
+	}
+
+	return report
+}
+
+// NodeCount implements NodeCounter.
+func (d *shardedDB) NodeCount() int {
+	var count int
+
+	for _, shard := range d.shards {
+		count += shard.NodeCount()
+	}
+
+	return count
+}
+
+// ClusterConfig implements DB.
+func (d *shardedDB) ClusterConfig(ctx context.Context, cluster string) (*types.ClusterConfig, error) {
+	return d.shard(cluster).ClusterConfig(ctx, cluster)
+}
+
+// SetClusterConfig implements DB.
+func (d *shardedDB) SetClusterConfig(ctx context.Context, cluster string, cfg *types.ClusterConfig) error {
+	return d.shard(cluster).SetClusterConfig(ctx, cluster, cfg)
+}
+
+// DeleteCluster implements DB.
+func (d *shardedDB) DeleteCluster(ctx context.Context, cluster string) (int, error) {
+	return d.shard(cluster).DeleteCluster(ctx, cluster)
+}
+
+// DeleteNodes implements DB.
+func (d *shardedDB) DeleteNodes(ctx context.Context, cluster string, selector map[string]string) ([]string, error) {
+	return d.shard(cluster).DeleteNodes(ctx, cluster, selector)
+}
+
+// ForEachCluster implements DB.
+func (d *shardedDB) ForEachCluster(ctx context.Context, fn func(cluster string, nodes []*types.Node) error) error {
+	for _, shard := range d.shards {
+		if err := shard.ForEachCluster(ctx, fn); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Get implements DB.
+func (d *shardedDB) Get(ctx context.Context, cluster, id string) (*types.Node, error) {
+	return d.shard(cluster).Get(ctx, cluster, id)
+}
+
+// List implements DB.
+func (d *shardedDB) List(ctx context.Context, cluster string) ([]*types.Node, error) {
+	return d.shard(cluster).List(ctx, cluster)
+}
+
+// Walk implements DB.
+func (d *shardedDB) Walk(ctx context.Context, cluster string, fn func(n *types.Node) error) error {
+	return d.shard(cluster).Walk(ctx, cluster, fn)
+}
+
+// Count implements DB.
+func (d *shardedDB) Count(ctx context.Context, cluster string) (int, error) {
+	return d.shard(cluster).Count(ctx, cluster)
+}
+
+// ListClusters implements DB.
+func (d *shardedDB) ListClusters(ctx context.Context, after string, limit int) ([]*types.ClusterInfo, error) {
+	var clusters []*types.ClusterInfo
+
+	// every shard returns its own first page, the merged page is the first limit of them
+	for _, shard := range d.shards {
+		page, err := shard.ListClusters(ctx, after, limit)
+		if err != nil {
+			return nil, err
+		}
+
+		clusters = append(clusters, page...)
+	}
+
+	sort.Slice(clusters, func(i, j int) bool {
+		return clusters[i].ID < clusters[j].ID
+	})
+
+	if limit > 0 && len(clusters) > limit {
+		clusters = clusters[:limit]
+	}
+
+	return clusters, nil
+}
+
+// Ping implements DB.
+func (d *shardedDB) Ping(ctx context.Context) error {
+	return nil
+}
+
+// Summarize implements DB.
+func (d *shardedDB) Summarize(ctx context.Context, cluster string) (*types.ClusterSummary, error) {
+	return d.shard(cluster).Summarize(ctx, cluster)
+}
+
+// Pin implements DB.
+func (d *shardedDB) Pin(ctx context.Context, cluster, id string, sticky bool) error {
+	return d.shard(cluster).Pin(ctx, cluster, id, sticky)
+}
+
+// Touch implements DB.
+func (d *shardedDB) Touch(ctx context.Context, cluster, id string) error {
+	return d.shard(cluster).Touch(ctx, cluster, id)
+}
+
+// Inspect implements Inspector.
+func (d *shardedDB) Inspect(ctx context.Context, cluster string) (*ClusterState, error) {
+	return d.shard(cluster).Inspect(ctx, cluster)
+}
+
+// Replay implements Replayer.
+func (d *shardedDB) Replay(ctx context.Context, cluster string) (*types.Replay, error) {
+	return d.shard(cluster).Replay(ctx, cluster)
+}
+
+// SetAlias implements DB.
+//
+// The alias is stored in the shard of the alias ID.
+func (d *shardedDB) SetAlias(ctx context.Context, alias, target string) error {
+	return d.shard(alias).SetAlias(ctx, alias, target)
+}
+
+// ResolveAlias implements DB.
+func (d *shardedDB) ResolveAlias(ctx context.Context, cluster string) (string, error) {
+	return d.shard(cluster).ResolveAlias(ctx, cluster)
+}
+
+// RemoveAddress implements DB.
+func (d *shardedDB) RemoveAddress(ctx context.Context, cluster, id string, addr *types.Address) error {
+	return d.shard(cluster).RemoveAddress(ctx, cluster, id, addr)
+}
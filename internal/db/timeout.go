@@ -0,0 +1,200 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/talos-systems/kubespan-manager/pkg/types"
+)
+
+// timeoutDB bounds every operation of another DB with a timeout.
+//
+// Long-running operations (Changes, ForEachCluster, Walk) and Clean are passed through as is.
+type timeoutDB struct {
+	DB
+
+	timeout time.Duration
+}
+
+// NewTimeout wraps the backend, so that every operation is bounded by the timeout.
+//
+// Operations exceeding the timeout fail with ErrTimeout.
+func NewTimeout(backend DB, timeout time.Duration) DB {
+	return &timeoutDB{
+		DB:      backend,
+		timeout: timeout,
+	}
+}
+
+func (d *timeoutDB) call(ctx context.Context, fn func(ctx context.Context) error) error {
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+
+	err := fn(ctx)
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%w: %s", ErrTimeout, err)
+	}
+
+	return err
+}
+
+// Add implements DB.
+func (d *timeoutDB) Add(ctx context.Context, cluster string, n *types.Node) error {
+	return d.call(ctx, func(ctx context.Context) error {
+		return d.DB.Add(ctx, cluster, n)
+	})
+}
+
+// Replace implements DB.
+func (d *timeoutDB) Replace(ctx context.Context, cluster string, n *types.Node) error {
+	return d.call(ctx, func(ctx context.Context) error {
+		return d.DB.Replace(ctx, cluster, n)
+	})
+}
+
+// AddAddresses implements DB.
+func (d *timeoutDB) AddAddresses(ctx context.Context, cluster, id string, ep ...*types.Address) error {
+	return d.call(ctx, func(ctx context.Context) error {
+		return d.DB.AddAddresses(ctx, cluster, id, ep...)
+	})
+}
+
+// RemoveAddress implements DB.
+func (d *timeoutDB) RemoveAddress(ctx context.Context, cluster, id string, addr *types.Address) error {
+	return d.call(ctx, func(ctx context.Context) error {
+		return d.DB.RemoveAddress(ctx, cluster, id, addr)
+	})
+}
+
+// Pin implements DB.
+func (d *timeoutDB) Pin(ctx context.Context, cluster, id string, sticky bool) error {
+	return d.call(ctx, func(ctx context.Context) error {
+		return d.DB.Pin(ctx, cluster, id, sticky)
+	})
+}
+
+// Touch implements DB.
+func (d *timeoutDB) Touch(ctx context.Context, cluster, id string) error {
+	return d.call(ctx, func(ctx context.Context) error {
+		return d.DB.Touch(ctx, cluster, id)
+	})
+}
+
+// DeleteCluster implements DB.
+func (d *timeoutDB) DeleteCluster(ctx context.Context, cluster string) (count int, err error) {
+	err = d.call(ctx, func(ctx context.Context) error {
+		count, err = d.DB.DeleteCluster(ctx, cluster)
+
+		return err
+	})
+
+	return count, err
+}
+
+// DeleteNodes implements DB.
+func (d *timeoutDB) DeleteNodes(ctx context.Context, cluster string, selector map[string]string) (removed []string, err error) {
+	err = d.call(ctx, func(ctx context.Context) error {
+		removed, err = d.DB.DeleteNodes(ctx, cluster, selector)
+
+		return err
+	})
+
+	return removed, err
+}
+
+// Get implements DB.
+func (d *timeoutDB) Get(ctx context.Context, cluster, id string) (n *types.Node, err error) {
+	err = d.call(ctx, func(ctx context.Context) error {
+		n, err = d.DB.Get(ctx, cluster, id)
+
+		return err
+	})
+
+	return n, err
+}
+
+// List implements DB.
+func (d *timeoutDB) List(ctx context.Context, cluster string) (list []*types.Node, err error) {
+	err = d.call(ctx, func(ctx context.Context) error {
+		list, err = d.DB.List(ctx, cluster)
+
+		return err
+	})
+
+	return list, err
+}
+
+// ClusterConfig implements DB.
+func (d *timeoutDB) ClusterConfig(ctx context.Context, cluster string) (cfg *types.ClusterConfig, err error) {
+	err = d.call(ctx, func(ctx context.Context) error {
+		cfg, err = d.DB.ClusterConfig(ctx, cluster)
+
+		return err
+	})
+
+	return cfg, err
+}
+
+// SetClusterConfig implements DB.
+func (d *timeoutDB) SetClusterConfig(ctx context.Context, cluster string, cfg *types.ClusterConfig) error {
+	return d.call(ctx, func(ctx context.Context) error {
+		return d.DB.SetClusterConfig(ctx, cluster, cfg)
+	})
+}
+
+// Count implements DB.
+func (d *timeoutDB) Count(ctx context.Context, cluster string) (count int, err error) {
+	err = d.call(ctx, func(ctx context.Context) error {
+		count, err = d.DB.Count(ctx, cluster)
+
+		return err
+	})
+
+	return count, err
+}
+
+// ListClusters implements DB.
+func (d *timeoutDB) ListClusters(ctx context.Context, after string, limit int) (clusters []*types.ClusterInfo, err error) {
+	err = d.call(ctx, func(ctx context.Context) error {
+		clusters, err = d.DB.ListClusters(ctx, after, limit)
+
+		return err
+	})
+
+	return clusters, err
+}
+
+// Summarize implements DB.
+func (d *timeoutDB) Summarize(ctx context.Context, cluster string) (summary *types.ClusterSummary, err error) {
+	err = d.call(ctx, func(ctx context.Context) error {
+		summary, err = d.DB.Summarize(ctx, cluster)
+
+		return err
+	})
+
+	return summary, err
+}
+
+// SetAlias implements DB.
+func (d *timeoutDB) SetAlias(ctx context.Context, alias, target string) error {
+	return d.call(ctx, func(ctx context.Context) error {
+		return d.DB.SetAlias(ctx, alias, target)
+	})
+}
+
+// ResolveAlias implements DB.
+func (d *timeoutDB) ResolveAlias(ctx context.Context, cluster string) (target string, err error) {
+	err = d.call(ctx, func(ctx context.Context) error {
+		target, err = d.DB.ResolveAlias(ctx, cluster)
+
+		return err
+	})
+
+	return target, err
+}
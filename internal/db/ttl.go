@@ -0,0 +1,25 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package db
+
+import (
+	"math/rand"
+	"time"
+)
+
+// DefaultTTLJitter is the default spread of the Redis key TTLs, as a fraction of the TTL.
+const DefaultTTLJitter = 0.1
+
+// jitterTTL returns the TTL randomly extended by up to jitter of its value, within [ttl, ttl*(1+jitter)].
+//
+// Nodes registered in a burst (e.g. a cluster coming up) would otherwise expire all at once.
+// The TTL is never shortened, so that the keys don't expire before the addresses they hold.
+func jitterTTL(ttl time.Duration, jitter float64) time.Duration {
+	if jitter <= 0 {
+		return ttl
+	}
+
+	return time.Duration(float64(ttl) * (1 + jitter*rand.Float64()))
+}
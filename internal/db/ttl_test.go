@@ -0,0 +1,34 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package db
+
+import (
+	"testing"
+	"time"
+)
+
+func TestJitterTTL(t *testing.T) {
+	const ttl = 10 * time.Minute
+
+	if got := jitterTTL(ttl, 0); got != ttl {
+		t.Fatalf("TTL changed without jitter: %s", got)
+	}
+
+	seen := make(map[time.Duration]struct{})
+
+	for i := 0; i < 100; i++ {
+		got := jitterTTL(ttl, 0.1)
+
+		if got < ttl || got > 11*time.Minute {
+			t.Fatalf("TTL %s out of the jitter range", got)
+		}
+
+		seen[got] = struct{}{}
+	}
+
+	if len(seen) < 2 {
+		t.Fatal("TTLs are not spread")
+	}
+}
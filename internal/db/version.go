@@ -0,0 +1,67 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/talos-systems/kubespan-manager/pkg/types"
+)
+
+// ErrVersionConflict means that the stored node version doesn't match the expected one.
+var ErrVersionConflict = errors.New("version conflict")
+
+// VersionConflictError describes the version conflict.
+type VersionConflictError struct {
+	Expected uint64
+	Current  uint64
+}
+
+func (e *VersionConflictError) Error() string {
+	return fmt.Sprintf("%s: expected version %d, current version %d", ErrVersionConflict, e.Expected, e.Current)
+}
+
+// Unwrap implements errors unwrapping.
+func (e *VersionConflictError) Unwrap() error {
+	return ErrVersionConflict
+}
+
+// ErrStaleGeneration means that the update carries a lower generation than the stored node.
+var ErrStaleGeneration = errors.New("stale generation")
+
+// checkGeneration rejects the update of the node which would decrease its generation.
+//
+// Generation 0 is not reported by the node, the update keeps the stored generation.
+func checkGeneration(existing, n *types.Node) error {
+	if existing == nil || n.Generation == 0 || n.Generation >= existing.Generation {
+		return nil
+	}
+
+	return fmt.Errorf("%w: generation %d is older than the stored generation %d", ErrStaleGeneration, n.Generation, existing.Generation)
+}
+
+type expectedVersionKey struct{}
+
+// ExpectVersion returns the context which makes the node updates conditional on the stored node version.
+//
+// Version 0 means that the node should not exist yet.
+func ExpectVersion(ctx context.Context, version uint64) context.Context {
+	return context.WithValue(ctx, expectedVersionKey{}, version)
+}
+
+// checkVersion verifies the current version of the node against the expected one, if any.
+func checkVersion(ctx context.Context, current uint64) error {
+	expected, ok := ctx.Value(expectedVersionKey{}).(uint64)
+	if !ok || expected == current {
+		return nil
+	}
+
+	return &VersionConflictError{
+		Expected: expected,
+		Current:  current,
+	}
+}
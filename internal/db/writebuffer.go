@@ -0,0 +1,358 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package db
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+
+	"github.com/talos-systems/kubespan-manager/pkg/types"
+)
+
+var (
+	bufferedWrites = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "discovery_write_buffer_pending",
+		Help: "Number of nodes with writes waiting in the write buffer.",
+	})
+
+	coalescedWrites = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "discovery_write_buffer_coalesced_total",
+		Help: "Number of writes merged into an already buffered write of the same node.",
+	})
+
+	failedBufferedWrites = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "discovery_write_buffer_failed_total",
+		Help: "Number of buffered node writes which failed to flush.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(bufferedWrites, coalescedWrites, failedBufferedWrites)
+}
+
+// WriteAck is the durability mode of the buffered writes.
+type WriteAck string
+
+// Supported durability modes.
+const (
+	// WriteAckFlush acknowledges the write once it is flushed to the backend.
+	WriteAckFlush WriteAck = "flush"
+
+	// WriteAckQueue acknowledges the write once it is queued, writes still in the buffer are lost on a crash.
+	WriteAckQueue WriteAck = "queue"
+)
+
+// WriteBufferOptions configures the write buffer.
+type WriteBufferOptions struct {
+	// Window is the interval the buffered writes are flushed at.
+	Window time.Duration
+
+	// MaxPending caps the number of nodes with buffered writes, writes of other nodes go directly
+	// to the backend once the buffer is full.
+	MaxPending int
+
+	// Ack is the durability mode.
+	Ack WriteAck
+}
+
+// bufferedDB coalesces the Add and AddAddresses writes of the same node within the window
+// into a single write to the backend.
+//
+// Other writes (including Pin) flush the buffer before proceeding, so that they apply on top of the buffered writes.
+// Reads are served by the backend, so they don't see the writes which are still buffered.
+type bufferedDB struct {
+	DB
+
+	logger *zap.Logger
+	opts   WriteBufferOptions
+
+	mu      sync.Mutex
+	pending map[string]*pendingWrite
+
+	// flushMu serializes the flushes, so that the writes of the same node are applied in order.
+	flushMu sync.Mutex
+
+	// once the buffer is closed, writes go directly to the backend
+	closed    bool
+	closeOnce sync.Once
+	stop      chan struct{}
+	stopped   chan struct{}
+}
+
+// pendingWrite is the merged state of the buffered writes of a single node.
+type pendingWrite struct {
+	cluster string
+
+	// node accumulates the node data and the addresses.
+	node *types.Node
+
+	// add is set if any of the writes is Add, otherwise the addresses are added to the existing node.
+	add bool
+
+	// correlationID is the correlation ID of the latest merged write, so that the flush can be traced back to it.
+	correlationID string
+
+	// waiters receive the result of the flush in the WriteAckFlush mode.
+	waiters []chan error
+}
+
+// NewWriteBuffer wraps the backend with the write buffer.
+//
+// Writes carrying the expected node version are never buffered, as the version is checked against the backend.
+// The returned DB implements io.Closer, it should be closed on shutdown, so that the buffered writes are not lost.
+func NewWriteBuffer(backend DB, logger *zap.Logger, opts WriteBufferOptions) (DB, error) {
+	switch opts.Ack {
+	case WriteAckFlush, WriteAckQueue:
+	default:
+		return nil, fmt.Errorf("unsupported write acknowledgement mode %q", opts.Ack)
+	}
+
+	if opts.Window <= 0 || opts.MaxPending <= 0 {
+		return nil, fmt.Errorf("write buffer window and size should be positive")
+	}
+
+	d := &bufferedDB{
+		DB:      backend,
+		logger:  logger,
+		opts:    opts,
+		pending: make(map[string]*pendingWrite),
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+
+	go d.run()
+
+	return d, nil
+}
+
+func (d *bufferedDB) run() {
+	defer close(d.stopped)
+
+	ticker := time.NewTicker(d.opts.Window)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-d.stop:
+			return
+		case <-ticker.C:
+			d.flush()
+		}
+	}
+}
+
+// Close stops the periodic flushes and flushes the writes left in the buffer.
+//
+// Writes after Close go directly to the backend.
+func (d *bufferedDB) Close() error {
+	d.closeOnce.Do(func() {
+		d.mu.Lock()
+		d.closed = true
+		d.mu.Unlock()
+
+		close(d.stop)
+		<-d.stopped
+
+		d.flush()
+	})
+
+	return nil
+}
+
+// buffer merges the write into the buffer.
+//
+// It returns false if the write should go directly to the backend.
+// If the write can't be merged, the merge error is returned right away and the pending write is kept as is.
+func (d *bufferedDB) buffer(ctx context.Context, cluster, id string, merge func(p *pendingWrite) error) (bool, error) {
+	if _, ok := ctx.Value(expectedVersionKey{}).(uint64); ok {
+		return false, nil
+	}
+
+	key := cluster + "/" + id
+
+	d.mu.Lock()
+
+	if d.closed {
+		d.mu.Unlock()
+
+		return false, nil
+	}
+
+	p, ok := d.pending[key]
+	if ok {
+		coalescedWrites.Inc()
+	} else {
+		if len(d.pending) >= d.opts.MaxPending {
+			d.mu.Unlock()
+
+			return false, nil
+		}
+
+		p = &pendingWrite{
+			cluster: cluster,
+			node:    &types.Node{ID: id},
+		}
+
+		d.pending[key] = p
+		bufferedWrites.Set(float64(len(d.pending)))
+	}
+
+	if err := merge(p); err != nil {
+		d.mu.Unlock()
+
+		return true, err
+	}
+
+	if id, ok := ctx.Value(CorrelationIDKey).(string); ok && id != "" {
+		p.correlationID = id
+	}
+
+	var done chan error
+
+	if d.opts.Ack == WriteAckFlush {
+		done = make(chan error, 1)
+		p.waiters = append(p.waiters, done)
+	}
+
+	d.mu.Unlock()
+
+	if done == nil {
+		return true, nil
+	}
+
+	select {
+	case err := <-done:
+		return true, err
+	case <-ctx.Done():
+		return true, ctx.Err()
+	}
+}
+
+// flush writes all the buffered writes to the backend.
+func (d *bufferedDB) flush() {
+	d.flushMu.Lock()
+	defer d.flushMu.Unlock()
+
+	d.mu.Lock()
+	batch := d.pending
+	d.pending = make(map[string]*pendingWrite)
+	bufferedWrites.Set(0)
+	d.mu.Unlock()
+
+	for _, p := range batch {
+		var err error
+
+		ctx := context.Background()
+
+		if p.correlationID != "" {
+			ctx = context.WithValue(ctx, CorrelationIDKey, p.correlationID) //nolint:staticcheck
+		}
+
+		if p.add {
+			err = d.DB.Add(ctx, p.cluster, p.node)
+		} else {
+			err = d.DB.AddAddresses(ctx, p.cluster, p.node.ID, p.node.Addresses...)
+		}
+
+		if err != nil {
+			failedBufferedWrites.Inc()
+
+			requestLogger(ctx, d.logger).Error("failed to flush buffered node write",
+				zap.String("cluster", p.cluster),
+				zap.String("node", p.node.ID),
+				zap.Int("writes", len(p.waiters)),
+				zap.Error(err),
+			)
+		}
+
+		for _, done := range p.waiters {
+			done <- err
+		}
+	}
+}
+
+// Add implements DB.
+func (d *bufferedDB) Add(ctx context.Context, cluster string, n *types.Node) error {
+	queued, err := d.buffer(ctx, cluster, n.ID, func(p *pendingWrite) error {
+		// a stale write coalesced after a newer one would lower the generation of the whole batch
+		if err := checkGeneration(p.node, n); err != nil {
+			return err
+		}
+
+		p.node.Merge(n.Snapshot())
+		p.add = true
+
+		return nil
+	})
+	if !queued {
+		return d.DB.Add(ctx, cluster, n)
+	}
+
+	return err
+}
+
+// AddAddresses implements DB.
+func (d *bufferedDB) AddAddresses(ctx context.Context, cluster, id string, ep ...*types.Address) error {
+	queued, err := d.buffer(ctx, cluster, id, func(p *pendingWrite) error {
+		for _, a := range ep {
+			copied := *a
+			p.node.AddAddresses(&copied)
+		}
+
+		return nil
+	})
+	if !queued {
+		return d.DB.AddAddresses(ctx, cluster, id, ep...)
+	}
+
+	return err
+}
+
+// Replace implements DB.
+func (d *bufferedDB) Replace(ctx context.Context, cluster string, n *types.Node) error {
+	d.flush()
+
+	return d.DB.Replace(ctx, cluster, n)
+}
+
+// RemoveAddress implements DB.
+func (d *bufferedDB) RemoveAddress(ctx context.Context, cluster, id string, addr *types.Address) error {
+	d.flush()
+
+	return d.DB.RemoveAddress(ctx, cluster, id, addr)
+}
+
+// Pin implements DB.
+func (d *bufferedDB) Pin(ctx context.Context, cluster, id string, sticky bool) error {
+	d.flush()
+
+	return d.DB.Pin(ctx, cluster, id, sticky)
+}
+
+// Touch implements DB.
+func (d *bufferedDB) Touch(ctx context.Context, cluster, id string) error {
+	d.flush()
+
+	return d.DB.Touch(ctx, cluster, id)
+}
+
+// DeleteCluster implements DB.
+func (d *bufferedDB) DeleteCluster(ctx context.Context, cluster string) (int, error) {
+	d.flush()
+
+	return d.DB.DeleteCluster(ctx, cluster)
+}
+
+// DeleteNodes implements DB.
+func (d *bufferedDB) DeleteNodes(ctx context.Context, cluster string, selector map[string]string) ([]string, error) {
+	d.flush()
+
+	return d.DB.DeleteNodes(ctx, cluster, selector)
+}
@@ -11,19 +11,33 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/url"
+	"strconv"
+	"time"
 
 	"github.com/talos-systems/kubespan-manager/pkg/types"
 )
 
 // Add adds a Node to the Cluster database, updating it if it already exists.
+//
+// Addresses of an existing Node are merged with the ones being added.
 func Add(rootURL, clusterID string, n *types.Node) error {
+	return post(rootURL, clusterID, "merge", n)
+}
+
+// Replace adds a Node to the Cluster database, replacing it if it already exists.
+func Replace(rootURL, clusterID string, n *types.Node) error {
+	return post(rootURL, clusterID, "replace", n)
+}
+
+func post(rootURL, clusterID, mode string, n *types.Node) error {
 	body := new(bytes.Buffer)
 
 	if err := json.NewEncoder(body).Encode(n); err != nil {
 		return fmt.Errorf("failed to encode Node information: %w", err)
 	}
 
-	req, err := http.NewRequestWithContext(context.TODO(), http.MethodPost, fmt.Sprintf("%s/%s", rootURL, clusterID), body)
+	req, err := http.NewRequestWithContext(context.TODO(), http.MethodPost, fmt.Sprintf("%s/%s?mode=%s", rootURL, clusterID, mode), body)
 	if err != nil {
 		return fmt.Errorf("failed to post Node information: %w", err)
 	}
@@ -67,6 +81,51 @@ func AddAddresses(rootURL, clusterID, id string, epList ...*types.Address) error
 	return nil
 }
 
+// Addresses returns the list of addresses of the Node defined by the given public key.
+func Addresses(rootURL, clusterID, publicKey string) ([]*types.Address, error) {
+	req, err := http.NewRequestWithContext(context.TODO(), http.MethodGet, fmt.Sprintf("%s/%s/%s/addresses", rootURL, clusterID, publicKey), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to request addresses of node %q/%q from server %q: %w", clusterID, publicKey, rootURL, err)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to request addresses of node %q/%q from server %q: %w", clusterID, publicKey, rootURL, err)
+	}
+	defer resp.Body.Close() //nolint:errcheck
+
+	if resp.StatusCode > 299 {
+		return nil, fmt.Errorf("server rejected request for addresses of node %q/%q: %s", clusterID, publicKey, resp.Status)
+	}
+
+	var list []*types.Address
+	if err = json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, fmt.Errorf("failed to decode response from server: %w", err)
+	}
+
+	return list, nil
+}
+
+// RemoveAddress removes a single address (identified by its IP or DNS name) from a node.
+func RemoveAddress(rootURL, clusterID, id, host string) error {
+	req, err := http.NewRequestWithContext(context.TODO(), http.MethodDelete, fmt.Sprintf("%s/%s/%s/addresses/%s", rootURL, clusterID, id, url.PathEscape(host)), nil)
+	if err != nil {
+		return fmt.Errorf("failed to make DELETE request: %w", err)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to remove address %q from node %q/%q: %w", host, clusterID, id, err)
+	}
+	defer resp.Body.Close() //nolint:errcheck
+
+	if resp.StatusCode > 299 {
+		return fmt.Errorf("server rejected removal of address %q from node %q/%q: %s", host, clusterID, id, resp.Status)
+	}
+
+	return nil
+}
+
 // Get returns the Node defined by the given public key, if and only if it exists within the given Cluster ID.
 func Get(rootURL, clusterID, publicKey string) (*types.Node, error) {
 	req, err := http.NewRequestWithContext(context.TODO(), http.MethodGet, fmt.Sprintf("%s/%s/%s", rootURL, clusterID, publicKey), nil)
@@ -108,3 +167,45 @@ func List(rootURL, clusterID string) ([]*types.Node, error) {
 
 	return list, nil
 }
+
+// Changes waits up to the given duration for the Nodes of the Cluster to change after the cursor.
+//
+// The returned Changes carry the new cursor, which should be passed to the next call.
+// Cursor 0 returns all the Nodes of the Cluster.
+// If the Reset flag is set, the Nodes are a full snapshot and any previously received state should be dropped.
+// If nothing changed before the timeout, empty Changes are returned.
+func Changes(rootURL, clusterID string, since uint64, wait time.Duration) (*types.Changes, error) {
+	req, err := http.NewRequestWithContext(context.TODO(), http.MethodGet, fmt.Sprintf("%s/%s?wait=%s&since=%d", rootURL, clusterID, wait, since), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to request changes from server %q: %w", rootURL, err)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to request changes from server %q: %w", rootURL, err)
+	}
+	defer resp.Body.Close() //nolint:errcheck
+
+	if resp.StatusCode > 399 {
+		return nil, fmt.Errorf("server rejected request for changes of cluster %q: %s", clusterID, resp.Status)
+	}
+
+	cursor, err := strconv.ParseUint(resp.Header.Get("X-Cursor"), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse cursor returned by server: %w", err)
+	}
+
+	changes := &types.Changes{
+		Cursor: cursor,
+	}
+
+	if resp.StatusCode == http.StatusNotModified {
+		return changes, nil
+	}
+
+	if err = json.NewDecoder(resp.Body).Decode(changes); err != nil {
+		return nil, fmt.Errorf("failed to decode response from server: %w", err)
+	}
+
+	return changes, nil
+}
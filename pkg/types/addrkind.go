@@ -0,0 +1,65 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package types
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// AddressKind tells how the host of the address is given.
+type AddressKind string
+
+// Address kinds, exactly one of the IP, Name and Service fields is set.
+const (
+	AddressKindIP   AddressKind = "ip"
+	AddressKindName AddressKind = "name"
+	AddressKindSRV  AddressKind = "srv"
+)
+
+// Kind returns the kind of the address.
+func (a *Address) Kind() AddressKind {
+	switch {
+	case !a.IP.IsZero():
+		return AddressKindIP
+	case a.Service != "":
+		return AddressKindSRV
+	default:
+		return AddressKindName
+	}
+}
+
+// Host returns the host portion of the address: the IP, the DNS name or the SRV service name.
+func (a *Address) Host() string {
+	switch a.Kind() {
+	case AddressKindIP:
+		return a.IP.String()
+	case AddressKindSRV:
+		return a.Service
+	default:
+		return a.Name
+	}
+}
+
+// isServiceName indicates whether the name is an SRV owner name (_service._proto.domain).
+func isServiceName(name string) bool {
+	return strings.HasPrefix(name, "_") && strings.Count(name, ".") >= 2
+}
+
+// resolveSRV picks the target of the SRV record with the highest priority and weight.
+func (a *Address) resolveSRV() (string, uint16, error) {
+	_, records, err := net.LookupSRV("", "", a.Service)
+	if err != nil {
+		return "", 0, err
+	}
+
+	if len(records) == 0 {
+		return "", 0, fmt.Errorf("no SRV records for %q", a.Service)
+	}
+
+	// records are sorted by priority and randomized by weight
+	return strings.TrimSuffix(records[0].Target, "."), records[0].Port, nil
+}
@@ -0,0 +1,38 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package types
+
+import "fmt"
+
+// AddressType describes how the address reaches the Node.
+type AddressType string
+
+// Supported address types, addresses without the type are direct.
+const (
+	AddressTypeDirect AddressType = "direct"
+	AddressTypeRelay  AddressType = "relay"
+	AddressTypeSTUN   AddressType = "stun"
+)
+
+// ParseAddressType parses the address type, empty type is parsed as direct.
+func ParseAddressType(s string) (AddressType, error) {
+	switch t := AddressType(s); t {
+	case "", AddressTypeDirect:
+		return AddressTypeDirect, nil
+	case AddressTypeRelay, AddressTypeSTUN:
+		return t, nil
+	default:
+		return "", fmt.Errorf("unsupported address type %q", s)
+	}
+}
+
+// IsType indicates whether the address is of the given type.
+func (a *Address) IsType(t AddressType) bool {
+	if a.Type == "" {
+		return t == AddressTypeDirect
+	}
+
+	return a.Type == t
+}
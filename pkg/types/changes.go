@@ -0,0 +1,70 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package types
+
+import "time"
+
+// Changes describes the changes of a cluster after a cursor.
+type Changes struct {
+	// Nodes are the Nodes added or updated after the cursor.
+	Nodes []*Node `json:"nodes,omitempty"`
+
+	// Removed are the IDs of the Nodes removed after the cursor.
+	Removed []string `json:"removed,omitempty"`
+
+	// Cursor is the current cursor of the cluster, it should be passed to the next call.
+	Cursor uint64 `json:"cursor"`
+
+	// Reset is set if the changes after the cursor are no longer known.
+	//
+	// In that case Nodes is a full snapshot of the cluster and any previously received state should be dropped.
+	Reset bool `json:"reset,omitempty"`
+
+	// Deltas describe how the Nodes changed after the cursor, keyed by the Node ID.
+	//
+	// They are only set if the backend tracks the changed fields, and are used by the delta notification format.
+	Deltas map[string]NodeDelta `json:"-"`
+
+	// Changed is the time of the earliest change after the cursor, zero if unknown or if the changes are a snapshot.
+	//
+	// It is used to measure the delivery latency of the notifications.
+	Changed time.Time `json:"-"`
+}
+
+// Empty indicates whether there are no changes.
+func (c *Changes) Empty() bool {
+	return len(c.Nodes) == 0 && len(c.Removed) == 0 && !c.Reset
+}
+
+// ChangeEvent is a single recorded change of a cluster Node.
+type ChangeEvent struct {
+	// Revision is the cursor of the cluster right after the change.
+	Revision uint64 `json:"revision"`
+
+	ID      string    `json:"id"`
+	Created bool      `json:"created,omitempty"`
+	Removed bool      `json:"removed,omitempty"`
+	Time    time.Time `json:"time"`
+
+	// Fields are the JSON keys of the changed fields, they are filled in from the Delta when the event is sent.
+	Fields []string `json:"fields,omitempty"`
+
+	// Delta tells which fields of the Node changed.
+	Delta NodeDelta `json:"-"`
+}
+
+// Replay is the sequence of the retained changes of a cluster, oldest first.
+type Replay struct {
+	Events []*ChangeEvent `json:"events"`
+
+	// Nodes is the state at the Cursor of the Nodes changed by the Events, removed Nodes are not included.
+	Nodes []*Node `json:"nodes"`
+
+	// Cursor is the cursor of the cluster after the last change, live changes should be requested after it.
+	Cursor uint64 `json:"cursor"`
+
+	// Truncated is set if the earlier changes are no longer retained.
+	Truncated bool `json:"truncated,omitempty"`
+}
@@ -0,0 +1,92 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package types
+
+import (
+	"fmt"
+	"time"
+)
+
+// ClusterConfig describes per-cluster overrides of the global defaults.
+//
+// Zero values mean that the global default is used.
+type ClusterConfig struct {
+	// AddressTTLSeconds is the amount of time after which addresses not reported again expire.
+	AddressTTLSeconds int `json:"addressTTLSeconds,omitempty"`
+
+	// MaxNodes is the maximum number of Nodes in the cluster.
+	MaxNodes int `json:"maxNodes,omitempty"`
+
+	// AllowedKeys is the list of the node keys allowed to register, any key is allowed if empty.
+	AllowedKeys []string `json:"allowedKeys,omitempty"`
+}
+
+// IsZero returns true if the config has no overrides.
+func (c *ClusterConfig) IsZero() bool {
+	return c.AddressTTLSeconds == 0 && c.MaxNodes == 0 && len(c.AllowedKeys) == 0
+}
+
+// Validate checks the overrides.
+//
+// Allowed keys are rewritten in the canonical key form, see NormalizeKey.
+func (c *ClusterConfig) Validate() error {
+	if c.AddressTTLSeconds < 0 {
+		return fmt.Errorf("address TTL should not be negative")
+	}
+
+	if c.MaxNodes < 0 {
+		return fmt.Errorf("max nodes should not be negative")
+	}
+
+	for i, key := range c.AllowedKeys {
+		id, err := NormalizeKey(key)
+		if err != nil {
+			return fmt.Errorf("allowed key %q: %w", key, err)
+		}
+
+		c.AllowedKeys[i] = id
+	}
+
+	return nil
+}
+
+// AddressTTL returns the address TTL, falling back to the default.
+//
+// It is safe to call on a nil ClusterConfig.
+func (c *ClusterConfig) AddressTTL(def time.Duration) time.Duration {
+	if c == nil || c.AddressTTLSeconds == 0 {
+		return def
+	}
+
+	return time.Duration(c.AddressTTLSeconds) * time.Second
+}
+
+// NodeLimit returns the maximum number of Nodes, zero means no limit.
+//
+// It is safe to call on a nil ClusterConfig.
+func (c *ClusterConfig) NodeLimit() int {
+	if c == nil {
+		return 0
+	}
+
+	return c.MaxNodes
+}
+
+// AllowsKey returns true if the node key is allowed to register.
+//
+// It is safe to call on a nil ClusterConfig.
+func (c *ClusterConfig) AllowsKey(id string) bool {
+	if c == nil || len(c.AllowedKeys) == 0 {
+		return true
+	}
+
+	for _, key := range c.AllowedKeys {
+		if key == id {
+			return true
+		}
+	}
+
+	return false
+}
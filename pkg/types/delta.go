@@ -0,0 +1,150 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package types
+
+// NodeFields is a set of the mutable Node fields.
+type NodeFields uint8
+
+// Mutable Node fields.
+const (
+	FieldName NodeFields = 1 << iota
+	FieldIP
+	FieldAddresses
+	FieldLabels
+	FieldAddressFamily
+	FieldSticky
+	FieldRole
+	FieldGeneration
+
+	AllNodeFields = FieldName | FieldIP | FieldAddresses | FieldLabels | FieldAddressFamily | FieldSticky | FieldRole | FieldGeneration
+)
+
+// NodeDelta describes how a Node changed after a cursor.
+type NodeDelta struct {
+	// Created is set if the Node didn't exist at the cursor.
+	Created bool
+
+	// Fields are the fields changed after the cursor.
+	Fields NodeFields
+}
+
+// Merge accumulates the later delta of the same Node.
+func (d NodeDelta) Merge(later NodeDelta) NodeDelta {
+	return NodeDelta{
+		Created: d.Created || later.Created,
+		Fields:  d.Fields | later.Fields,
+	}
+}
+
+// Snapshot returns a copy of the Node which is not affected by the later updates of the Node.
+func (n *Node) Snapshot() *Node {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	snapshot := &Node{
+		Name:                    n.Name,
+		ID:                      n.ID,
+		IP:                      n.IP,
+		LastSeen:                n.LastSeen,
+		LastModified:            n.LastModified,
+		Version:                 n.Version,
+		AddressFamilyPreference: n.AddressFamilyPreference,
+		Role:                    n.Role,
+		Sticky:                  n.Sticky,
+		Generation:              n.Generation,
+	}
+
+	for _, a := range n.Addresses {
+		copied := *a
+		snapshot.Addresses = append(snapshot.Addresses, &copied)
+	}
+
+	if n.Labels != nil {
+		snapshot.Labels = make(map[string]string, len(n.Labels))
+
+		for k, v := range n.Labels {
+			snapshot.Labels[k] = v
+		}
+	}
+
+	return snapshot
+}
+
+// Diff returns the delta of the Node relative to its previous state, nil previous state means the Node was created.
+//
+// Re-reporting the same addresses is not a change of the addresses.
+func (n *Node) Diff(prev *Node) NodeDelta {
+	if prev == nil {
+		return NodeDelta{Created: true, Fields: AllNodeFields}
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	var fields NodeFields
+
+	if n.Name != prev.Name {
+		fields |= FieldName
+	}
+
+	if n.IP != prev.IP {
+		fields |= FieldIP
+	}
+
+	if n.AddressFamilyPreference != prev.AddressFamilyPreference {
+		fields |= FieldAddressFamily
+	}
+
+	if n.Sticky != prev.Sticky {
+		fields |= FieldSticky
+	}
+
+	if n.Role != prev.Role {
+		fields |= FieldRole
+	}
+
+	if n.Generation != prev.Generation {
+		fields |= FieldGeneration
+	}
+
+	if !equalLabels(n.Labels, prev.Labels) {
+		fields |= FieldLabels
+	}
+
+	if !equalAddresses(n.Addresses, prev.Addresses) {
+		fields |= FieldAddresses
+	}
+
+	return NodeDelta{Fields: fields}
+}
+
+func equalLabels(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for k, v := range a {
+		if other, ok := b[k]; !ok || other != v {
+			return false
+		}
+	}
+
+	return true
+}
+
+func equalAddresses(a, b []*Address) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if !a[i].Equal(b[i]) || a[i].Priority != b[i].Priority || a[i].TTLSeconds != b[i].TTLSeconds || a[i].Type != b[i].Type ||
+			a[i].Weight != b[i].Weight {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,91 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package types
+
+import "fmt"
+
+// AddressFamily is the IP address family of the endpoints.
+type AddressFamily string
+
+// Supported address families, AddressFamilyBoth matches any address.
+const (
+	AddressFamilyBoth AddressFamily = ""
+	AddressFamilyIPv4 AddressFamily = "4"
+	AddressFamilyIPv6 AddressFamily = "6"
+)
+
+// ParseAddressFamily parses the address family: 4, 6 or both (the default if empty).
+func ParseAddressFamily(s string) (AddressFamily, error) {
+	switch s {
+	case "", "both":
+		return AddressFamilyBoth, nil
+	case "4":
+		return AddressFamilyIPv4, nil
+	case "6":
+		return AddressFamilyIPv6, nil
+	default:
+		return "", fmt.Errorf("unsupported address family %q", s)
+	}
+}
+
+// InFamily indicates whether the address belongs to the address family.
+//
+// DNS addresses might resolve to any family, so they always match.
+func (a *Address) InFamily(family AddressFamily) bool {
+	switch {
+	case family == AddressFamilyBoth, a.IP.IsZero():
+		return true
+	case family == AddressFamilyIPv4:
+		return a.IP.Is4()
+	default:
+		return a.IP.Is6()
+	}
+}
+
+// WithAddresses returns the Node with the addresses matching the predicate only.
+//
+// The Node is not modified, a trimmed copy is returned if any address is filtered out.
+func (n *Node) WithAddresses(match func(a *Address) bool) *Node {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	addresses := make([]*Address, 0, len(n.Addresses))
+
+	for _, a := range n.Addresses {
+		if match(a) {
+			addresses = append(addresses, a)
+		}
+	}
+
+	if len(addresses) == len(n.Addresses) {
+		return n
+	}
+
+	return &Node{
+		Name:                    n.Name,
+		ID:                      n.ID,
+		IP:                      n.IP,
+		Addresses:               addresses,
+		LastSeen:                n.LastSeen,
+		LastModified:            n.LastModified,
+		Labels:                  n.Labels,
+		Version:                 n.Version,
+		AddressFamilyPreference: n.AddressFamilyPreference,
+		Role:                    n.Role,
+		Sticky:                  n.Sticky,
+		Generation:              n.Generation,
+	}
+}
+
+// WithAddressFamily returns the Node with the addresses of the given family only.
+func (n *Node) WithAddressFamily(family AddressFamily) *Node {
+	if family == AddressFamilyBoth {
+		return n
+	}
+
+	return n.WithAddresses(func(a *Address) bool {
+		return a.InFamily(family)
+	})
+}
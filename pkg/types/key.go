@@ -0,0 +1,42 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package types
+
+import (
+	"encoding/base64"
+	"errors"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// keyEncodings are the accepted textual forms of the Wireguard keys.
+var keyEncodings = []*base64.Encoding{
+	base64.StdEncoding,
+	base64.RawStdEncoding,
+	base64.URLEncoding,
+	base64.RawURLEncoding,
+}
+
+// NormalizeKey returns the canonical form (padded standard base64) of the Wireguard public key.
+//
+// Keys are accepted with or without padding, in the standard or URL-safe alphabet,
+// so that the same key always maps to the same node ID.
+func NormalizeKey(key string) (string, error) {
+	for _, enc := range keyEncodings {
+		b, err := enc.DecodeString(key)
+		if err != nil || len(b) != wgtypes.KeyLen {
+			continue
+		}
+
+		k, err := wgtypes.NewKey(b)
+		if err != nil {
+			return "", err
+		}
+
+		return k.String(), nil
+	}
+
+	return "", errors.New("not a valid wireguard key")
+}
@@ -0,0 +1,108 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package types
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	maxLabelNameLength   = 63
+	maxLabelPrefixLength = 253
+	maxLabelValueLength  = 63
+)
+
+var (
+	labelNameRe   = regexp.MustCompile(`^[A-Za-z0-9]([-A-Za-z0-9_.]*[A-Za-z0-9])?$`)
+	labelPrefixRe = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?(\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*$`)
+)
+
+// ValidateLabels checks label keys and values.
+//
+// Label keys follow the Kubernetes convention: an optional DNS subdomain prefix and a name separated by a slash.
+// Label values are either empty or follow the same rules as label key names.
+func ValidateLabels(labels map[string]string) error {
+	for key, value := range labels {
+		if err := validateLabelKey(key); err != nil {
+			return err
+		}
+
+		if len(value) > maxLabelValueLength {
+			return fmt.Errorf("label %q value is longer than %d characters", key, maxLabelValueLength)
+		}
+
+		if value != "" && !labelNameRe.MatchString(value) {
+			return fmt.Errorf("label %q value %q contains invalid characters", key, value)
+		}
+	}
+
+	return nil
+}
+
+// LabelsSize returns the total size of the label keys and values in bytes.
+func LabelsSize(labels map[string]string) int {
+	size := 0
+
+	for key, value := range labels {
+		size += len(key) + len(value)
+	}
+
+	return size
+}
+
+func validateLabelKey(key string) error {
+	name := key
+
+	if idx := strings.LastIndexByte(key, '/'); idx >= 0 {
+		prefix := key[:idx]
+		name = key[idx+1:]
+
+		if len(prefix) > maxLabelPrefixLength || !labelPrefixRe.MatchString(prefix) {
+			return fmt.Errorf("label %q prefix is not a valid DNS subdomain", key)
+		}
+	}
+
+	if name == "" || len(name) > maxLabelNameLength {
+		return fmt.Errorf("label %q name should be 1 to %d characters long", key, maxLabelNameLength)
+	}
+
+	if !labelNameRe.MatchString(name) {
+		return fmt.Errorf("label %q name contains invalid characters", key)
+	}
+
+	return nil
+}
+
+// ParseLabelSelector parses a list of key=value label selectors.
+func ParseLabelSelector(selectors []string) (map[string]string, error) {
+	selector := make(map[string]string, len(selectors))
+
+	for _, sel := range selectors {
+		idx := strings.IndexByte(sel, '=')
+		if idx <= 0 {
+			return nil, fmt.Errorf("label selector %q should be in the key=value form", sel)
+		}
+
+		selector[sel[:idx]] = sel[idx+1:]
+	}
+
+	return selector, nil
+}
+
+// MatchLabels indicates whether the Node has all the labels of the selector.
+func (n *Node) MatchLabels(selector map[string]string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for key, value := range selector {
+		if v, ok := n.Labels[key]; !ok || v != value {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,8 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package pb contains the protobuf messages of the wire schema in types.proto.
+package pb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative types.proto
@@ -0,0 +1,295 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package types
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+	"inet.af/netaddr"
+
+	"github.com/talos-systems/kubespan-manager/pkg/types/pb"
+)
+
+// MIMEProtobuf is the content type of the protobuf-encoded bodies.
+const MIMEProtobuf = "application/x-protobuf"
+
+// marshalOptions keeps the encoding stable: the labels are sorted.
+var marshalOptions = proto.MarshalOptions{Deterministic: true}
+
+// MarshalProto encodes the Address as the Address protobuf message.
+func (a *Address) MarshalProto() ([]byte, error) {
+	return marshalOptions.Marshal(a.toProto())
+}
+
+// UnmarshalProto decodes the Address from the Address protobuf message.
+func (a *Address) UnmarshalProto(b []byte) error {
+	var msg pb.Address
+
+	if err := proto.Unmarshal(b, &msg); err != nil {
+		return err
+	}
+
+	return a.fromProto(&msg)
+}
+
+func (a *Address) toProto() *pb.Address {
+	msg := &pb.Address{
+		LastReported: encodeTime(a.LastReported),
+		Ip:           encodeIP(a.IP),
+		Name:         a.Name,
+		Port:         uint32(a.Port),
+		Priority:     int64(a.Priority),
+		Type:         string(a.Type),
+		Service:      a.Service,
+		Weight:       uint32(a.Weight),
+	}
+
+	if a.TTLSeconds > 0 {
+		msg.TtlSeconds = uint32(a.TTLSeconds)
+	}
+
+	return msg
+}
+
+func (a *Address) fromProto(msg *pb.Address) error {
+	*a = Address{
+		LastReported: decodeTime(msg.LastReported),
+		Name:         msg.Name,
+		Port:         uint16(msg.Port),
+		Priority:     int(msg.Priority),
+		TTLSeconds:   int(msg.TtlSeconds),
+		Type:         AddressType(msg.Type),
+		Service:      msg.Service,
+		Weight:       uint16(msg.Weight),
+	}
+
+	return decodeIP(msg.Ip, &a.IP)
+}
+
+// MarshalProto encodes the Node as the Node protobuf message.
+func (n *Node) MarshalProto() ([]byte, error) {
+	return marshalOptions.Marshal(n.toProto())
+}
+
+// UnmarshalProto decodes the Node from the Node protobuf message.
+func (n *Node) UnmarshalProto(b []byte) error {
+	var msg pb.Node
+
+	if err := proto.Unmarshal(b, &msg); err != nil {
+		return err
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return n.fromProto(&msg)
+}
+
+func (n *Node) toProto() *pb.Node {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	msg := &pb.Node{
+		Name:                    n.Name,
+		Id:                      n.ID,
+		Ip:                      encodeIP(n.IP),
+		Addresses:               make([]*pb.Address, 0, len(n.Addresses)),
+		LastSeen:                encodeTime(n.LastSeen),
+		Version:                 n.Version,
+		AddressFamilyPreference: string(n.AddressFamilyPreference),
+		Sticky:                  n.Sticky,
+		Role:                    string(n.Role),
+		Generation:              n.Generation,
+		LastModified:            encodeTime(n.LastModified),
+	}
+
+	for _, a := range n.Addresses {
+		msg.Addresses = append(msg.Addresses, a.toProto())
+	}
+
+	// the labels are copied, as the message is encoded after the lock is released
+	if len(n.Labels) > 0 {
+		msg.Labels = make(map[string]string, len(n.Labels))
+
+		for k, v := range n.Labels {
+			msg.Labels[k] = v
+		}
+	}
+
+	return msg
+}
+
+// fromProto sets the fields of the Node from the message, the caller should hold the lock.
+func (n *Node) fromProto(msg *pb.Node) error {
+	n.Name, n.ID, n.IP, n.Addresses, n.LastSeen, n.Labels, n.Version = msg.Name, msg.Id, netaddr.IP{}, nil, decodeTime(msg.LastSeen), nil, msg.Version
+	n.AddressFamilyPreference = AddressFamily(msg.AddressFamilyPreference)
+	n.Sticky = msg.Sticky
+	n.Role = NodeRole(msg.Role)
+	n.Generation = msg.Generation
+	n.LastModified = decodeTime(msg.LastModified)
+
+	if err := decodeIP(msg.Ip, &n.IP); err != nil {
+		return err
+	}
+
+	for _, am := range msg.Addresses {
+		a := new(Address)
+
+		if err := a.fromProto(am); err != nil {
+			return fmt.Errorf("error decoding address: %w", err)
+		}
+
+		n.Addresses = append(n.Addresses, a)
+	}
+
+	if len(msg.Labels) > 0 {
+		n.Labels = msg.Labels
+	}
+
+	return nil
+}
+
+// MarshalProto encodes the Changes as the Changes protobuf message.
+func (c *Changes) MarshalProto() ([]byte, error) {
+	msg := &pb.Changes{
+		Nodes:   make([]*pb.Node, 0, len(c.Nodes)),
+		Removed: c.Removed,
+		Cursor:  c.Cursor,
+		Reset_:  c.Reset,
+	}
+
+	for _, n := range c.Nodes {
+		msg.Nodes = append(msg.Nodes, n.toProto())
+	}
+
+	return marshalOptions.Marshal(msg)
+}
+
+// UnmarshalProto decodes the Changes from the Changes protobuf message.
+func (c *Changes) UnmarshalProto(b []byte) error {
+	var msg pb.Changes
+
+	if err := proto.Unmarshal(b, &msg); err != nil {
+		return err
+	}
+
+	*c = Changes{
+		Removed: msg.Removed,
+		Cursor:  msg.Cursor,
+		Reset:   msg.Reset_,
+	}
+
+	for _, nm := range msg.Nodes {
+		n := new(Node)
+
+		if err := n.fromProto(nm); err != nil {
+			return fmt.Errorf("error decoding node: %w", err)
+		}
+
+		c.Nodes = append(c.Nodes, n)
+	}
+
+	return nil
+}
+
+// MarshalNodesProto encodes the list of nodes as the NodeList protobuf message.
+func MarshalNodesProto(nodes []*Node) ([]byte, error) {
+	msg := &pb.NodeList{
+		Nodes: make([]*pb.Node, 0, len(nodes)),
+	}
+
+	for _, n := range nodes {
+		msg.Nodes = append(msg.Nodes, n.toProto())
+	}
+
+	return marshalOptions.Marshal(msg)
+}
+
+// MarshalAddressesProto encodes the list of addresses as the AddressList protobuf message.
+func MarshalAddressesProto(addresses []*Address) ([]byte, error) {
+	msg := &pb.AddressList{
+		Addresses: make([]*pb.Address, 0, len(addresses)),
+	}
+
+	for _, a := range addresses {
+		msg.Addresses = append(msg.Addresses, a.toProto())
+	}
+
+	return marshalOptions.Marshal(msg)
+}
+
+// UnmarshalAddressesProto decodes the list of addresses from the AddressList protobuf message.
+func UnmarshalAddressesProto(b []byte) ([]*Address, error) {
+	var msg pb.AddressList
+
+	if err := proto.Unmarshal(b, &msg); err != nil {
+		return nil, err
+	}
+
+	var addresses []*Address
+
+	for _, am := range msg.Addresses {
+		a := new(Address)
+
+		if err := a.fromProto(am); err != nil {
+			return nil, fmt.Errorf("error decoding address: %w", err)
+		}
+
+		addresses = append(addresses, a)
+	}
+
+	return addresses, nil
+}
+
+// encodeIP returns the 4 or 16 bytes of the IP address, nil for the zero address.
+func encodeIP(ip netaddr.IP) []byte {
+	if ip.IsZero() {
+		return nil
+	}
+
+	if ip.Is4() {
+		raw := ip.As4()
+
+		return raw[:]
+	}
+
+	raw := ip.As16()
+
+	return raw[:]
+}
+
+func decodeIP(b []byte, ip *netaddr.IP) error {
+	if len(b) == 0 {
+		return nil
+	}
+
+	var ok bool
+
+	if *ip, ok = netaddr.FromStdIP(net.IP(b)); !ok {
+		return fmt.Errorf("invalid IP address length %d", len(b))
+	}
+
+	return nil
+}
+
+// encodeTime returns the time in nanoseconds since the Unix epoch, 0 for the zero time.
+func encodeTime(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+
+	return t.UnixNano()
+}
+
+func decodeTime(x int64) time.Time {
+	if x == 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(0, x)
+}
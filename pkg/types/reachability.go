@@ -0,0 +1,72 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package types
+
+import "time"
+
+// ReachabilityStatus is the outcome of the endpoint probe.
+type ReachabilityStatus string
+
+// Reachability statuses.
+const (
+	// Reachable means that the endpoint responded to the probe.
+	Reachable ReachabilityStatus = "reachable"
+	// Unreachable means that the endpoint actively refused the probe or could not be reached at all.
+	Unreachable ReachabilityStatus = "unreachable"
+	// ReachabilityUnknown means that the probe got no answer, which is expected e.g. from Wireguard.
+	ReachabilityUnknown ReachabilityStatus = "unknown"
+)
+
+// Reachability is the advisory result of probing an Address from the discovery service.
+//
+// It is never stored, but attached to the responses when probing is enabled.
+type Reachability struct {
+	Status   ReachabilityStatus `json:"status"`
+	ProbedAt time.Time          `json:"probedAt"`
+}
+
+// WithReachability returns the Node with the addresses annotated with the probe results.
+//
+// The Node is not modified, a copy is returned if any address has a probe result.
+func (n *Node) WithReachability(lookup func(a *Address) *Reachability) *Node {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	var (
+		addresses []*Address
+		annotated bool
+	)
+
+	for _, a := range n.Addresses {
+		r := lookup(a)
+		if r != nil {
+			annotated = true
+		}
+
+		copied := *a
+		copied.Reachability = r
+
+		addresses = append(addresses, &copied)
+	}
+
+	if !annotated {
+		return n
+	}
+
+	return &Node{
+		Name:                    n.Name,
+		ID:                      n.ID,
+		IP:                      n.IP,
+		Addresses:               addresses,
+		LastSeen:                n.LastSeen,
+		LastModified:            n.LastModified,
+		Labels:                  n.Labels,
+		Version:                 n.Version,
+		AddressFamilyPreference: n.AddressFamilyPreference,
+		Role:                    n.Role,
+		Sticky:                  n.Sticky,
+		Generation:              n.Generation,
+	}
+}
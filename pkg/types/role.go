@@ -0,0 +1,26 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package types
+
+import "fmt"
+
+// NodeRole is the role of the Node in the Kubernetes cluster.
+type NodeRole string
+
+// Supported node roles, Nodes without the role don't match any role filter.
+const (
+	NodeRoleControlPlane NodeRole = "controlplane"
+	NodeRoleWorker       NodeRole = "worker"
+)
+
+// ParseNodeRole parses the node role.
+func ParseNodeRole(s string) (NodeRole, error) {
+	switch r := NodeRole(s); r {
+	case NodeRoleControlPlane, NodeRoleWorker:
+		return r, nil
+	default:
+		return "", fmt.Errorf("unsupported node role %q", s)
+	}
+}
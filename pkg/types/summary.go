@@ -0,0 +1,70 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package types
+
+import (
+	"fmt"
+	"time"
+)
+
+// ClusterInfo identifies a cluster known to the service.
+type ClusterInfo struct {
+	// ID is the cluster ID.
+	ID string `json:"id"`
+
+	// Nodes is the number of Nodes in the cluster.
+	Nodes int `json:"nodes"`
+}
+
+// ClusterSummary describes the aggregate state of a cluster.
+type ClusterSummary struct {
+	// Nodes is the number of Nodes in the cluster.
+	Nodes int `json:"nodes"`
+
+	// NodesWithAddresses is the number of Nodes which have at least one address.
+	NodesWithAddresses int `json:"nodesWithAddresses"`
+
+	// Endpoints is the number of distinct addresses of all the Nodes.
+	Endpoints int `json:"endpoints"`
+
+	// NewestLastSeen and OldestLastSeen are the bounds of the LastSeen times of the Nodes.
+	NewestLastSeen time.Time `json:"newestLastSeen,omitempty"`
+	OldestLastSeen time.Time `json:"oldestLastSeen,omitempty"`
+}
+
+// Summarize returns the summary of the set of Nodes.
+func Summarize(nodes []*Node) *ClusterSummary {
+	summary := &ClusterSummary{}
+
+	endpoints := make(map[string]struct{})
+
+	for _, n := range nodes {
+		n.mu.Lock()
+
+		summary.Nodes++
+
+		if len(n.Addresses) > 0 {
+			summary.NodesWithAddresses++
+		}
+
+		for _, a := range n.Addresses {
+			endpoints[fmt.Sprintf("%s|%s|%s|%d", a.IP, a.Name, a.Service, a.Port)] = struct{}{}
+		}
+
+		if summary.NewestLastSeen.IsZero() || n.LastSeen.After(summary.NewestLastSeen) {
+			summary.NewestLastSeen = n.LastSeen
+		}
+
+		if summary.OldestLastSeen.IsZero() || n.LastSeen.Before(summary.OldestLastSeen) {
+			summary.OldestLastSeen = n.LastSeen
+		}
+
+		n.mu.Unlock()
+	}
+
+	summary.Endpoints = len(endpoints)
+
+	return summary
+}
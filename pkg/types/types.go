@@ -9,13 +9,16 @@ import (
 	"encoding/json"
 	"fmt"
 	"net"
+	"sort"
 	"sync"
 	"time"
 
 	"inet.af/netaddr"
 )
 
-// Address describes an IP or DNS address with optional Port.
+// Address describes an IP or DNS address with optional Port, or a DNS SRV service resolved by the clients.
+//
+// Exactly one of IP, Name and Service is set, see Kind.
 type Address struct {
 	// LastReported indicates the time at which this address was last reported.
 	LastReported time.Time `json:"lastReported"`
@@ -23,8 +26,62 @@ type Address struct {
 	IP netaddr.IP `json:"ip,omitempty"`
 	// Name is the DNS name of this NodeAddress, if known.
 	Name string `json:"name,omitempty"`
+	// Service is the DNS SRV owner name of this NodeAddress (e.g. _wireguard._udp.example.com), if known.
+	//
+	// The SRV records carry the target hosts and ports, so they are resolved by the clients at connect time.
+	Service string `json:"service,omitempty"`
+	// Weight is the weight of the SRV service, used by the clients to choose among the targets of the same priority.
+	Weight uint16 `json:"weight,omitempty"`
 	// Port is the port number for this NodeAddress, if known.
 	Port uint16 `json:"port,omitempty"`
+	// Priority is the connection preference of this NodeAddress, addresses with higher priority should be tried first.
+	//
+	// Addresses with the same priority are kept in the order they were reported.
+	Priority int `json:"priority,omitempty"`
+	// TTLSeconds is the amount of time after which this NodeAddress expires unless reported again.
+	//
+	// If zero, the expiration timeout of the cluster applies.
+	TTLSeconds int `json:"ttlSeconds,omitempty"`
+	// Type tells how this NodeAddress reaches the Node: directly, via a relay or as discovered via STUN.
+	//
+	// If empty, the address is direct.
+	Type AddressType `json:"type,omitempty"`
+	// Reachability is the result of the endpoint probe, set in the responses only if probing is enabled.
+	Reachability *Reachability `json:"reachability,omitempty"`
+}
+
+// MarshalJSON implements json.Marshaler.
+//
+// Zero IP is omitted, so that DNS addresses are serialized using the Name only.
+func (a *Address) MarshalJSON() ([]byte, error) {
+	type address Address
+
+	aux := struct {
+		*address
+		IP *netaddr.IP `json:"ip,omitempty"`
+	}{
+		address: (*address)(a),
+	}
+
+	if !a.IP.IsZero() {
+		aux.IP = &a.IP
+	}
+
+	return json.Marshal(aux)
+}
+
+// TTL returns the expiration timeout of the address, falling back to the default.
+func (a *Address) TTL(def time.Duration) time.Duration {
+	if a.TTLSeconds <= 0 {
+		return def
+	}
+
+	return time.Duration(a.TTLSeconds) * time.Second
+}
+
+// ExpiresIn returns the time left until the address expires, falling back to the default timeout.
+func (a *Address) ExpiresIn(def time.Duration) time.Duration {
+	return a.TTL(def) - time.Since(a.LastReported)
 }
 
 // EqualHost indicates whether two addresses have the same host portion, ignoring the ports.
@@ -33,7 +90,7 @@ func (a *Address) EqualHost(other *Address) bool {
 		return a.IP == other.IP
 	}
 
-	return a.Name == other.Name
+	return a.Name == other.Name && a.Service == other.Service
 }
 
 // Equal indicates whether two addresses are equal.
@@ -45,12 +102,35 @@ func (a *Address) Equal(other *Address) bool {
 	return a.Port == other.Port
 }
 
+// ParseAddress parses the canonical host representation of an Address: an IP address, an SRV service name or a DNS name.
+func ParseAddress(host string) *Address {
+	if ip, err := netaddr.ParseIP(host); err == nil {
+		return &Address{IP: ip}
+	}
+
+	if isServiceName(host) {
+		return &Address{Service: host}
+	}
+
+	return &Address{Name: host}
+}
+
 // Endpoint returns a UDP endpoint address for the Address, using the defaultPort if none is known.
+//
+// SRV services are resolved to the preferred target.
 func (a *Address) Endpoint(defaultPort uint16) (*net.UDPAddr, error) {
 	proto := "udp"
 	addr := a.Name
 	port := a.Port
 
+	if a.Kind() == AddressKindSRV {
+		var err error
+
+		if addr, port, err = a.resolveSRV(); err != nil {
+			return nil, err
+		}
+	}
+
 	if !a.IP.IsZero() {
 		addr = a.IP.String()
 
@@ -86,6 +166,37 @@ type Node struct {
 	// Addresses is a list of addresses for the Node.
 	Addresses []*Address `json:"selfIPs,omitempty"`
 
+	// LastSeen is the time at which the Node was last added or updated.
+	LastSeen time.Time `json:"lastSeen"`
+
+	// LastModified is the time at which the Node was last changed, the heartbeats don't count.
+	//
+	// It is managed by the database, the value reported by the Node itself is ignored.
+	LastModified time.Time `json:"lastModified"`
+
+	// Labels is the set of metadata labels of the Node (e.g. region, zone).
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// Version is incremented on every update of the Node, it is used for optimistic concurrency control.
+	Version uint64 `json:"version,omitempty"`
+
+	// AddressFamilyPreference hints the peers which address family to try first: 4, 6 or empty for no preference.
+	AddressFamilyPreference AddressFamily `json:"addressFamilyPreference,omitempty"`
+
+	// Role is the role of the Node in the Kubernetes cluster: controlplane, worker or empty if unknown.
+	Role NodeRole `json:"role,omitempty"`
+
+	// Sticky pins the Node (e.g. a relay or a bootstrap peer): it is never garbage collected
+	// and its addresses never expire.
+	//
+	// Pins are managed by the admin API, the value reported by the Node itself is ignored.
+	Sticky bool `json:"sticky,omitempty"`
+
+	// Generation is the generation of the Node configuration reported by the Node, 0 if not reported.
+	//
+	// Updates with a lower generation than the stored one are rejected, so that a late write can't regress the Node.
+	Generation int64 `json:"generation,omitempty"`
+
 	mu sync.Mutex
 }
 
@@ -109,6 +220,18 @@ func (n *Node) AddAddresses(addresses ...*Address) {
 					existing.Port = a.Port
 				}
 
+				if a.Priority != 0 {
+					existing.Priority = a.Priority
+				}
+
+				if a.TTLSeconds != 0 {
+					existing.TTLSeconds = a.TTLSeconds
+				}
+
+				if a.Type != "" {
+					existing.Type = a.Type
+				}
+
 				existing.LastReported = a.LastReported
 
 				break
@@ -116,20 +239,111 @@ func (n *Node) AddAddresses(addresses ...*Address) {
 		}
 
 		if !found {
+			// probe results are attached to the responses only, never stored
+			a.Reachability = nil
+
 			n.Addresses = append(n.Addresses, a)
 		}
 	}
+
+	n.sortAddresses()
+}
+
+// SortAddresses orders the addresses of the Node by priority.
+func (n *Node) SortAddresses() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.sortAddresses()
+}
+
+func (n *Node) sortAddresses() {
+	sort.SliceStable(n.Addresses, func(i, j int) bool {
+		return n.Addresses[i].Priority > n.Addresses[j].Priority
+	})
+}
+
+// MarkSeen records the time at which the Node was last seen.
+func (n *Node) MarkSeen(t time.Time) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.LastSeen = t
+}
+
+// MarkModified records the time at which the Node was last changed.
+func (n *Node) MarkModified(t time.Time) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.LastModified = t
+}
+
+// Heartbeat marks the Node and all its addresses as seen at the given time, without changing anything else.
+func (n *Node) Heartbeat(t time.Time) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.LastSeen = t
+
+	for _, a := range n.Addresses {
+		a.LastReported = t
+	}
+}
+
+// Merge updates the Node with the information from the other Node.
+//
+// Name, IP, labels and role are replaced, while addresses are merged with the already known ones.
+func (n *Node) Merge(other *Node) {
+	n.mu.Lock()
+	n.Name = other.Name
+	n.IP = other.IP
+	n.Labels = other.Labels
+	n.AddressFamilyPreference = other.AddressFamilyPreference
+	n.Role = other.Role
+
+	if other.Generation != 0 {
+		n.Generation = other.Generation
+	}
+
+	n.mu.Unlock()
+
+	n.AddAddresses(other.Addresses...)
+}
+
+// RemoveAddress removes the address with the same host as the given one from the Node.
+//
+// It returns false if no such address is known.
+func (n *Node) RemoveAddress(addr *Address) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for i, existing := range n.Addresses {
+		if existing.EqualHost(addr) {
+			n.Addresses = append(n.Addresses[:i], n.Addresses[i+1:]...)
+
+			return true
+		}
+	}
+
+	return false
 }
 
 // ExpireAddressesOlderThan removes addresses from the Node which have not been reported within the given timeframe.
+//
+// Addresses with their own TTL expire according to it instead, addresses of the sticky Node never expire.
 func (n *Node) ExpireAddressesOlderThan(maxAge time.Duration) {
 	n.mu.Lock()
 	defer n.mu.Unlock()
 
+	if n.Sticky {
+		return
+	}
+
 	i := 0
 
 	for _, a := range n.Addresses {
-		if time.Since(a.LastReported) < maxAge {
+		if a.ExpiresIn(maxAge) > 0 {
 			n.Addresses[i] = a
 
 			i++
@@ -141,6 +355,26 @@ func (n *Node) ExpireAddressesOlderThan(maxAge time.Duration) {
 	n.Addresses = n.Addresses[:i]
 }
 
+// MarshalJSON implements json.Marshaler.
+//
+// Zero IP is omitted.
+func (n *Node) MarshalJSON() ([]byte, error) {
+	type node Node
+
+	aux := struct {
+		*node
+		IP *netaddr.IP `json:"ip,omitempty"`
+	}{
+		node: (*node)(n),
+	}
+
+	if !n.IP.IsZero() {
+		aux.IP = &n.IP
+	}
+
+	return json.Marshal(aux)
+}
+
 // MarshalBinary implements encoding.BinaryMarshaler.
 func (n *Node) MarshalBinary() ([]byte, error) {
 	return json.Marshal(n)
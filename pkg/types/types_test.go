@@ -5,6 +5,11 @@
 package types_test
 
 import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
 	"testing"
 	"time"
 
@@ -46,3 +51,320 @@ func TestEncoderDecoder(t *testing.T) {
 		t.Errorf("IDs do not match: %s != %s", n.ID, n2.ID)
 	}
 }
+
+func TestRemoveAddress(t *testing.T) {
+	n := &types.Node{
+		ID: "IHOPEfmiUG1kE832FAxm77J5WP0O1ZHp9OwqbGowL1E=",
+	}
+
+	n.AddAddresses(
+		types.ParseAddress("2001:db8:2002::2"),
+		types.ParseAddress("mynode.mydomain.com"),
+	)
+
+	if !n.RemoveAddress(types.ParseAddress("2001:db8:2002::2")) {
+		t.Fatalf("failed to remove existing address")
+	}
+
+	if n.RemoveAddress(types.ParseAddress("2001:db8:2002::2")) {
+		t.Errorf("removed address which does not exist")
+	}
+
+	if !n.RemoveAddress(types.ParseAddress("mynode.mydomain.com")) {
+		t.Fatalf("failed to remove last address")
+	}
+
+	if len(n.Addresses) != 0 {
+		t.Errorf("expected no addresses, got %d", len(n.Addresses))
+	}
+}
+
+func TestAddressPriority(t *testing.T) {
+	n := &types.Node{
+		ID: "IHOPEfmiUG1kE832FAxm77J5WP0O1ZHp9OwqbGowL1E=",
+	}
+
+	n.AddAddresses(
+		&types.Address{Name: "wan.mydomain.com"},
+		&types.Address{IP: netaddr.MustParseIP("192.168.0.1"), Priority: 10},
+		&types.Address{Name: "other.mydomain.com"},
+	)
+
+	expected := []string{"192.168.0.1", "wan.mydomain.com", "other.mydomain.com"}
+
+	for i, a := range n.Addresses {
+		host := a.Name
+		if !a.IP.IsZero() {
+			host = a.IP.String()
+		}
+
+		if host != expected[i] {
+			t.Fatalf("unexpected address order: %s at %d, expected %s", host, i, expected[i])
+		}
+	}
+
+	// re-reporting the address without priority keeps it
+	n.AddAddresses(types.ParseAddress("192.168.0.1"))
+
+	if n.Addresses[0].Priority != 10 {
+		t.Errorf("priority was reset: %d", n.Addresses[0].Priority)
+	}
+
+	n.AddAddresses(&types.Address{Name: "other.mydomain.com", Priority: 20})
+
+	if n.Addresses[0].Name != "other.mydomain.com" {
+		t.Errorf("updated priority was not applied: %v", n.Addresses)
+	}
+}
+
+func TestMarshalJSONOmitsZeroIP(t *testing.T) {
+	n := &types.Node{
+		ID: "IHOPEfmiUG1kE832FAxm77J5WP0O1ZHp9OwqbGowL1E=",
+		Addresses: []*types.Address{
+			{
+				Name: "mynode.mydomain.com",
+				Port: 51512,
+			},
+		},
+	}
+
+	data, err := json.Marshal(n)
+	if err != nil {
+		t.Fatalf("failed to marshal node: %s", err)
+	}
+
+	if bytes.Contains(data, []byte(`"ip"`)) {
+		t.Errorf("zero IP should not be serialized: %s", data)
+	}
+
+	n2 := new(types.Node)
+	if err = json.Unmarshal(data, n2); err != nil {
+		t.Fatalf("failed to unmarshal node: %s", err)
+	}
+
+	if len(n2.Addresses) != 1 || n2.Addresses[0].Name != "mynode.mydomain.com" || !n2.Addresses[0].IP.IsZero() {
+		t.Errorf("unexpected addresses after round trip: %s", data)
+	}
+}
+
+func TestValidateLabels(t *testing.T) {
+	for _, tt := range []struct {
+		labels map[string]string
+		valid  bool
+	}{
+		{map[string]string{"zone": "us-east-1a"}, true},
+		{map[string]string{"topology.kubernetes.io/region": "us-east-1"}, true},
+		{map[string]string{"empty": ""}, true},
+		{map[string]string{"": "value"}, false},
+		{map[string]string{"bad key": "value"}, false},
+		{map[string]string{"key": "-value"}, false},
+		{map[string]string{"Bad_Prefix/key": "value"}, false},
+	} {
+		err := types.ValidateLabels(tt.labels)
+
+		if tt.valid && err != nil {
+			t.Errorf("labels %v should be valid: %s", tt.labels, err)
+		}
+
+		if !tt.valid && err == nil {
+			t.Errorf("labels %v should be invalid", tt.labels)
+		}
+	}
+}
+
+func TestProtoRoundTrip(t *testing.T) {
+	n := &types.Node{
+		Name:         "node1",
+		ID:           "IHOPEfmiUG1kE832FAxm77J5WP0O1ZHp9OwqbGowL1E=",
+		IP:           netaddr.MustParseIP("fd00::1"),
+		LastSeen:     time.Unix(1630000000, 0),
+		LastModified: time.Unix(1620000000, 0),
+		Labels:       map[string]string{"zone": "a", "empty": ""},
+		Version:      3,
+		Sticky:       true,
+		Role:         types.NodeRoleControlPlane,
+		Generation:   7,
+		Addresses: []*types.Address{
+			{IP: netaddr.MustParseIP("192.168.0.1"), Port: 51820, Priority: -1, LastReported: time.Unix(1630000000, 5)},
+			{Name: "wan.mydomain.com"},
+			{Service: "_wireguard._udp.mydomain.com", Port: 51820, Weight: 5},
+		},
+	}
+
+	data, err := n.MarshalProto()
+	if err != nil {
+		t.Fatalf("failed to marshal node: %s", err)
+	}
+
+	n2 := new(types.Node)
+	if err = n2.UnmarshalProto(data); err != nil {
+		t.Fatalf("failed to unmarshal node: %s", err)
+	}
+
+	expected, _ := json.Marshal(n) //nolint:errcheck
+	actual, _ := json.Marshal(n2)  //nolint:errcheck
+
+	if !bytes.Equal(expected, actual) {
+		t.Errorf("node changed after round trip:\n%s\n%s", expected, actual)
+	}
+
+	if err = n2.UnmarshalProto([]byte{0x0a, 0x05, 'a'}); err == nil {
+		t.Errorf("truncated message should fail to decode")
+	}
+
+	changes := &types.Changes{
+		Nodes:   []*types.Node{n},
+		Removed: []string{"9NqSzEoeNRqwCaBKdkxUR2dqvhxMyUe5nDm9yZ3JSn0="},
+		Cursor:  42,
+		Reset:   true,
+	}
+
+	if data, err = changes.MarshalProto(); err != nil {
+		t.Fatalf("failed to marshal changes: %s", err)
+	}
+
+	changes2 := new(types.Changes)
+	if err = changes2.UnmarshalProto(data); err != nil {
+		t.Fatalf("failed to unmarshal changes: %s", err)
+	}
+
+	expected, _ = json.Marshal(changes) //nolint:errcheck
+	actual, _ = json.Marshal(changes2)  //nolint:errcheck
+
+	if !bytes.Equal(expected, actual) {
+		t.Errorf("changes changed after round trip:\n%s\n%s", expected, actual)
+	}
+}
+
+// TestProtoCompatibility decodes the node encoded by the previous hand-written codec,
+// which is still found in the Redis payloads stored with -redis-codec=proto.
+func TestProtoCompatibility(t *testing.T) {
+	data, err := hex.DecodeString("0a056e6f646531122c49484f5045666d695547316b453833324641786d37374a355750304f315a4870394f777162476f774c31453d" +
+		"1a10fd00000000000000000000000000000122200885808cbfd28bbbcf161204c0a8000120ec9403280130d8043a0572656c617922121a1077616e2e6d79" +
+		"646f6d61696e2e636f6d222420ec9403421c5f7769726567756172642e5f7564702e6d79646f6d61696e2e636f6d48052880808cbfd28bbbcf16608080" +
+		"88c1abadd9bd1632070a05656d70747932090a047a6f6e6512016138034201364801520c636f6e74726f6c706c616e655807")
+	if err != nil {
+		t.Fatalf("failed to decode hex: %s", err)
+	}
+
+	expected := &types.Node{
+		Name:                    "node1",
+		ID:                      "IHOPEfmiUG1kE832FAxm77J5WP0O1ZHp9OwqbGowL1E=",
+		IP:                      netaddr.MustParseIP("fd00::1"),
+		LastSeen:                time.Unix(1630000000, 0),
+		LastModified:            time.Unix(1620000000, 0),
+		Labels:                  map[string]string{"zone": "a", "empty": ""},
+		Version:                 3,
+		AddressFamilyPreference: types.AddressFamily("6"),
+		Sticky:                  true,
+		Role:                    types.NodeRoleControlPlane,
+		Generation:              7,
+		Addresses: []*types.Address{
+			{IP: netaddr.MustParseIP("192.168.0.1"), Port: 51820, Priority: -1, LastReported: time.Unix(1630000000, 5), TTLSeconds: 600, Type: "relay"},
+			{Name: "wan.mydomain.com"},
+			{Service: "_wireguard._udp.mydomain.com", Port: 51820, Weight: 5},
+		},
+	}
+
+	n := new(types.Node)
+	if err = n.UnmarshalProto(data); err != nil {
+		t.Fatalf("failed to unmarshal node: %s", err)
+	}
+
+	expectedJSON, _ := json.Marshal(expected) //nolint:errcheck
+	actualJSON, _ := json.Marshal(n)          //nolint:errcheck
+
+	if !bytes.Equal(expectedJSON, actualJSON) {
+		t.Errorf("unexpected decoded node:\n%s\n%s", expectedJSON, actualJSON)
+	}
+}
+
+func TestNodeValidate(t *testing.T) {
+	n := &types.Node{
+		ID: "IHOPEfmiUG1kE832FAxm77J5WP0O1ZHp9OwqbGowL1E=",
+		IP: netaddr.MustParseIP("fd00::1"),
+		Addresses: []*types.Address{
+			{IP: netaddr.MustParseIP("192.168.0.1"), Port: 51820},
+			{Name: "wan.mydomain.com"},
+			{Service: "_wireguard._udp.mydomain.com", Weight: 10},
+		},
+	}
+
+	if err := n.Validate(types.ValidateOptions{}); err != nil {
+		t.Fatalf("node should be valid: %s", err)
+	}
+
+	bad := &types.Node{
+		ID:        "not-a-key",
+		Addresses: []*types.Address{nil, {}, {Service: "wireguard.mydomain.com"}, {Name: "wan.mydomain.com", Weight: 1}},
+		Labels:    map[string]string{"bad key": "value"},
+		Name:      "node\n[Peer]",
+	}
+
+	err := bad.Validate(types.ValidateOptions{})
+
+	var verr *types.ValidationError
+
+	if !errors.As(err, &verr) {
+		t.Fatalf("expected validation error, got %v", err)
+	}
+
+	// key, name, IP, four addresses and labels
+	if len(verr.Problems) != 8 {
+		t.Errorf("unexpected problems: %q", verr.Problems)
+	}
+
+	if err = (&types.Node{ID: n.ID}).Validate(types.ValidateOptions{AllowZeroIP: true, AllowNoAddresses: true}); err != nil {
+		t.Errorf("relaxed validation failed: %s", err)
+	}
+
+	n.Labels = map[string]string{"zone": "us-east-1a", "rack": "r1"}
+
+	if err = n.Validate(types.ValidateOptions{MaxLabels: 2, MaxLabelBytes: 20}); err != nil {
+		t.Errorf("labels within the limits should be valid: %s", err)
+	}
+
+	err = n.Validate(types.ValidateOptions{MaxLabels: 1, MaxLabelBytes: 10})
+
+	if !errors.As(err, &verr) || len(verr.Problems) != 2 {
+		t.Fatalf("expected label count and size problems, got %v", err)
+	}
+
+	if !strings.Contains(verr.Problems[0], "at most 1") || !strings.Contains(verr.Problems[1], "at most 10") {
+		t.Errorf("limits should be reported: %q", verr.Problems)
+	}
+
+	n.Addresses[0].TTLSeconds = 7200
+
+	if err = n.Validate(types.ValidateOptions{MaxAddressTTL: time.Hour}); !errors.As(err, &verr) || len(verr.Problems) != 1 {
+		t.Fatalf("expected address TTL problem, got %v", err)
+	}
+
+	if err = n.Validate(types.ValidateOptions{MaxAddressTTL: 2 * time.Hour}); err != nil {
+		t.Errorf("address TTL within the limit should be valid: %s", err)
+	}
+}
+
+func TestNormalizeKey(t *testing.T) {
+	const canonical = "+/8+AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxw="
+
+	for _, key := range []string{
+		canonical,
+		"+/8+AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxw",
+		"-_8-AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxw=",
+		"-_8-AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxw",
+	} {
+		got, err := types.NormalizeKey(key)
+		if err != nil {
+			t.Fatalf("failed to normalize %q: %s", key, err)
+		}
+
+		if got != canonical {
+			t.Errorf("key %q normalized to %q, expected %q", key, got, canonical)
+		}
+	}
+
+	if _, err := types.NormalizeKey("c2hvcnQ="); err == nil {
+		t.Error("short key should be rejected")
+	}
+}
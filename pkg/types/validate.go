@@ -0,0 +1,185 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package types
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// maxAddressNameLength is the maximum length of a DNS name.
+const maxAddressNameLength = 253
+
+// maxNodeNameLength is the maximum length of the node name, long enough for a FQDN.
+const maxNodeNameLength = 253
+
+// validDNSName checks the DNS name loosely: it should be short enough and free of separators.
+func validDNSName(name string) bool {
+	return len(name) <= maxAddressNameLength && !strings.ContainsAny(name, " \t\n/:")
+}
+
+// validNodeName checks that the node name is short enough and printable.
+//
+// The name ends up in the configs rendered for the other nodes (e.g. as wg-quick comments),
+// so line breaks and other control characters are never allowed.
+func validNodeName(name string) bool {
+	if len(name) > maxNodeNameLength {
+		return false
+	}
+
+	for _, r := range name {
+		if !unicode.IsPrint(r) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// ValidationError aggregates all the problems found by Node.Validate.
+type ValidationError struct {
+	Problems []string
+}
+
+// Error implements error.
+func (e *ValidationError) Error() string {
+	return "invalid node: " + strings.Join(e.Problems, "; ")
+}
+
+func (e *ValidationError) add(format string, args ...interface{}) {
+	e.Problems = append(e.Problems, fmt.Sprintf(format, args...))
+}
+
+// ValidateOptions relaxes the Node validation.
+type ValidateOptions struct {
+	// AllowZeroIP accepts nodes without the Wireguard interface IP.
+	AllowZeroIP bool
+
+	// AllowNoAddresses accepts nodes without any address.
+	AllowNoAddresses bool
+
+	// MaxLabels is the maximum number of the labels of a node, 0 means no limit.
+	MaxLabels int
+
+	// MaxLabelBytes is the maximum total size of the label keys and values of a node, 0 means no limit.
+	MaxLabelBytes int
+
+	// MaxAddressTTL is the maximum TTL of an address, 0 means no limit.
+	//
+	// Huge TTLs would otherwise pin the addresses (and the Redis keys) forever.
+	MaxAddressTTL time.Duration
+}
+
+// Validate checks the whole Node: the key, the IP, the addresses and the labels.
+//
+// All the problems are reported at once as *ValidationError.
+// A valid node ID is rewritten in the canonical key form, see NormalizeKey.
+func (n *Node) Validate(opts ValidateOptions) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	verr := &ValidationError{}
+
+	if id, err := NormalizeKey(n.ID); err != nil {
+		verr.add("node ID is not a valid wireguard key")
+	} else {
+		n.ID = id
+	}
+
+	if !validNodeName(n.Name) {
+		verr.add("node name should be printable and at most %d bytes long", maxNodeNameLength)
+	}
+
+	if n.IP.IsZero() && !opts.AllowZeroIP {
+		verr.add("node IP is not set")
+	}
+
+	if len(n.Addresses) == 0 && !opts.AllowNoAddresses {
+		verr.add("node has no addresses")
+	}
+
+	verr.addresses(n.Addresses, opts)
+
+	if err := ValidateLabels(n.Labels); err != nil {
+		verr.add("%s", err)
+	}
+
+	if opts.MaxLabels > 0 && len(n.Labels) > opts.MaxLabels {
+		verr.add("node has %d labels, at most %d are allowed", len(n.Labels), opts.MaxLabels)
+	}
+
+	if size := LabelsSize(n.Labels); opts.MaxLabelBytes > 0 && size > opts.MaxLabelBytes {
+		verr.add("node labels take %d bytes, at most %d are allowed", size, opts.MaxLabelBytes)
+	}
+
+	if n.Role != "" {
+		if _, err := ParseNodeRole(string(n.Role)); err != nil {
+			verr.add("%s", err)
+		}
+	}
+
+	if _, err := ParseAddressFamily(string(n.AddressFamilyPreference)); err != nil {
+		verr.add("%s", err)
+	}
+
+	if n.Generation < 0 {
+		verr.add("node generation is negative")
+	}
+
+	if len(verr.Problems) > 0 {
+		return verr
+	}
+
+	return nil
+}
+
+// ValidateAddresses checks the addresses reported without the rest of the Node (e.g. by PUT).
+func ValidateAddresses(addresses []*Address, opts ValidateOptions) error {
+	verr := &ValidationError{}
+
+	verr.addresses(addresses, opts)
+
+	if len(verr.Problems) > 0 {
+		return verr
+	}
+
+	return nil
+}
+
+func (e *ValidationError) addresses(addresses []*Address, opts ValidateOptions) {
+	for i, a := range addresses {
+		switch {
+		case a == nil:
+			e.add("address %d is empty", i)
+
+			continue
+		case a.IP.IsZero() && a.Name == "" && a.Service == "":
+			e.add("address %d has neither IP nor name", i)
+		case a.Kind() == AddressKindIP && (a.Name != "" || a.Service != ""), a.Name != "" && a.Service != "":
+			e.add("address %d has more than one of IP, name and service", i)
+		case !validDNSName(a.Name):
+			e.add("address %d name %q is not a valid DNS name", i, a.Name)
+		case a.Service != "" && (!validDNSName(a.Service) || !isServiceName(a.Service)):
+			e.add("address %d service %q is not a valid SRV name", i, a.Service)
+		}
+
+		if a.Weight != 0 && a.Service == "" {
+			e.add("address %d has a weight, but it is not a service", i)
+		}
+
+		switch {
+		case a.TTLSeconds < 0:
+			e.add("address %d TTL is negative", i)
+		case opts.MaxAddressTTL > 0 && int64(a.TTLSeconds) > int64(opts.MaxAddressTTL/time.Second):
+			e.add("address %d TTL is longer than %s", i, opts.MaxAddressTTL)
+		}
+
+		if _, err := ParseAddressType(string(a.Type)); err != nil {
+			e.add("address %d: %s", i, err)
+		}
+	}
+}